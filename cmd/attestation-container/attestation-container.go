@@ -6,6 +6,7 @@ package main
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"net"
 	"os"
@@ -28,6 +29,7 @@ var (
 	insecureVirtual           = flag.Bool("insecure-virtual", false, "If set, dummy attestation is returned (INSECURE: do not use in production)")
 	logLevel                  = flag.String("loglevel", "warning", "Logging Level: trace, debug, info, warning, error, fatal, panic.")
 	logFile                   = flag.String("logfile", "", "Logging Target: An optional file name/path. Omit for console output.")
+	tlsPolicy                 = flag.String("tls-policy", "", "base64-encoded JSON TLS policy of outbound connections. By default TLS 1.2 or newer is required")
 
 	platformCertificateValue *common.THIMCerts = nil
 	// UVM Endorsement (UVM reference info)
@@ -84,7 +86,7 @@ func (s *server) FetchAttestation(ctx context.Context, in *pb.FetchAttestationRe
 			certFetcher = attest.DefaultAzureCertFetcherNew()
 		}
 		logrus.Trace("Fetching platform certificate...")
-		platformCertificate, _, err = certFetcher.GetCertChain(SNPReport.ChipID, SNPReport.ReportedTCB)
+		platformCertificate, _, err = certFetcher.GetCertChain(ctx, SNPReport.ChipID, SNPReport.ReportedTCB)
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "failed to fetch platform certificate: %s", err)
 		}
@@ -126,6 +128,20 @@ func main() {
 
 	validateFlags()
 
+	if *tlsPolicy != "" {
+		tlsPolicyBytes, err := base64.StdEncoding.DecodeString(*tlsPolicy)
+		if err != nil {
+			logrus.Fatalf("Failed to decode TLS policy: %s", err.Error())
+		}
+		policy := common.TLSPolicy{}
+		if err := json.Unmarshal(tlsPolicyBytes, &policy); err != nil {
+			logrus.Fatalf("Failed to unmarshal TLS policy: %s", err.Error())
+		}
+		if err := common.SetTLSPolicy(policy); err != nil {
+			logrus.Fatalf("Invalid TLS policy: %s", err.Error())
+		}
+	}
+
 	logrus.Info("Attestation container started...")
 
 	if *insecureVirtual {
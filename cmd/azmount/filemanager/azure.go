@@ -6,14 +6,15 @@ package filemanager
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
-	"encoding/json"
-	"fmt"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
 	"github.com/Microsoft/confidential-sidecar-containers/pkg/msi"
@@ -21,63 +22,178 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// tokenRefresher is a function callback passed during the creation of token credentials
-// its implementation shall update an expired token with a new token and return the new
-// expiring duration.
-func tokenRefresher(credential azblob.TokenCredential) (t time.Duration) {
+// httpSender sends the requests of the pipeline with the HTTP client that
+// enforces the TLS policy instead of the default client of the pipeline.
+func httpSender() pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			r, err := common.HTTPClient().Do(request.WithContext(ctx))
+			if err != nil {
+				err = pipeline.NewError(err, "HTTP request failed")
+			}
+			return pipeline.NewHTTPResponse(r), err
+		}
+	})
+}
 
-	// we extract the audience from the existing token so that we can set the resource
-	// id for retrieving a new (refresh) token  for the same audience.
-	currentToken := credential.Token()
-	// JWT tokens comprise three fields. the second field is the payload (or claims).
-	// we care about the `aud` attribute of the payload
-	currentTokenFields := strings.Split(currentToken, ".")
-	logrus.Debugf("Current token fields: %v", currentTokenFields)
+// Offsets and lengths of the pages of a page blob must be multiples of this
+const pageBlobAlignment = 512
 
-	payload, err := base64.RawURLEncoding.DecodeString(currentTokenFields[1])
-	if err != nil {
-		logrus.Errorf("Error decoding base64 token payload: %s", err)
-		return 0
+// checkPageBlobBlockSize checks that blocks of blockSize bytes can be
+// downloaded and uploaded as pages of a page blob.
+func checkPageBlobBlockSize(blockSize int64) error {
+	if blockSize <= 0 || blockSize%pageBlobAlignment != 0 {
+		return errors.Errorf("Block size of %d bytes isn't a positive multiple of the %d bytes of a page blob page", blockSize, pageBlobAlignment)
 	}
-	logrus.Debugf("Current token payload: %s", string(payload))
+	return nil
+}
 
-	var payloadMap map[string]interface{}
-	err = json.Unmarshal([]byte(payload), &payloadMap)
-	if err != nil {
-		logrus.Errorf("Error unmarshalling token payload: %s", err)
-		return 0
+// newTokenPipeline returns the pipeline of azblob.NewPipeline with a policy
+// that refreshes the token of credential synchronously if it has expired.
+func newTokenPipeline(credential azblob.TokenCredential, refresher *tokenRefresher) pipeline.Pipeline {
+	o := azblob.PipelineOptions{HTTPSender: httpSender()}
+	f := []pipeline.Factory{
+		azblob.NewTelemetryPolicyFactory(o.Telemetry),
+		azblob.NewUniqueRequestIDPolicyFactory(),
+		azblob.NewRetryPolicyFactory(o.Retry),
+		refresher.policy(),
+		credential,
+		azblob.NewRequestLogPolicyFactory(o.RequestLog),
+		pipeline.MethodFactoryMarker(),
 	}
-	audience := payloadMap["aud"].(string)
+	return pipeline.NewPipeline(f, pipeline.Options{HTTPSender: o.HTTPSender, Log: o.Log})
+}
+
+// Ways of accessing a page blob
+type BlobAccess int
+
+const (
+	// Anonymous access to a blob in a public container
+	BlobAccessPublic BlobAccess = iota
+	// Access with a token of the managed identity
+	BlobAccessPrivate
+	// Anonymous access is tried first, and a token is used if it is denied
+	BlobAccessAuto
+)
 
-	identity := common.Identity{
-		ClientId: payloadMap["appid"].(string),
+// anonymousAccessDenied returns whether err is the response of the storage
+// account to an anonymous request to a blob that isn't public. Storage
+// accounts answer 404 instead of 403 when the container is private, and 409
+// when anonymous access is disabled for the whole account.
+func anonymousAccessDenied(err error) bool {
+	var storageErr azblob.StorageError
+	if !errors.As(err, &storageErr) || storageErr.Response() == nil {
+		return false
 	}
+	switch storageErr.Response().StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusConflict:
+		return true
+	}
+	return false
+}
 
-	// retrieve token using the existing token audience
-	logrus.Debugf("Retrieving new token for audience %s and identity %s", audience, identity)
-	refreshToken, err := common.GetToken(audience, identity)
+// publicBlobURL returns the URL of the page blob at u accessed anonymously.
+func publicBlobURL(u *url.URL) azblob.PageBlobURL {
+	// we can use anonymous credentials to access public azure blob storage
+	logrus.Trace("Using anonymous credentials to access public azure blob storage...")
 
-	if err != nil {
-		logrus.Errorf("Error retrieving token: %s", err)
-		return 0
+	anonCredential := azblob.NewAnonymousCredential()
+	logrus.Debugf("Anonymous credential created: %s", anonCredential)
+	blobURL := azblob.NewPageBlobURL(*u, azblob.NewPipeline(anonCredential, azblob.PipelineOptions{HTTPSender: httpSender()}))
+	logrus.Debugf("Blob URL created: %s", blobURL)
+	return blobURL
+}
+
+// privateBlobURL returns the URL of the page blob at u accessed with a token
+// of identity, which is refreshed in the background until AzureTeardown is
+// called.
+func privateBlobURL(u *url.URL, identity common.Identity) (azblob.PageBlobURL, error) {
+	// The url Host denotes the scope/audience for which we need to get a
+	// token, unless it has been overridden
+	audience := identity.StorageAudience(u.Host)
+
+	var getToken tokenSource
+	if msi.WorkloadIdentityEnabled() {
+		logrus.Infof("Requesting token for using workload identity from %s", audience)
+		getToken = func() (string, time.Time, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), msi.WorkloadIdentityRquestTokenTimeout)
+			defer cancel()
+			accessToken, err := msi.GetAccessTokenFromFederatedToken(ctx, audience)
+			if err != nil {
+				return "", time.Time{}, errors.Wrapf(err, "retrieving authentication token using workload identity failed")
+			}
+			expiresOn, err := tokenExpiry(accessToken)
+			if err != nil {
+				logrus.WithError(err).Debugf("Can't get the expiration of the token, assuming %s", defaultTokenLifetime)
+				expiresOn = time.Now().Add(defaultTokenLifetime)
+			}
+			return accessToken, expiresOn, nil
+		}
+	} else {
+		// we use token credentials to access private azure blob storage
+		logrus.Trace("Using token credentials to access private azure blob storage...")
+		getToken = func() (string, time.Time, error) {
+			token, err := common.GetToken(audience, identity)
+			if err != nil {
+				return "", time.Time{}, err
+			}
+			expiresIn, err := strconv.ParseInt(token.ExpiresIn, 10, 64)
+			if err != nil {
+				return "", time.Time{}, errors.Wrapf(err, "Error parsing token expiration to seconds")
+			}
+			return token.AccessToken, time.Now().Add(time.Duration(expiresIn) * time.Second), nil
+		}
 	}
-	logrus.Debugf("Retrieved new token: %s", refreshToken.AccessToken)
 
-	// Duration expects nanosecond count
-	ExpiresInSeconds, err := strconv.ParseInt(refreshToken.ExpiresIn, 10, 64)
-	if err != nil {
-		logrus.Errorf("Error parsing token expiration to seconds: %s", err)
-		return 0
+	var accessToken string
+	var expiresOn time.Time
+	var err error
+	count := 0
+	logrus.Debugf("Getting token for %s", audience)
+	for {
+		accessToken, expiresOn, err = getToken()
+		if err == nil {
+			break
+		}
+		if msi.WorkloadIdentityEnabled() {
+			return azblob.PageBlobURL{}, err
+		}
+		logrus.Infof("Can't obtain a token required for accessing private blobs from %s. Will retry in case the identity sidecar is not running yet...", identity.TokenURI())
+		time.Sleep(3 * time.Second)
+		count++
+		if count == 20 {
+			return azblob.PageBlobURL{}, errors.Wrapf(err, "Timeout of 60 seconds expired. Could not obtain token")
+		}
 	}
-	credential.SetToken(refreshToken.AccessToken)
-	return time.Duration(1000 * 1000 * 1000 * ExpiresInSeconds)
+	logrus.Debugf("Token obtained: %s", common.LogSecret(accessToken))
+
+	// The token is refreshed in the background before it expires, so
+	// that the requests don't wait for it
+	tokenCredential := azblob.NewTokenCredential(accessToken, nil)
+	logrus.Debugf("Token credential created: %s", common.LogSecret(tokenCredential.Token()))
+	fm.tokenRefresher = newTokenRefresher(tokenCredential, expiresOn, getToken)
+	fm.tokenRefresher.Start()
+	blobURL := azblob.NewPageBlobURL(*u, newTokenPipeline(tokenCredential, fm.tokenRefresher))
+	logrus.Debugf("Blob URL created: %s", blobURL)
+	return blobURL, nil
 }
 
 // For more information about the library used to access Azure:
 //
 //     https://pkg.go.dev/github.com/Azure/azure-storage-blob-go/azblob
 
-func AzureSetup(urlString string, urlPrivate bool, identity common.Identity) error {
+// AzureSetup connects to the page blob at urlString, accessed as set by access.
+// If maxImageSize is bigger than zero, blobs larger than maxImageSize bytes are
+// rejected. If allowedHosts isn't empty, the host of urlString must be one of
+// them. If blockDigests isn't empty, it maps block indices to the hex-encoded
+// SHA-256 digests that those blocks must have when they are downloaded.
+// InitializeCache must be called first, as the block size must be aligned to
+// the pages of the blob.
+//
+// ctx bounds the requests to the blob, both during the setup and in the
+// downloads and uploads of blocks afterwards, so cancelling it abandons the
+// requests in flight instead of blocking on them.
+func AzureSetup(ctx context.Context, urlString string, access BlobAccess, identity common.Identity, maxImageSize int64, allowedHosts []string, blockDigests map[int64]string) error {
 	// Create a ContainerURL object that wraps a blob's URL and a default
 	// request pipeline.
 	//
@@ -87,77 +203,58 @@ func AzureSetup(urlString string, urlPrivate bool, identity common.Identity) err
 	//
 	// https://pkg.go.dev/github.com/Azure/azure-storage-blob-go/azblob#hdr-URL_Types
 	logrus.Info("Connecting to Azure...")
+	if err := checkPageBlobBlockSize(fm.blockSize); err != nil {
+		return err
+	}
+	if err := setBlockDigests(blockDigests); err != nil {
+		return err
+	}
+
 	u, err := url.Parse(urlString)
 	if err != nil {
 		return errors.Wrapf(err, "Can't parse URL string %s", urlString)
 	}
 
-	if urlPrivate {
-		ctx, cancel := context.WithTimeout(context.Background(), msi.WorkloadIdentityRquestTokenTimeout)
-		defer cancel()
-		accessToken := ""
-		var tokenRefresherFunc func(azblob.TokenCredential) (t time.Duration)
+	if !common.HostAllowed(u.Host, allowedHosts) {
+		return errors.Errorf("Host %s isn't in the list of allowed hosts", u.Host)
+	}
 
-		if msi.WorkloadIdentityEnabled() {
-			tokenRefresherFunc = nil
-			logrus.Infof("Requesting token for using workload identity from %s", fmt.Sprintf("https://%s", u.Host))
-			accessToken, err = msi.GetAccessTokenFromFederatedToken(ctx, fmt.Sprintf("https://%s", u.Host))
-			if err != nil {
-				return errors.Wrapf(err, "retrieving authentication token using workload identity failed")
-			}
-		} else {
-			tokenRefresherFunc = tokenRefresher
-			// we use token credentials to access private azure blob storage the blob's
-			// url Host denotes the scope/audience for which we need to get a token
-			logrus.Trace("Using token credentials to access private azure blob storage...")
-
-			var token common.TokenResponse
-			count := 0
-			logrus.Debugf("Getting token for https://%s", u.Host)
-			for {
-				token, err = common.GetToken("https://"+u.Host, identity)
-
-				if err != nil {
-					logrus.Info("Can't obtain a token required for accessing private blobs. Will retry in case the ACI identity sidecar is not running yet...")
-					time.Sleep(3 * time.Second)
-					count++
-					if count == 20 {
-						return errors.Wrapf(err, "Timeout of 60 seconds expired. Could not obtain token")
-					}
-				} else {
-					logrus.Debugf("Token obtained: %s", token.AccessToken)
-					accessToken = token.AccessToken
-					break
-				}
-			}
+	switch access {
+	case BlobAccessPrivate:
+		if fm.blobURL, err = privateBlobURL(u, identity); err != nil {
+			return err
 		}
-		tokenCredential := azblob.NewTokenCredential(accessToken, tokenRefresherFunc)
-		logrus.Debugf("Token credential created: %s", tokenCredential.Token())
-		fm.blobURL = azblob.NewPageBlobURL(*u, azblob.NewPipeline(tokenCredential, azblob.PipelineOptions{}))
-		logrus.Debugf("Blob URL created: %s", fm.blobURL)
-	} else {
-		// we can use anonymous credentials to access public azure blob storage
-		logrus.Trace("Using anonymous credentials to access public azure blob storage...")
-
-		anonCredential := azblob.NewAnonymousCredential()
-		logrus.Debugf("Anonymous credential created: %s", anonCredential)
-		fm.blobURL = azblob.NewPageBlobURL(*u, azblob.NewPipeline(anonCredential, azblob.PipelineOptions{}))
-		logrus.Debugf("Blob URL created: %s", fm.blobURL)
+	case BlobAccessPublic, BlobAccessAuto:
+		fm.blobURL = publicBlobURL(u)
+	default:
+		return errors.Errorf("Unknown blob access: %d", access)
 	}
 
-	// Use a never-expiring context
-	fm.ctx = context.Background()
+	fm.ctx = ctx
 
 	logrus.Trace("Getting size of file...")
 	// Get file size
 	getMetadata, err := fm.blobURL.GetProperties(fm.ctx, azblob.BlobAccessConditions{},
 		azblob.ClientProvidedKeyOptions{})
+	if err != nil && access == BlobAccessAuto && anonymousAccessDenied(err) {
+		logrus.WithError(err).Debug("Anonymous access denied")
+		logrus.Info("Anonymous access to the blob was denied, using token credentials...")
+		if fm.blobURL, err = privateBlobURL(u, identity); err != nil {
+			return err
+		}
+		getMetadata, err = fm.blobURL.GetProperties(fm.ctx, azblob.BlobAccessConditions{},
+			azblob.ClientProvidedKeyOptions{})
+	}
 	if err != nil {
 		return errors.Wrapf(err, "Can't get blob file size")
 	}
 	fm.contentLength = getMetadata.ContentLength()
 	logrus.Tracef("Blob Size: %d bytes", fm.contentLength)
 
+	if maxImageSize > 0 && fm.contentLength > maxImageSize {
+		return errors.Errorf("Blob size %d bytes exceeds the maximum image size of %d bytes", fm.contentLength, maxImageSize)
+	}
+
 	// Setup data downloader and uploader
 	fm.downloadBlock = AzureDownloadBlock
 	fm.uploadBlock = AzureUploadBlock
@@ -165,34 +262,58 @@ func AzureSetup(urlString string, urlPrivate bool, identity common.Identity) err
 	return nil
 }
 
+// AzureTeardown stops the background refresh of the token of a private blob.
+func AzureTeardown() {
+	if fm.tokenRefresher != nil {
+		fm.tokenRefresher.Stop()
+		fm.tokenRefresher = nil
+	}
+}
+
 func AzureUploadBlock(blockIndex int64, b []byte) (err error) {
-	logrus.Info("Uploading block...")
+	logrus.Debugf("Uploading block %d...", blockIndex)
 	bytesInBlock := GetBlockSize()
 	var offset int64 = blockIndex * bytesInBlock
 	logrus.Tracef("Block offset %d = block index %d * bytes in block %d", offset, blockIndex, bytesInBlock)
 
+	ctx, cancel := blockContext()
+	defer cancel()
 	r := bytes.NewReader(b)
-	_, err = fm.blobURL.UploadPages(fm.ctx, offset, r, azblob.PageBlobAccessConditions{},
+	_, err = fm.blobURL.UploadPages(ctx, offset, r, azblob.PageBlobAccessConditions{},
 		nil, azblob.NewClientProvidedKeyOptions(nil, nil, nil))
 	if err != nil {
-		return errors.Wrapf(err, "Can't upload block")
+		return errors.Wrapf(blockError(ctx, "upload", blockIndex, err), "Can't upload block")
 	}
 
 	return nil
 }
 
 func AzureDownloadBlock(blockIndex int64) (err error, b []byte) {
-	logrus.Info("Downloading block...")
+	logrus.Debugf("Downloading block %d...", blockIndex)
 	bytesInBlock := GetBlockSize()
 	var offset int64 = blockIndex * bytesInBlock
 	logrus.Tracef("Block offset %d = block index %d * bytes in block %d", offset, blockIndex, bytesInBlock)
 	var count int64 = bytesInBlock
 
-	get, err := fm.blobURL.Download(fm.ctx, offset, count, azblob.BlobAccessConditions{},
+	// The body is read with the context of the request, so the timeout also
+	// bounds the transfer of the block
+	ctx, cancel := blockContext()
+	defer cancel()
+	if fm.downloadConcurrency > 1 {
+		data, err := downloadRanges(ctx, offset, count, fm.downloadConcurrency)
+		if err != nil {
+			return errors.Wrapf(blockError(ctx, "download", blockIndex, err), "Can't download block"), nil
+		}
+		if err := verifyBlockDigest(blockIndex, data); err != nil {
+			return err, nil
+		}
+		return nil, data
+	}
+	get, err := fm.blobURL.Download(ctx, offset, count, azblob.BlobAccessConditions{},
 		false, azblob.ClientProvidedKeyOptions{})
 	if err != nil {
 		var empty []byte
-		return errors.Wrapf(err, "Can't download block"), empty
+		return errors.Wrapf(blockError(ctx, "download", blockIndex, err), "Can't download block"), empty
 	}
 
 	blobData := &bytes.Buffer{}
@@ -203,8 +324,138 @@ func AzureDownloadBlock(blockIndex int64) (err error, b []byte) {
 
 	if err != nil {
 		var empty []byte
-		return errors.Wrapf(err, "ReadFrom() failed for block"), empty
+		return errors.Wrapf(blockError(ctx, "download", blockIndex, err), "ReadFrom() failed for block"), empty
+	}
+
+	if err := verifyBlockDigest(blockIndex, blobData.Bytes()); err != nil {
+		var empty []byte
+		return err, empty
 	}
 
 	return nil, blobData.Bytes()
 }
+
+// setBlockDigests sets the digests that downloaded blocks are verified
+// against. Blocks of read-write files change when they are written, so they
+// can't be verified.
+func setBlockDigests(blockDigests map[int64]string) error {
+	fm.blockDigests = nil
+	if len(blockDigests) == 0 {
+		return nil
+	}
+	if fm.readWrite {
+		return errors.New("Block digests can't be verified in read-write files")
+	}
+	digests := make(map[int64][]byte, len(blockDigests))
+	for blockIndex, hexDigest := range blockDigests {
+		digest, err := hex.DecodeString(hexDigest)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid digest of block %d", blockIndex)
+		}
+		if blockIndex < 0 || len(digest) != sha256.Size {
+			return errors.Errorf("Invalid digest of block %d: expected a SHA-256 digest of a non-negative block index", blockIndex)
+		}
+		digests[blockIndex] = digest
+	}
+	fm.blockDigests = digests
+	return nil
+}
+
+// verifyBlockDigest checks that the SHA-256 digest of the downloaded data of
+// a block matches the one in the block digests, if there is one, so that
+// corrupted blocks never reach the filesystem.
+func verifyBlockDigest(blockIndex int64, data []byte) error {
+	expected, ok := fm.blockDigests[blockIndex]
+	if !ok {
+		return nil
+	}
+	actual := sha256.Sum256(data)
+	if !bytes.Equal(actual[:], expected) {
+		logrus.Errorf("Digest mismatch of block %d: expected %x, got %x", blockIndex, expected, actual)
+		return errors.Errorf("Digest of block %d doesn't match: expected %x, got %x", blockIndex, expected, actual)
+	}
+	return nil
+}
+
+// Set the number of sub-ranges that each block is split in, which are
+// downloaded from Azure Blob Storage at the same time. Values below 2
+// download each block in a single request. It must be called before the file
+// is set up.
+func SetDownloadConcurrency(concurrency int) {
+	fm.downloadConcurrency = concurrency
+}
+
+// downloadRanges downloads the count bytes of the blob at offset in
+// concurrency sub-ranges at the same time, and returns them in order. The
+// sub-ranges are aligned to pages, so the last one can be shorter, and the
+// range stops at the end of the blob. If any sub-range fails, the others are
+// cancelled and the error identifies the offset of the one that failed.
+func downloadRanges(ctx context.Context, offset int64, count int64, concurrency int) ([]byte, error) {
+	if fm.contentLength > 0 && offset+count > fm.contentLength {
+		count = fm.contentLength - offset
+	}
+	rangeSize := (count + int64(concurrency) - 1) / int64(concurrency)
+	rangeSize = (rangeSize + pageBlobAlignment - 1) / pageBlobAlignment * pageBlobAlignment
+	if count <= 0 || rangeSize <= 0 {
+		return nil, errors.Errorf("no data to download at offset %d", offset)
+	}
+	numRanges := int((count + rangeSize - 1) / rangeSize)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ranges := make([][]byte, numRanges)
+	// The first range that fails cancels the others, so its error is recorded
+	// before the cancel and the errors of the cancelled ranges are dropped
+	var (
+		errMu    sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < numRanges; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rangeOffset := offset + int64(i)*rangeSize
+			rangeCount := rangeSize
+			if remaining := offset + count - rangeOffset; remaining < rangeCount {
+				rangeCount = remaining
+			}
+			data, err := downloadRange(ctx, rangeOffset, rangeCount)
+			if err != nil {
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = errors.Wrapf(err, "failed to download range at offset %d", rangeOffset)
+				}
+				errMu.Unlock()
+				cancel()
+				return
+			}
+			ranges[i] = data
+		}(i)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return bytes.Join(ranges, nil), nil
+}
+
+// downloadRange downloads the count bytes of the blob at offset.
+func downloadRange(ctx context.Context, offset int64, count int64) ([]byte, error) {
+	get, err := fm.blobURL.Download(ctx, offset, count, azblob.BlobAccessConditions{},
+		false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	reader := get.Body(azblob.RetryReaderOptions{})
+	defer reader.Close()
+	data := &bytes.Buffer{}
+	if _, err := data.ReadFrom(reader); err != nil {
+		return nil, err
+	}
+	if int64(data.Len()) != count {
+		return nil, errors.Errorf("downloaded %d bytes, expected %d", data.Len(), count)
+	}
+	return data.Bytes(), nil
+}
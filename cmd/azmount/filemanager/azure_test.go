@@ -0,0 +1,299 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package filemanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+)
+
+func Test_CheckPageBlobBlockSize(t *testing.T) {
+	for _, blockSize := range []int64{512, 4096, BLOCK_SIZE} {
+		if err := checkPageBlobBlockSize(blockSize); err != nil {
+			t.Errorf("expected block size %d to be valid: %v", blockSize, err)
+		}
+	}
+	for _, blockSize := range []int64{0, -512, 1000} {
+		if err := checkPageBlobBlockSize(blockSize); err == nil {
+			t.Errorf("expected block size %d to be rejected", blockSize)
+		}
+	}
+
+	// AzureSetup rejects a misaligned block size before connecting
+	origBlockSize := fm.blockSize
+	defer func() { fm.blockSize = origBlockSize }()
+	fm.blockSize = 1000
+	err := AzureSetup(context.Background(), "https://account.blob.core.windows.net/c/image", BlobAccessPublic, common.Identity{}, 0, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "isn't a positive multiple") {
+		t.Fatalf("expected AzureSetup to reject the block size, got %v", err)
+	}
+}
+
+func Test_AzureSetup_BlobAccessAuto(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/public/image":
+			w.Header().Set("Content-Length", "4096")
+			w.WriteHeader(http.StatusOK)
+		case "/invalid/image":
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			// Private container
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	origBlobURL, origContentLength := fm.blobURL, fm.contentLength
+	origDownloadBlock, origUploadBlock := fm.downloadBlock, fm.uploadBlock
+	defer func() {
+		fm.blobURL, fm.contentLength = origBlobURL, origContentLength
+		fm.downloadBlock, fm.uploadBlock = origDownloadBlock, origUploadBlock
+	}()
+
+	// Public blobs are accessed without a token
+	if err := AzureSetup(context.Background(), server.URL+"/public/image", BlobAccessAuto, common.Identity{}, 0, nil, nil); err != nil {
+		t.Fatalf("expected public blob to be accessed anonymously: %v", err)
+	}
+	if fm.contentLength != 4096 || fm.tokenRefresher != nil {
+		t.Fatalf("unexpected access to public blob of %d bytes", fm.contentLength)
+	}
+
+	// Blobs of private containers are reported as not found, which makes
+	// the auto access switch to a token
+	for path, denied := range map[string]bool{"/private/image": true, "/invalid/image": false} {
+		u, _ := url.Parse(server.URL + path)
+		_, err := publicBlobURL(u).GetProperties(context.Background(), azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		if err == nil || anonymousAccessDenied(err) != denied {
+			t.Errorf("%s: expected denied=%t, got %v", path, denied, err)
+		}
+	}
+}
+
+func Test_AzureDownloadBlock_Ranges(t *testing.T) {
+	// The blob ends in the middle of the last page of the block
+	blob := make([]byte, 4*pageBlobAlignment+100)
+	for i := range blob {
+		blob[i] = byte(i % 251)
+	}
+	failingOffset := int64(-1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("x-ms-range"), "bytes=%d-%d", &start, &end); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if start == failingOffset {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// The other ranges stall until the failure cancels them
+		if failingOffset >= 0 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+			return
+		}
+		if end >= int64(len(blob)) {
+			end = int64(len(blob)) - 1
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(blob[start : end+1])
+	}))
+	defer server.Close()
+
+	origBlobURL, origContentLength := fm.blobURL, fm.contentLength
+	origBlockSize, origConcurrency := fm.blockSize, fm.downloadConcurrency
+	defer func() {
+		fm.blobURL, fm.contentLength = origBlobURL, origContentLength
+		fm.blockSize, fm.downloadConcurrency = origBlockSize, origConcurrency
+	}()
+	u, _ := url.Parse(server.URL + "/public/image")
+	fm.blobURL = publicBlobURL(u)
+	fm.contentLength = int64(len(blob))
+	fm.blockSize = 8 * pageBlobAlignment
+
+	for _, concurrency := range []int{1, 2, 3, 8} {
+		SetDownloadConcurrency(concurrency)
+		err, data := AzureDownloadBlock(0)
+		if err != nil {
+			t.Fatalf("concurrency %d: unexpected error: %v", concurrency, err)
+		}
+		if !bytes.Equal(data, blob) {
+			t.Fatalf("concurrency %d: downloaded %d bytes that don't match the blob", concurrency, len(data))
+		}
+	}
+
+	// A failing sub-range fails the whole block, and its error is reported
+	// instead of the errors of the ranges it cancelled
+	SetDownloadConcurrency(4)
+	failingOffset = 2 * pageBlobAlignment
+	err, _ := AzureDownloadBlock(0)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("range at offset %d", failingOffset)) {
+		t.Fatalf("expected the block download to fail at offset %d, got %v", failingOffset, err)
+	}
+}
+
+func Test_AzureDownloadBlock_Digests(t *testing.T) {
+	blob := bytes.Repeat([]byte{0xab}, 2*pageBlobAlignment)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int64
+		fmt.Sscanf(r.Header.Get("x-ms-range"), "bytes=%d-%d", &start, &end)
+		if r.Method == http.MethodHead {
+			start, end = 0, int64(len(blob))-1
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(blob[start : end+1])
+		}
+	}))
+	defer server.Close()
+
+	origBlobURL, origContentLength := fm.blobURL, fm.contentLength
+	origDownloadBlock, origUploadBlock := fm.downloadBlock, fm.uploadBlock
+	origBlockSize, origDigests, origReadWrite := fm.blockSize, fm.blockDigests, fm.readWrite
+	defer func() {
+		fm.blobURL, fm.contentLength = origBlobURL, origContentLength
+		fm.downloadBlock, fm.uploadBlock = origDownloadBlock, origUploadBlock
+		fm.blockSize, fm.blockDigests, fm.readWrite = origBlockSize, origDigests, origReadWrite
+	}()
+	fm.blockSize = pageBlobAlignment
+
+	block := sha256.Sum256(blob[:pageBlobAlignment])
+	digests := map[int64]string{
+		0: hex.EncodeToString(block[:]),
+		1: strings.Repeat("00", sha256.Size),
+	}
+
+	// Read-write files change when they are written, so they can't be verified
+	fm.readWrite = true
+	err := AzureSetup(context.Background(), server.URL+"/public/image", BlobAccessPublic, common.Identity{}, 0, nil, digests)
+	if err == nil || !strings.Contains(err.Error(), "read-write") {
+		t.Fatalf("expected digests of a read-write file to be rejected, got %v", err)
+	}
+	fm.readWrite = false
+	if err := AzureSetup(context.Background(), server.URL+"/public/image", BlobAccessPublic, common.Identity{}, 0, nil, digests); err != nil {
+		t.Fatalf("unexpected setup error: %v", err)
+	}
+
+	// Block 0 matches its digest, block 1 doesn't and block 2 has none
+	if err, data := AzureDownloadBlock(0); err != nil || !bytes.Equal(data, blob[:pageBlobAlignment]) {
+		t.Fatalf("expected block 0 to be verified, got %v", err)
+	}
+	if err, _ := AzureDownloadBlock(1); err == nil || !strings.Contains(err.Error(), "Digest of block 1 doesn't match") {
+		t.Fatalf("expected block 1 to fail verification, got %v", err)
+	}
+	fm.blockDigests = nil
+	if err, _ := AzureDownloadBlock(1); err != nil {
+		t.Fatalf("expected block 1 not to be verified without digests, got %v", err)
+	}
+
+	// Malformed digests are rejected at setup
+	for _, digest := range []string{"not hex", "abcd"} {
+		err := AzureSetup(context.Background(), server.URL+"/public/image", BlobAccessPublic, common.Identity{}, 0, nil, map[int64]string{0: digest})
+		if err == nil || !strings.Contains(err.Error(), "Invalid digest of block 0") {
+			t.Errorf("expected digest %q to be rejected, got %v", digest, err)
+		}
+	}
+}
+
+func Test_AzureSetup_Context(t *testing.T) {
+	// The server stalls downloads until the test ends
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			select {
+			case <-stalled:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		w.Header().Set("Content-Length", "4096")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	origBlobURL, origContentLength, origCtx := fm.blobURL, fm.contentLength, fm.ctx
+	origDownloadBlock, origUploadBlock := fm.downloadBlock, fm.uploadBlock
+	defer func() {
+		fm.blobURL, fm.contentLength, fm.ctx = origBlobURL, origContentLength, origCtx
+		fm.downloadBlock, fm.uploadBlock = origDownloadBlock, origUploadBlock
+	}()
+
+	// A cancelled context fails the setup
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := AzureSetup(ctx, server.URL+"/public/image", BlobAccessPublic, common.Identity{}, 0, nil, nil); err == nil {
+		t.Fatal("expected setup with a cancelled context to fail")
+	}
+
+	// Cancelling the context after the setup abandons stalled downloads
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	if err := AzureSetup(ctx, server.URL+"/public/image", BlobAccessPublic, common.Identity{}, 0, nil, nil); err != nil {
+		t.Fatalf("unexpected setup error: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		err, _ := AzureDownloadBlock(0)
+		done <- err
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected the download to fail after the context was cancelled")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("download kept blocking after the context was cancelled")
+	}
+}
+
+func Test_PrivateBlobURL_TokenAudience(t *testing.T) {
+	t.Setenv("AZURE_FEDERATED_TOKEN_FILE", "")
+	var resources []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resources = append(resources, r.URL.Query().Get("resource"))
+		w.Write([]byte(`{"access_token":"token","expires_in":"3600"}`))
+	}))
+	defer server.Close()
+	defer AzureTeardown()
+
+	u, _ := url.Parse("https://account.blob.core.windows.net/c/image")
+	for _, tc := range []struct {
+		audience string
+		resource string
+	}{
+		// The audience is derived from the host of the blob by default
+		{"", "https://account.blob.core.windows.net"},
+		{"https://storage.azure.com", "https://storage.azure.com"},
+	} {
+		resources = nil
+		identity := common.Identity{TokenAudience: tc.audience, TokenEndpoint: server.URL + "/token"}
+		if _, err := privateBlobURL(u, identity); err != nil {
+			t.Fatalf("audience %q: unexpected error: %v", tc.audience, err)
+		}
+		AzureTeardown()
+		if len(resources) != 1 || resources[0] != tc.resource {
+			t.Errorf("audience %q: expected a token for %s, got %v", tc.audience, tc.resource, resources)
+		}
+	}
+}
@@ -4,47 +4,122 @@
 package filemanager
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
+// Returned by writes after too many blocks have failed to upload
+var ErrWritesDisabled = errors.New("writes disabled after repeated upload failures")
+
 type FileManager struct {
 	// Context objects to access data from Azure Blob Storage
 	ctx     context.Context
 	blobURL azblob.PageBlobURL
+	// Refresher of the token of private blobs
+	tokenRefresher *tokenRefresher
 
 	// Objects to access data from local storage
 	filePath string
 
+	// Layer of an OCI artifact in a container registry
+	ociBlob *ociBlob
+
 	// The maximum size for a page blob is 8 TB
 	contentLength int64
 
 	// Cache handler
 	cache     *lru.Cache
 	blockSize int64
+	numBlocks int
 
 	// Mutex for the block cache
 	mutex sync.Mutex
 
+	// Downloads in flight, keyed by block index, so that concurrent reads of a
+	// block that isn't cached share a single download. Protected by the mutex.
+	downloads map[int64]*blockDownload
+
 	// Function used to access a block from the raw filesystem image
 	downloadBlock func(blockIndex int64) (error, []byte)
 
-	// Function used to write block to raw filesystem image
+	// Function used to write block to raw filesystem image. data can hold
+	// several contiguous blocks starting at blockIndex.
 	uploadBlock func(blockIndex int64, data []byte) error
 
+	// Maximum time that the download or upload of a block can take. Zero
+	// means no limit.
+	blockTimeout time.Duration
+
+	// Number of sub-ranges of a block downloaded at the same time from Azure
+	// Blob Storage. Values below 2 download whole blocks.
+	downloadConcurrency int
+
+	// Expected SHA-256 digests of blocks downloaded from Azure Blob Storage,
+	// keyed by block index. Blocks without a digest aren't verified.
+	blockDigests map[int64][]byte
+
 	// Read-Write cache
 	readWrite bool
+
+	// Blocks that couldn't be uploaded when they were evicted, keyed by block
+	// index. They are kept here so that their contents aren't lost, and they
+	// are moved back to the cache when they are accessed again so that the
+	// upload is retried on the next eviction. Protected by the mutex.
+	failedUploads map[int64][]byte
+
+	// Number of consecutive failed uploads. Protected by the mutex.
+	uploadFailures int
+
+	// Number of consecutive failed uploads after which writes are rejected.
+	// Zero means that writes are never rejected.
+	maxUploadFailures int
+
+	// Set once maxUploadFailures has been reached. Protected by the mutex.
+	writesDisabled bool
+
+	// Set while the cache is purged after its blocks have been uploaded in
+	// batches, so that they aren't uploaded again. Protected by the mutex.
+	purgingUploaded bool
+
+	// Access pattern of the file and number of blocks read ahead of
+	// sequential reads. Protected by the mutex.
+	accessPattern   string
+	readAheadBlocks int
+
+	// Last block read and number of consecutive sequential reads before it,
+	// used to detect sequential access. Protected by the mutex.
+	lastBlockRead   int64
+	sequentialReads int
+}
+
+// A download of a block that other readers of the same block can wait for
+type blockDownload struct {
+	// Closed when the download has finished
+	done chan struct{}
+	data []byte
+	err  error
 }
 
 // Global state of the file manager
 var fm FileManager
 
+// Maximum number of bytes uploaded in a single request when contiguous blocks
+// are uploaded together, which is the largest Put Page request of page blobs.
+const maxUploadBatchBytes = 4 * 1024 * 1024
+
 func onEvict(key interface{}, value interface{}) {
+	if fm.purgingUploaded {
+		return
+	}
 	blockIndex := key.(int64)
 	bytes, ok := value.(*[]byte)
 	if !ok {
@@ -53,8 +128,49 @@ func onEvict(key interface{}, value interface{}) {
 
 	err := fm.uploadBlock(blockIndex, *bytes)
 	if err != nil {
-		panic(errors.Wrapf(err, "Can't upload block %d", blockIndex))
+		uploadFailed(blockIndex, *bytes, err)
+		return
+	}
+	fm.uploadFailures = 0
+}
+
+// Keep a block that couldn't be uploaded and disable writes if there have been
+// too many consecutive failures. This must be called holding the mutex.
+func uploadFailed(blockIndex int64, data []byte, err error) {
+	uploadBatchFailed(blockIndex, [][]byte{data}, err)
+}
+
+// Keep contiguous blocks, starting at firstBlockIndex, that couldn't be
+// uploaded in a single request, which counts as a single failure. This must be
+// called holding the mutex.
+func uploadBatchFailed(firstBlockIndex int64, blocks [][]byte, err error) {
+	if fm.failedUploads == nil {
+		fm.failedUploads = make(map[int64][]byte)
+	}
+	for i, data := range blocks {
+		fm.failedUploads[firstBlockIndex+int64(i)] = data
+	}
+	fm.uploadFailures++
+
+	if len(blocks) == 1 {
+		logrus.Errorf("Can't upload block %d (%d consecutive failures): %s", firstBlockIndex, fm.uploadFailures, err.Error())
+	} else {
+		logrus.Errorf("Can't upload blocks %d to %d (%d consecutive failures): %s", firstBlockIndex, firstBlockIndex+int64(len(blocks))-1, fm.uploadFailures, err.Error())
 	}
+
+	if fm.maxUploadFailures > 0 && fm.uploadFailures >= fm.maxUploadFailures && !fm.writesDisabled {
+		logrus.Errorf("%d consecutive uploads failed, rejecting further writes", fm.uploadFailures)
+		fm.writesDisabled = true
+	}
+}
+
+// Set the number of consecutive failed uploads after which writes are
+// rejected with ErrWritesDisabled. Zero means that writes are never rejected.
+func SetMaxUploadFailures(maxUploadFailures int) {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+
+	fm.maxUploadFailures = maxUploadFailures
 }
 
 func InitializeCache(blockSize int, numBlocks int, readWrite bool) error {
@@ -76,20 +192,87 @@ func InitializeCache(blockSize int, numBlocks int, readWrite bool) error {
 	fm.cache = cache
 	fm.readWrite = readWrite
 	fm.blockSize = int64(blockSize)
+	fm.numBlocks = numBlocks
+	fm.lastBlockRead = -1
+	fm.sequentialReads = 0
+	fm.failedUploads = nil
+	fm.uploadFailures = 0
+	fm.writesDisabled = false
 
 	return nil
 }
 
-// This clears cache. It is only needed for testing purposes.
+// This clears cache, uploading all dirty blocks of read-write caches. Blocks
+// that failed to upload earlier are uploaded again, and an error is returned
+// if any of them still can't be uploaded. Contiguous blocks are uploaded in a
+// single request of up to maxUploadBatchBytes.
 func ClearCache() error {
 	fm.mutex.Lock()
 	defer fm.mutex.Unlock()
 
+	if fm.readWrite {
+		uploadDirtyBlocks()
+		fm.purgingUploaded = true
+	}
 	fm.cache.Purge()
+	fm.purgingUploaded = false
+
+	if len(fm.failedUploads) > 0 {
+		return fmt.Errorf("%d blocks couldn't be uploaded", len(fm.failedUploads))
+	}
 
 	return nil
 }
 
+// Upload the blocks of the cache and the ones that failed to upload earlier,
+// coalescing contiguous blocks. The blocks that fail to upload are kept in
+// failedUploads. This must be called holding the mutex.
+func uploadDirtyBlocks() {
+	dirty := fm.failedUploads
+	fm.failedUploads = nil
+	if dirty == nil {
+		dirty = make(map[int64][]byte)
+	}
+	// The cache has the latest contents of a block
+	for _, key := range fm.cache.Keys() {
+		if value, ok := fm.cache.Peek(key); ok {
+			dirty[key.(int64)] = *value.(*[]byte)
+		}
+	}
+
+	indexes := make([]int64, 0, len(dirty))
+	for blockIndex := range dirty {
+		indexes = append(indexes, blockIndex)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	maxBatchBlocks := int(maxUploadBatchBytes / fm.blockSize)
+	if maxBatchBlocks < 1 {
+		maxBatchBlocks = 1
+	}
+	for start := 0; start < len(indexes); {
+		end := start + 1
+		for end < len(indexes) && end-start < maxBatchBlocks && indexes[end] == indexes[end-1]+1 {
+			end++
+		}
+
+		blocks := make([][]byte, 0, end-start)
+		for _, blockIndex := range indexes[start:end] {
+			blocks = append(blocks, dirty[blockIndex])
+		}
+		data := blocks[0]
+		if len(blocks) > 1 {
+			data = bytes.Join(blocks, nil)
+		}
+		if err := fm.uploadBlock(indexes[start], data); err != nil {
+			uploadBatchFailed(indexes[start], blocks, err)
+		} else {
+			fm.uploadFailures = 0
+		}
+		start = end
+	}
+}
+
 func GetFileSize() int64 {
 	return fm.contentLength
 }
@@ -115,16 +298,85 @@ func GetBlockFromCache(blockIndex int64) ([]byte, error) {
 	return nil, nil
 }
 
+// Utility function to get a block from the cache or, if it isn't there, from
+// the blocks that failed to upload. Blocks that failed to upload are removed
+// from them, so the caller must add the block back to the cache. This must be
+// called holding the mutex.
+func getDirtyBlock(blockIndex int64) ([]byte, error) {
+	dat, err := GetBlockFromCache(blockIndex)
+	if err != nil || dat != nil {
+		return dat, err
+	}
+	if dat, ok := fm.failedUploads[blockIndex]; ok {
+		delete(fm.failedUploads, blockIndex)
+		return dat, nil
+	}
+	return nil, nil
+}
+
 // Utility function to download the block
 func DownloadBlock(blockIndex int64) ([]byte, error) {
+	downloads.start(blockIndex)
 	err, dat := fm.downloadBlock(blockIndex)
 	if err != nil {
+		downloads.end(blockIndex, 0)
 		return []byte{}, errors.Wrapf(err, "Can't download block")
 	}
+	downloads.end(blockIndex, len(dat))
 	return dat, nil
 }
 
+// Utility function to download a block that isn't in the cache and save it to
+// the cache. Concurrent calls for the same block share the same download, and
+// the block is added to the cache under the same lock that removes it from the
+// downloads in progress. This must be called without holding the mutex. It is
+// only used by read-only caches: read-write caches still serialize every
+// download under fm.mutex, see GetBlock.
+func downloadBlockToCache(blockIndex int64) ([]byte, error) {
+	fm.mutex.Lock()
+	if d, ok := fm.downloads[blockIndex]; ok {
+		// Another reader is already downloading this block, wait for it
+		fm.mutex.Unlock()
+		<-d.done
+		return d.data, d.err
+	}
+	if fm.downloads == nil {
+		fm.downloads = make(map[int64]*blockDownload)
+	}
+	d := &blockDownload{done: make(chan struct{})}
+	fm.downloads[blockIndex] = d
+	fm.mutex.Unlock()
+
+	d.data, d.err = DownloadBlock(blockIndex)
+
+	fm.mutex.Lock()
+	if d.err == nil {
+		// A previous download of the same block may have saved it to the
+		// cache in the meantime. In that case, keep the cached copy.
+		cached, err := GetBlockFromCache(blockIndex)
+		if err != nil {
+			d.data, d.err = nil, err
+		} else if cached != nil {
+			d.data = cached
+		} else {
+			fm.cache.Add(blockIndex, &d.data)
+		}
+	}
+	delete(fm.downloads, blockIndex)
+	fm.mutex.Unlock()
+	close(d.done)
+
+	return d.data, d.err
+}
+
 func GetBlock(blockIndex int64) (error, []byte) {
+	// Read-write caches can have dirty blocks that are uploaded on eviction, so
+	// keep the mutex held while downloading to make sure a stale download never
+	// replaces a block that has been written in the meantime.
+	if !fm.readWrite {
+		return getReadOnlyBlock(blockIndex)
+	}
+
 	fm.mutex.Lock()
 	defer fm.mutex.Unlock()
 
@@ -141,7 +393,7 @@ func GetBlock(blockIndex int64) (error, []byte) {
 	}
 
 	// Check if this block is in the cache
-	dat, err := GetBlockFromCache(blockIndex)
+	dat, err := getDirtyBlock(blockIndex)
 	if err != nil {
 		return err, []byte{}
 	}
@@ -159,6 +411,43 @@ func GetBlock(blockIndex int64) (error, []byte) {
 	return nil, dat
 }
 
+// getReadOnlyBlock is the read-only version of GetBlock. The mutex isn't held
+// while downloading, so different blocks can be downloaded concurrently.
+func getReadOnlyBlock(blockIndex int64) (error, []byte) {
+	// Check bounds
+	if blockIndex < 0 {
+		errorString := fmt.Sprintf("Invalid block index (%d)", blockIndex)
+		return errors.New(errorString), []byte{}
+	}
+
+	maxIndex := (fm.contentLength - 1) / fm.blockSize
+	if blockIndex > maxIndex {
+		errorString := fmt.Sprintf("Block index over limit (%d > %d)", blockIndex, maxIndex)
+		return errors.New(errorString), []byte{}
+	}
+
+	// Check if this block is in the cache
+	fm.mutex.Lock()
+	dat, err := GetBlockFromCache(blockIndex)
+	fm.mutex.Unlock()
+	if err != nil {
+		return err, []byte{}
+	}
+	if dat != nil {
+		readAhead(blockIndex)
+		return nil, dat
+	}
+
+	// If it isn't in the cache, download it
+	readAhead(blockIndex)
+	dat, err = downloadBlockToCache(blockIndex)
+	if err != nil {
+		return err, []byte{}
+	}
+
+	return nil, dat
+}
+
 func GetBytes(offset int64, to int64) (error, []byte) {
 	if offset < 0 || to < 0 {
 		errorString := fmt.Sprintf("GetBytes(%d, %d): negative pointer", offset, to)
@@ -197,6 +486,10 @@ func SetBlock(blockIndex int64, blockOffset int64, data []byte) error {
 	fm.mutex.Lock()
 	defer fm.mutex.Unlock()
 
+	if fm.writesDisabled {
+		return ErrWritesDisabled
+	}
+
 	// Check bounds
 	if blockIndex < 0 {
 		errorString := fmt.Sprintf("Invalid block index (%d)", blockIndex)
@@ -210,7 +503,7 @@ func SetBlock(blockIndex int64, blockOffset int64, data []byte) error {
 	}
 
 	// Check if this block is in the cache
-	dat, err := GetBlockFromCache(blockIndex)
+	dat, err := getDirtyBlock(blockIndex)
 	if err != nil {
 		return err
 	}
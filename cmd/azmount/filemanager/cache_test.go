@@ -10,7 +10,11 @@ import (
 	"io"
 	"os"
 	"path"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -356,11 +360,234 @@ func Test_SetBlock_TestBounds(t *testing.T) {
 	}
 }
 
+// Test that concurrent reads of a block that isn't in the cache only download
+// it once, and that all readers get the right data.
+func Test_GetBlock_ConcurrentDownload(t *testing.T) {
+	ClearCache()
+
+	// Earlier tests may have written to the block in read-write caches, so
+	// compare with the current contents of the file
+	err, reference := fm.downloadBlock(5)
+	if err != nil {
+		t.Fatalf("downloadBlock(5) failed: %s", err.Error())
+	}
+
+	var downloads int32
+	downloadBlock := fm.downloadBlock
+	defer func() { fm.downloadBlock = downloadBlock }()
+	fm.downloadBlock = func(blockIndex int64) (error, []byte) {
+		atomic.AddInt32(&downloads, 1)
+		// Give the other readers time to request the same block
+		time.Sleep(10 * time.Millisecond)
+		return downloadBlock(blockIndex)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err, data := GetBlock(5)
+			if err != nil {
+				t.Errorf("GetBlock(5) failed: %s", err.Error())
+				return
+			}
+			if !bytes.Equal(data, reference) {
+				t.Errorf("GetBlock(5) returned wrong data")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if downloads != 1 {
+		t.Errorf("block 5 downloaded %d times, expected 1", downloads)
+	}
+}
+
+// Test that the blocks after sequential reads are downloaded in the
+// background, and that random reads aren't read ahead.
+func Test_GetBlock_ReadAhead(t *testing.T) {
+	if IsReadWrite() {
+		t.Skip("only read-only caches read ahead")
+	}
+
+	ClearCache()
+	defer SetAccessPattern(AccessPatternRandom, 0)
+
+	waitForBlock := func(blockIndex int64) bool {
+		for i := 0; i < 100; i++ {
+			fm.mutex.Lock()
+			cached := fm.cache.Contains(blockIndex)
+			fm.mutex.Unlock()
+			if cached {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	if err := SetAccessPattern(AccessPatternSequential, 4); err != nil {
+		t.Fatalf("SetAccessPattern failed: %s", err.Error())
+	}
+	if err, _ := GetBlock(20); err != nil {
+		t.Fatalf("GetBlock(20) failed: %s", err.Error())
+	}
+	for i := int64(21); i <= 24; i++ {
+		if !waitForBlock(i) {
+			t.Errorf("block %d wasn't read ahead", i)
+		}
+	}
+	if fm.cache.Contains(int64(25)) {
+		t.Errorf("block 25 was read ahead beyond the read-ahead window")
+	}
+
+	// The auto pattern only reads ahead after a few sequential reads
+	ClearCache()
+	if err := SetAccessPattern(AccessPatternAuto, 4); err != nil {
+		t.Fatalf("SetAccessPattern failed: %s", err.Error())
+	}
+	for _, i := range []int64{40, 60, 50} {
+		if err, _ := GetBlock(i); err != nil {
+			t.Fatalf("GetBlock(%d) failed: %s", i, err.Error())
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if fm.cache.Contains(int64(51)) {
+		t.Errorf("block 51 was read ahead of random reads")
+	}
+	for i := int64(51); i <= 53; i++ {
+		if err, _ := GetBlock(i); err != nil {
+			t.Fatalf("GetBlock(%d) failed: %s", i, err.Error())
+		}
+	}
+	if !waitForBlock(56) {
+		t.Errorf("block 56 wasn't read ahead of sequential reads")
+	}
+
+	if err := SetAccessPattern("backwards", 4); err == nil {
+		t.Errorf("expected unknown access pattern to be rejected")
+	}
+}
+
+// Test that blocks that fail to upload aren't lost, and that writes are
+// rejected after too many consecutive failures.
+func Test_SetBytes_UploadFailures(t *testing.T) {
+	if !IsReadWrite() {
+		t.Skip("only read-write caches upload blocks")
+	}
+
+	ClearCache()
+
+	uploadBlock := fm.uploadBlock
+	defer func() {
+		fm.uploadBlock = uploadBlock
+		ClearCache()
+		fm.maxUploadFailures = 0
+		fm.writesDisabled = false
+	}()
+	fm.uploadBlock = func(blockIndex int64, data []byte) error {
+		return errors.New("upload failed")
+	}
+	SetMaxUploadFailures(2)
+
+	data := GenerateRandomData(BYTES_PER_32KB)
+	if err := SetBytes(BLOCK2_OFFSET, data); err != nil {
+		t.Fatalf("SetBytes() failed: %s", err.Error())
+	}
+
+	// The first failure doesn't disable writes
+	if err := ClearCache(); err == nil {
+		t.Fatalf("ClearCache() should have failed")
+	}
+	if err := SetBytes(BLOCK3_OFFSET, data); err != nil {
+		t.Fatalf("SetBytes() failed: %s", err.Error())
+	}
+
+	// The block that failed to upload is still readable
+	err, readData := GetBytes(BLOCK2_OFFSET, BLOCK2_OFFSET+BYTES_PER_32KB)
+	if err != nil {
+		t.Fatalf("GetBytes() failed: %s", err.Error())
+	}
+	if !bytes.Equal(readData, data) {
+		t.Errorf("GetBytes() returned wrong data after a failed upload")
+	}
+
+	if err := ClearCache(); err == nil {
+		t.Fatalf("ClearCache() should have failed")
+	}
+	if err := SetBytes(BLOCK5_OFFSET, data); !errors.Is(err, ErrWritesDisabled) {
+		t.Fatalf("SetBytes() returned %v, expected ErrWritesDisabled", err)
+	}
+
+	// Once the backend works again, the blocks are uploaded
+	fm.uploadBlock = uploadBlock
+	if err := ClearCache(); err != nil {
+		t.Fatalf("ClearCache() failed: %s", err.Error())
+	}
+	for _, offset := range []int64{BLOCK2_OFFSET, BLOCK3_OFFSET} {
+		err, readData := GetBytes(offset, offset+BYTES_PER_32KB)
+		if err != nil {
+			t.Fatalf("GetBytes() failed: %s", err.Error())
+		}
+		if !bytes.Equal(readData, data) {
+			t.Errorf("GetBytes(%d) returned wrong data after the upload", offset)
+		}
+	}
+}
+
+// Test that contiguous dirty blocks are uploaded together when the cache is
+// cleared.
+func Test_ClearCache_UploadBatches(t *testing.T) {
+	if !IsReadWrite() {
+		t.Skip("only read-write caches upload blocks")
+	}
+
+	ClearCache()
+
+	uploadBlock := fm.uploadBlock
+	defer func() { fm.uploadBlock = uploadBlock }()
+	type upload struct {
+		blockIndex int64
+		blocks     int64
+	}
+	var uploads []upload
+	fm.uploadBlock = func(blockIndex int64, data []byte) error {
+		uploads = append(uploads, upload{blockIndex, int64(len(data)) / BLOCK_SIZE})
+		return uploadBlock(blockIndex, data)
+	}
+
+	// Blocks 0 to 4 are contiguous, but a request holds at most 4 of them
+	data := GenerateRandomData(BYTES_PER_32KB)
+	for _, blockIndex := range []int64{6, 2, 0, 1, 3, 4} {
+		if err := SetBytes(blockIndex*BLOCK_SIZE, data); err != nil {
+			t.Fatalf("SetBytes() failed: %s", err.Error())
+		}
+	}
+	if err := ClearCache(); err != nil {
+		t.Fatalf("ClearCache() failed: %s", err.Error())
+	}
+	expected := []upload{{0, maxUploadBatchBytes / BLOCK_SIZE}, {4, 1}, {6, 1}}
+	if !reflect.DeepEqual(uploads, expected) {
+		t.Fatalf("expected uploads %v, got %v", expected, uploads)
+	}
+
+	for _, blockIndex := range []int64{0, 3, 4, 6} {
+		err, readData := GetBytes(blockIndex*BLOCK_SIZE, blockIndex*BLOCK_SIZE+BYTES_PER_32KB)
+		if err != nil {
+			t.Fatalf("GetBytes() failed: %s", err.Error())
+		}
+		if !bytes.Equal(readData, data) {
+			t.Errorf("GetBytes() returned wrong data for block %d after the upload", blockIndex)
+		}
+	}
+}
+
 // The tests only test the filemanager cache code. In order for them to run
 // faster, the local file reader is setup, not the Azure downloader. The
 // TestMain funcion needs to generate a reference file so that the tests can
 // run.
-func DoAllTests(m *testing.M, readWrite bool) {
+func DoAllTests(m *testing.M, readWrite bool) int {
 	if err := InitializeCache(BLOCK_SIZE, NUM_BLOCKS, readWrite); err != nil {
 		fmt.Printf("Failed to initialize cache: %s\n", err.Error())
 	}
@@ -385,12 +612,17 @@ func DoAllTests(m *testing.M, readWrite bool) {
 		fmt.Printf("Local filesystem setup error: %s\n", err.Error())
 	}
 
-	m.Run()
+	return m.Run()
 }
 
 func TestMain(m *testing.M) {
 	// test read-write cache
-	DoAllTests(m, true)
+	readWriteCode := DoAllTests(m, true)
 	// test read-only cache
-	DoAllTests(m, false)
+	readOnlyCode := DoAllTests(m, false)
+
+	if readWriteCode != 0 {
+		os.Exit(readWriteCode)
+	}
+	os.Exit(readOnlyCode)
 }
@@ -47,7 +47,7 @@ func LocalSetup(filePath string, readWrite bool) error {
 }
 
 func LocalDownloadBlock(blockIndex int64) (err error, b []byte) {
-	logrus.Info("Downloading block...")
+	logrus.Debugf("Downloading block %d...", blockIndex)
 	bytesInBlock := GetBlockSize()
 	var offset int64 = blockIndex * bytesInBlock
 	logrus.Tracef("Block offset %d = block index %d * bytes in block %d", offset, blockIndex, bytesInBlock)
@@ -77,7 +77,7 @@ func LocalDownloadBlock(blockIndex int64) (err error, b []byte) {
 }
 
 func LocalUploadBlock(blockIndex int64, data []byte) error {
-	logrus.Info("Uploading block...")
+	logrus.Debugf("Uploading block %d...", blockIndex)
 	bytesInBlock := GetBlockSize()
 	var offset int64 = blockIndex * bytesInBlock
 	logrus.Tracef("Block offset %d = block index %d * bytes in blck %d", offset, blockIndex, bytesInBlock)
@@ -0,0 +1,397 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package filemanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/msi"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// OCIScheme is the URL scheme of images stored as an OCI artifact in a
+// container registry, for example:
+//
+//	oci://myregistry.azurecr.io/encrypted-images/data:v1
+//	oci://myregistry.azurecr.io/encrypted-images/data@sha256:...
+const OCIScheme = "oci"
+
+// Media types of the manifests accepted from the registry
+const (
+	ociManifestMediaType    = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// Scheme used to connect to the registry. Only changed by tests.
+var ociRegistryScheme = "https"
+
+// OCIAuth are the credentials used to get a token from the registry. If
+// Username is empty, an anonymous token is requested.
+type OCIAuth struct {
+	Username string
+	Password string
+}
+
+// ociReference is a parsed "oci://" URL.
+type ociReference struct {
+	Registry   string
+	Repository string
+	// Tag or digest of the manifest
+	Reference string
+}
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// ociBlob gives access to the layer of an OCI artifact that contains the
+// encrypted image.
+type ociBlob struct {
+	ref   ociReference
+	auth  OCIAuth
+	layer ociDescriptor
+
+	// Bearer token of the registry, refreshed when it expires
+	tokenMutex sync.Mutex
+	token      string
+}
+
+// parseOCIReference parses "oci://registry/repository:tag" and
+// "oci://registry/repository@digest". The tag defaults to "latest".
+func parseOCIReference(ref string) (ociReference, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ociReference{}, errors.Wrapf(err, "Can't parse OCI reference %s", ref)
+	}
+	if u.Scheme != OCIScheme || u.Host == "" {
+		return ociReference{}, errors.Errorf("Invalid OCI reference %s", ref)
+	}
+
+	r := ociReference{Registry: u.Host, Reference: "latest"}
+	repository := strings.TrimPrefix(u.Path, "/")
+	if name, digest, ok := strings.Cut(repository, "@"); ok {
+		repository, r.Reference = name, digest
+	} else if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository, r.Reference = repository[:i], repository[i+1:]
+	}
+	if repository == "" || r.Reference == "" {
+		return ociReference{}, errors.Errorf("Invalid OCI reference %s", ref)
+	}
+	r.Repository = repository
+	return r, nil
+}
+
+func (r ociReference) url(kind string, name string) string {
+	return fmt.Sprintf("%s://%s/v2/%s/%s/%s", ociRegistryScheme, r.Registry, r.Repository, kind, name)
+}
+
+// parseBearerChallenge parses the parameters of a WWW-Authenticate header like
+// `Bearer realm="https://...",service="...",scope="..."`.
+func parseBearerChallenge(header string) (map[string]string, error) {
+	scheme, params, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil, errors.Errorf("Unsupported authentication challenge: %s", header)
+	}
+
+	challenge := make(map[string]string)
+	for params != "" {
+		var key, value string
+		key, params, _ = strings.Cut(strings.TrimLeft(params, ", "), "=")
+		if strings.HasPrefix(params, `"`) {
+			value, params, _ = strings.Cut(params[1:], `"`)
+		} else {
+			value, params, _ = strings.Cut(params, ",")
+		}
+		challenge[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	if challenge["realm"] == "" {
+		return nil, errors.Errorf("Authentication challenge without realm: %s", header)
+	}
+	return challenge, nil
+}
+
+// authenticate gets a new token from the token service in the challenge of a
+// 401 response of the registry.
+func (b *ociBlob) authenticate(challengeHeader string) error {
+	challenge, err := parseBearerChallenge(challengeHeader)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if service := challenge["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := challenge["scope"]
+	if scope == "" {
+		scope = "repository:" + b.ref.Repository + ":pull"
+	}
+	query.Set("scope", scope)
+
+	req, err := http.NewRequest("GET", challenge["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return errors.Wrapf(err, "Can't create token request")
+	}
+	if b.auth.Username != "" {
+		req.SetBasicAuth(b.auth.Username, b.auth.Password)
+	}
+
+	resp, err := common.HTTPClient().Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Token request to %s failed", challenge["realm"])
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("Token request to %s failed with status %s", challenge["realm"], resp.Status)
+	}
+
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return errors.Wrapf(err, "Can't decode token response")
+	}
+
+	b.tokenMutex.Lock()
+	defer b.tokenMutex.Unlock()
+	b.token = tokenResponse.Token
+	if b.token == "" {
+		b.token = tokenResponse.AccessToken
+	}
+	return nil
+}
+
+// get sends a GET request to the registry. If the registry asks for a token,
+// a new one is requested and the request is sent again.
+func (b *ociBlob) get(ctx context.Context, urlString string, header http.Header) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", urlString, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Can't create request")
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+
+		b.tokenMutex.Lock()
+		if b.token != "" {
+			req.Header.Set("Authorization", "Bearer "+b.token)
+		}
+		b.tokenMutex.Unlock()
+
+		resp, err := common.HTTPClient().Do(req)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Request to %s failed", urlString)
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+
+		resp.Body.Close()
+		logrus.Debugf("Requesting registry token for %s", b.ref.Repository)
+		if err := b.authenticate(resp.Header.Get("WWW-Authenticate")); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// resolve downloads the manifest and finds the layer with the image.
+func (b *ociBlob) resolve() error {
+	header := http.Header{}
+	header.Set("Accept", ociManifestMediaType+", "+dockerManifestMediaType)
+	resp, err := b.get(context.Background(), b.ref.url("manifests", b.ref.Reference), header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("Can't get manifest %s: %s", b.ref.Reference, resp.Status)
+	}
+
+	manifestBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "Can't read manifest")
+	}
+
+	// A manifest pulled by digest must match it
+	if strings.HasPrefix(b.ref.Reference, "sha256:") {
+		digest := sha256.Sum256(manifestBytes)
+		if "sha256:"+hex.EncodeToString(digest[:]) != b.ref.Reference {
+			return errors.Errorf("Digest of manifest doesn't match %s", b.ref.Reference)
+		}
+	}
+
+	var manifest ociManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return errors.Wrapf(err, "Can't decode manifest")
+	}
+	if len(manifest.Layers) != 1 {
+		return errors.Errorf("Manifest %s has %d layers, expected a single layer with the image", b.ref.Reference, len(manifest.Layers))
+	}
+	b.layer = manifest.Layers[0]
+	logrus.Debugf("Image layer: %s (%d bytes)", b.layer.Digest, b.layer.Size)
+	return nil
+}
+
+// readAt reads count bytes of the layer starting at offset, abandoning the
+// request when ctx is done. Fewer bytes are returned at the end of the layer.
+func (b *ociBlob) readAt(ctx context.Context, offset int64, count int64) ([]byte, error) {
+	if offset+count > b.layer.Size {
+		count = b.layer.Size - offset
+	}
+	if count <= 0 {
+		return []byte{}, nil
+	}
+
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+count-1))
+	// Registries usually redirect blob downloads to a storage account. The
+	// HTTP client doesn't forward the Authorization header to other hosts.
+	resp, err := b.get(ctx, b.ref.url("blobs", b.layer.Digest), header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, errors.Errorf("Can't download range of layer %s: %s", b.layer.Digest, resp.Status)
+	}
+
+	data := &bytes.Buffer{}
+	if _, err := data.ReadFrom(resp.Body); err != nil {
+		return nil, errors.Wrapf(err, "ReadFrom() failed for layer")
+	}
+	if int64(data.Len()) != count {
+		return nil, errors.Errorf("Got %d bytes of layer %s, expected %d", data.Len(), b.layer.Digest, count)
+	}
+	return data.Bytes(), nil
+}
+
+// OCISetup connects to the registry of the OCI artifact at ref and exposes its
+// only layer, which contains the encrypted image. OCI images are read-only. If
+// maxImageSize is bigger than zero, layers larger than maxImageSize bytes are
+// rejected. If allowedHosts isn't empty, the registry must be one of them.
+func OCISetup(ref string, auth OCIAuth, maxImageSize int64, allowedHosts []string) error {
+	logrus.Info("Connecting to registry...")
+	r, err := parseOCIReference(ref)
+	if err != nil {
+		return err
+	}
+
+	if !common.HostAllowed(r.Registry, allowedHosts) {
+		return errors.Errorf("Host %s isn't in the list of allowed hosts", r.Registry)
+	}
+
+	blob := &ociBlob{ref: r, auth: auth}
+	if err := blob.resolve(); err != nil {
+		return err
+	}
+
+	if maxImageSize > 0 && blob.layer.Size > maxImageSize {
+		return errors.Errorf("Layer size %d bytes exceeds the maximum image size of %d bytes", blob.layer.Size, maxImageSize)
+	}
+
+	fm.ctx = context.Background()
+	fm.ociBlob = blob
+	fm.contentLength = blob.layer.Size
+	fm.downloadBlock = OCIDownloadBlock
+	fm.uploadBlock = OCIUploadBlock
+
+	return nil
+}
+
+// ACRAuth gets the credentials of a private Azure Container Registry with the
+// managed identity or the workload identity of the container.
+func ACRAuth(registry string, identity common.Identity) (OCIAuth, error) {
+	audience := identity.RegistryAudience()
+
+	var accessToken string
+	if msi.WorkloadIdentityEnabled() {
+		ctx, cancel := context.WithTimeout(context.Background(), msi.WorkloadIdentityRquestTokenTimeout)
+		defer cancel()
+		token, err := msi.GetAccessTokenFromFederatedToken(ctx, audience)
+		if err != nil {
+			return OCIAuth{}, errors.Wrapf(err, "retrieving authentication token using workload identity failed")
+		}
+		accessToken = token
+	} else {
+		token, err := common.GetToken(audience, identity)
+		if err != nil {
+			return OCIAuth{}, errors.Wrapf(err, "Could not obtain token for %s", audience)
+		}
+		accessToken = token.AccessToken
+	}
+
+	return acrExchangeToken(registry, accessToken)
+}
+
+// acrExchangeToken exchanges an Azure AD access token for a refresh token of
+// the Azure Container Registry at registry, which is used as the password of
+// the token flow of the registry.
+func acrExchangeToken(registry string, accessToken string) (OCIAuth, error) {
+	form := url.Values{}
+	form.Set("grant_type", "access_token")
+	form.Set("service", registry)
+	form.Set("access_token", accessToken)
+
+	exchangeURL := fmt.Sprintf("%s://%s/oauth2/exchange", ociRegistryScheme, registry)
+	resp, err := common.HTTPClient().PostForm(exchangeURL, form)
+	if err != nil {
+		return OCIAuth{}, errors.Wrapf(err, "Token exchange with %s failed", registry)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return OCIAuth{}, errors.Errorf("Token exchange with %s failed with status %s", registry, resp.Status)
+	}
+
+	var exchangeResponse struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&exchangeResponse); err != nil {
+		return OCIAuth{}, errors.Wrapf(err, "Can't decode token exchange response")
+	}
+
+	// ACR expects this username with refresh tokens
+	return OCIAuth{Username: "00000000-0000-0000-0000-000000000000", Password: exchangeResponse.RefreshToken}, nil
+}
+
+func OCIDownloadBlock(blockIndex int64) (err error, b []byte) {
+	logrus.Debugf("Downloading block %d...", blockIndex)
+	bytesInBlock := GetBlockSize()
+	var offset int64 = blockIndex * bytesInBlock
+	logrus.Tracef("Block offset %d = block index %d * bytes in block %d", offset, blockIndex, bytesInBlock)
+
+	ctx, cancel := blockContext()
+	defer cancel()
+	data, err := fm.ociBlob.readAt(ctx, offset, bytesInBlock)
+	if err != nil {
+		var empty []byte
+		return errors.Wrapf(blockError(ctx, "download", blockIndex, err), "Can't download block"), empty
+	}
+	return nil, data
+}
+
+func OCIUploadBlock(blockIndex int64, b []byte) error {
+	return errors.Errorf("Can't upload block %d: images in a registry are read-only", blockIndex)
+}
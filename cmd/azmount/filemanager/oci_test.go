@@ -0,0 +1,112 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package filemanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_ParseOCIReference(t *testing.T) {
+	tests := []struct {
+		ref      string
+		expected ociReference
+	}{
+		{"oci://registry.io/images/data:v1", ociReference{"registry.io", "images/data", "v1"}},
+		{"oci://registry.io:5000/data", ociReference{"registry.io:5000", "data", "latest"}},
+		{"oci://registry.io/data@sha256:abcd", ociReference{"registry.io", "data", "sha256:abcd"}},
+	}
+	for _, test := range tests {
+		r, err := parseOCIReference(test.ref)
+		if err != nil || r != test.expected {
+			t.Errorf("parseOCIReference(%s) = %+v, %v", test.ref, r, err)
+		}
+	}
+
+	for _, ref := range []string{"https://registry.io/data:v1", "oci://registry.io/", "oci:///data"} {
+		if _, err := parseOCIReference(ref); err == nil {
+			t.Errorf("expected %s to be rejected", ref)
+		}
+	}
+}
+
+func Test_OCIBlob(t *testing.T) {
+	layer := GenerateRandomData(3*BYTES_PER_KB + 100)
+	layerDigest := sha256.Sum256(layer)
+	manifest, _ := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Layers: []ociDescriptor{{
+			MediaType: "application/octet-stream",
+			Digest:    "sha256:" + hex.EncodeToString(layerDigest[:]),
+			Size:      int64(len(layer)),
+		}},
+	})
+	manifestDigest := sha256.Sum256(manifest)
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			if r.URL.Query().Get("scope") != "repository:images/data:pull" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, `{"token": "registry-token"}`)
+		case r.Header.Get("Authorization") != "Bearer registry-token":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:images/data:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		case strings.HasPrefix(r.URL.Path, "/v2/images/data/manifests/"):
+			w.Write(manifest)
+		case strings.HasPrefix(r.URL.Path, "/v2/images/data/blobs/"):
+			var start, end int
+			fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(layer[start : end+1])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	origScheme := ociRegistryScheme
+	defer func() { ociRegistryScheme = origScheme }()
+	ociRegistryScheme = "http"
+	registry := strings.TrimPrefix(server.URL, "http://")
+
+	for _, reference := range []string{"v1", "sha256:" + hex.EncodeToString(manifestDigest[:])} {
+		blob := &ociBlob{ref: ociReference{registry, "images/data", reference}}
+		if err := blob.resolve(); err != nil {
+			t.Fatalf("resolve(%s) failed: %v", reference, err)
+		}
+		if blob.layer.Size != int64(len(layer)) {
+			t.Fatalf("unexpected layer size %d", blob.layer.Size)
+		}
+
+		data, err := blob.readAt(context.Background(), BYTES_PER_KB, 2*BYTES_PER_KB)
+		if err != nil || !bytes.Equal(data, layer[BYTES_PER_KB:3*BYTES_PER_KB]) {
+			t.Fatalf("readAt returned wrong data (%v)", err)
+		}
+
+		// Reads past the end of the layer are truncated
+		data, err = blob.readAt(context.Background(), 3*BYTES_PER_KB, BYTES_PER_KB)
+		if err != nil || !bytes.Equal(data, layer[3*BYTES_PER_KB:]) {
+			t.Fatalf("readAt returned wrong data at the end of the layer (%v)", err)
+		}
+	}
+
+	// A manifest that doesn't match the digest in the reference is rejected
+	blob := &ociBlob{ref: ociReference{registry, "images/data", "sha256:" + strings.Repeat("0", 64)}}
+	if err := blob.resolve(); err == nil {
+		t.Fatalf("expected manifest with the wrong digest to be rejected")
+	}
+}
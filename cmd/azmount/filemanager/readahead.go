@@ -0,0 +1,88 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package filemanager
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Access patterns of the file, which select the read-ahead strategy
+const (
+	// Blocks are only downloaded when they are read (the default)
+	AccessPatternRandom = "random"
+	// The blocks after each block read are downloaded in the background
+	AccessPatternSequential = "sequential"
+	// Blocks are read ahead while the reads are sequential
+	AccessPatternAuto = "auto"
+)
+
+// Number of consecutive sequential reads after which the auto access pattern
+// starts reading ahead
+const sequentialReadsThreshold = 3
+
+// SetAccessPattern sets the access pattern of the file and the number of
+// blocks read ahead of sequential reads. Read-ahead is only done by read-only
+// caches, and it is limited to half of the cache so that the blocks read
+// ahead don't evict each other before they are read.
+func SetAccessPattern(accessPattern string, readAheadBlocks int) error {
+	switch accessPattern {
+	case "", AccessPatternRandom, AccessPatternSequential, AccessPatternAuto:
+	default:
+		return errors.Errorf("Unknown access pattern: %s", accessPattern)
+	}
+	if readAheadBlocks < 0 {
+		return errors.Errorf("Invalid number of read-ahead blocks: %d", readAheadBlocks)
+	}
+
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+
+	fm.accessPattern = accessPattern
+	fm.readAheadBlocks = readAheadBlocks
+	fm.lastBlockRead = -1
+	fm.sequentialReads = 0
+	return nil
+}
+
+// readAhead records a read of blockIndex and, if the access pattern asks for
+// it, starts downloading the blocks that follow it in the background.
+func readAhead(blockIndex int64) {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+
+	if blockIndex == fm.lastBlockRead+1 {
+		fm.sequentialReads++
+	} else if blockIndex != fm.lastBlockRead {
+		fm.sequentialReads = 0
+	}
+	fm.lastBlockRead = blockIndex
+
+	switch fm.accessPattern {
+	case AccessPatternSequential:
+	case AccessPatternAuto:
+		if fm.sequentialReads < sequentialReadsThreshold {
+			return
+		}
+	default:
+		return
+	}
+
+	count := int64(fm.readAheadBlocks)
+	if count > int64(fm.numBlocks/2) {
+		count = int64(fm.numBlocks / 2)
+	}
+	maxIndex := (fm.contentLength - 1) / fm.blockSize
+	for i := blockIndex + 1; i <= blockIndex+count && i <= maxIndex; i++ {
+		if _, downloading := fm.downloads[i]; downloading || fm.cache.Contains(i) {
+			continue
+		}
+		logrus.Tracef("Reading ahead block %d", i)
+		go func(i int64) {
+			if _, err := downloadBlockToCache(i); err != nil {
+				logrus.Debugf("Can't read ahead block %d: %s", i, err.Error())
+			}
+		}(i)
+	}
+}
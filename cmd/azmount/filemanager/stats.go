@@ -0,0 +1,164 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package filemanager
+
+import (
+	"sync"
+	"time"
+)
+
+// DownloadStats are the statistics of the blocks downloaded from the image.
+type DownloadStats struct {
+	BytesDownloaded  int64 `json:"bytes_downloaded"`
+	BlocksDownloaded int64 `json:"blocks_downloaded"`
+	// Time during which at least one download was in progress. Concurrent
+	// downloads are only counted once, so that BytesDownloaded divided by
+	// this is the effective bandwidth.
+	DownloadTimeMs int64 `json:"download_time_ms"`
+}
+
+// BandwidthBytesPerSec returns the effective download bandwidth, or zero if
+// nothing has been downloaded.
+func (s DownloadStats) BandwidthBytesPerSec() int64 {
+	if s.DownloadTimeMs <= 0 {
+		return 0
+	}
+	return s.BytesDownloaded * 1000 / s.DownloadTimeMs
+}
+
+type downloadTracker struct {
+	mutex sync.Mutex
+	stats DownloadStats
+	// Time spent downloading, including the current busy period
+	downloadTime time.Duration
+	// Downloads in progress and start of the current busy period
+	inFlight  []inFlightDownload
+	busySince time.Time
+	// Index of the last block downloaded, -1 if none
+	lastBlock int64
+	// Called after each download with the updated statistics
+	hook func(DownloadStats)
+}
+
+type inFlightDownload struct {
+	blockIndex int64
+	start      time.Time
+}
+
+// Statistics of the downloads of the file manager
+var downloads = downloadTracker{lastBlock: -1}
+
+// SetDownloadStatsHook sets a function that is called with the updated
+// statistics after each download. It must not block for long, as downloads
+// wait for it.
+func SetDownloadStatsHook(hook func(DownloadStats)) {
+	downloads.mutex.Lock()
+	defer downloads.mutex.Unlock()
+
+	downloads.hook = hook
+}
+
+// GetDownloadStats returns the statistics of the downloads so far.
+func GetDownloadStats() DownloadStats {
+	downloads.mutex.Lock()
+	defer downloads.mutex.Unlock()
+
+	return downloads.stats
+}
+
+func (t *downloadTracker) start(blockIndex int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	if len(t.inFlight) == 0 {
+		t.busySince = now
+	}
+	t.inFlight = append(t.inFlight, inFlightDownload{blockIndex: blockIndex, start: now})
+}
+
+func (t *downloadTracker) end(blockIndex int64, bytes int) {
+	t.mutex.Lock()
+	for i, d := range t.inFlight {
+		if d.blockIndex == blockIndex {
+			t.inFlight = append(t.inFlight[:i], t.inFlight[i+1:]...)
+			break
+		}
+	}
+	if len(t.inFlight) == 0 {
+		t.downloadTime += time.Since(t.busySince)
+	}
+	if bytes > 0 {
+		t.stats.BytesDownloaded += int64(bytes)
+		t.stats.BlocksDownloaded++
+		t.lastBlock = blockIndex
+	}
+	t.stats.DownloadTimeMs = t.downloadTime.Milliseconds()
+	stats, hook := t.stats, t.hook
+	t.mutex.Unlock()
+
+	if hook != nil {
+		hook(stats)
+	}
+}
+
+// InFlightBlock is a block whose download is in progress.
+type InFlightBlock struct {
+	Index     int64 `json:"index"`
+	ElapsedMs int64 `json:"elapsed_ms"`
+}
+
+// DownloadStatus is a live view of the downloads, which tells a download that
+// is stuck from one that is progressing slowly.
+type DownloadStatus struct {
+	DownloadStats
+	BandwidthBytesPerSec int64           `json:"bandwidth_bytes_per_sec"`
+	InFlightBlocks       []InFlightBlock `json:"in_flight_blocks"`
+	CachedBlocks         int             `json:"cached_blocks"`
+	CacheBlocks          int             `json:"cache_blocks"`
+	BlockSize            int64           `json:"block_size"`
+	FileSize             int64           `json:"file_size"`
+	// Bytes after the last block downloaded, and the time that they take to
+	// download at the current bandwidth. This estimates when sequential reads
+	// of the file complete.
+	BytesRemaining        int64 `json:"bytes_remaining"`
+	EstimatedCompletionMs int64 `json:"estimated_completion_ms,omitempty"`
+}
+
+// GetDownloadStatus returns the current status of the downloads. It doesn't
+// wait for the downloads in progress.
+func GetDownloadStatus() DownloadStatus {
+	status := DownloadStatus{
+		BlockSize: fm.blockSize,
+		FileSize:  fm.contentLength,
+	}
+	if fm.cache != nil {
+		status.CachedBlocks = fm.cache.Len()
+		status.CacheBlocks = fm.numBlocks
+	}
+
+	downloads.mutex.Lock()
+	now := time.Now()
+	status.DownloadStats = downloads.stats
+	if len(downloads.inFlight) > 0 {
+		// Include the current busy period, which isn't counted yet
+		status.DownloadTimeMs = (downloads.downloadTime + now.Sub(downloads.busySince)).Milliseconds()
+	}
+	status.InFlightBlocks = make([]InFlightBlock, 0, len(downloads.inFlight))
+	for _, d := range downloads.inFlight {
+		status.InFlightBlocks = append(status.InFlightBlocks, InFlightBlock{Index: d.blockIndex, ElapsedMs: now.Sub(d.start).Milliseconds()})
+	}
+	lastBlock := downloads.lastBlock
+	downloads.mutex.Unlock()
+
+	status.BandwidthBytesPerSec = status.DownloadStats.BandwidthBytesPerSec()
+	status.BytesRemaining = status.FileSize - (lastBlock+1)*status.BlockSize
+	if status.BytesRemaining < 0 {
+		status.BytesRemaining = 0
+	}
+	if status.BandwidthBytesPerSec > 0 {
+		status.EstimatedCompletionMs = status.BytesRemaining * 1000 / status.BandwidthBytesPerSec
+	}
+	return status
+}
@@ -0,0 +1,81 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package filemanager
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_DownloadStats(t *testing.T) {
+	var hookStats DownloadStats
+	SetDownloadStatsHook(func(stats DownloadStats) {
+		hookStats = stats
+	})
+	defer SetDownloadStatsHook(nil)
+
+	before := GetDownloadStats()
+	if _, err := DownloadBlock(2); err != nil {
+		t.Fatalf("DownloadBlock failed: %v", err)
+	}
+	after := GetDownloadStats()
+
+	if after.BytesDownloaded-before.BytesDownloaded != BLOCK_SIZE {
+		t.Errorf("expected %d more bytes downloaded, got %d", BLOCK_SIZE, after.BytesDownloaded-before.BytesDownloaded)
+	}
+	if after.BlocksDownloaded-before.BlocksDownloaded != 1 {
+		t.Errorf("expected 1 more block downloaded, got %d", after.BlocksDownloaded-before.BlocksDownloaded)
+	}
+	if hookStats != after {
+		t.Errorf("hook got %+v, expected %+v", hookStats, after)
+	}
+
+	if bandwidth := (DownloadStats{BytesDownloaded: 3000, DownloadTimeMs: 1500}).BandwidthBytesPerSec(); bandwidth != 2000 {
+		t.Errorf("expected 2000 bytes/s, got %d", bandwidth)
+	}
+}
+
+func Test_DownloadStatus(t *testing.T) {
+	downloadBlock := fm.downloadBlock
+	defer func() { fm.downloadBlock = downloadBlock }()
+	release := make(chan struct{})
+	fm.downloadBlock = func(blockIndex int64) (error, []byte) {
+		<-release
+		return downloadBlock(blockIndex)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := DownloadBlock(3)
+		done <- err
+	}()
+
+	// The download shows up as in flight until it ends
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := GetDownloadStatus()
+		if len(status.InFlightBlocks) == 1 && status.InFlightBlocks[0].Index == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("block 3 isn't in flight: %+v", status.InFlightBlocks)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("DownloadBlock failed: %v", err)
+	}
+
+	status := GetDownloadStatus()
+	if len(status.InFlightBlocks) != 0 {
+		t.Errorf("expected no downloads in flight, got %+v", status.InFlightBlocks)
+	}
+	if status.CacheBlocks != NUM_BLOCKS || status.BlockSize != BLOCK_SIZE {
+		t.Errorf("unexpected cache in status: %+v", status)
+	}
+	if expected := status.FileSize - 4*BLOCK_SIZE; status.BytesRemaining != expected {
+		t.Errorf("expected %d bytes remaining, got %d", expected, status.BytesRemaining)
+	}
+}
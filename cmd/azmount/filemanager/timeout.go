@@ -0,0 +1,57 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package filemanager
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// BlockTimeoutError is returned when the download or upload of a block takes
+// longer than the timeout set with SetBlockTimeout. The request is abandoned,
+// so that the read or write of the block fails instead of hanging.
+type BlockTimeoutError struct {
+	// "download" or "upload"
+	Op         string
+	BlockIndex int64
+	Timeout    time.Duration
+}
+
+func (e *BlockTimeoutError) Error() string {
+	return fmt.Sprintf("%s of block %d timed out after %s", e.Op, e.BlockIndex, e.Timeout)
+}
+
+func (e *BlockTimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// Set the maximum time that the download or upload of a block can take. Zero
+// means no limit. It must be called before the file is set up.
+func SetBlockTimeout(timeout time.Duration) {
+	fm.blockTimeout = timeout
+}
+
+// blockContext returns the context of a request for a block, derived from the
+// context of the file manager and bounded by the block timeout.
+func blockContext() (context.Context, context.CancelFunc) {
+	ctx := fm.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if fm.blockTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, fm.blockTimeout)
+}
+
+// blockError returns a BlockTimeoutError if the request for a block failed
+// with err because ctx, returned by blockContext, timed out, and err
+// otherwise.
+func blockError(ctx context.Context, op string, blockIndex int64, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded && fm.blockTimeout > 0 {
+		return &BlockTimeoutError{Op: op, BlockIndex: blockIndex, Timeout: fm.blockTimeout}
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package filemanager
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func Test_BlockTimeout(t *testing.T) {
+	// The registry never answers requests for the layer
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	origScheme := ociRegistryScheme
+	origBlob := fm.ociBlob
+	origTimeout := fm.blockTimeout
+	defer func() {
+		ociRegistryScheme = origScheme
+		fm.ociBlob = origBlob
+		SetBlockTimeout(origTimeout)
+	}()
+	ociRegistryScheme = "http"
+	fm.ociBlob = &ociBlob{
+		ref:   ociReference{strings.TrimPrefix(server.URL, "http://"), "images/data", "v1"},
+		layer: ociDescriptor{Digest: "sha256:" + strings.Repeat("0", 64), Size: 1 << 30},
+	}
+	SetBlockTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	err, _ := OCIDownloadBlock(1)
+	var timeoutErr *BlockTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected a BlockTimeoutError, got %v", err)
+	}
+	if timeoutErr.Op != "download" || timeoutErr.BlockIndex != 1 || timeoutErr.Timeout != 50*time.Millisecond {
+		t.Errorf("unexpected error %+v", timeoutErr)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the error to wrap context.DeadlineExceeded")
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("download wasn't abandoned after the timeout, took %s", elapsed)
+	}
+
+	// Errors of requests that didn't time out are returned as they are
+	ctx, cancel := blockContext()
+	defer cancel()
+	if err := blockError(ctx, "upload", 1, errors.New("failed")); err.Error() != "failed" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
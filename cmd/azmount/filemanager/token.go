@@ -0,0 +1,169 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package filemanager
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Tokens are refreshed this long before they expire, so that requests
+	// don't wait for a new token
+	tokenRefreshMargin = 5 * time.Minute
+	// Interval between the attempts to refresh a token after a failure
+	tokenRefreshRetryInterval = 30 * time.Second
+	// Lifetime assumed for tokens without an expiration time, which is the
+	// minimum lifetime of Microsoft Entra access tokens
+	defaultTokenLifetime = time.Hour
+)
+
+// tokenSource returns a new token and the time when it expires.
+type tokenSource func() (string, time.Time, error)
+
+// tokenRefresher refreshes the token of a credential in the background before
+// it expires. If the background refresh keeps failing until the token expires,
+// the next request refreshes it synchronously instead.
+type tokenRefresher struct {
+	credential azblob.TokenCredential
+	getToken   tokenSource
+	margin     time.Duration
+	retry      time.Duration
+	now        func() time.Time
+
+	mutex     sync.Mutex
+	expiresOn time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newTokenRefresher returns a refresher of credential, whose current token
+// expires at expiresOn. Start must be called to refresh it in the background.
+func newTokenRefresher(credential azblob.TokenCredential, expiresOn time.Time, getToken tokenSource) *tokenRefresher {
+	return &tokenRefresher{
+		credential: credential,
+		getToken:   getToken,
+		margin:     tokenRefreshMargin,
+		retry:      tokenRefreshRetryInterval,
+		now:        time.Now,
+		expiresOn:  expiresOn,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// refresh gets a new token and sets it in the credential.
+func (r *tokenRefresher) refresh() error {
+	token, expiresOn, err := r.getToken()
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.credential.SetToken(token)
+	r.expiresOn = expiresOn
+	logrus.Debugf("Token refreshed, it expires at %s", expiresOn)
+	return nil
+}
+
+// nextRefresh returns how long to wait before refreshing the token.
+func (r *tokenRefresher) nextRefresh() time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.expiresOn.Add(-r.margin).Sub(r.now())
+}
+
+// Start refreshes the token in the background until Stop is called.
+func (r *tokenRefresher) Start() {
+	go func() {
+		defer close(r.done)
+
+		wait := r.nextRefresh()
+		for {
+			timer := time.NewTimer(wait)
+			select {
+			case <-r.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			if err := r.refresh(); err != nil {
+				logrus.WithError(err).Warnf("Failed to refresh token, retrying in %s", r.retry)
+				wait = r.retry
+				continue
+			}
+			wait = r.nextRefresh()
+		}
+	}()
+}
+
+// Stop stops the background refresh and waits for it to end.
+func (r *tokenRefresher) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+// ensureFresh refreshes the token synchronously if it has expired, which only
+// happens if the background refresh has failed.
+func (r *tokenRefresher) ensureFresh() error {
+	r.mutex.Lock()
+	expired := !r.now().Before(r.expiresOn)
+	r.mutex.Unlock()
+	if !expired {
+		return nil
+	}
+
+	logrus.Info("Token has expired, refreshing it before the request")
+	return r.refresh()
+}
+
+// policy returns a pipeline policy that makes sure that the token hasn't
+// expired before each request.
+func (r *tokenRefresher) policy() pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			if err := r.ensureFresh(); err != nil {
+				return nil, errors.Wrapf(err, "failed to refresh expired token")
+			}
+			return next.Do(ctx, request)
+		}
+	})
+}
+
+// tokenExpiry returns the expiration time in the "exp" claim of a JWT token.
+func tokenExpiry(token string) (time.Time, error) {
+	// JWT tokens comprise three fields. the second field is the payload (or claims).
+	fields := strings.Split(token, ".")
+	if len(fields) != 3 {
+		return time.Time{}, errors.Errorf("token has %d fields instead of 3", len(fields))
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(fields[1])
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "Error decoding base64 token payload")
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, errors.Wrapf(err, "Error unmarshalling token payload")
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, errors.Errorf("token has no exp claim")
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
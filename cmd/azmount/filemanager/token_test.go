@@ -0,0 +1,91 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package filemanager
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/pkg/errors"
+)
+
+func Test_TokenRefresher_Background(t *testing.T) {
+	var calls int32
+	getToken := func() (string, time.Time, error) {
+		n := atomic.AddInt32(&calls, 1)
+		// The first attempt fails and is retried
+		if n == 1 {
+			return "", time.Time{}, errors.New("identity sidecar not ready")
+		}
+		return fmt.Sprintf("token-%d", n), time.Now().Add(60 * time.Millisecond), nil
+	}
+
+	credential := azblob.NewTokenCredential("token-0", nil)
+	r := newTokenRefresher(credential, time.Now().Add(60*time.Millisecond), getToken)
+	r.margin = 50 * time.Millisecond
+	r.retry = 5 * time.Millisecond
+	r.Start()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&calls) < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	r.Stop()
+
+	n := atomic.LoadInt32(&calls)
+	if n < 4 {
+		t.Fatalf("expected the token to be refreshed repeatedly, got %d calls", n)
+	}
+	if credential.Token() == "token-0" {
+		t.Fatalf("expected the token of the credential to be replaced")
+	}
+
+	// No refresh happens after Stop
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&calls) != n {
+		t.Fatalf("expected no refresh after Stop")
+	}
+}
+
+func Test_TokenRefresher_EnsureFresh(t *testing.T) {
+	now := time.Now()
+	calls := 0
+	getToken := func() (string, time.Time, error) {
+		calls++
+		return "new-token", now.Add(time.Hour), nil
+	}
+
+	credential := azblob.NewTokenCredential("old-token", nil)
+	r := newTokenRefresher(credential, now.Add(time.Minute), getToken)
+	r.now = func() time.Time { return now }
+
+	if err := r.ensureFresh(); err != nil || calls != 0 {
+		t.Fatalf("expected a valid token not to be refreshed (%d calls, %v)", calls, err)
+	}
+
+	// The background refresh failed until the token expired
+	now = now.Add(2 * time.Minute)
+	if err := r.ensureFresh(); err != nil || calls != 1 || credential.Token() != "new-token" {
+		t.Fatalf("expected an expired token to be refreshed (%d calls, %v)", calls, err)
+	}
+}
+
+func Test_TokenExpiry(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"aud":"https://storage.azure.com","exp":1700000000}`))
+	expiresOn, err := tokenExpiry("header." + payload + ".signature")
+	if err != nil || !expiresOn.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("unexpected expiration %s (%v)", expiresOn, err)
+	}
+
+	noExp := base64.RawURLEncoding.EncodeToString([]byte(`{"aud":"https://storage.azure.com"}`))
+	for _, token := range []string{"opaque", "header." + noExp + ".signature"} {
+		if _, err := tokenExpiry(token); err == nil {
+			t.Errorf("expected the expiration of %s to be unknown", token)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"bazil.org/fuse/fs"
 	"github.com/Microsoft/confidential-sidecar-containers/cmd/azmount/filemanager"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 // For more information about the library used to set up the FUSE filesystem:
@@ -160,6 +161,10 @@ func (f File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.Writ
 	}
 
 	err := filemanager.SetBytes(int64(offset), req.Data)
+	if errors.Is(err, filemanager.ErrWritesDisabled) {
+		// The backend keeps failing, behave like a read-only filesystem
+		return fuse.Errno(syscall.EROFS)
+	}
 	if err == nil {
 		resp.Size = len(req.Data)
 	}
@@ -167,6 +172,9 @@ func (f File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.Writ
 }
 
 func (f File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
-	filemanager.ClearCache()
+	if err := filemanager.ClearCache(); err != nil {
+		logrus.Errorf("Fsync failed: %s", err.Error())
+		return fuse.Errno(syscall.EIO)
+	}
 	return nil
 }
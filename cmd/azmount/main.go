@@ -15,17 +15,27 @@ package main
 //     ls -l test/data
 //     cat test/data
 //
+// It is also possible to mount the only layer of an OCI artifact in a container
+// registry:
+//
+//     ./azmount -mountpoint test -url oci://myregistry.azurecr.io/images/data:v1
+//
 // It is possible to mount a local file as well, which is useful for testing:
 //
 //     mkdir test
 //     ./azmount -mountpoint test -localpath /path/to/file.txt
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Microsoft/confidential-sidecar-containers/cmd/azmount/filemanager"
 	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
@@ -37,17 +47,69 @@ func usage() {
 	flag.PrintDefaults()
 }
 
+// statsFileContents is written to the stats file: the download statistics and
+// the size of the image, which remotefs checks against the exposed file.
+type statsFileContents struct {
+	filemanager.DownloadStats
+	FileSize int64 `json:"file_size"`
+}
+
+// statsFileWriter returns a function that atomically replaces the file at path
+// with the download statistics, so that readers never see a partial file.
+func statsFileWriter(path string) func(filemanager.DownloadStats) {
+	var mutex sync.Mutex
+	var lastBlocks int64 = -1
+	return func(stats filemanager.DownloadStats) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		// Concurrent downloads can report their statistics out of order
+		if stats.BlocksDownloaded < lastBlocks {
+			return
+		}
+		lastBlocks = stats.BlocksDownloaded
+
+		statsJSON, err := json.Marshal(statsFileContents{DownloadStats: stats, FileSize: filemanager.GetFileSize()})
+		if err != nil {
+			logrus.Errorf("Failed to marshal download statistics: %s", err.Error())
+			return
+		}
+		tempPath := path + ".tmp"
+		if err := os.WriteFile(tempPath, statsJSON, 0644); err != nil {
+			logrus.Errorf("Failed to write download statistics: %s", err.Error())
+			return
+		}
+		if err := os.Rename(tempPath, path); err != nil {
+			logrus.Errorf("Failed to write download statistics: %s", err.Error())
+		}
+	}
+}
+
 func main() {
 	mountPoint := flag.String("mountpoint", "", "System path to mount the filesystem to.")
-	pageBlobUrl := flag.String("url", "", "URL of page blob with the filesystem to mount.")
-	pageBlobPrivate := flag.String("private", "false", "Page blob is private and thus requires credentials")
+	pageBlobUrl := flag.String("url", "", "URL of page blob with the filesystem to mount, or oci://registry/repository:tag of an OCI artifact.")
+	pageBlobPrivate := flag.String("private", "false", "Page blob is private and thus requires credentials: true, false, or auto to use credentials only if anonymous access is denied")
 	encodedIdentity := flag.String("identity", "", "base64-encoded string of identity information")
+	encodedTLSPolicy := flag.String("tlspolicy", "", "base64-encoded string of the TLS policy of outbound connections")
+	encodedResolverPolicy := flag.String("resolverpolicy", "", "base64-encoded string of the resolver policy of outbound connections")
+	encodedConnectionPolicy := flag.String("connectionpolicy", "", "base64-encoded string of the connection pool policy of outbound connections")
 	localFilePath := flag.String("localpath", "", "Path of a local file with the filesystem to mount.")
-	logLevel := flag.String("loglevel", "warning", "Logging Level: trace, debug, info, warning, error, fatal, panic.")
+	logFormat := flag.String("logformat", "text", "Logging Format: text or json. JSON logs have structured fields and redact secrets.")
+	logLevel := flag.String("loglevel", "info", "Logging Level: trace, debug, info, warning, error, fatal, panic.")
 	logFile := flag.String("logfile", "", "Logging Target: An optional file name/path. Omit for console output.")
 	blockSize := flag.Int("blocksize", 512, "Size of a cache block in KiB")
 	numBlocks := flag.Int("numblocks", 32, "Number of cache blocks")
+	accessPattern := flag.String("accesspattern", "random", "Access pattern of the file: random, sequential or auto. Blocks are read ahead of sequential reads")
+	readAhead := flag.Int("readahead", 8, "Number of blocks read ahead of sequential reads, at most half of the cache blocks")
 	readWrite := flag.String("readWrite", "false", "Read-Write file system")
+	maxImageSize := flag.Int64("maxsize", 0, "Maximum size of the image in bytes. 0 means unlimited")
+	allowedHosts := flag.String("allowedhosts", "", "Comma-separated list of hosts that the URL can point to. Wildcards like *.blob.core.windows.net are allowed. Empty means any host")
+	blockTimeout := flag.Int("blocktimeout", 0, "Maximum time in milliseconds that the download or upload of a block can take. 0 means no limit")
+	downloadConcurrency := flag.Int("downloadconcurrency", 1, "Number of sub-ranges of each block downloaded at the same time from Azure Blob Storage. 1 downloads each block in a single request")
+	blockManifest := flag.String("blockmanifest", "", "Path of a JSON file that maps block indices to the hex-encoded SHA-256 digests that downloaded blocks are verified against. Omit to not verify them.")
+	maxUploadFailures := flag.Int("maxuploadfailures", 3, "Number of consecutive failed uploads after which writes fail with EROFS. 0 means never")
+	statsFile := flag.String("statsfile", "", "Path of a file where the download statistics are written after each download. Omit to not write them.")
+	statusSocket := flag.String("statussocket", "", "Path of a unix socket where the live status of the downloads is served over HTTP. Omit to not serve it.")
 
 	flag.Usage = usage
 
@@ -68,7 +130,9 @@ func main() {
 		logrus.Fatal(err)
 	}
 	logrus.SetLevel(level)
-	logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: false, DisableQuote: true, DisableTimestamp: true})
+	if err := common.SetLogFormat(*logFormat); err != nil {
+		logrus.Fatal(err)
+	}
 
 	parseError := false
 
@@ -102,9 +166,22 @@ func main() {
 		parseError = true
 	}
 
-	pageBlobPrivateBool, err := strconv.ParseBool(*pageBlobPrivate)
-	if err != nil {
-		logrus.Fatal("The private attribute needs to be true or false")
+	if *maxImageSize < 0 {
+		logrus.Fatal("Invalid maximum image size\n")
+		parseError = true
+	}
+
+	blobAccess := filemanager.BlobAccessAuto
+	pageBlobPrivateBool := false
+	if *pageBlobPrivate != "auto" {
+		pageBlobPrivateBool, err = strconv.ParseBool(*pageBlobPrivate)
+		if err != nil {
+			logrus.Fatal("The private attribute needs to be true, false or auto")
+		}
+		blobAccess = filemanager.BlobAccessPublic
+		if pageBlobPrivateBool {
+			blobAccess = filemanager.BlobAccessPrivate
+		}
 	}
 
 	readWriteBool, err := strconv.ParseBool(*readWrite)
@@ -112,6 +189,11 @@ func main() {
 		logrus.Fatal("The readWrite attribute needs to be true or false")
 	}
 
+	if *maxUploadFailures < 0 {
+		logrus.Fatal("Invalid maximum number of upload failures\n")
+		parseError = true
+	}
+
 	if parseError {
 		usage()
 		os.Exit(1)
@@ -127,17 +209,90 @@ func main() {
 	logrus.Debugf("   Local Path:  %s", *localFilePath)
 	logrus.Infof("   Log Level:   %s", *logLevel)
 	logrus.Infof("   Log File:    %s", *logFile)
+	logrus.Infof("   Log Format:  %s", *logFormat)
 	logrus.Debugf("   Block Size:  %d KiB", *blockSize)
 	logrus.Debugf("   Num. Blocks: %d", *numBlocks)
+	logrus.Debugf("   Access Pattern: %s", *accessPattern)
+	logrus.Debugf("   Read-Ahead:  %d blocks", *readAhead)
 	logrus.Debugf("   ReadWrite:    %s", *readWrite)
+	logrus.Debugf("   Max. Size:   %d bytes", *maxImageSize)
+	logrus.Debugf("   Block Timeout: %d ms", *blockTimeout)
+	logrus.Debugf("   Download Concurrency: %d", *downloadConcurrency)
+	logrus.Debugf("   Block Manifest: %s", *blockManifest)
+	logrus.Debugf("   Max. Upload Failures: %d", *maxUploadFailures)
+	logrus.Debugf("   Allowed Hosts: %s", *allowedHosts)
+	logrus.Debugf("   Stats File:  %s", *statsFile)
+	logrus.Debugf("   Status Socket: %s", *statusSocket)
 
 	logrus.Info("Initializing cache...")
 	if err := filemanager.InitializeCache(*blockSize*1024, *numBlocks, readWriteBool); err != nil {
 		logrus.Fatalf("Failed to initialize cache: " + err.Error())
 	}
+	filemanager.SetMaxUploadFailures(*maxUploadFailures)
+	if *blockTimeout < 0 {
+		logrus.Fatalf("Invalid block timeout: %d", *blockTimeout)
+	}
+	filemanager.SetBlockTimeout(time.Duration(*blockTimeout) * time.Millisecond)
+	if *downloadConcurrency < 1 {
+		logrus.Fatalf("Invalid download concurrency: %d", *downloadConcurrency)
+	}
+	filemanager.SetDownloadConcurrency(*downloadConcurrency)
+	if err := filemanager.SetAccessPattern(*accessPattern, *readAhead); err != nil {
+		logrus.Fatalf("Invalid access pattern: " + err.Error())
+	}
+	var writeStats func(filemanager.DownloadStats)
+	if *statsFile != "" {
+		writeStats = statsFileWriter(*statsFile)
+		filemanager.SetDownloadStatsHook(writeStats)
+	}
+	if *statusSocket != "" {
+		if err := serveStatus(*statusSocket); err != nil {
+			logrus.Fatalf("Failed to serve download status: " + err.Error())
+		}
+	}
 
 	if *pageBlobUrl != "" {
-		logrus.Info("Setting up Azure connection...")
+		if *encodedTLSPolicy != "" {
+			tlsPolicyBytes, err := base64.StdEncoding.DecodeString(*encodedTLSPolicy)
+			if err != nil {
+				logrus.Fatalf("Could not decode TLS policy string: %s", err.Error())
+			}
+			tlsPolicy := common.TLSPolicy{}
+			if err = json.Unmarshal(tlsPolicyBytes, &tlsPolicy); err != nil {
+				logrus.Fatalf("Failed to unmarshal TLS policy bytes: %s", err.Error())
+			}
+			if err = common.SetTLSPolicy(tlsPolicy); err != nil {
+				logrus.Fatalf("Invalid TLS policy: %s", err.Error())
+			}
+		}
+
+		if *encodedResolverPolicy != "" {
+			resolverPolicyBytes, err := base64.StdEncoding.DecodeString(*encodedResolverPolicy)
+			if err != nil {
+				logrus.Fatalf("Could not decode resolver policy string: %s", err.Error())
+			}
+			resolverPolicy := common.ResolverPolicy{}
+			if err = json.Unmarshal(resolverPolicyBytes, &resolverPolicy); err != nil {
+				logrus.Fatalf("Failed to unmarshal resolver policy bytes: %s", err.Error())
+			}
+			if err = common.SetResolverPolicy(resolverPolicy); err != nil {
+				logrus.Fatalf("Invalid resolver policy: %s", err.Error())
+			}
+		}
+
+		if *encodedConnectionPolicy != "" {
+			connectionPolicyBytes, err := base64.StdEncoding.DecodeString(*encodedConnectionPolicy)
+			if err != nil {
+				logrus.Fatalf("Could not decode connection policy string: %s", err.Error())
+			}
+			connectionPolicy := common.ConnectionPolicy{}
+			if err = json.Unmarshal(connectionPolicyBytes, &connectionPolicy); err != nil {
+				logrus.Fatalf("Failed to unmarshal connection policy bytes: %s", err.Error())
+			}
+			if err = common.SetConnectionPolicy(connectionPolicy); err != nil {
+				logrus.Fatalf("Invalid connection policy: %s", err.Error())
+			}
+		}
 
 		identityBytes, err := base64.StdEncoding.DecodeString(*encodedIdentity)
 		if err != nil {
@@ -150,10 +305,57 @@ func main() {
 			logrus.Infof("Failed to unmarshal identity bytes: %s", err.Error())
 		}
 
-		if err = filemanager.AzureSetup(*pageBlobUrl, pageBlobPrivateBool, identity); err != nil {
-			logrus.Fatalf("Azure connection setup error: " + err.Error())
+		var allowedHostsList []string
+		if *allowedHosts != "" {
+			allowedHostsList = strings.Split(*allowedHosts, ",")
+		}
+
+		if strings.HasPrefix(*pageBlobUrl, filemanager.OCIScheme+"://") {
+			logrus.Info("Setting up registry connection...")
+
+			if readWriteBool {
+				logrus.Fatal("Images in a registry can't be mounted read-write")
+			}
+			if blobAccess == filemanager.BlobAccessAuto {
+				logrus.Fatal("Images in a registry can't detect whether they are private")
+			}
+			if *blockManifest != "" {
+				logrus.Fatal("Blocks of images in a registry can't be verified against a manifest")
+			}
+
+			auth := filemanager.OCIAuth{}
+			if pageBlobPrivateBool {
+				u, err := url.Parse(*pageBlobUrl)
+				if err != nil {
+					logrus.Fatalf("Can't parse URL string %s: %s", *pageBlobUrl, err.Error())
+				}
+				if auth, err = filemanager.ACRAuth(u.Host, identity); err != nil {
+					logrus.Fatalf("Registry authentication error: " + err.Error())
+				}
+			}
+
+			if err = filemanager.OCISetup(*pageBlobUrl, auth, *maxImageSize, allowedHostsList); err != nil {
+				logrus.Fatalf("Registry connection setup error: " + err.Error())
+			}
+			logrus.Info("Registry connection set up")
+		} else {
+			var blockDigests map[int64]string
+			if *blockManifest != "" {
+				manifestBytes, err := os.ReadFile(*blockManifest)
+				if err != nil {
+					logrus.Fatalf("Could not read block manifest: %s", err.Error())
+				}
+				if err = json.Unmarshal(manifestBytes, &blockDigests); err != nil {
+					logrus.Fatalf("Failed to unmarshal block manifest: %s", err.Error())
+				}
+			}
+
+			logrus.Info("Setting up Azure connection...")
+			if err = filemanager.AzureSetup(context.Background(), *pageBlobUrl, blobAccess, identity, *maxImageSize, allowedHostsList, blockDigests); err != nil {
+				logrus.Fatalf("Azure connection setup error: " + err.Error())
+			}
+			logrus.Info("Azure connection set up")
 		}
-		logrus.Info("Azure connection set up")
 	}
 
 	if *localFilePath != "" {
@@ -164,10 +366,17 @@ func main() {
 		logrus.Info("Local filesystem set up")
 	}
 
+	// Write the size of the image before it is exposed, so that it can be
+	// checked as soon as the file appears
+	if writeStats != nil {
+		writeStats(filemanager.GetDownloadStats())
+	}
+
 	logrus.Info("Setting up FUSE...")
 	err = FuseSetup(*mountPoint, readWriteBool)
 	if err != nil {
 		logrus.Fatalf("FUSE error: " + err.Error())
 	}
+	filemanager.AzureTeardown()
 	logrus.Info("FUSE ended")
 }
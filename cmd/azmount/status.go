@@ -0,0 +1,51 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/Microsoft/confidential-sidecar-containers/cmd/azmount/filemanager"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// serveStatus serves the live status of the downloads as JSON over HTTP on a
+// unix socket at path, for example:
+//
+//	curl --unix-socket /tmp/azmount.sock http://localhost/
+func serveStatus(path string) error {
+	// Remove the socket left by a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove %s", path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", path)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return errors.Wrapf(err, "failed to set permissions of %s", path)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(filemanager.GetDownloadStatus()); err != nil {
+			logrus.Debugf("Failed to write download status: %s", err.Error())
+		}
+	})
+	go func() {
+		if err := http.Serve(listener, handler); err != nil {
+			logrus.Errorf("Download status server stopped: %s", err.Error())
+		}
+	}()
+	return nil
+}
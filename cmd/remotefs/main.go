@@ -4,48 +4,21 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/Microsoft/confidential-sidecar-containers/pkg/attest"
 	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/remotefs"
 	"github.com/sirupsen/logrus"
 )
 
-type AzureInfo struct {
-	CertFetcher attest.CertFetcher `json:"certcache,omitempty"`
-	Identity    common.Identity    `json:"identity,omitempty"`
-}
-
-type RemoteFilesystemsInformation struct {
-	AzureInfo        AzureInfo         `json:"azure_info"`
-	AzureFilesystems []AzureFilesystem `json:"azure_filesystems"`
-}
-
-// AzureFilesystem contains information about a filesystem image stored in Azure
-// Blob Storage.
-type AzureFilesystem struct {
-	// This is the URL of the image
-	AzureUrl string `json:"azure_url"`
-	// This is a private AzureUrl
-	AzureUrlPrivate bool `json:"azure_url_private"`
-	// This is the path where the filesystem will be exposed in the container.
-	MountPoint string `json:"mount_point"`
-	// This is the information used by encfs to derive the encryption key of the filesystem
-	// if the key being released is a private RSA key
-	KeyDerivationBlob common.KeyDerivationBlob `json:"key_derivation,omitempty"`
-	// This is the information used by skr to release the encryption key of the filesystem
-	KeyBlob common.KeyBlob `json:"key,omitempty"`
-	// This is a testing key hexstring encoded to be used against the filesystem. This should
-	// be used only for testing.
-	RawKeyHexString string `json:"raw_key,omitempty"`
-	// This is a flag specifying if this file system is read-write
-	ReadWrite bool `json:"read_write,omitempty"`
-}
-
 func usage() {
 	fmt.Printf("Usage of %s:\n", os.Args[0])
 	flag.PrintDefaults()
@@ -53,13 +26,33 @@ func usage() {
 
 func main() {
 	base64string := flag.String("base64", "", "base64-encoded json string with all information")
+	logFormat := flag.String("logformat", "text", "Logging Format: text or json. JSON logs have structured fields and redact secrets.")
 	logLevel := flag.String("loglevel", "warning", "Logging Level: trace, debug, info, warning, error, fatal, panic.")
 	logFile := flag.String("logfile", "", "Logging Target: An optional file name/path. Omit for console output.")
+	stateFile := flag.String("statefile", "", "Optional path of a JSON file used to skip the filesystems already mounted when the tool is restarted.")
+	statusFile := flag.String("statusfile", "", "Optional path of a JSON file where the status of the mounts is written.")
+	auditSyslog := flag.String("auditsyslog", "", "Optional syslog daemon where the audit events are sent: local, udp://host:port or tcp://host:port.")
+	auditTag := flag.String("audittag", "remotefs", "Tag of the audit events sent to syslog.")
+	teardown := flag.Bool("teardown", false, "Unmount the filesystems in the state file, close their devices and exit.")
+	teardownGraceMs := flag.Int("teardowngracems", int(remotefs.DefaultTeardownGracePeriod/time.Millisecond), "Time in milliseconds that -teardown waits for the workload to release a filesystem before detaching it.")
+	cleanupTemp := flag.Bool("cleanuptemp", true, "Remove the temporary directories left by previous runs once nothing is mounted under them and no process uses them.")
+	healthAddr := flag.String("healthaddr", "", "Optional address, like :8080, where the health of the mounts is served over HTTP for readiness and liveness probes. The tool then keeps running after mounting the filesystems until it is stopped, unless post_mount_mode is exit.")
+	printUsage := flag.Bool("usage", false, "Print the memory usage of the azmount processes of the filesystems in the state file as JSON and exit.")
 
 	flag.Usage = usage
 
 	flag.Parse()
 
+	if *printUsage {
+		if *stateFile == "" {
+			logrus.Fatal("-usage needs -statefile")
+		}
+		if err := remotefs.PrintAzmountUsage(*stateFile); err != nil {
+			logrus.Fatalf("Failed to read azmount usage: %s", err.Error())
+		}
+		os.Exit(0)
+	}
+
 	if *logFile != "" {
 		// If the file doesn't exist, create it. If it exists, append to it.
 		file, err := os.OpenFile(*logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -75,21 +68,52 @@ func main() {
 		logrus.Fatal(err)
 	}
 	logrus.SetLevel(level)
-	logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: false, DisableQuote: true, DisableTimestamp: true})
+	if err := common.SetLogFormat(*logFormat); err != nil {
+		logrus.Fatal(err)
+	}
 
 	logrus.Infof("Starting %s...", os.Args[0])
 
 	logrus.Infof("Args:")
 	logrus.Infof("   Log Level: %s", *logLevel)
 	logrus.Infof("   Log File:  %s", *logFile)
+	logrus.Infof("   Log Format: %s", *logFormat)
+	logrus.Infof("   Status File: %s", *statusFile)
+	logrus.Infof("   State File: %s", *stateFile)
+	logrus.Infof("   Audit Syslog: %s", *auditSyslog)
+	logrus.Infof("   Health Address: %s", *healthAddr)
 	logrus.Debugf("   base64:    %s", *base64string)
 
+	if *auditSyslog != "" {
+		if err := remotefs.SetAuditSyslog(*auditSyslog, *auditTag); err != nil {
+			logrus.Fatalf("Failed to set up audit events: %s", err.Error())
+		}
+	}
+
+	if *teardown {
+		if *stateFile == "" {
+			logrus.Fatal("-teardown needs -statefile")
+		}
+		if err := remotefs.TeardownAzureFilesystems(*stateFile, time.Duration(*teardownGraceMs)*time.Millisecond); err != nil {
+			logrus.Fatalf("Failed to tear down filesystems: %s", err.Error())
+		}
+		os.Exit(0)
+	}
+
 	logrus.Info("Creating temporary directory")
-	tempDir, err := os.MkdirTemp("", "remotefs")
+	tempDir, err := os.MkdirTemp("", remotefs.TempDirPattern)
 	if err != nil {
 		logrus.Fatalf("Failed to create temp dir: %s", err.Error())
 	}
 	logrus.Infof("Temporary directory: %s", tempDir)
+	if err := remotefs.MarkTempDir(tempDir); err != nil {
+		logrus.Fatalf("Failed to mark temp dir: %s", err.Error())
+	}
+	if *cleanupTemp {
+		if err := remotefs.CleanupStaleTempDirs(tempDir); err != nil {
+			logrus.WithError(err).Warn("Failed to clean up stale temporary directories")
+		}
+	}
 
 	// Decode information
 	bytes, err := base64.StdEncoding.DecodeString(*base64string)
@@ -97,26 +121,53 @@ func main() {
 		logrus.Fatalf("Failed to decode base64: %s", err.Error())
 	}
 
-	info := RemoteFilesystemsInformation{}
+	info := remotefs.RemoteFilesystemsInformation{}
 	err = json.Unmarshal(bytes, &info)
 	if err != nil {
 		logrus.Fatalf("Failed to unmarshal base64 string: %s", err.Error())
 	}
 
 	// populate missing attributes in KeyBlob
-	for i, _ := range info.AzureFilesystems {
-		// set the api versions and the tee type for which the authority will authorize secure key release
-		info.AzureFilesystems[i].KeyBlob.AKV.APIVersion = "api-version=7.4"
-		info.AzureFilesystems[i].KeyBlob.Authority.APIVersion = "api-version=2020-10-01"
-		info.AzureFilesystems[i].KeyBlob.Authority.TEEType = "SevSnpVM"
-	}
+	info.PopulateKeyBlobs()
 
-	logrus.Debugf("JSON = %+v", info)
+	logrus.Infof("Effective configuration:\n%s", info.DumpConfig())
 
-	err = MountAzureFilesystems(tempDir, info)
-	if err != nil {
+	// Abort the mount if the sidecar is asked to shut down
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *healthAddr != "" {
+		if err := remotefs.ServeHealth(*healthAddr); err != nil {
+			logrus.Fatalf("Failed to serve health: %s", err.Error())
+		}
+	}
+
+	remotefs.StatusFilePath = *statusFile
+	remotefs.StateFilePath = *stateFile
+	err = remotefs.MountAzureFilesystems(ctx, tempDir, info)
+	if err != nil && *healthAddr != "" {
+		// Keep the failure served on /readyz until the sidecar is asked to
+		// shut down, instead of stopping the health service with the tool
+		logrus.Errorf("Failed to mount filesystems: %s", err.Error())
+		logrus.Info("Serving the failure on the health service until stopped")
+		<-ctx.Done()
+		os.Exit(1)
+	} else if err != nil {
 		logrus.Fatalf("Failed to mount filesystems: %s", err.Error())
 	}
 
+	// Keep running until the sidecar is asked to shut down, so that the
+	// probes keep getting answers and the container of the azmount processes
+	// isn't stopped
+	switch remotefs.EffectivePostMountMode(info, *healthAddr) {
+	case remotefs.PostMountModeStayResident:
+		logrus.Info("Filesystems mounted, staying resident until stopped")
+		<-ctx.Done()
+	default:
+		if *healthAddr != "" {
+			logrus.Warn("Filesystems mounted, exiting: the health service stops")
+		}
+	}
+
 	os.Exit(0)
 }
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"flag"
@@ -131,19 +132,18 @@ func main() {
 		}
 	}
 
+	if err := common.SetTLSPolicy(info.TLSPolicy); err != nil {
+		logrus.Fatalf("Invalid TLS policy: %s", err.Error())
+	}
+
 	EncodedUvmInformation, err := common.GetUvmInformation() // from the env.
 	if err != nil {
 		logrus.Infof("Failed to extract UVM_* environment variables: %s", err.Error())
 	}
 
-	if common.ThimCertsAbsent(&EncodedUvmInformation.InitialCerts) {
-		logrus.Info("ThimCerts is absent, retrieving THIMCerts from THIM endpoint.")
-		thimCerts, err := info.CertFetcher.GetThimCerts("")
-		if err != nil {
-			logrus.Fatalf("Failed to retrieve thim certs: %s", err.Error())
-		}
-
-		EncodedUvmInformation.InitialCerts = *thimCerts
+	EncodedUvmInformation.InitialCerts, err = info.CertFetcher.InitialCerts(context.Background(), info.ThimCertPolicy, EncodedUvmInformation.InitialCerts, "")
+	if err != nil {
+		logrus.Fatalf("Failed to retrieve thim certs: %s", err.Error())
 	}
 
 	// See above comment about hostname and risk of breaking confidentiality
@@ -162,7 +162,7 @@ func PostMAAAttest(c *gin.Context) {
 		return
 	}
 
-	maaToken, err := certState.Attest(maa, runtimeDataBytes, *uvmInfo)
+	maaToken, err := certState.Attest(c.Request.Context(), maa, runtimeDataBytes, *uvmInfo)
 	if err != nil {
 		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
 	}
@@ -223,7 +223,7 @@ func PostKeyRelease(c *gin.Context) {
 		return
 	}
 
-	jwKey, err := skr.SecureKeyRelease(*identity, *certState, skrKeyBlob, *uvmInfo)
+	jwKey, err := skr.SecureKeyRelease(c.Request.Context(), *identity, *certState, skrKeyBlob, *uvmInfo)
 	if err != nil {
 		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
 		return
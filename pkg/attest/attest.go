@@ -4,9 +4,12 @@
 package attest
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"time"
 
 	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
 	"github.com/pkg/errors"
@@ -18,15 +21,25 @@ import (
 type CertState struct {
 	CertFetcher CertFetcher `json:"cert_cache"`
 	Tcbm        uint64      `json:"tcbm"`
+	// Optional nonce, e.g. a deployment identifier, included in the report
+	// data of the attestation reports after the hash of the runtime data so
+	// that audit logs can correlate the attestation to the deployment.
+	ReportDataNonce []byte `json:"report_data_nonce,omitempty"`
+	// Maximum time in milliseconds that Attest waits for the SNP device to
+	// appear before falling back to the fake attestation report. Zero means
+	// that it doesn't wait.
+	SNPDeviceTimeoutMs int64 `json:"snp_device_timeout_ms,omitempty"`
+	// Checks of the VCEK certificate chain before it is sent to MAA
+	CertChainPolicy CertChainPolicy `json:"cert_chain_policy,omitempty"`
 }
 
 const (
 	sha256len = 32
 )
 
-func (certState *CertState) RefreshCertChain(SNPReport SNPAttestationReport) ([]byte, error) {
+func (certState *CertState) RefreshCertChain(ctx context.Context, SNPReport SNPAttestationReport) ([]byte, error) {
 	logrus.Info("Refreshing CertChain...")
-	vcekCertChain, thimTcbm, err := certState.CertFetcher.GetCertChain(SNPReport.ChipID, SNPReport.ReportedTCB)
+	vcekCertChain, thimTcbm, err := certState.CertFetcher.GetCertChain(ctx, SNPReport.ChipID, SNPReport.ReportedTCB)
 	if err != nil {
 		return nil, errors.Wrap(err, "Refreshing CertChain failed")
 	}
@@ -53,6 +66,27 @@ func GenerateMAAReportData(inputBytes []byte) [REPORT_DATA_SIZE]byte {
 	return reportData
 }
 
+// ValidateReportDataNonce checks that nonce fits in the report data after the
+// SHA256 hash of the runtime data.
+func ValidateReportDataNonce(nonce []byte) error {
+	if len(nonce) > REPORT_DATA_SIZE-sha256len {
+		return errors.Errorf("report data nonce is too large: %d bytes, maximum is %d bytes", len(nonce), REPORT_DATA_SIZE-sha256len)
+	}
+	return nil
+}
+
+// AddReportDataNonce copies nonce into the report data after the SHA256 hash
+// of the runtime data. Shorter nonces are padded with zeros.
+func AddReportDataNonce(reportData *[REPORT_DATA_SIZE]byte, nonce []byte) error {
+	if err := ValidateReportDataNonce(nonce); err != nil {
+		return err
+	}
+	padded := make([]byte, REPORT_DATA_SIZE-sha256len)
+	copy(padded, nonce)
+	copy(reportData[sha256len:], padded)
+	return nil
+}
+
 // Takes bytes and generate host data that UVM creates at launch of SNP VM (SHA256 hash of arbitrary data).
 // It's only useful to create fake attestation report
 func GenerateMAAHostData(inputBytes []byte) [HOST_DATA_SIZE]byte {
@@ -87,7 +121,7 @@ func GenerateMAAHostData(inputBytes []byte) [HOST_DATA_SIZE]byte {
 //	retrieval and has been reported by the PSP in the attestation report as REPORT DATA
 //
 // Note that it uses fake attestation report if it's not running inside SNP VM
-func (certState *CertState) Attest(maa common.MAA, runtimeDataBytes []byte, uvmInformation common.UvmInformation) (string, error) {
+func (certState *CertState) Attest(ctx context.Context, maa common.MAA, runtimeDataBytes []byte, uvmInformation common.UvmInformation) (string, error) {
 	logrus.Info("Decoding UVM encoded security policy...")
 	inittimeDataBytes, err := base64.StdEncoding.DecodeString(uvmInformation.EncodedSecurityPolicy)
 	if err != nil {
@@ -97,7 +131,11 @@ func (certState *CertState) Attest(maa common.MAA, runtimeDataBytes []byte, uvmI
 
 	// Fetch the attestation report
 	var reportFetcher AttestationReportFetcher
-	if IsSNPVM() {
+	isSNP := isSNPVM()
+	if !isSNP && certState.SNPDeviceTimeoutMs > 0 {
+		isSNP = waitForSNPDevice(time.Duration(certState.SNPDeviceTimeoutMs) * time.Millisecond)
+	}
+	if isSNP {
 		logrus.Info("Running inside SNP VM, using real attestation report fetcher...")
 		reportFetcher, err = NewAttestationReportFetcher()
 		if err != nil {
@@ -111,6 +149,11 @@ func (certState *CertState) Attest(maa common.MAA, runtimeDataBytes []byte, uvmI
 	}
 
 	reportData := GenerateMAAReportData(runtimeDataBytes)
+	if len(certState.ReportDataNonce) > 0 {
+		if err := AddReportDataNonce(&reportData, certState.ReportDataNonce); err != nil {
+			return "", err
+		}
+	}
 	logrus.Info("Fetching Attestation Report...")
 	SNPReportBytes, err := reportFetcher.FetchAttestationReportByte(reportData)
 	if err != nil {
@@ -125,6 +168,10 @@ func (certState *CertState) Attest(maa common.MAA, runtimeDataBytes []byte, uvmI
 		return "", errors.Wrapf(err, "Failed to deserialize attestation report")
 	}
 
+	if len(certState.ReportDataNonce) > 0 {
+		logrus.Infof("Attestation report measurement: %s report data nonce: %s", SNPReport.Measurement, hex.EncodeToString(certState.ReportDataNonce))
+	}
+
 	logrus.Debugf("SNP Report Reported TCB: %d\nCert Chain TCBM Value: %d\n", SNPReport.ReportedTCB, certState.Tcbm)
 
 	// At this point check that the TCB of the cert chain matches that reported so we fail early or
@@ -134,7 +181,7 @@ func (certState *CertState) Attest(maa common.MAA, runtimeDataBytes []byte, uvmI
 	if SNPReport.ReportedTCB != certState.Tcbm {
 		// TCB values not the same, try refreshing cert cache first
 		logrus.Info("TCB values not the same, trying to refresh cert chain...")
-		vcekCertChain, err = certState.RefreshCertChain(SNPReport)
+		vcekCertChain, err = certState.RefreshCertChain(ctx, SNPReport)
 		if err != nil {
 			return "", err
 		}
@@ -153,7 +200,7 @@ func (certState *CertState) Attest(maa common.MAA, runtimeDataBytes []byte, uvmI
 
 			// refresh certs again
 			logrus.Info("Refreshing cert chain again...")
-			vcekCertChain, err = certState.RefreshCertChain(SNPReport)
+			vcekCertChain, err = certState.RefreshCertChain(ctx, SNPReport)
 			if err != nil {
 				return "", err
 			}
@@ -169,6 +216,10 @@ func (certState *CertState) Attest(maa common.MAA, runtimeDataBytes []byte, uvmI
 		vcekCertChain = []byte(certString)
 	}
 
+	if err := certState.CertChainPolicy.VerifyCertChain(ctx, vcekCertChain); err != nil {
+		return "", errors.Wrapf(err, "VCEK certificate chain verification failed")
+	}
+
 	var uvmReferenceInfoBytes []byte
 	if len(uvmInformation.EncodedUvmReferenceInfo) > 0 {
 		uvmReferenceInfoBytes, err = base64.StdEncoding.DecodeString(uvmInformation.EncodedUvmReferenceInfo)
@@ -4,6 +4,8 @@
 package attest
 
 import (
+	"bytes"
+	"context"
 	_ "embed"
 	"testing"
 
@@ -93,7 +95,7 @@ func Test_MAA(t *testing.T) {
 		APIVersion:   "api-version=2020-10-15-preview",
 	}
 
-	ValidCertChain, _, err := certFetcher.GetCertChain(TestSNPReport.ChipID, TestSNPReport.PlatformVersion)
+	ValidCertChain, _, err := certFetcher.GetCertChain(context.Background(), TestSNPReport.ChipID, TestSNPReport.PlatformVersion)
 	if err != nil {
 		t.Fatalf("retrieving cert chain failed")
 	}
@@ -105,7 +107,7 @@ func Test_MAA(t *testing.T) {
 		APIVersion:   "api-version=2020-10-15-preview",
 	}
 
-	ProductionValidCertChain, _, err := ProductionCertCache.GetCertChain(ProductionTestSNPReport.ChipID, ProductionTestSNPReport.PlatformVersion)
+	ProductionValidCertChain, _, err := ProductionCertCache.GetCertChain(context.Background(), ProductionTestSNPReport.ChipID, ProductionTestSNPReport.PlatformVersion)
 	if err != nil {
 		t.Fatalf("retrieving cert chain failed")
 	}
@@ -329,3 +331,25 @@ func Test_MAA(t *testing.T) {
 		})
 	}
 }
+
+func Test_AddReportDataNonce(t *testing.T) {
+	reportData := GenerateMAAReportData([]byte("runtime data"))
+	hash := reportData
+
+	nonce := []byte{0x01, 0x02, 0x03}
+	if err := AddReportDataNonce(&reportData, nonce); err != nil {
+		t.Fatalf("AddReportDataNonce failed: %v", err)
+	}
+	if !bytes.Equal(reportData[:sha256len], hash[:sha256len]) {
+		t.Fatalf("runtime data hash was modified")
+	}
+	expected := make([]byte, REPORT_DATA_SIZE-sha256len)
+	copy(expected, nonce)
+	if !bytes.Equal(reportData[sha256len:], expected) {
+		t.Fatalf("unexpected nonce in report data: %x", reportData[sha256len:])
+	}
+
+	if err := AddReportDataNonce(&reportData, make([]byte, REPORT_DATA_SIZE-sha256len+1)); err == nil {
+		t.Fatalf("expected nonce larger than the report data to be rejected")
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package attest
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"time"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// CertChainPolicy selects the checks of the VCEK certificate chain (VCEK, ASK
+// and ARK) done before it is sent to MAA with the attestation report. MAA
+// evaluates the chain too, but these checks fail earlier and tell apart why
+// the chain isn't trusted.
+type CertChainPolicy struct {
+	// If true, the validity period of each certificate and the signatures
+	// of the chain up to a self-signed root are checked
+	Verify bool `json:"verify,omitempty"`
+	// PEM-encoded root certificates (ARKs) that the chain must end in. If it
+	// is empty, any self-signed root is accepted.
+	TrustedRoots []string `json:"trusted_roots,omitempty"`
+	// If true, the certificates are checked against the CRLs of their CRL
+	// distribution points, e.g. https://kdsintf.amd.com/vcek/v1/Milan/crl,
+	// which needs network access. Only used if Verify is true.
+	CheckRevocation bool `json:"check_revocation,omitempty"`
+}
+
+// Reasons why a certificate chain isn't trusted, matched with errors.Is on
+// the error of VerifyCertChain
+var (
+	ErrCertExpired   = errors.New("certificate expired or not yet valid")
+	ErrCertRevoked   = errors.New("certificate revoked")
+	ErrUntrustedRoot = errors.New("certificate chain not anchored in a trusted root")
+)
+
+// Test dependencies
+var (
+	timeNow  = time.Now
+	fetchCRL = func(ctx context.Context, uri string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "http get request creation failed")
+		}
+		httpResponse, err := common.HTTPClient().Do(req)
+		if err != nil {
+			return nil, errors.Wrapf(err, "CRL request to %s failed", uri)
+		}
+		return common.HTTPResponseBody(httpResponse)
+	}
+)
+
+// parseCertChain parses the PEM certificates of certChain, from the leaf to
+// the root.
+func parseCertChain(certChain []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for rest := certChain; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse x509 certificate")
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) < 2 {
+		return nil, errors.Errorf("certificate chain has %d certificates, expected the VCEK and its issuers", len(certs))
+	}
+	return certs, nil
+}
+
+// VerifyCertChain checks the PEM certificate chain certChain, ordered from
+// the VCEK to the ARK, according to the policy. The error wraps
+// ErrCertExpired, ErrCertRevoked or ErrUntrustedRoot if the chain is well
+// formed but can't be trusted.
+func (p CertChainPolicy) VerifyCertChain(ctx context.Context, certChain []byte) error {
+	if !p.Verify {
+		return nil
+	}
+	certs, err := parseCertChain(certChain)
+	if err != nil {
+		return err
+	}
+
+	now := timeNow()
+	for _, cert := range certs {
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return errors.Wrapf(ErrCertExpired, "%s is valid from %s to %s", cert.Subject.CommonName, cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+
+	// The issuers aren't required to have the CA basic constraint, so the
+	// signatures are checked directly
+	for i, cert := range certs {
+		issuer := cert
+		if i+1 < len(certs) {
+			issuer = certs[i+1]
+		}
+		if err := issuer.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+			return errors.Wrapf(ErrUntrustedRoot, "%s isn't signed by %s: %v", cert.Subject.CommonName, issuer.Subject.CommonName, err)
+		}
+	}
+
+	root := certs[len(certs)-1]
+	if len(p.TrustedRoots) > 0 {
+		trusted := false
+		for _, trustedRoot := range p.TrustedRoots {
+			block, _ := pem.Decode([]byte(trustedRoot))
+			if block == nil {
+				return errors.New("trusted root isn't a PEM certificate")
+			}
+			if bytes.Equal(block.Bytes, root.Raw) {
+				trusted = true
+				break
+			}
+		}
+		if !trusted {
+			return errors.Wrapf(ErrUntrustedRoot, "%s isn't one of the trusted roots", root.Subject.CommonName)
+		}
+	}
+
+	if p.CheckRevocation {
+		if err := checkRevocation(ctx, certs, now); err != nil {
+			return err
+		}
+	}
+
+	logrus.Debugf("Certificate chain of %s verified", certs[0].Subject.CommonName)
+	return nil
+}
+
+// checkRevocation checks certs against the CRLs of their CRL distribution
+// points, which must be signed by the root of the chain like the ones of AMD,
+// and current at now.
+func checkRevocation(ctx context.Context, certs []*x509.Certificate, now time.Time) error {
+	root := certs[len(certs)-1]
+	checked := make(map[string]bool)
+	for _, cert := range certs {
+		for _, uri := range cert.CRLDistributionPoints {
+			if checked[uri] {
+				continue
+			}
+			checked[uri] = true
+
+			logrus.Debugf("Fetching CRL from %s...", uri)
+			crlBytes, err := fetchCRL(ctx, uri)
+			if err != nil {
+				return errors.Wrapf(err, "failed to fetch CRL")
+			}
+			// The CRL is served as DER, but accept PEM too
+			if block, _ := pem.Decode(crlBytes); block != nil {
+				crlBytes = block.Bytes
+			}
+			crl, err := x509.ParseRevocationList(crlBytes)
+			if err != nil {
+				return errors.Wrapf(err, "failed to parse CRL from %s", uri)
+			}
+			if err := crl.CheckSignatureFrom(root); err != nil {
+				return errors.Wrapf(err, "CRL from %s isn't signed by %s", uri, root.Subject.CommonName)
+			}
+			// A stale CRL could miss recent revocations
+			if now.Before(crl.ThisUpdate) || (!crl.NextUpdate.IsZero() && now.After(crl.NextUpdate)) {
+				return errors.Errorf("CRL from %s is valid from %s to %s", uri, crl.ThisUpdate.Format(time.RFC3339), crl.NextUpdate.Format(time.RFC3339))
+			}
+
+			// Serial numbers are unique per issuer
+			for _, entry := range crl.RevokedCertificateEntries {
+				for _, revoked := range certs {
+					if bytes.Equal(revoked.RawIssuer, crl.RawIssuer) && revoked.SerialNumber.Cmp(entry.SerialNumber) == 0 {
+						return errors.Wrapf(ErrCertRevoked, "%s (serial %s) revoked at %s", revoked.Subject.CommonName, revoked.SerialNumber, entry.RevocationTime.Format(time.RFC3339))
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
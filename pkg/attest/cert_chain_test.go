@@ -0,0 +1,158 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package attest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func Test_VerifyCertChain(t *testing.T) {
+	origTimeNow := timeNow
+	defer func() {
+		timeNow = origTimeNow
+	}()
+	timeNow = func() time.Time {
+		return time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	// The chain of the test data is VCEK, ASK and ARK of Milan
+	chain := []byte(amd_certificate_pem)
+	blocks := strings.SplitAfter(amd_certificate_pem, "-----END CERTIFICATE-----")
+	vcek, ark := strings.TrimSpace(blocks[0]), strings.TrimSpace(blocks[2])
+
+	if err := (CertChainPolicy{}).VerifyCertChain(context.Background(), []byte("not a chain")); err != nil {
+		t.Fatalf("expected no check without verify, got %v", err)
+	}
+	if err := (CertChainPolicy{Verify: true}).VerifyCertChain(context.Background(), chain); err != nil {
+		t.Fatalf("VerifyCertChain failed: %v", err)
+	}
+	if err := (CertChainPolicy{Verify: true, TrustedRoots: []string{ark}}).VerifyCertChain(context.Background(), chain); err != nil {
+		t.Fatalf("VerifyCertChain with the ARK as trusted root failed: %v", err)
+	}
+	if err := (CertChainPolicy{Verify: true, TrustedRoots: []string{vcek}}).VerifyCertChain(context.Background(), chain); !errors.Is(err, ErrUntrustedRoot) {
+		t.Fatalf("expected the ARK to be untrusted, got %v", err)
+	}
+	// The VCEK isn't signed by the ARK
+	if err := (CertChainPolicy{Verify: true}).VerifyCertChain(context.Background(), []byte(vcek+"\n"+ark)); !errors.Is(err, ErrUntrustedRoot) {
+		t.Fatalf("expected a chain without the ASK to be untrusted, got %v", err)
+	}
+	if err := (CertChainPolicy{Verify: true}).VerifyCertChain(context.Background(), []byte(vcek)); err == nil || errors.Is(err, ErrUntrustedRoot) {
+		t.Fatalf("expected a chain with only the VCEK to be malformed, got %v", err)
+	}
+
+	// The VCEK expires in November 2029
+	timeNow = func() time.Time {
+		return time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	if err := (CertChainPolicy{Verify: true}).VerifyCertChain(context.Background(), chain); !errors.Is(err, ErrCertExpired) {
+		t.Fatalf("expected the VCEK to be expired, got %v", err)
+	}
+}
+
+// testCert creates a certificate for key signed by parent with parentKey, or
+// a self-signed one if parent is nil.
+func testCert(t *testing.T, name string, serial int64, key *ecdsa.PrivateKey, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		CRLDistributionPoints: []string{"https://kds.example.com/crl"},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func Test_VerifyCertChain_Revocation(t *testing.T) {
+	origFetchCRL := fetchCRL
+	defer func() {
+		fetchCRL = origFetchCRL
+	}()
+
+	keys := make([]*ecdsa.PrivateKey, 4)
+	for i := range keys {
+		var err error
+		if keys[i], err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ark := testCert(t, "ARK-Test", 1, keys[0], nil, nil)
+	ask := testCert(t, "SEV-Test", 2, keys[1], ark, keys[0])
+	vcek := testCert(t, "SEV-VCEK", 2, keys[2], ask, keys[1])
+	var chain []byte
+	for _, cert := range []*x509.Certificate{vcek, ask, ark} {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+
+	crl := func(signer *ecdsa.PrivateKey, thisUpdate time.Time, revoked ...int64) []byte {
+		template := &x509.RevocationList{Number: big.NewInt(1), ThisUpdate: thisUpdate, NextUpdate: thisUpdate.Add(time.Hour)}
+		for _, serial := range revoked {
+			template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+		}
+		der, err := x509.CreateRevocationList(rand.Reader, template, ark, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+
+	now := time.Now()
+	policy := CertChainPolicy{Verify: true, CheckRevocation: true}
+	fetches := 0
+	for _, tc := range []struct {
+		name    string
+		crl     []byte
+		revoked string
+		fails   bool
+	}{
+		{name: "NotRevoked", crl: crl(keys[0], now, 5)},
+		// The ASK is revoked, but not the VCEK with the same serial number
+		// issued by the ASK
+		{name: "Revoked", crl: crl(keys[0], now, 2), revoked: "SEV-Test", fails: true},
+		{name: "NotSignedByRoot", crl: crl(keys[3], now), fails: true},
+		{name: "Stale", crl: crl(keys[0], now.Add(-2*time.Hour)), fails: true},
+		{name: "NotYetValid", crl: crl(keys[0], now.Add(time.Hour)), fails: true},
+	} {
+		fetchCRL = func(ctx context.Context, uri string) ([]byte, error) {
+			fetches++
+			return tc.crl, nil
+		}
+		err := policy.VerifyCertChain(context.Background(), chain)
+		if (err != nil) != tc.fails {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+		if errors.Is(err, ErrCertRevoked) != (tc.revoked != "") || (tc.revoked != "" && !strings.Contains(err.Error(), tc.revoked)) {
+			t.Errorf("%s: expected %q to be revoked, got %v", tc.name, tc.revoked, err)
+		}
+	}
+	// The CRL of the distribution point shared by the chain is fetched once
+	if fetches != 5 {
+		t.Fatalf("expected one CRL fetch per verification, got %d", fetches)
+	}
+}
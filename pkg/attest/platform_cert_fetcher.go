@@ -11,6 +11,7 @@ package attest
 */
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/pem"
 	"fmt"
@@ -159,7 +160,7 @@ const (
 	defaultRetryMaxRetries = 2
 )
 
-func fetchWithRetry(requestURL string, baseSec int, maxRetries int, httpRequestFunc func(string) (*http.Response, error)) ([]byte, error) {
+func fetchWithRetry(ctx context.Context, requestURL string, baseSec int, maxRetries int, httpRequestFunc func(string) (*http.Response, error)) ([]byte, error) {
 	logrus.Debugf("fetchWithRetry: requestURL=%s, baseSec=%d, maxRetries=%d", requestURL, baseSec, maxRetries)
 	if maxRetries < 0 {
 		return nil, errors.New("invalid `maxRetries` value")
@@ -173,14 +174,26 @@ func fetchWithRetry(requestURL string, baseSec int, maxRetries int, httpRequestF
 			maxDelay := math.Pow(float64(baseSec), float64(retryCount))
 			delaySec := rand.Float64() * maxDelay
 			delaySecInt := math.Min(math.MaxInt64, delaySec)
-			time.Sleep(time.Duration(delaySecInt) * time.Second)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Duration(delaySecInt) * time.Second):
+			}
 		}
 		if httpRequestFunc != nil {
 			res, err = httpRequestFunc(requestURL)
 		} else {
-			res, err = http.Get(requestURL)
+			var req *http.Request
+			req, err = http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+			if err != nil {
+				return nil, errors.Wrapf(err, "http get request creation failed")
+			}
+			res, err = common.HTTPClient().Do(req)
 		}
 		if err != nil {
+			if !common.Retryable(err, nil) {
+				return nil, errors.Wrapf(err, "http get request failed")
+			}
 			logrus.Debugf("fetch on retry %d: http.Get failed: %s", retryCount, err)
 			retryCount++
 			continue
@@ -196,9 +209,11 @@ func fetchWithRetry(requestURL string, baseSec int, maxRetries int, httpRequestF
 				continue
 			}
 			return resBody, nil
-		} else if res.StatusCode == 408 || res.StatusCode == 429 || 500 <= res.StatusCode {
+		} else if common.Retryable(nil, res) {
 			// Got status code that is worth to retry
-			logrus.Debugf("fetch on retry %d: http.Get failed with a status code worth a retry", retryCount)
+			res.Body.Close()
+			logrus.Debugf("fetch on retry %d: http.Get failed with status code %d, which is worth a retry", retryCount, res.StatusCode)
+			err = errors.Errorf("GET request failed with status code %d", res.StatusCode)
 			retryCount++
 			continue
 		} else {
@@ -220,7 +235,7 @@ func fetchWithRetry(requestURL string, baseSec int, maxRetries int, httpRequestF
 // are retrieved from the attestation report.
 // Returns the cert chain as a bytes array, the TCBM from the local THIM cert cache is as a string
 // (only in the case of a local THIM endpoint), and any errors encountered
-func (certFetcher CertFetcher) retrieveCertChain(chipID string, reportedTCB uint64) ([]byte, uint64, error) {
+func (certFetcher CertFetcher) retrieveCertChain(ctx context.Context, chipID string, reportedTCB uint64) ([]byte, uint64, error) {
 	logrus.Info("Retrieving Cert Chain...")
 	// HTTP GET request to cert cache service
 	var uri string
@@ -239,7 +254,7 @@ func (certFetcher CertFetcher) retrieveCertChain(chipID string, reportedTCB uint
 			// AMD cert cache endpoint returns the VCEK certificate in DER format
 			logrus.Trace("Fetching VCEK cert from AMD endpoint...")
 			uri = fmt.Sprintf(AmdVCEKRequestURITemplate, certFetcher.Endpoint, certFetcher.TEEType, chipID, reportedTCBBytes[UcodeSplTcbmByteIndex], reportedTCBBytes[SnpSplTcbmByteIndex], reportedTCBBytes[TeeSplTcbmByteIndex], reportedTCBBytes[BlSplTcbmByteIndex])
-			derBytes, err := fetchWithRetry(uri, defaultRetryBaseSec, defaultRetryMaxRetries, nil)
+			derBytes, err := fetchWithRetry(ctx, uri, defaultRetryBaseSec, defaultRetryMaxRetries, nil)
 			if err != nil {
 				return nil, reportedTCB, err
 			}
@@ -249,7 +264,7 @@ func (certFetcher CertFetcher) retrieveCertChain(chipID string, reportedTCB uint
 			// now retrieve the cert chain
 			logrus.Trace("Fetching cert chain from AMD endpoint...")
 			uri = fmt.Sprintf(AmdCertChainRequestURITemplate, certFetcher.Endpoint, certFetcher.TEEType)
-			certChainPEMBytes, err := fetchWithRetry(uri, defaultRetryBaseSec, defaultRetryMaxRetries, nil)
+			certChainPEMBytes, err := fetchWithRetry(ctx, uri, defaultRetryBaseSec, defaultRetryMaxRetries, nil)
 			if err != nil {
 				return nil, reportedTCB, errors.Wrapf(err, "pulling AMD cert chain response from URL '%s' failed", uri)
 			}
@@ -262,7 +277,7 @@ func (certFetcher CertFetcher) retrieveCertChain(chipID string, reportedTCB uint
 		case "LocalTHIM":
 			logrus.Debugf("Retrieving Cert Chain from Local THIM Endpoint %s...", certFetcher.Endpoint)
 			uri = fmt.Sprintf(LocalTHIMUriTemplate, certFetcher.Endpoint)
-			THIMCertsBytes, err := fetchWithRetry(uri, defaultRetryBaseSec, defaultRetryMaxRetries, getThimCertsHttp)
+			THIMCertsBytes, err := fetchWithRetry(ctx, uri, defaultRetryBaseSec, defaultRetryMaxRetries, getThimCertsHttp)
 			if err != nil {
 				return nil, thimTcbm, errors.Wrapf(err, "pulling cert chain response from URL '%s' failed", uri)
 			}
@@ -285,7 +300,7 @@ func (certFetcher CertFetcher) retrieveCertChain(chipID string, reportedTCB uint
 			uri = fmt.Sprintf(AzureCertCacheRequestURITemplate, certFetcher.Endpoint, certFetcher.TEEType, chipID, strconv.FormatUint(reportedTCB, 16), certFetcher.APIVersion)
 
 			logrus.Trace("Fetching cert chain from AzCache endpoint...")
-			certChain, err := fetchWithRetry(uri, defaultRetryBaseSec, defaultRetryMaxRetries, nil)
+			certChain, err := fetchWithRetry(ctx, uri, defaultRetryBaseSec, defaultRetryMaxRetries, nil)
 			if err != nil {
 				return nil, thimTcbm, errors.Wrapf(err, "pulling certchain response from AzCache URL '%s' failed", uri)
 			}
@@ -311,8 +326,8 @@ https://www.amd.com/en/support/tech-docs/versioned-chip-endorsement-key-vcek-cer
 
 It also returns TCB as uint64 (useful only when "LocalTHIM" is used for EndpointType).
 */
-func (certFetcher CertFetcher) GetCertChain(chipID string, reportedTCB uint64) ([]byte, uint64, error) {
-	return certFetcher.retrieveCertChain(chipID, reportedTCB)
+func (certFetcher CertFetcher) GetCertChain(ctx context.Context, chipID string, reportedTCB uint64) ([]byte, uint64, error) {
+	return certFetcher.retrieveCertChain(ctx, chipID, reportedTCB)
 }
 
 func getThimCertsHttp(uri string) (*http.Response, error) {
@@ -324,12 +339,14 @@ func getThimCertsHttp(uri string) (*http.Response, error) {
 	return httpResponse, nil
 }
 
-func (certFetcher CertFetcher) GetThimCerts(uri string) (*common.THIMCerts, error) {
+// GetThimCerts fetches the THIM certificates from uri, or from the default local
+// THIM endpoint if uri is empty. Retries are abandoned when ctx is cancelled.
+func (certFetcher CertFetcher) GetThimCerts(ctx context.Context, uri string) (*common.THIMCerts, error) {
 	if len(uri) == 0 {
 		uri = defaultLocalThimURI
 	}
 	uri = fmt.Sprintf(LocalTHIMUriTemplate, uri)
-	THIMCertsBytes, err := fetchWithRetry(uri, defaultRetryBaseSec, defaultRetryMaxRetries, getThimCertsHttp)
+	THIMCertsBytes, err := fetchWithRetry(ctx, uri, defaultRetryBaseSec, defaultRetryMaxRetries, getThimCertsHttp)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Fetching THIM Certs with retries failed.")
 	}
@@ -9,6 +9,7 @@
 package attest
 
 import (
+	"context"
 	_ "embed"
 	"testing"
 )
@@ -72,7 +73,7 @@ func TestCertFetcherWithRealAttestationReport(t *testing.T) {
 
 	for _, tc := range testcases {
 		t.Run(tc.name, func(t *testing.T) {
-			certchain, _, err := tc.certFetcher.GetCertChain(tc.chipID, tc.platformVersion)
+			certchain, _, err := tc.certFetcher.GetCertChain(context.Background(), tc.chipID, tc.platformVersion)
 
 			if tc.expectErr {
 				if err == nil {
@@ -4,11 +4,15 @@
 package attest
 
 import (
+	"context"
 	_ "embed"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"encoding/hex"
 
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
 	"github.com/pkg/errors"
 )
 
@@ -118,7 +122,7 @@ func Test_CertFetcher(t *testing.T) {
 
 	for _, tc := range testcases {
 		t.Run(tc.name, func(t *testing.T) {
-			certchain, _, err := tc.certFetcher.GetCertChain(tc.chipID, tc.platformVersion)
+			certchain, _, err := tc.certFetcher.GetCertChain(context.Background(), tc.chipID, tc.platformVersion)
 
 			if tc.expectErr {
 				if err == nil {
@@ -138,3 +142,43 @@ func Test_CertFetcher(t *testing.T) {
 		})
 	}
 }
+
+func Test_FetchWithRetry_Retryable(t *testing.T) {
+	defer common.SetRetryable(nil)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	// A base of 0 seconds doesn't wait between the retries
+	if _, err := fetchWithRetry(context.Background(), server.URL, 0, 2, nil); err == nil {
+		t.Fatalf("expected the fetch to fail")
+	}
+	if requests != 3 {
+		t.Fatalf("expected 502 to be retried by default, got %d requests", requests)
+	}
+
+	requests = 0
+	common.SetRetryable(func(err error, res *http.Response) bool {
+		return res == nil || res.StatusCode != http.StatusBadGateway
+	})
+	if _, err := fetchWithRetry(context.Background(), server.URL, 0, 2, nil); err == nil {
+		t.Fatalf("expected the fetch to fail")
+	}
+	if requests != 1 {
+		t.Fatalf("expected 502 not to be retried, got %d requests", requests)
+	}
+}
+
+func Test_GetCertChain_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	certFetcher := CertFetcher{EndpointType: "AzCache", Endpoint: "americas.test.acccache.azure.net", TEEType: "SevSnpVM", APIVersion: "api-version=2020-10-15-preview"}
+	if _, _, err := certFetcher.GetCertChain(ctx, "deadbeef", 0xdb18000000000004); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the fetch to stop with the context, got %v", err)
+	}
+}
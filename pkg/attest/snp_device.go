@@ -5,13 +5,19 @@ package attest
 
 import (
 	"os"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 const SNP_DEVICE_PATH_5 = "/dev/sev"
 const SNP_DEVICE_PATH_6 = "/dev/sev-guest"
 
+// Interval between the checks of waitForSNPDevice
+const snpDevicePollInterval = 100 * time.Millisecond
+
 // Check if the code is being run in SNP VM for Linux kernel version 5.x.
 func IsSNPVM5() bool {
 	_, err := os.Stat(SNP_DEVICE_PATH_5)
@@ -27,3 +33,43 @@ func IsSNPVM6() bool {
 func IsSNPVM() bool {
 	return IsSNPVM5() || IsSNPVM6()
 }
+
+var (
+	// Replaced by the tests
+	isSNPVM = IsSNPVM
+
+	// Serializes the waits for the SNP device, and records if one has
+	// already timed out
+	snpDeviceMutex    sync.Mutex
+	snpDeviceTimedOut bool
+)
+
+// waitForSNPDevice waits up to timeout for the SNP device to appear, which
+// happens after the container starts on some hosts, and returns whether it
+// exists. Once a wait has timed out, later calls don't wait again, so that
+// every attestation isn't delayed when not running inside an SNP VM.
+func waitForSNPDevice(timeout time.Duration) bool {
+	if isSNPVM() {
+		return true
+	}
+
+	snpDeviceMutex.Lock()
+	defer snpDeviceMutex.Unlock()
+	if snpDeviceTimedOut {
+		return false
+	}
+
+	logrus.Infof("Waiting up to %s for the SNP device...", timeout)
+	deadline := time.Now().Add(timeout)
+	for {
+		if isSNPVM() {
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			logrus.Warnf("SNP device not found after %s", timeout)
+			snpDeviceTimedOut = true
+			return false
+		}
+		time.Sleep(snpDevicePollInterval)
+	}
+}
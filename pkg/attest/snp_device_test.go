@@ -0,0 +1,41 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package attest
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_WaitForSNPDevice(t *testing.T) {
+	origIsSNPVM := isSNPVM
+	defer func() {
+		isSNPVM = origIsSNPVM
+		snpDeviceTimedOut = false
+	}()
+
+	// The device appears after a few checks
+	checks := 0
+	isSNPVM = func() bool {
+		checks++
+		return checks > 3
+	}
+	if !waitForSNPDevice(10 * time.Second) {
+		t.Fatalf("expected the SNP device to be found")
+	}
+
+	// The device never appears, and later calls don't wait again
+	isSNPVM = func() bool { return false }
+	start := time.Now()
+	if waitForSNPDevice(200 * time.Millisecond) {
+		t.Fatalf("expected the wait for the SNP device to time out")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("returned after %s, before the timeout", elapsed)
+	}
+	start = time.Now()
+	if waitForSNPDevice(10*time.Second) || time.Since(start) > time.Second {
+		t.Fatalf("expected no second wait for the SNP device")
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package attest
+
+import (
+	"context"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// When the THIM certificates of the UVM information are replaced by the ones
+// fetched from THIM
+const (
+	// Only use the provided certificates, and fail if they are absent
+	ThimCertPolicyUseProvided = "use-provided"
+	// Fetch the certificates if they aren't provided, the default
+	ThimCertPolicyFetchIfAbsent = "fetch-if-absent"
+	// Always fetch the certificates, ignoring the provided ones
+	ThimCertPolicyAlwaysFetch = "always-fetch"
+)
+
+// ValidateThimCertPolicy checks that policy is empty or one of the
+// ThimCertPolicy values.
+func ValidateThimCertPolicy(policy string) error {
+	switch policy {
+	case "", ThimCertPolicyUseProvided, ThimCertPolicyFetchIfAbsent, ThimCertPolicyAlwaysFetch:
+		return nil
+	default:
+		return errors.Errorf("unknown THIM cert policy: %s", policy)
+	}
+}
+
+// InitialCerts returns the THIM certificates of the first attestation
+// according to policy: the provided ones, usually from the UVM information,
+// or the ones fetched from uri as GetThimCerts does.
+func (certFetcher CertFetcher) InitialCerts(ctx context.Context, policy string, provided common.THIMCerts, uri string) (common.THIMCerts, error) {
+	if err := ValidateThimCertPolicy(policy); err != nil {
+		return common.THIMCerts{}, err
+	}
+
+	absent := common.ThimCertsAbsent(&provided)
+	switch policy {
+	case ThimCertPolicyUseProvided:
+		if absent {
+			return common.THIMCerts{}, errors.Errorf("THIM certs are absent and the THIM cert policy is %s", ThimCertPolicyUseProvided)
+		}
+		return provided, nil
+	case ThimCertPolicyAlwaysFetch:
+		logrus.Info("Retrieving THIMCerts from THIM endpoint, ignoring the provided ones.")
+	default:
+		if !absent {
+			return provided, nil
+		}
+		logrus.Info("ThimCerts is absent, retrieving THIMCerts from THIM endpoint.")
+	}
+
+	thimCerts, err := certFetcher.GetThimCerts(ctx, uri)
+	if err != nil {
+		return common.THIMCerts{}, err
+	}
+	return *thimCerts, nil
+}
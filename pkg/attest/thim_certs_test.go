@@ -0,0 +1,62 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package attest
+
+import (
+	"context"
+	_ "embed"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+)
+
+//go:embed test_data/uvm_host_amd_certificate.json
+var amd_certificate_json []byte
+
+func Test_InitialCerts(t *testing.T) {
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(amd_certificate_json)
+	}))
+	defer server.Close()
+	uri := strings.TrimPrefix(server.URL, "http://")
+
+	fetched, err := common.ParseTHIMCertsFromByte(amd_certificate_json)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provided := common.THIMCerts{VcekCert: "provided-vcek", CertificateChain: "provided-chain", Tcbm: "1"}
+
+	for _, tc := range []struct {
+		policy   string
+		provided common.THIMCerts
+		expected common.THIMCerts
+		fetches  int
+		fails    bool
+	}{
+		{policy: "", provided: provided, expected: provided},
+		{policy: "", provided: common.THIMCerts{}, expected: fetched, fetches: 1},
+		{policy: ThimCertPolicyFetchIfAbsent, provided: provided, expected: provided},
+		{policy: ThimCertPolicyUseProvided, provided: provided, expected: provided},
+		{policy: ThimCertPolicyUseProvided, provided: common.THIMCerts{}, fails: true},
+		{policy: ThimCertPolicyAlwaysFetch, provided: provided, expected: fetched, fetches: 1},
+		{policy: "sometimes", provided: provided, fails: true},
+	} {
+		fetches = 0
+		certs, err := (CertFetcher{}).InitialCerts(context.Background(), tc.policy, tc.provided, uri)
+		if (err != nil) != tc.fails {
+			t.Errorf("%q: unexpected error %v", tc.policy, err)
+		}
+		if !tc.fails && certs != tc.expected {
+			t.Errorf("%q: expected %+v, got %+v", tc.policy, tc.expected, certs)
+		}
+		if fetches != tc.fetches {
+			t.Errorf("%q: expected %d fetches, got %d", tc.policy, tc.fetches, fetches)
+		}
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"hash"
+	"net/url"
 	"runtime"
 	"strings"
 
@@ -30,10 +31,127 @@ const (
 	RSASize = 2048
 )
 
+// Types of vault that keys are released from
+const (
+	VaultTypeKeyVault   = "akv"
+	VaultTypeManagedHSM = "mhsm"
+)
+
+// AKVReleaseKeyAPIVersion is the API version of the key release used when the
+// AKV doesn't set one. Key vaults and managed HSMs release keys with the same
+// path and API version, so the type of vault only changes the resource of the
+// token used to access it.
+const AKVReleaseKeyAPIVersion = "api-version=7.4"
+
 type AKV struct {
 	Endpoint    string `json:"endpoint"`
 	APIVersion  string `json:"api_version,omitempty"`
 	BearerToken string `json:"bearer_token,omitempty"`
+	// TokenResource is the resource for which the authentication token used to
+	// access the AKV is requested, e.g. https://managedhsm.azure.net. If empty,
+	// it is derived from the endpoint.
+	TokenResource string `json:"token_resource,omitempty"`
+	// ReleaseEncryption is the algorithm requested from the AKV to wrap
+	// released keys with the wrapping key generated for the release:
+	// CKM_RSA_AES_KEY_WRAP, RSA_AES_KEY_WRAP_256 or RSA_AES_KEY_WRAP_384. If
+	// empty, the default of the AKV is used.
+	ReleaseEncryption string `json:"release_encryption,omitempty"`
+	// VaultType is the type of vault at the endpoint: "akv" for a key vault
+	// or "mhsm" for a managed HSM. If empty, it is detected from the endpoint,
+	// as managed HSMs are at "<name>.managedhsm.<domain>".
+	VaultType string `json:"vault_type,omitempty"`
+}
+
+// Type returns the type of vault at the endpoint, VaultTypeKeyVault or
+// VaultTypeManagedHSM.
+func (akv AKV) Type() (string, error) {
+	switch akv.VaultType {
+	case VaultTypeKeyVault, VaultTypeManagedHSM:
+		return akv.VaultType, nil
+	case "":
+	default:
+		return "", errors.Errorf("unknown vault type: %s", akv.VaultType)
+	}
+
+	host := akv.Endpoint
+	if u, err := url.Parse(host); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	host = strings.SplitN(host, "/", 2)[0]
+	if strings.Contains(host, ".managedhsm.") {
+		return VaultTypeManagedHSM, nil
+	}
+	return VaultTypeKeyVault, nil
+}
+
+// ReleaseKeyURI returns the URI of the release of the key kid. Both types of
+// vault use the same path, and AKVReleaseKeyAPIVersion if APIVersion isn't
+// set. It fails if VaultType is unknown.
+func (akv AKV) ReleaseKeyURI(kid string) (string, error) {
+	if _, err := akv.Type(); err != nil {
+		return "", err
+	}
+	apiVersion := akv.APIVersion
+	if apiVersion == "" {
+		apiVersion = AKVReleaseKeyAPIVersion
+	}
+	return fmt.Sprintf(AKVReleaseKeyRequestURITemplate, akv.Endpoint, kid, apiVersion), nil
+}
+
+// Algorithms used by AKV to wrap released keys
+var releaseEncryptionAlgorithms = map[string]bool{
+	"CKM_RSA_AES_KEY_WRAP": true,
+	"RSA_AES_KEY_WRAP_256": true,
+	"RSA_AES_KEY_WRAP_384": true,
+}
+
+// AKVError is the error returned by AKV when a request fails. When a key
+// release is denied, the message usually explains which condition of the
+// release policy isn't satisfied by the claims of the attestation token.
+type AKVError struct {
+	Status  string
+	Code    string
+	Message string
+	// Code of the inner error, if any, like "AccessDenied"
+	InnerCode string
+	Err       *HTTPError
+}
+
+func (e *AKVError) Error() string {
+	code := e.Code
+	if e.InnerCode != "" {
+		code += "/" + e.InnerCode
+	}
+	return fmt.Sprintf("AKV returned %s (%s): %s", e.Status, code, e.Message)
+}
+
+func (e *AKVError) Unwrap() error {
+	return e.Err
+}
+
+// newAKVError parses the error in the body of the response of AKV, which is
+// like {"error": {"code": "Forbidden", "message": "...", "innererror": {...}}}.
+// It returns nil if the body isn't an AKV error.
+func newAKVError(httpErr *HTTPError) *AKVError {
+	var body struct {
+		Error struct {
+			Code       string `json:"code"`
+			Message    string `json:"message"`
+			InnerError struct {
+				Code string `json:"code"`
+			} `json:"innererror"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(httpErr.Body, &body); err != nil || body.Error.Code == "" {
+		return nil
+	}
+	return &AKVError{
+		Status:    httpErr.Status,
+		Code:      body.Error.Code,
+		Message:   body.Error.Message,
+		InnerCode: body.Error.InnerError.Code,
+		Err:       httpErr,
+	}
 }
 
 // Helper Functions
@@ -44,15 +162,11 @@ func RsaAESKeyUnwrap(alg string, ciphertext []byte, priv *rsa.PrivateKey) ([]byt
 	// ======================
 	// First N bytes contain the encrypted emphimeral AES key where N equals the
 	// size of the private key. Remaining bytes are the wrapped key
-	encryptedKEK := make([]byte, RSASize/8)
-	for i := range encryptedKEK {
-		encryptedKEK[i] = ciphertext[i]
-	}
-
-	encryptedKey := make([]byte, len(ciphertext)-RSASize/8)
-	for i := range encryptedKey {
-		encryptedKey[i] = ciphertext[i+RSASize/8]
+	if len(ciphertext) <= priv.Size() {
+		return nil, errors.Errorf("ciphertext of %d bytes is too short for a %d-bit wrapping key", len(ciphertext), priv.Size()*8)
 	}
+	encryptedKEK := ciphertext[:priv.Size()]
+	encryptedKey := ciphertext[priv.Size():]
 
 	// Before performing decryption, choose the hash function based on the key
 	// encryption algorithm
@@ -219,6 +333,7 @@ type ReleasePolicy struct {
 // ReleaseKey interface
 type releaseKeyRequest struct {
 	Target string `json:"target"`
+	Enc    string `json:"enc,omitempty"`
 }
 
 type releaseKeyResponse struct {
@@ -325,9 +440,14 @@ func (akv AKV) ImportPlaintextKey(key interface{}, releasePolicy ReleasePolicy,
 // The private key is kept within the utility VM and hence is isolated with hardware-based
 // guarantees.
 func (akv AKV) ReleaseKey(maaTokenBase64 string, kid string, privateWrappingKey *rsa.PrivateKey) (_ []byte, _ string, err error) {
+	if akv.ReleaseEncryption != "" && !releaseEncryptionAlgorithms[akv.ReleaseEncryption] {
+		return nil, "", errors.Errorf("unsupported release encryption algorithm: %s", akv.ReleaseEncryption)
+	}
+
 	// Construct release key request to AKV
 	request := releaseKeyRequest{
 		Target: maaTokenBase64,
+		Enc:    akv.ReleaseEncryption,
 	}
 	// Create HTTP POST request to a AKV service that requires authorization
 	// bearer token
@@ -336,7 +456,10 @@ func (akv AKV) ReleaseKey(maaTokenBase64 string, kid string, privateWrappingKey
 		return nil, "", errors.Wrapf(err, "marshalling release key request failed")
 	}
 
-	uri := fmt.Sprintf(AKVReleaseKeyRequestURITemplate, akv.Endpoint, kid, akv.APIVersion)
+	uri, err := akv.ReleaseKeyURI(kid)
+	if err != nil {
+		return nil, "", err
+	}
 
 	httpResponse, err := HTTPPRequest("POST", uri, releaseKeyJSONData, akv.BearerToken)
 	if err != nil {
@@ -345,6 +468,12 @@ func (akv AKV) ReleaseKey(maaTokenBase64 string, kid string, privateWrappingKey
 
 	httpResponseBodyBytes, err := HTTPResponseBody(httpResponse)
 	if err != nil {
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) {
+			if akvErr := newAKVError(httpErr); akvErr != nil {
+				return nil, "", akvErr
+			}
+		}
 		return nil, "", errors.Wrapf(err, "pulling AKV response body failed")
 	}
 
@@ -426,6 +555,11 @@ func _releaseKey(akv AKV, AKVJWS string, privateWrappingKey *rsa.PrivateKey) (ke
 		return nil, "", errors.Wrapf(err, "unmarshalling jws response payload failed")
 	}
 
+	// Don't accept a weaker wrapping algorithm than the requested one
+	if akv.ReleaseEncryption != "" && payloadJSON.Request.Enc != akv.ReleaseEncryption {
+		return nil, "", errors.Errorf("key wrapped with %s, requested %s", payloadJSON.Request.Enc, akv.ReleaseEncryption)
+	}
+
 	// decode KeyHSM no-padding base64 url representation and retrieve the Ciphertext field
 	keyHSMBytes, err := base64.RawURLEncoding.DecodeString(payloadJSON.Response.Key.Key.KeyHSM)
 	if err != nil {
@@ -0,0 +1,70 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAKVError(t *testing.T) {
+	body := `{"error":{"code":"Forbidden","message":"Target environment attestation statement cannot be verified. x-ms-sevsnpvm-guestsvn must be at least 3.","innererror":{"code":"AccessDenied"}}}`
+	resp := &http.Response{
+		Status:     "403 Forbidden",
+		StatusCode: http.StatusForbidden,
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+	_, err := HTTPResponseBody(resp)
+
+	var httpErr *HTTPError
+	if assert.True(t, errors.As(err, &httpErr)) {
+		akvErr := newAKVError(httpErr)
+		if assert.NotNil(t, akvErr) {
+			assert.Equal(t, "Forbidden", akvErr.Code)
+			assert.Equal(t, "AccessDenied", akvErr.InnerCode)
+			assert.Contains(t, akvErr.Error(), "guestsvn must be at least 3")
+			assert.True(t, errors.As(akvErr, &httpErr), "AKVError must wrap the HTTPError")
+		}
+	}
+
+	assert.Nil(t, newAKVError(&HTTPError{Status: "502 Bad Gateway", Body: []byte("<html>")}))
+}
+
+func TestAKVReleaseKeyURI(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		akv  AKV
+		uri  string
+	}{
+		{"KeyVault", AKV{Endpoint: "myvault.vault.azure.net"}, "https://myvault.vault.azure.net/keys/key/release?api-version=7.4"},
+		{"ManagedHSM", AKV{Endpoint: "myhsm.managedhsm.azure.net"}, "https://myhsm.managedhsm.azure.net/keys/key/release?api-version=7.4"},
+		{"ManagedHSMPrivateEndpoint", AKV{Endpoint: "myhsm.privatelink.managedhsm.azure.net", VaultType: VaultTypeManagedHSM}, "https://myhsm.privatelink.managedhsm.azure.net/keys/key/release?api-version=7.4"},
+		{"APIVersion", AKV{Endpoint: "myhsm.managedhsm.azure.net", APIVersion: "api-version=7.5"}, "https://myhsm.managedhsm.azure.net/keys/key/release?api-version=7.5"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			uri, err := tc.akv.ReleaseKeyURI("key")
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.uri, uri)
+			}
+		})
+	}
+
+	for endpoint, vaultType := range map[string]string{
+		"myvault.vault.azure.net":                 VaultTypeKeyVault,
+		"https://myhsm.managedhsm.azure.cn/":      VaultTypeManagedHSM,
+		"myvault.privatelink.vaultcore.azure.net": VaultTypeKeyVault,
+	} {
+		detected, err := AKV{Endpoint: endpoint}.Type()
+		assert.NoError(t, err)
+		assert.Equal(t, vaultType, detected, endpoint)
+	}
+
+	_, err := AKV{Endpoint: "myvault.vault.azure.net", VaultType: "hsm"}.ReleaseKeyURI("key")
+	assert.ErrorContains(t, err, "unknown vault type")
+}
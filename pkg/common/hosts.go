@@ -0,0 +1,39 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"net"
+	"strings"
+)
+
+// HostAllowed returns whether host is in allowedHosts. Entries are either host
+// names, which must match exactly, or wildcards like "*.blob.core.windows.net",
+// which match any subdomain. The comparison ignores case and the port of host.
+// An empty allowedHosts allows any host.
+func HostAllowed(host string, allowedHosts []string) bool {
+	if len(allowedHosts) == 0 {
+		return true
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return false
+	}
+
+	for _, allowed := range allowedHosts {
+		allowed = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(allowed)), ".")
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasPrefix(suffix, ".") && strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if allowed != "" && host == allowed {
+			return true
+		}
+	}
+	return false
+}
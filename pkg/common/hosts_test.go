@@ -0,0 +1,25 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostAllowed(t *testing.T) {
+	allowed := []string{"myaccount.blob.core.windows.net", "*.file.core.windows.net"}
+
+	assert.True(t, HostAllowed("anything.example.com", nil))
+	assert.True(t, HostAllowed("myaccount.blob.core.windows.net", allowed))
+	assert.True(t, HostAllowed("MyAccount.blob.core.windows.net:443", allowed))
+	assert.True(t, HostAllowed("share.file.core.windows.net", allowed))
+
+	assert.False(t, HostAllowed("other.blob.core.windows.net", allowed))
+	assert.False(t, HostAllowed("myaccount.blob.core.windows.net.evil.com", allowed))
+	assert.False(t, HostAllowed("file.core.windows.net", allowed))
+	assert.False(t, HostAllowed("evilfile.core.windows.net", allowed))
+	assert.False(t, HostAllowed("", allowed))
+}
@@ -13,6 +13,8 @@ import (
 
 type HTTPError struct {
 	Status string
+	// Body of the response, which often explains the error
+	Body []byte
 }
 
 func (e HTTPError) Error() string {
@@ -21,8 +23,7 @@ func (e HTTPError) Error() string {
 
 func httpClientDoRequest(req *http.Request) (*http.Response, error) {
 	httpClientDoWrapper := func() (interface{}, error) {
-		client := &http.Client{}
-		return client.Do(req)
+		return HTTPClient().Do(req)
 	}
 
 	resp, err := httpClientDoWrapper()
@@ -79,7 +80,7 @@ func HTTPResponseBody(httpResponse *http.Response) ([]byte, error) {
 		httpResponseBodyBytes, _ = io.ReadAll(io.LimitReader(httpResponse.Body, int64(respLen)))
 	}
 	if httpResponse.StatusCode < 200 || httpResponse.StatusCode > 207 {
-		return nil, errors.Wrapf(&HTTPError{httpResponse.Status}, string(httpResponseBodyBytes))
+		return nil, errors.Wrapf(&HTTPError{Status: httpResponse.Status, Body: httpResponseBodyBytes}, string(httpResponseBodyBytes))
 	}
 	return httpResponseBodyBytes, nil
 }
@@ -8,9 +8,18 @@ package common
 //
 // Safe use of this is to ensure that the secret has enough entropy. Examples
 // include RSA private keys.
+//
+// Algorithm selects the key derivation function, HKDF if empty. Iterations,
+// Memory and Parallelism are the work factors of PBKDF2 and Argon2id, and the
+// defaults are used if they are zero.
 type KeyDerivationBlob struct {
-	Salt  string `json:"salt,omitempty`
-	Label string `json:"label,omitemtpy`
+	Salt        string `json:"salt,omitempty"`
+	Label       string `json:"label,omitempty"`
+	Algorithm   string `json:"algorithm,omitempty"`
+	Iterations  uint32 `json:"iterations,omitempty"`
+	Memory      uint32 `json:"memory,omitempty"`
+	Parallelism uint8  `json:"parallelism,omitempty"`
+	KeyLength   uint32 `json:"key_length,omitempty"`
 }
 
 // KeyBlob contains information about the AKV service that holds the secret
@@ -0,0 +1,146 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Key derivation functions supported in KeyDerivationBlob.Algorithm
+const (
+	KeyDerivationHKDF     = "HKDF"
+	KeyDerivationPBKDF2   = "PBKDF2"
+	KeyDerivationArgon2id = "Argon2id"
+)
+
+const (
+	// Label used for HKDF if none is specified
+	DefaultKeyDerivationLabel = "Symmetric Encryption Key"
+	// Length in bytes of the derived key if none is specified
+	DefaultKeyDerivationKeyLength = 32
+	// PBKDF2-HMAC-SHA256 iterations if none are specified
+	DefaultPBKDF2Iterations = 600000
+	// Argon2id parameters if none are specified, as recommended in RFC 9106
+	DefaultArgon2idIterations  = 3
+	DefaultArgon2idMemory      = 64 * 1024
+	DefaultArgon2idParallelism = 4
+)
+
+// Bounds of the parameters of the key derivation, so that a configuration
+// can't make the derivation run for hours or exhaust the memory of the UVM
+const (
+	MaxKeyDerivationKeyLength = 1024
+	MaxPBKDF2Iterations       = 10000000
+	MaxArgon2idIterations     = 100
+	// 2 GiB, the memory of the first recommended option of RFC 9106
+	MaxArgon2idMemory = 2 * 1024 * 1024
+	// Minimum length in bytes of the salt of PBKDF2 and Argon2id, as required
+	// by RFC 9106
+	MinKeyDerivationSaltLength = 8
+)
+
+// VolumeBinding identifies the volume that a derived key is bound to, together
+// with the KID of the released key.
+type VolumeBinding struct {
+	MountPoint string `json:"mount_point"`
+	Index      int    `json:"index"`
+}
+
+// BindToVolume returns a copy of blob whose HKDF label is bound to the volume
+// of binding and to the released key kid. The label becomes
+// "<label>:<hex SHA256 of kid, mount point and index>", with the parts of the
+// hash separated by NUL bytes, so the key derived for another volume, or from
+// another released key, is different. Only HKDF has a label.
+func (blob KeyDerivationBlob) BindToVolume(kid string, binding VolumeBinding) (KeyDerivationBlob, error) {
+	if blob.Algorithm != "" && blob.Algorithm != KeyDerivationHKDF {
+		return KeyDerivationBlob{}, errors.Errorf("only %s keys can be bound to a volume, not %s", KeyDerivationHKDF, blob.Algorithm)
+	}
+
+	label := blob.Label
+	if label == "" {
+		label = DefaultKeyDerivationLabel
+	}
+	h := sha256.New()
+	h.Write([]byte(kid))
+	h.Write([]byte{0})
+	h.Write([]byte(binding.MountPoint))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.Itoa(binding.Index)))
+
+	blob.Label = label + ":" + hex.EncodeToString(h.Sum(nil))
+	return blob, nil
+}
+
+// DeriveKey derives a symmetric key from secret and salt using the algorithm
+// and parameters of the blob. SHA256 is used as hashing function for HKDF and
+// PBKDF2. The label is only used by HKDF.
+func (blob KeyDerivationBlob) DeriveKey(secret []byte, salt []byte) ([]byte, error) {
+	keyLength := blob.KeyLength
+	if keyLength == 0 {
+		keyLength = DefaultKeyDerivationKeyLength
+	}
+	if keyLength > MaxKeyDerivationKeyLength {
+		return nil, errors.Errorf("key length %d is larger than %d bytes", keyLength, MaxKeyDerivationKeyLength)
+	}
+	if blob.Algorithm == KeyDerivationPBKDF2 || blob.Algorithm == KeyDerivationArgon2id {
+		if len(salt) < MinKeyDerivationSaltLength {
+			return nil, errors.Errorf("salt of %s must be at least %d bytes, got %d", blob.Algorithm, MinKeyDerivationSaltLength, len(salt))
+		}
+	}
+
+	switch blob.Algorithm {
+	case "", KeyDerivationHKDF:
+		label := blob.Label
+		if label == "" {
+			label = DefaultKeyDerivationLabel
+		}
+		key := make([]byte, keyLength)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(label)), key); err != nil {
+			return nil, errors.Wrapf(err, "failed to derive key with HKDF")
+		}
+		return key, nil
+
+	case KeyDerivationPBKDF2:
+		iterations := blob.Iterations
+		if iterations == 0 {
+			iterations = DefaultPBKDF2Iterations
+		}
+		if iterations > MaxPBKDF2Iterations {
+			return nil, errors.Errorf("%d iterations of %s are more than %d", iterations, blob.Algorithm, MaxPBKDF2Iterations)
+		}
+		return pbkdf2.Key(secret, salt, int(iterations), int(keyLength), sha256.New), nil
+
+	case KeyDerivationArgon2id:
+		iterations := blob.Iterations
+		if iterations == 0 {
+			iterations = DefaultArgon2idIterations
+		}
+		if iterations > MaxArgon2idIterations {
+			return nil, errors.Errorf("%d iterations of %s are more than %d", iterations, blob.Algorithm, MaxArgon2idIterations)
+		}
+		memory := blob.Memory
+		if memory == 0 {
+			memory = DefaultArgon2idMemory
+		}
+		if memory > MaxArgon2idMemory {
+			return nil, errors.Errorf("memory %d KiB of %s is more than %d KiB", memory, blob.Algorithm, MaxArgon2idMemory)
+		}
+		parallelism := blob.Parallelism
+		if parallelism == 0 {
+			parallelism = DefaultArgon2idParallelism
+		}
+		return argon2.IDKey(secret, salt, iterations, memory, parallelism, keyLength), nil
+
+	default:
+		return nil, errors.Errorf("key derivation algorithm %s not supported", blob.Algorithm)
+	}
+}
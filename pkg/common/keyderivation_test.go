@@ -0,0 +1,103 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestDeriveKey(t *testing.T) {
+	secret := []byte("secret")
+	salt := []byte("saltsalt")
+
+	// HKDF is the default, with the default label
+	expected := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(DefaultKeyDerivationLabel)), expected)
+	assert.NoError(t, err)
+
+	key, err := KeyDerivationBlob{}.DeriveKey(secret, salt)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, key)
+
+	key, err = KeyDerivationBlob{Algorithm: KeyDerivationHKDF}.DeriveKey(secret, salt)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, key)
+
+	// PBKDF2 with the configured iterations and key length
+	key, err = KeyDerivationBlob{Algorithm: KeyDerivationPBKDF2, Iterations: 1000, KeyLength: 64}.DeriveKey(secret, salt)
+	assert.NoError(t, err)
+	assert.Equal(t, pbkdf2.Key(secret, salt, 1000, 64, sha256.New), key)
+
+	// Argon2id with the configured parameters
+	key, err = KeyDerivationBlob{Algorithm: KeyDerivationArgon2id, Iterations: 1, Memory: 1024, Parallelism: 1}.DeriveKey(secret, salt)
+	assert.NoError(t, err)
+	assert.Equal(t, argon2.IDKey(secret, salt, 1, 1024, 1, 32), key)
+
+	// Unknown algorithm
+	_, err = KeyDerivationBlob{Algorithm: "MD5"}.DeriveKey(secret, salt)
+	assert.Error(t, err)
+}
+
+func TestDeriveKeyBounds(t *testing.T) {
+	secret := []byte("secret")
+	salt := []byte("saltsalt")
+
+	for _, blob := range []KeyDerivationBlob{
+		{KeyLength: MaxKeyDerivationKeyLength + 1},
+		{Algorithm: KeyDerivationPBKDF2, KeyLength: 4294967295},
+		{Algorithm: KeyDerivationPBKDF2, Iterations: MaxPBKDF2Iterations + 1},
+		{Algorithm: KeyDerivationArgon2id, Iterations: MaxArgon2idIterations + 1},
+		{Algorithm: KeyDerivationArgon2id, Memory: 4294967295},
+	} {
+		_, err := blob.DeriveKey(secret, salt)
+		assert.Error(t, err, "%+v", blob)
+	}
+
+	// PBKDF2 and Argon2id need a salt of at least 8 bytes, HKDF doesn't
+	for _, algorithm := range []string{KeyDerivationPBKDF2, KeyDerivationArgon2id} {
+		_, err := KeyDerivationBlob{Algorithm: algorithm, Iterations: 1, Memory: 1024, Parallelism: 1}.DeriveKey(secret, []byte("salt"))
+		assert.Error(t, err, algorithm)
+	}
+	_, err := KeyDerivationBlob{Algorithm: KeyDerivationHKDF}.DeriveKey(secret, []byte("salt"))
+	assert.NoError(t, err)
+}
+
+func TestBindToVolume(t *testing.T) {
+	secret := []byte("secret")
+	salt := []byte("salt")
+	kid := "fs-key"
+
+	bound, err := KeyDerivationBlob{}.BindToVolume(kid, VolumeBinding{MountPoint: "/mnt/remote/share0", Index: 0})
+	assert.NoError(t, err)
+	h := sha256.Sum256([]byte("fs-key\x00/mnt/remote/share0\x000"))
+	assert.Equal(t, DefaultKeyDerivationLabel+":"+hex.EncodeToString(h[:]), bound.Label)
+	key, err := bound.DeriveKey(secret, salt)
+	assert.NoError(t, err)
+
+	// Distinct volumes, or keys, get distinct bindings and keys
+	for _, other := range []struct {
+		kid     string
+		binding VolumeBinding
+	}{
+		{kid, VolumeBinding{MountPoint: "/mnt/remote/share1", Index: 0}},
+		{kid, VolumeBinding{MountPoint: "/mnt/remote/share0", Index: 1}},
+		{"other-key", VolumeBinding{MountPoint: "/mnt/remote/share0", Index: 0}},
+	} {
+		otherBound, err := KeyDerivationBlob{}.BindToVolume(other.kid, other.binding)
+		assert.NoError(t, err)
+		assert.NotEqual(t, bound.Label, otherBound.Label)
+		otherKey, err := otherBound.DeriveKey(secret, salt)
+		assert.NoError(t, err)
+		assert.NotEqual(t, key, otherKey)
+	}
+
+	// Only HKDF has a label
+	_, err = KeyDerivationBlob{Algorithm: KeyDerivationPBKDF2}.BindToVolume(kid, VolumeBinding{MountPoint: "/mnt/remote/share0"})
+	assert.Error(t, err)
+}
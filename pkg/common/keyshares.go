@@ -0,0 +1,113 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Schemes used to combine key shares
+const (
+	// All the shares are needed, and the key is the XOR of all of them
+	KeyShareSchemeXOR = "xor"
+	// Shamir's secret sharing over GF(256). Any threshold shares are needed,
+	// and the x coordinate of each share is its index in the list plus one.
+	KeyShareSchemeShamir = "shamir"
+)
+
+// KeyShare is a share of a key released from a key vault. X is the x
+// coordinate of the share for Shamir's secret sharing.
+type KeyShare struct {
+	X     byte
+	Bytes []byte
+}
+
+// CombineKeyShares reconstructs a key from its shares. For KeyShareSchemeXOR
+// all the shares are needed, for KeyShareSchemeShamir at least threshold of
+// them. All shares need to have the same length.
+func CombineKeyShares(scheme string, threshold int, shares []KeyShare) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no key shares")
+	}
+	for _, share := range shares {
+		if len(share.Bytes) != len(shares[0].Bytes) {
+			return nil, errors.New("key shares have different lengths")
+		}
+	}
+
+	switch scheme {
+	case "", KeyShareSchemeXOR:
+		key := make([]byte, len(shares[0].Bytes))
+		for _, share := range shares {
+			for i := range key {
+				key[i] ^= share.Bytes[i]
+			}
+		}
+		return key, nil
+
+	case KeyShareSchemeShamir:
+		if threshold < 2 {
+			return nil, errors.Errorf("invalid threshold %d for shamir key shares", threshold)
+		}
+		if len(shares) < threshold {
+			return nil, errors.Errorf("%d key shares available, %d required", len(shares), threshold)
+		}
+		shares = shares[:threshold]
+		for i := range shares {
+			if shares[i].X == 0 {
+				return nil, errors.New("invalid x coordinate 0 for shamir key share")
+			}
+			for j := 0; j < i; j++ {
+				if shares[i].X == shares[j].X {
+					return nil, errors.Errorf("duplicate x coordinate %d for shamir key shares", shares[i].X)
+				}
+			}
+		}
+
+		// Lagrange interpolation at x = 0
+		key := make([]byte, len(shares[0].Bytes))
+		for i, share := range shares {
+			basis := byte(1)
+			for j, other := range shares {
+				if i != j {
+					basis = gf256Mul(basis, gf256Div(other.X, other.X^share.X))
+				}
+			}
+			for k := range key {
+				key[k] ^= gf256Mul(share.Bytes[k], basis)
+			}
+		}
+		return key, nil
+
+	default:
+		return nil, errors.Errorf("key share scheme %s not supported", scheme)
+	}
+}
+
+// gf256Mul multiplies in GF(2^8) with the AES polynomial x^8 + x^4 + x^3 + x + 1
+func gf256Mul(a byte, b byte) byte {
+	var p byte
+	for b != 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+
+// gf256Div divides in GF(2^8). b must not be zero.
+func gf256Div(a byte, b byte) byte {
+	// b^254 is the inverse of b
+	inv := byte(1)
+	for i := 0; i < 254; i++ {
+		inv = gf256Mul(inv, b)
+	}
+	return gf256Mul(a, inv)
+}
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// splitKeyShamir splits key in n shares, any threshold of which can
+// reconstruct it.
+func splitKeyShamir(t *testing.T, key []byte, n int, threshold int) []KeyShare {
+	coefficients := make([][]byte, len(key))
+	for i := range coefficients {
+		coefficients[i] = make([]byte, threshold)
+		coefficients[i][0] = key[i]
+		_, err := rand.Read(coefficients[i][1:])
+		assert.NoError(t, err)
+	}
+
+	shares := make([]KeyShare, n)
+	for s := range shares {
+		x := byte(s + 1)
+		shares[s] = KeyShare{X: x, Bytes: make([]byte, len(key))}
+		for i := range key {
+			// Horner's method
+			var y byte
+			for c := threshold - 1; c >= 0; c-- {
+				y = gf256Mul(y, x) ^ coefficients[i][c]
+			}
+			shares[s].Bytes[i] = y
+		}
+	}
+	return shares
+}
+
+func TestCombineKeyShares(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	assert.NoError(t, err)
+
+	// XOR of all the shares
+	share := make([]byte, 32)
+	_, err = rand.Read(share)
+	assert.NoError(t, err)
+	other := make([]byte, 32)
+	for i := range other {
+		other[i] = key[i] ^ share[i]
+	}
+	combined, err := CombineKeyShares(KeyShareSchemeXOR, 0, []KeyShare{{Bytes: share}, {Bytes: other}})
+	assert.NoError(t, err)
+	assert.Equal(t, key, combined)
+
+	// Any 3 of 5 shamir shares
+	shares := splitKeyShamir(t, key, 5, 3)
+	combined, err = CombineKeyShares(KeyShareSchemeShamir, 3, []KeyShare{shares[4], shares[1], shares[2]})
+	assert.NoError(t, err)
+	assert.Equal(t, key, combined)
+
+	combined, err = CombineKeyShares(KeyShareSchemeShamir, 3, shares)
+	assert.NoError(t, err)
+	assert.Equal(t, key, combined)
+
+	// Not enough shares
+	_, err = CombineKeyShares(KeyShareSchemeShamir, 3, shares[:2])
+	assert.Error(t, err)
+
+	// Invalid threshold
+	_, err = CombineKeyShares(KeyShareSchemeShamir, 1, shares)
+	assert.Error(t, err)
+
+	// Duplicate shares
+	_, err = CombineKeyShares(KeyShareSchemeShamir, 3, []KeyShare{shares[0], shares[0], shares[1]})
+	assert.Error(t, err)
+
+	// Unknown scheme
+	_, err = CombineKeyShares("unknown", 0, shares)
+	assert.Error(t, err)
+}
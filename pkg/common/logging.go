@@ -0,0 +1,65 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Formats of the logs of the tools
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Names of the fields of structured logs, shared by all the tools so that log
+// pipelines can rely on them
+const (
+	LogFieldFilesystemIndex = "filesystem_index"
+	LogFieldAzureURL        = "azure_url"
+	LogFieldMountPoint      = "mount_point"
+	LogFieldDurationMs      = "duration_ms"
+	LogFieldKID             = "kid"
+	LogFieldAKVEndpoint     = "akv_endpoint"
+	LogFieldPID             = "pid"
+	LogFieldLogFile         = "log_file"
+)
+
+// Placeholder of the secrets in JSON logs
+const logRedacted = "<redacted>"
+
+var logFormat = LogFormatText
+
+// SetLogFormat sets the formatter of logrus. Text logs (the default) are meant
+// to be read by people. JSON logs are meant to be parsed: every line is an
+// object with a timestamp and the fields of the entry, and secrets logged with
+// LogSecret are redacted, as the logs are usually shipped elsewhere.
+func SetLogFormat(format string) error {
+	switch format {
+	case "", LogFormatText:
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: false, DisableQuote: true, DisableTimestamp: true})
+		format = LogFormatText
+	case LogFormatJSON:
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return errors.Errorf("unknown log format: %s", format)
+	}
+	logFormat = format
+	return nil
+}
+
+// LogFormat returns the format set with SetLogFormat.
+func LogFormat() string {
+	return logFormat
+}
+
+// LogSecret returns value to be logged, or a placeholder if the logs are in
+// JSON.
+func LogSecret(value interface{}) interface{} {
+	if logFormat == LogFormatJSON {
+		return logRedacted
+	}
+	return value
+}
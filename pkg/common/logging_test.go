@@ -0,0 +1,42 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetLogFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	defer func() {
+		logrus.SetOutput(os.Stderr)
+		assert.NoError(t, SetLogFormat(LogFormatText))
+	}()
+
+	// JSON logs are one object per line with stable fields and no secrets
+	assert.NoError(t, SetLogFormat(LogFormatJSON))
+	assert.Equal(t, LogFormatJSON, LogFormat())
+	logrus.WithFields(logrus.Fields{LogFieldFilesystemIndex: 1, LogFieldDurationMs: 1500}).Infof("Mounted with key %v", LogSecret([]byte("secret")))
+	var entry map[string]interface{}
+	if assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry)) {
+		assert.Equal(t, float64(1), entry[LogFieldFilesystemIndex])
+		assert.Equal(t, float64(1500), entry[LogFieldDurationMs])
+		assert.Equal(t, "Mounted with key <redacted>", entry["msg"])
+	}
+
+	// Text logs keep the values for debugging
+	assert.NoError(t, SetLogFormat(""))
+	assert.Equal(t, LogFormatText, LogFormat())
+	assert.Equal(t, "value", LogSecret("value"))
+
+	assert.Error(t, SetLogFormat("xml"))
+	assert.Equal(t, LogFormatText, LogFormat())
+}
@@ -196,6 +196,6 @@ func (maa MAA) Attest(SNPReportHexBytes []byte, vcekCertChain []byte, policyBlob
 		return "", errors.New("empty token string in maa response")
 	}
 
-	logrus.Debugf("MAA Token: %s", maaResponse.Token)
+	logrus.Debugf("MAA Token: %s", LogSecret(maaResponse.Token))
 	return maaResponse.Token, nil
 }
@@ -0,0 +1,76 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PolicySource provides the base64-encoded security policy that is sent with
+// the attestation reports of the secure key releases.
+type PolicySource interface {
+	EncodedSecurityPolicy(ctx context.Context) (string, error)
+}
+
+// UvmPolicySource reads the security policy from the security context
+// directory or the environment, like GetUvmInformation.
+type UvmPolicySource struct{}
+
+func (UvmPolicySource) EncodedSecurityPolicy(ctx context.Context) (string, error) {
+	info, err := GetUvmInformation()
+	if err != nil {
+		return "", err
+	}
+	return info.EncodedSecurityPolicy, nil
+}
+
+// HTTPPolicySource fetches the security policy from a provisioning service,
+// for deployments that deliver it after the container group has started. The
+// response body is the base64-encoded policy.
+type HTTPPolicySource struct {
+	// URL that returns the policy
+	URL string `json:"url"`
+	// Resource of the managed identity token sent as a bearer token. No token
+	// is sent if it is empty.
+	TokenResource string `json:"token_resource,omitempty"`
+	// Identity used to request the token
+	Identity Identity `json:"-"`
+}
+
+func (s HTTPPolicySource) EncodedSecurityPolicy(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "security policy request creation failed")
+	}
+	if s.TokenResource != "" {
+		token, err := GetToken(s.TokenResource, s.Identity)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to get token for the security policy source")
+		}
+		req.Header.Add("Authorization", "Bearer "+token.AccessToken)
+	}
+
+	resp, err := HTTPClient().Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to fetch security policy from %s", s.URL)
+	}
+	body, err := HTTPResponseBody(resp)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to fetch security policy from %s", s.URL)
+	}
+
+	policy := strings.TrimSpace(string(body))
+	if policy == "" {
+		return "", errors.Errorf("security policy from %s is empty", s.URL)
+	}
+	if _, err := base64.StdEncoding.DecodeString(policy); err != nil {
+		return "", errors.Wrapf(err, "security policy from %s isn't base64-encoded", s.URL)
+	}
+	return policy, nil
+}
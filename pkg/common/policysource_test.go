@@ -0,0 +1,51 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPPolicySource(t *testing.T) {
+	policy := "cGFja2FnZSBwb2xpY3k="
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			assert.Equal(t, "api://provisioning", r.URL.Query().Get("resource"))
+			w.Write([]byte(`{"access_token":"token"}`))
+		case "/policy":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(policy + "\n"))
+		case "/invalid":
+			w.Write([]byte("not base64!"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	identity := Identity{TokenEndpoint: server.URL + "/token"}
+
+	source := HTTPPolicySource{URL: server.URL + "/policy", TokenResource: "api://provisioning", Identity: identity}
+	encoded, err := source.EncodedSecurityPolicy(context.Background())
+	if assert.NoError(t, err) {
+		assert.Equal(t, policy, encoded)
+	}
+
+	// Without a token the service denies the request
+	_, err = HTTPPolicySource{URL: server.URL + "/policy"}.EncodedSecurityPolicy(context.Background())
+	assert.Error(t, err)
+
+	_, err = HTTPPolicySource{URL: server.URL + "/invalid"}.EncodedSecurityPolicy(context.Background())
+	assert.Error(t, err)
+	_, err = HTTPPolicySource{URL: server.URL + "/missing"}.EncodedSecurityPolicy(context.Background())
+	assert.Error(t, err)
+}
@@ -0,0 +1,80 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ConnectionPolicy tunes the pool of idle connections of the HTTP client, so
+// that the connections to storage, AKV and MAA are reused across the mounts
+// of many filesystems instead of being opened again.
+type ConnectionPolicy struct {
+	// Maximum number of idle connections to all hosts
+	MaxIdleConns int `json:"max_idle_conns,omitempty"`
+	// Maximum number of idle connections to each host
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host,omitempty"`
+	// Seconds after which an idle connection is closed
+	IdleConnTimeoutSeconds int `json:"idle_conn_timeout_seconds,omitempty"`
+}
+
+// Defaults of ConnectionPolicy. Go keeps only 2 idle connections per host,
+// which is too few for the parallel block downloads of azmount and the key
+// releases of many filesystems.
+const (
+	DefaultMaxIdleConns        = 100
+	DefaultMaxIdleConnsPerHost = 32
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+var httpConnectionPolicy = ConnectionPolicy{}
+
+// validate checks that the values of the policy aren't negative. Zero values
+// select the defaults.
+func (p ConnectionPolicy) validate() error {
+	if p.MaxIdleConns < 0 || p.MaxIdleConnsPerHost < 0 || p.IdleConnTimeoutSeconds < 0 {
+		return errors.Errorf("invalid connection policy, negative values aren't allowed: %+v", p)
+	}
+	if p.MaxIdleConns > 0 && p.MaxIdleConnsPerHost > p.MaxIdleConns {
+		return errors.Errorf("max_idle_conns_per_host %d is greater than max_idle_conns %d", p.MaxIdleConnsPerHost, p.MaxIdleConns)
+	}
+	return nil
+}
+
+// apply sets the pool limits of the policy on transport, with the defaults
+// for the values that aren't set.
+func (p ConnectionPolicy) apply(transport *http.Transport) {
+	transport.MaxIdleConns = DefaultMaxIdleConns
+	if p.MaxIdleConns > 0 {
+		transport.MaxIdleConns = p.MaxIdleConns
+	}
+	transport.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	if p.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = p.MaxIdleConnsPerHost
+	}
+	if transport.MaxIdleConnsPerHost > transport.MaxIdleConns {
+		transport.MaxIdleConnsPerHost = transport.MaxIdleConns
+	}
+	transport.IdleConnTimeout = DefaultIdleConnTimeout
+	if p.IdleConnTimeoutSeconds > 0 {
+		transport.IdleConnTimeout = time.Duration(p.IdleConnTimeoutSeconds) * time.Second
+	}
+}
+
+// SetConnectionPolicy applies policy to the client returned by HTTPClient.
+// Until it is called, the defaults of ConnectionPolicy are used.
+func SetConnectionPolicy(policy ConnectionPolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+
+	httpClientMutex.Lock()
+	defer httpClientMutex.Unlock()
+	httpConnectionPolicy = policy
+	httpClient = newHTTPClient(httpTLSConfig, httpDialContext)
+	return nil
+}
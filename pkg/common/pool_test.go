@@ -0,0 +1,39 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionPolicy(t *testing.T) {
+	transport := HTTPClient().Transport.(*http.Transport)
+	assert.Equal(t, DefaultMaxIdleConns, transport.MaxIdleConns)
+	assert.Equal(t, DefaultMaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, DefaultIdleConnTimeout, transport.IdleConnTimeout)
+
+	assert.Error(t, SetConnectionPolicy(ConnectionPolicy{MaxIdleConns: -1}))
+	assert.Error(t, SetConnectionPolicy(ConnectionPolicy{MaxIdleConns: 8, MaxIdleConnsPerHost: 16}))
+
+	assert.NoError(t, SetConnectionPolicy(ConnectionPolicy{MaxIdleConns: 200, MaxIdleConnsPerHost: 64, IdleConnTimeoutSeconds: 30}))
+	defer func() { assert.NoError(t, SetConnectionPolicy(ConnectionPolicy{})) }()
+	transport = HTTPClient().Transport.(*http.Transport)
+	assert.Equal(t, 200, transport.MaxIdleConns)
+	assert.Equal(t, 64, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 30*time.Second, transport.IdleConnTimeout)
+
+	// The TLS policy keeps the connection policy
+	assert.NoError(t, SetTLSPolicy(TLSPolicy{}))
+	transport = HTTPClient().Transport.(*http.Transport)
+	assert.Equal(t, 64, transport.MaxIdleConnsPerHost)
+
+	// The per-host default is capped by a smaller total
+	assert.NoError(t, SetConnectionPolicy(ConnectionPolicy{MaxIdleConns: 10}))
+	transport = HTTPClient().Transport.(*http.Transport)
+	assert.Equal(t, 10, transport.MaxIdleConnsPerHost)
+}
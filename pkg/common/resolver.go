@@ -0,0 +1,114 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ResolverPolicy directs the outbound connections to hosts that the resolver
+// of the UVM can't resolve, like internal names of air-gapped networks. TLS
+// certificates are still verified against the original host names.
+type ResolverPolicy struct {
+	// Address of the DNS server used instead of the one in resolv.conf, like
+	// "10.0.0.10" or "10.0.0.10:53"
+	Nameserver string `json:"nameserver,omitempty"`
+	// Static map of host names to IP addresses, checked before DNS
+	Hosts map[string]string `json:"hosts,omitempty"`
+}
+
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// parse returns the static hosts of the policy, with lower case names, and the
+// resolver that queries its nameserver, or nil if it doesn't set one.
+func (p ResolverPolicy) parse() (map[string]string, *net.Resolver, error) {
+	hosts := make(map[string]string, len(p.Hosts))
+	for host, ip := range p.Hosts {
+		if net.ParseIP(ip) == nil {
+			return nil, nil, errors.Errorf("invalid IP address of host %s: %s", host, ip)
+		}
+		hosts[strings.ToLower(host)] = ip
+	}
+
+	if p.Nameserver == "" {
+		return hosts, nil, nil
+	}
+	nameserver := p.Nameserver
+	if _, _, err := net.SplitHostPort(nameserver); err != nil {
+		nameserver = net.JoinHostPort(nameserver, "53")
+	}
+	host, _, _ := net.SplitHostPort(nameserver)
+	if net.ParseIP(host) == nil {
+		return nil, nil, errors.Errorf("invalid nameserver: %s", p.Nameserver)
+	}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, nameserver)
+		},
+	}
+	return hosts, resolver, nil
+}
+
+// DialContext returns the dial function that enforces the policy, or nil if
+// the policy is empty.
+func (p ResolverPolicy) DialContext() (dialContextFunc, error) {
+	if p.Nameserver == "" && len(p.Hosts) == 0 {
+		return nil, nil
+	}
+	hosts, resolver, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	// Same timeouts as http.DefaultTransport
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Resolver: resolver}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			if ip, ok := hosts[strings.ToLower(host)]; ok {
+				addr = net.JoinHostPort(ip, port)
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}, nil
+}
+
+// LookupHost resolves host with the policy, for the connections that aren't
+// made by this process, like the ones of the kernel NFS client. The static
+// hosts are checked first, then the nameserver of the policy or, if it
+// doesn't set one, the resolver of the system is queried.
+func (p ResolverPolicy) LookupHost(ctx context.Context, host string) ([]string, error) {
+	hosts, resolver, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if ip, ok := hosts[strings.ToLower(host)]; ok {
+		return []string{ip}, nil
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return resolver.LookupHost(ctx, host)
+}
+
+// SetResolverPolicy applies policy to the client returned by HTTPClient. Until
+// it is called, the resolver of the system is used.
+func SetResolverPolicy(policy ResolverPolicy) error {
+	dialContext, err := policy.DialContext()
+	if err != nil {
+		return err
+	}
+
+	httpClientMutex.Lock()
+	defer httpClientMutex.Unlock()
+	httpDialContext = dialContext
+	httpClient = newHTTPClient(httpTLSConfig, httpDialContext)
+	return nil
+}
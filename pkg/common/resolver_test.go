@@ -0,0 +1,64 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolverPolicy(t *testing.T) {
+	dialContext, err := ResolverPolicy{}.DialContext()
+	assert.NoError(t, err)
+	assert.Nil(t, dialContext)
+
+	_, err = ResolverPolicy{Hosts: map[string]string{"storage.internal": "not-an-ip"}}.DialContext()
+	assert.Error(t, err)
+	_, err = ResolverPolicy{Nameserver: "dns.internal"}.DialContext()
+	assert.Error(t, err)
+	_, err = ResolverPolicy{Nameserver: "10.0.0.10"}.DialContext()
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	assert.NoError(t, SetResolverPolicy(ResolverPolicy{Hosts: map[string]string{"Storage.Internal": "127.0.0.1"}}))
+	defer func() { assert.NoError(t, SetResolverPolicy(ResolverPolicy{})) }()
+
+	resp, err := HTTPClient().Get("http://storage.internal:" + port + "/")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// The TLS policy keeps the resolver policy
+	assert.NoError(t, SetTLSPolicy(TLSPolicy{}))
+	resp, err = HTTPClient().Get("http://storage.internal:" + port + "/")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+	}
+}
+
+func TestResolverPolicyLookupHost(t *testing.T) {
+	policy := ResolverPolicy{Hosts: map[string]string{"Account.File.Core.Windows.Net": "10.1.2.3"}}
+	addrs, err := policy.LookupHost(context.Background(), "account.file.core.windows.net")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"10.1.2.3"}, addrs)
+	}
+
+	// Without a nameserver, other hosts are resolved by the system
+	addrs, err = policy.LookupHost(context.Background(), "127.0.0.1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"127.0.0.1"}, addrs)
+	}
+
+	_, err = ResolverPolicy{Nameserver: "dns.internal"}.LookupHost(context.Background(), "account.file.core.windows.net")
+	assert.Error(t, err)
+}
@@ -0,0 +1,46 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"net/http"
+	"sync"
+)
+
+// RetryableFunc returns whether a request that failed with err, or got the
+// unsuccessful response res, is worth retrying. Only one of them is set.
+type RetryableFunc func(err error, res *http.Response) bool
+
+// DefaultRetryable retries transport errors and the responses that usually
+// mean a transient problem: 408, 429 and 5xx.
+func DefaultRetryable(err error, res *http.Response) bool {
+	if err != nil {
+		return true
+	}
+	return res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+}
+
+var (
+	retryableLock sync.RWMutex
+	retryable     RetryableFunc = DefaultRetryable
+)
+
+// SetRetryable replaces the classifier used by the retry loops of the
+// package and the packages that use it, like the certificate fetcher. A nil
+// retryableFunc restores DefaultRetryable.
+func SetRetryable(retryableFunc RetryableFunc) {
+	if retryableFunc == nil {
+		retryableFunc = DefaultRetryable
+	}
+	retryableLock.Lock()
+	defer retryableLock.Unlock()
+	retryable = retryableFunc
+}
+
+// Retryable classifies err or res with the classifier set by SetRetryable.
+func Retryable(err error, res *http.Response) bool {
+	retryableLock.RLock()
+	defer retryableLock.RUnlock()
+	return retryable(err, res)
+}
@@ -0,0 +1,45 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func Test_Retryable(t *testing.T) {
+	defer SetRetryable(nil)
+
+	for _, tc := range []struct {
+		status    int
+		retryable bool
+	}{
+		{http.StatusRequestTimeout, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusBadGateway, true},
+		{http.StatusNotFound, false},
+	} {
+		if retryable := Retryable(nil, &http.Response{StatusCode: tc.status}); retryable != tc.retryable {
+			t.Errorf("status %d: expected retryable to be %t", tc.status, tc.retryable)
+		}
+	}
+	if !Retryable(errors.New("connection reset"), nil) {
+		t.Errorf("expected transport errors to be retryable")
+	}
+
+	// Proxies that return 502 for permanent errors
+	SetRetryable(func(err error, res *http.Response) bool {
+		return res == nil || (res.StatusCode != http.StatusBadGateway && DefaultRetryable(err, res))
+	})
+	if Retryable(nil, &http.Response{StatusCode: http.StatusBadGateway}) {
+		t.Errorf("expected the classifier to be replaced")
+	}
+
+	SetRetryable(nil)
+	if !Retryable(nil, &http.Response{StatusCode: http.StatusBadGateway}) {
+		t.Errorf("expected the default classifier to be restored")
+	}
+}
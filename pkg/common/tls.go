@@ -0,0 +1,112 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// TLSPolicy constrains the TLS configuration of all outbound connections.
+// Connections to servers that can't negotiate it fail.
+type TLSPolicy struct {
+	// Minimum TLS version: "1.2" (the default) or "1.3"
+	MinVersion string `json:"min_version,omitempty"`
+	// Names of the allowed cipher suites for TLS 1.2, for example
+	// "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384". The cipher suites of TLS 1.3
+	// can't be restricted. By default the secure cipher suites of Go are used.
+	CipherSuites []string `json:"cipher_suites,omitempty"`
+	// Names of the allowed key exchange curves in order of preference:
+	// "X25519", "P256", "P384" and "P521". By default all of them are allowed.
+	CurvePreferences []string `json:"curve_preferences,omitempty"`
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+var (
+	httpClientMutex sync.Mutex
+	httpTLSConfig   = &tls.Config{MinVersion: tls.VersionTLS12}
+	httpDialContext dialContextFunc
+	httpClient      = newHTTPClient(httpTLSConfig, nil)
+)
+
+// TLSConfig returns the TLS configuration that enforces the policy.
+func (p TLSPolicy) TLSConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+
+	switch p.MinVersion {
+	case "", "1.2":
+		config.MinVersion = tls.VersionTLS12
+	case "1.3":
+		config.MinVersion = tls.VersionTLS13
+	default:
+		return nil, errors.Errorf("unsupported minimum TLS version: %s", p.MinVersion)
+	}
+
+	if len(p.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range p.CipherSuites {
+			id, ok := suites[strings.TrimSpace(name)]
+			if !ok {
+				return nil, errors.Errorf("unsupported or insecure cipher suite: %s", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+
+	for _, name := range p.CurvePreferences {
+		curve, ok := tlsCurves[strings.TrimSpace(name)]
+		if !ok {
+			return nil, errors.Errorf("unsupported curve: %s", name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+
+	return config, nil
+}
+
+// SetTLSPolicy applies policy to the client returned by HTTPClient. Until it
+// is called, TLS 1.2 or newer is required.
+func SetTLSPolicy(policy TLSPolicy) error {
+	config, err := policy.TLSConfig()
+	if err != nil {
+		return err
+	}
+
+	httpClientMutex.Lock()
+	defer httpClientMutex.Unlock()
+	httpTLSConfig = config
+	httpClient = newHTTPClient(httpTLSConfig, httpDialContext)
+	return nil
+}
+
+func newHTTPClient(config *tls.Config, dialContext dialContextFunc) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	if dialContext != nil {
+		transport.DialContext = dialContext
+	}
+	httpConnectionPolicy.apply(transport)
+	return &http.Client{Transport: transport}
+}
+
+// HTTPClient returns the HTTP client that enforces the TLS, resolver and
+// connection policies. All the outbound HTTP connections must use it.
+func HTTPClient() *http.Client {
+	httpClientMutex.Lock()
+	defer httpClientMutex.Unlock()
+	return httpClient
+}
@@ -0,0 +1,45 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSPolicy(t *testing.T) {
+	config, err := TLSPolicy{}.TLSConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+	assert.Empty(t, config.CipherSuites)
+
+	config, err = TLSPolicy{
+		MinVersion:       "1.3",
+		CipherSuites:     []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+		CurvePreferences: []string{"P384", "X25519"},
+	}.TLSConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), config.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, config.CipherSuites)
+	assert.Equal(t, []tls.CurveID{tls.CurveP384, tls.X25519}, config.CurvePreferences)
+
+	_, err = TLSPolicy{MinVersion: "1.0"}.TLSConfig()
+	assert.Error(t, err)
+
+	// Insecure cipher suites are rejected
+	_, err = TLSPolicy{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}.TLSConfig()
+	assert.Error(t, err)
+
+	_, err = TLSPolicy{CurvePreferences: []string{"P224"}}.TLSConfig()
+	assert.Error(t, err)
+
+	assert.Error(t, SetTLSPolicy(TLSPolicy{MinVersion: "1.1"}))
+	assert.NoError(t, SetTLSPolicy(TLSPolicy{MinVersion: "1.3"}))
+	transport := HTTPClient().Transport.(*http.Transport)
+	assert.Equal(t, uint16(tls.VersionTLS13), transport.TLSClientConfig.MinVersion)
+	assert.NoError(t, SetTLSPolicy(TLSPolicy{}))
+}
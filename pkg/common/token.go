@@ -5,12 +5,27 @@ package common
 
 import (
 	"encoding/json"
+	"strings"
 
 	"github.com/pkg/errors"
 )
 
 type Identity struct {
 	ClientId string `json:"client_id"`
+	// TokenAudience overrides the audience of the tokens requested to access
+	// Azure Storage, which is otherwise derived from the host of the blob url.
+	// It is needed when the host isn't the storage resource, e.g. with custom
+	// domains or private endpoints.
+	TokenAudience string `json:"token_audience,omitempty"`
+	// RegistryTokenAudience overrides the audience of the tokens requested to
+	// access Azure Container Registry, ContainerRegistryTokenAudience by
+	// default. The storage audience is never used for registries.
+	RegistryTokenAudience string `json:"registry_token_audience,omitempty"`
+	// TokenEndpoint overrides the URL of the managed identity endpoint that
+	// issues the tokens, which is the IMDS endpoint of ACI by default. It is
+	// needed when the token provider runs at another address. If it has no
+	// query, the api-version of IMDS is added.
+	TokenEndpoint string `json:"token_endpoint,omitempty"`
 }
 
 type TokenResponse struct {
@@ -25,8 +40,49 @@ type TokenResponse struct {
 
 const (
 	TokenURITemplate = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01"
+	TokenAPIVersion  = "2018-02-01"
 )
 
+// Audiences of the tokens requested for each service in the public cloud. A
+// token is only requested for the service that it is sent to, so that a token
+// leaked by one service can't be used with the others. MAA and THIM don't
+// need a token.
+const (
+	KeyVaultTokenAudience          = "https://vault.azure.net"
+	ManagedHSMTokenAudience        = "https://managedhsm.azure.net"
+	ContainerRegistryTokenAudience = "https://containerregistry.azure.net"
+)
+
+// StorageAudience returns the audience of the tokens of i used to access the
+// blobs of host: the storage account itself unless TokenAudience is set.
+func (i Identity) StorageAudience(host string) string {
+	if i.TokenAudience != "" {
+		return i.TokenAudience
+	}
+	return "https://" + host
+}
+
+// RegistryAudience returns the audience of the tokens of i used to access
+// Azure Container Registry.
+func (i Identity) RegistryAudience() string {
+	if i.RegistryTokenAudience != "" {
+		return i.RegistryTokenAudience
+	}
+	return ContainerRegistryTokenAudience
+}
+
+// TokenURI returns the URL of the endpoint that issues the tokens of i, to
+// which the resource and client_id parameters are appended.
+func (i Identity) TokenURI() string {
+	if i.TokenEndpoint == "" {
+		return TokenURITemplate
+	}
+	if strings.Contains(i.TokenEndpoint, "?") {
+		return i.TokenEndpoint
+	}
+	return i.TokenEndpoint + "?api-version=" + TokenAPIVersion
+}
+
 // GetToken retrieves an authentication token which will be used for authorizing
 // requests sent to Azure services requiring authorization (e.g., Azure Blob, AKV)
 func GetToken(ResourceId string, i Identity) (r TokenResponse, err error) {
@@ -40,7 +96,7 @@ func GetToken(ResourceId string, i Identity) (r TokenResponse, err error) {
 		client_id_param = "&client_id=" + i.ClientId
 	}
 
-	uri := TokenURITemplate + resource_param + client_id_param
+	uri := i.TokenURI() + resource_param + client_id_param
 	httpResponse, err := HTTPGetRequest(uri, true)
 
 	if err != nil {
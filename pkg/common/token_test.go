@@ -0,0 +1,52 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenURI(t *testing.T) {
+	assert.Equal(t, TokenURITemplate, Identity{}.TokenURI())
+	assert.Equal(t, "http://localhost:8081/token?api-version=2018-02-01",
+		Identity{TokenEndpoint: "http://localhost:8081/token"}.TokenURI())
+	assert.Equal(t, "http://localhost:8081/token?api-version=2019-08-01",
+		Identity{TokenEndpoint: "http://localhost:8081/token?api-version=2019-08-01"}.TokenURI())
+}
+
+func TestGetTokenEndpoint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/token", r.URL.Path)
+		assert.Equal(t, "true", r.Header.Get("Metadata"))
+		assert.Equal(t, TokenAPIVersion, r.URL.Query().Get("api-version"))
+		assert.Equal(t, "https://vault.azure.net", r.URL.Query().Get("resource"))
+		assert.Equal(t, "client", r.URL.Query().Get("client_id"))
+		w.Write([]byte(`{"access_token":"token","expires_in":"3600"}`))
+	}))
+	defer server.Close()
+
+	token, err := GetToken("https://vault.azure.net", Identity{ClientId: "client", TokenEndpoint: server.URL + "/token"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "token", token.AccessToken)
+		assert.Equal(t, "3600", token.ExpiresIn)
+	}
+}
+
+func TestIdentityAudiences(t *testing.T) {
+	assert.Equal(t, "https://account.blob.core.windows.net", Identity{}.StorageAudience("account.blob.core.windows.net"))
+	assert.Equal(t, ContainerRegistryTokenAudience, Identity{}.RegistryAudience())
+
+	// The storage audience only applies to storage
+	i := Identity{TokenAudience: "https://storage.azure.com"}
+	assert.Equal(t, "https://storage.azure.com", i.StorageAudience("account.blob.core.windows.net"))
+	assert.Equal(t, ContainerRegistryTokenAudience, i.RegistryAudience())
+
+	i = Identity{RegistryTokenAudience: "https://containerregistry.azure.cn"}
+	assert.Equal(t, "https://containerregistry.azure.cn", i.RegistryAudience())
+	assert.Equal(t, "https://account.blob.core.windows.net", i.StorageAudience("account.blob.core.windows.net"))
+}
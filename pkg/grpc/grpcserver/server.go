@@ -46,6 +46,14 @@ type AzureInformation struct {
 	// useful only when the container group has been assigned
 	// more than one managed identity.
 	Identity common.Identity `json:"identity,omitempty"`
+	// TLS policy of all outbound connections. This is optional, by default
+	// TLS 1.2 or newer is required.
+	TLSPolicy common.TLSPolicy `json:"tls_policy,omitempty"`
+	// When the THIM certificates of the UVM information are replaced by the
+	// ones fetched from THIM: "use-provided", "fetch-if-absent" or
+	// "always-fetch". This is optional, by default they are fetched only if
+	// they are absent.
+	ThimCertPolicy string `json:"thim_cert_policy,omitempty"`
 }
 
 const (
@@ -264,7 +272,7 @@ func (s *Server) UnWrapKey(c context.Context, grpcInput *keyprovider.KeyProvider
 	// MHSM has limit on the request size. We do not pass the EncodedSecurityPolicy here so
 	// it is not presented as fine-grained init-time claims in the MAA token, which would
 	// introduce larger MAA tokens that MHSM would accept
-	keyBytes, err := skr.SecureKeyRelease((*(s.Azure_info)).Identity, *(s.ServerCertState), skrKeyBlob, *(s.EncodedUvmInformation))
+	keyBytes, err := skr.SecureKeyRelease(c, (*(s.Azure_info)).Identity, *(s.ServerCertState), skrKeyBlob, *(s.EncodedUvmInformation))
 	if err != nil {
 		return nil, errors.Wrapf(err, "SKR failed")
 	}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
 )
 
 const (
@@ -36,7 +37,7 @@ func GetAccessTokenFromFederatedToken(ctx context.Context, encodedResourceUrl st
 		return string(token), err
 	})
 
-	confidentialClient, err := confidential.New(fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/token", tenantID), clientID, cred)
+	confidentialClient, err := confidential.New(fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/token", tenantID), clientID, cred, confidential.WithHTTPClient(common.HTTPClient()))
 	if err != nil {
 		return "", fmt.Errorf("failed to create confidential client: %v", err)
 	}
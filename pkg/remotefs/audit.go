@@ -0,0 +1,113 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"encoding/json"
+	"log/syslog"
+	"net/url"
+	"strconv"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Audit events
+const (
+	AuditKeyReleased        = "key_released"
+	AuditFilesystemMounted  = "filesystem_mounted"
+	AuditFilesystemResumed  = "filesystem_resumed"
+	AuditFilesystemFailed   = "filesystem_failed"
+	AuditFilesystemTornDown = "filesystem_torn_down"
+)
+
+// Address of the syslog daemon of the host
+const auditSyslogLocalAddress = "local"
+
+// AuditEvent is a security-relevant action of the tool, recorded in the audit
+// trail of the host. It only has identifiers that aren't secret.
+type AuditEvent struct {
+	Event string `json:"event"`
+	Index int    `json:"index"`
+	// Keys released, as <AKV endpoint>/keys/<KID>, and TCBM of the
+	// attestation that released them
+	Keys []string `json:"keys,omitempty"`
+	Tcbm string   `json:"tcbm,omitempty"`
+	// Mount
+	MountPoint string `json:"mount_point,omitempty"`
+	Source     string `json:"source,omitempty"`
+	// Failure, as in the status file
+	ErrorCode string `json:"error_code,omitempty"`
+}
+
+// auditWriter is implemented by *syslog.Writer.
+type auditWriter interface {
+	Notice(m string) error
+	Warning(m string) error
+}
+
+// Destination of the audit events. No events are emitted if it is nil.
+var auditLog auditWriter
+
+// SetAuditSyslog sends the audit events to the syslog daemon at address, as
+// "udp://host:port" or "tcp://host:port", or to the local one, which is
+// usually journald, if address is "local".
+func SetAuditSyslog(address string, tag string) error {
+	priority := syslog.LOG_AUTHPRIV | syslog.LOG_NOTICE
+	var writer *syslog.Writer
+	var err error
+	if address == auditSyslogLocalAddress {
+		writer, err = syslog.New(priority, tag)
+	} else {
+		u, parseErr := url.Parse(address)
+		if parseErr != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return errors.Errorf("invalid syslog address: %s", address)
+		}
+		writer, err = syslog.Dial(u.Scheme, u.Host, priority, tag)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to syslog at %s", address)
+	}
+	auditLog = writer
+	return nil
+}
+
+// audit emits event. Failures are only logged, so that the mounts don't
+// depend on the syslog daemon.
+func audit(event AuditEvent) {
+	if auditLog == nil {
+		return
+	}
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		logrus.WithError(err).Warn("failed to marshal audit event")
+		return
+	}
+	if event.Event == AuditFilesystemFailed {
+		err = auditLog.Warning(string(eventJSON))
+	} else {
+		err = auditLog.Notice(string(eventJSON))
+	}
+	if err != nil {
+		logrus.WithError(err).Warnf("failed to emit audit event %s", event.Event)
+	}
+}
+
+// auditKeyRelease emits the release of the key of filesystem index with the
+// key blobs in keyBlobs, attested with tcbm.
+func auditKeyRelease(index int, tcbm uint64, keyBlobs []common.KeyBlob) {
+	event := AuditEvent{
+		Event: AuditKeyReleased,
+		Index: index,
+		Tcbm:  strconv.FormatUint(tcbm, 16),
+	}
+	for _, keyBlob := range keyBlobs {
+		event.Keys = append(event.Keys, keyBlob.AKV.Endpoint+"/keys/"+keyBlob.KID)
+	}
+	audit(event)
+}
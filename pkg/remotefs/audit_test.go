@@ -0,0 +1,68 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+)
+
+type fakeAuditWriter struct {
+	notices  []string
+	warnings []string
+}
+
+func (w *fakeAuditWriter) Notice(m string) error {
+	w.notices = append(w.notices, m)
+	return nil
+}
+
+func (w *fakeAuditWriter) Warning(m string) error {
+	w.warnings = append(w.warnings, m)
+	return nil
+}
+
+func Test_Audit(t *testing.T) {
+	origAuditLog := auditLog
+	defer func() {
+		auditLog = origAuditLog
+	}()
+
+	// Nothing is emitted by default
+	auditLog = nil
+	audit(AuditEvent{Event: AuditFilesystemMounted})
+
+	writer := &fakeAuditWriter{}
+	auditLog = writer
+	keyBlob := common.KeyBlob{KID: "key", AKV: common.AKV{Endpoint: "vault.vault.azure.net", BearerToken: "secret"}}
+	auditKeyRelease(1, 0xdb18000000000004, []common.KeyBlob{keyBlob})
+	audit(AuditEvent{Event: AuditFilesystemFailed, Index: 2, ErrorCode: "fsck_failed"})
+
+	if len(writer.notices) != 1 || len(writer.warnings) != 1 {
+		t.Fatalf("unexpected events: %v %v", writer.notices, writer.warnings)
+	}
+	if strings.Contains(writer.notices[0], "secret") {
+		t.Fatalf("event contains a secret: %s", writer.notices[0])
+	}
+	var event AuditEvent
+	if err := json.Unmarshal([]byte(writer.notices[0]), &event); err != nil {
+		t.Fatalf("invalid event: %v", err)
+	}
+	if event.Event != AuditKeyReleased || event.Index != 1 || event.Tcbm != "db18000000000004" ||
+		len(event.Keys) != 1 || event.Keys[0] != "vault.vault.azure.net/keys/key" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+
+	for _, address := range []string{"syslog.example.com", "http://syslog.example.com:514", "udp://"} {
+		if err := SetAuditSyslog(address, "remotefs"); err == nil {
+			t.Errorf("expected address %s to be rejected", address)
+		}
+	}
+}
@@ -0,0 +1,1984 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/attest"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/skr"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Test dependencies
+var (
+	_azmountExited           = azmountExited
+	_azmountRun              = azmountRun
+	_checkImageExists        = checkImageExists
+	_cryptsetupOpen          = cryptsetupOpen
+	_cryptsetupClose         = cryptsetupClose
+	_cryptsetupCloseDeferred = cryptsetupCloseDeferred
+	_cryptsetupProbe         = cryptsetupProbe
+	_cryptsetupTestKey       = cryptsetupTestKey
+	_hashImage               = hashImage
+	_isMountPoint            = isMountPoint
+	_lookupHost              = common.ResolverPolicy.LookupHost
+	_mountSingleFilesystem   = mountSingleFilesystem
+	_readExt4UUID            = readExt4UUID
+	_runFsck                 = runFsck
+	_releaseKeys             = skr.ReleaseKeys
+	_secureKeyRelease        = skr.SecureKeyRelease
+	ioutilReadFile           = os.ReadFile
+	ioutilWriteFile          = os.WriteFile
+	osGetenv                 = os.Getenv
+	osMkdirAll               = os.MkdirAll
+	osRemoveAll              = os.RemoveAll
+	osStat                   = os.Stat
+	timeAfter                = time.After
+	unixKill                 = unix.Kill
+	unixMkfifo               = unix.Mkfifo
+	unixMount                = unix.Mount
+	unixUnmount              = unix.Unmount
+)
+
+var (
+	// for testing encrypted filesystems without releasing secrets from
+	// AKV allowTestingWithRawKey needs to be set to true and a raw key
+	// needs to have been provided. Default mode is that such testing is
+	// disabled.
+	allowTestingWithRawKey = false
+	// insecureStubAttestation is only set when the binary is built with the
+	// insecure_stub_attestation build tag. In that mode key release is served
+	// by a stub so that the mount pipeline can be exercised off SNP hardware.
+	insecureStubAttestation = false
+	// Path of the status file written by MountAzureFilesystems. No status
+	// file is written if it is empty.
+	StatusFilePath string
+	// Path of the state file used to resume the mounts after a restart. The
+	// mounts aren't resumed if it is empty.
+	StateFilePath string
+	// Source of the security policy when the UVM information doesn't have it.
+	// If it is nil, the security_policy_source of the configuration is used.
+	PolicySource common.PolicySource
+)
+
+// azmountOptions are the arguments of an azmount process started by
+// azmountRun.
+type azmountOptions struct {
+	// Identity used by azmount to access private images
+	identity common.Identity
+	// Hosts that azmount can fetch the image from, any host if empty
+	allowedHosts []string
+	// Policies of the outbound connections of azmount
+	tlsPolicy        common.TLSPolicy
+	resolverPolicy   common.ResolverPolicy
+	connectionPolicy common.ConnectionPolicy
+	// Folder where azmount exposes the image
+	imageLocalFolder string
+	// URL of the image, and "true", "false" or "auto" if it is private
+	azureImageUrl        string
+	azureImageUrlPrivate string
+	// If set, azmount exposes this file instead of downloading the image
+	localImagePath string
+	logFile        string
+	// logrus level used by azmount
+	logLevel string
+	// File where azmount writes its download statistics
+	statsFile string
+	// Size in KiB and number of the blocks of the azmount cache
+	cacheBlockSize string
+	numBlocks      string
+	// Read-ahead strategy of the azmount cache
+	accessPattern string
+	// Number of consecutive failed uploads after which azmount fails the
+	// writes, "0" for never
+	maxUploadFailures string
+	readWrite         bool
+	maxImageSizeBytes int64
+	// Timeout of the download and upload of each block of the image
+	blockTimeoutMs int
+	// Number of sub-ranges of each block downloaded at the same time
+	downloadConcurrency int
+	// Path of the manifest of SHA-256 digests of the blocks of the image
+	blockManifest string
+}
+
+// azmountArgs returns the command line arguments of azmount for opts.
+func azmountArgs(opts azmountOptions) ([]string, error) {
+	identityJson, err := json.Marshal(opts.identity)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal identity")
+	}
+
+	encodedIdentity := base64.StdEncoding.EncodeToString(identityJson)
+	allowedHosts := strings.Join(opts.allowedHosts, ",")
+
+	tlsPolicyJson, err := json.Marshal(opts.tlsPolicy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal TLS policy")
+	}
+	encodedTLSPolicy := base64.StdEncoding.EncodeToString(tlsPolicyJson)
+
+	resolverPolicyJson, err := json.Marshal(opts.resolverPolicy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal resolver policy")
+	}
+	encodedResolverPolicy := base64.StdEncoding.EncodeToString(resolverPolicyJson)
+
+	connectionPolicyJson, err := json.Marshal(opts.connectionPolicy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal connection policy")
+	}
+	encodedConnectionPolicy := base64.StdEncoding.EncodeToString(connectionPolicyJson)
+
+	if opts.localImagePath != "" {
+		return []string{"-mountpoint", opts.imageLocalFolder, "-localpath", opts.localImagePath, "-logfile", opts.logFile, "-loglevel", opts.logLevel, "-logformat", common.LogFormat(), "-statsfile", opts.statsFile, "-blocksize", opts.cacheBlockSize, "-numblocks", opts.numBlocks, "-accesspattern", opts.accessPattern, "-readWrite", strconv.FormatBool(opts.readWrite)}, nil
+	}
+
+	downloadConcurrency := opts.downloadConcurrency
+	if downloadConcurrency == 0 {
+		downloadConcurrency = 1
+	}
+	args := []string{"-mountpoint", opts.imageLocalFolder, "-url", opts.azureImageUrl, "-private", opts.azureImageUrlPrivate, "-identity", encodedIdentity, "-tlspolicy", encodedTLSPolicy, "-resolverpolicy", encodedResolverPolicy, "-connectionpolicy", encodedConnectionPolicy, "-allowedhosts", allowedHosts, "-logfile", opts.logFile, "-loglevel", opts.logLevel, "-logformat", common.LogFormat(), "-statsfile", opts.statsFile, "-blocksize", opts.cacheBlockSize, "-numblocks", opts.numBlocks, "-accesspattern", opts.accessPattern, "-readWrite", strconv.FormatBool(opts.readWrite), "-maxuploadfailures", opts.maxUploadFailures, "-maxsize", strconv.FormatInt(opts.maxImageSizeBytes, 10), "-blocktimeout", strconv.Itoa(opts.blockTimeoutMs), "-downloadconcurrency", strconv.Itoa(downloadConcurrency)}
+	if opts.blockManifest != "" {
+		args = append(args, "-blockmanifest", opts.blockManifest)
+	}
+	return args, nil
+}
+
+// azmountRun starts azmount with the specified options, and leaves it running
+// in the background.
+func azmountRun(opts azmountOptions) (*exec.Cmd, error) {
+	args, err := azmountArgs(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.localImagePath != "" {
+		logrus.Debugf("Starting azmount: -mountpoint %s -localpath %s -logfile %s -loglevel %s -blocksize %s KB -numblock %s -accesspattern %s -readWrite %s", opts.imageLocalFolder, opts.localImagePath, opts.logFile, opts.logLevel, opts.cacheBlockSize, opts.numBlocks, opts.accessPattern, strconv.FormatBool(opts.readWrite))
+	} else {
+		logrus.Debugf("Starting azmount: -mountpoint %s -url %s -private %s -logfile %s -loglevel %s -blocksize %s KB -numblock %s -accesspattern %s -readWrite %s -maxuploadfailures %s -maxsize %d -blocktimeout %d -downloadconcurrency %d -blockmanifest %s", opts.imageLocalFolder, opts.azureImageUrl, opts.azureImageUrlPrivate, opts.logFile, opts.logLevel, opts.cacheBlockSize, opts.numBlocks, opts.accessPattern, strconv.FormatBool(opts.readWrite), opts.maxUploadFailures, opts.maxImageSizeBytes, opts.blockTimeoutMs, opts.downloadConcurrency, opts.blockManifest)
+	}
+	cmd := exec.Command("/bin/azmount", args...)
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "azmount failed to start")
+	}
+	logrus.Infof("azmount running...")
+	return cmd, nil
+}
+
+// azmountStop kills an azmount process started by azmountRun and detaches the
+// FUSE filesystem it was serving.
+func azmountStop(cmd *exec.Cmd, imageLocalFolder string) {
+	if cmd != nil && cmd.Process != nil {
+		if err := cmd.Process.Kill(); err != nil {
+			logrus.WithError(err).Debugf("failed to kill azmount serving %s", imageLocalFolder)
+		}
+	}
+	if err := unixUnmount(imageLocalFolder, unix.MNT_DETACH); err != nil {
+		logrus.WithError(err).Debugf("failed to unmount %s", imageLocalFolder)
+	}
+}
+
+// azmountPID returns the PID of an azmount process started by azmountRun, or
+// zero if it isn't known.
+func azmountPID(cmd *exec.Cmd) int {
+	if cmd == nil || cmd.Process == nil {
+		return 0
+	}
+	return cmd.Process.Pid
+}
+
+// azmountExited returns true if the azmount process started by azmountRun has
+// exited. The process isn't reaped, so it can still be waited for afterwards.
+func azmountExited(cmd *exec.Cmd) bool {
+	if cmd == nil || cmd.Process == nil {
+		return false
+	}
+	var info unix.Siginfo
+	err := unix.Waitid(unix.P_PID, cmd.Process.Pid, &info, unix.WEXITED|unix.WNOHANG|unix.WNOWAIT, nil)
+	// If the process hasn't exited, Signo is left as zero
+	return err == nil && info.Signo != 0
+}
+
+// azmountLogTailSize is the maximum number of bytes of the azmount log that
+// are included in an AzmountNotReadyError.
+const azmountLogTailSize = 2048
+
+// azmountLogTail returns the last azmountLogTailSize bytes of the azmount log.
+func azmountLogTail(azmountLogFile string) string {
+	log, err := ioutilReadFile(azmountLogFile)
+	if err != nil {
+		return fmt.Sprintf("<failed to read %s: %s>", azmountLogFile, err.Error())
+	}
+	if len(log) > azmountLogTailSize {
+		log = log[len(log)-azmountLogTailSize:]
+	}
+	return string(log)
+}
+
+// AzmountNotReadyError is returned by mountAzureFile when azmount doesn't
+// expose the filesystem image in time.
+type AzmountNotReadyError struct {
+	// Path of the image that was expected to be exposed by azmount
+	ImageLocalFile string
+	// True if azmount had already exited when the wait timed out. This usually
+	// means that azmount failed because of a configuration or authentication
+	// error, rather than slow storage.
+	AzmountExited bool
+	// Path of the azmount log, which has all of it
+	LogFile string
+	// Last lines of the azmount log. They aren't part of Error(), as they can
+	// contain the SAS token of the image URL.
+	LogTail string
+	// Time waited for the image, which is distinct from the timeout of the
+	// download of each block by azmount
+	Timeout time.Duration
+	// Last error returned when checking for the image
+	Err error
+}
+
+func (e *AzmountNotReadyError) Error() string {
+	state := "still running"
+	if e.AzmountExited {
+		state = "exited"
+	}
+	return fmt.Sprintf("timed out after %s while waiting for encrypted filesystem image %s (azmount %s, log %s): %v", e.Timeout, e.ImageLocalFile, state, e.LogFile, e.Err)
+}
+
+func (e *AzmountNotReadyError) Unwrap() error {
+	return e.Err
+}
+
+// cryptsetupCommand runs cryptsetup with the provided arguments
+func cryptsetupCommand(args []string) error {
+	// By default, cryptsetup doesn't print much information, which makes it
+	// hard to debug it when there are problems. The verbosity follows the log
+	// level of the tool.
+	verboseArgs := append(cryptsetupVerbosityArgs(logrus.GetLevel()), args...)
+	logrus.Debugf("Executing cryptsetup with args: %s", verboseArgs)
+	cmd := exec.Command("cryptsetup", verboseArgs...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		logrus.Debugf("cryptsetup %s output:\n%s", args[0], output)
+		return newCryptsetupError(args, output, err)
+	}
+	if len(output) != 0 {
+		logrus.Debugf("cryptsetup %s output:\n%s", args[0], output)
+	}
+	return nil
+}
+
+// cryptsetupOpen runs "cryptsetup luksOpen" with the right arguments, or
+// "cryptsetup open --type plain" for images without a LUKS header. If
+// headerPath is set, the LUKS header is read from it instead of from source.
+func cryptsetupOpen(source string, deviceName string, keyFilePath string, headerPath string, options CryptsetupOptions) error {
+	openArgs := []string{
+		// Open device with the key passed to luksFormat
+		"luksOpen", source, deviceName, "--key-file", keyFilePath,
+		// Don't use a journal to increase performance
+		"--integrity-no-journal",
+		"--persistent"}
+	if options.isPlain() {
+		// There is no header to read the parameters from, or to store the
+		// flags in, and the key is used as it is
+		openArgs = append([]string{"open", source, deviceName, "--key-file", keyFilePath}, options.plainArgs()...)
+	}
+
+	if options.PerfNoReadWorkqueue {
+		openArgs = append(openArgs, "--perf-no_read_workqueue")
+	}
+	if options.PerfNoWriteWorkqueue {
+		openArgs = append(openArgs, "--perf-no_write_workqueue")
+	}
+	if options.PerfSameCPUCrypt {
+		openArgs = append(openArgs, "--perf-same_cpu_crypt")
+	}
+	// Only try the selected keyslot, so a wrong key fails fast
+	openArgs = append(openArgs, options.keySlotArgs()...)
+	openArgs = append(openArgs, headerArgs(headerPath)...)
+
+	return cryptsetupCommand(openArgs)
+}
+
+// cryptsetupClose runs "cryptsetup luksClose" to remove a device created by
+// cryptsetupOpen.
+func cryptsetupClose(deviceName string) error {
+	return cryptsetupCommand([]string{"luksClose", deviceName})
+}
+
+// cryptsetupCloseDeferred marks a device created by cryptsetupOpen for
+// deferred removal, which the kernel does once it isn't in use anymore.
+func cryptsetupCloseDeferred(deviceName string) error {
+	return cryptsetupCommand([]string{"close", "--deferred", deviceName})
+}
+
+// defaultImageReadyTimeout is how long to wait for azmount to expose the
+// filesystem image before giving up.
+const defaultImageReadyTimeout = 60 * time.Second
+
+// imageReadyPollInterval is how often mountAzureFile checks for the image.
+const imageReadyPollInterval = 60 * time.Millisecond
+
+// mountAzureFile starts azmount with opts to expose the image of the
+// filesystem at index in a folder inside tempDir, and waits up to
+// imageReadyTimeout for the image to be ready. The folder, log and statistics
+// files of opts are set by mountAzureFile. It returns the path of the image
+// and the azmount process, which the caller stops with azmountStop if the
+// mount fails later. If the image isn't ready, azmount is stopped.
+func mountAzureFile(ctx context.Context, tempDir string, index int, opts azmountOptions, imageReadyTimeout time.Duration) (string, *exec.Cmd, error) {
+
+	imageLocalFolder := filepath.Join(tempDir, fmt.Sprintf("%d", index))
+	if err := osMkdirAll(imageLocalFolder, 0755); err != nil {
+		return "", nil, errors.Wrapf(err, "mkdir failed: %s", imageLocalFolder)
+	}
+
+	// Location in the UVM of the encrypted filesystem image.
+	imageLocalFile := filepath.Join(imageLocalFolder, "data")
+	logrus.Debugf("Location in the UVM of the encrypted filesystem image %s", imageLocalFile)
+
+	// Location of log file generated by azmount
+	azmountLogFile := filepath.Join(tempDir, fmt.Sprintf("log-%d.txt", index))
+	logrus.Debugf("Location of log file generated by azmount %s", azmountLogFile)
+
+	azmountStatsFile := azmountStatsFilePath(tempDir, index)
+
+	// Any program that sets up a FUSE filesystem becomes a server that listens
+	// to requests from the kernel, and it gets stuck in the loop that serves
+	// requests, so it is needed to run it in a different process so that the
+	// execution can continue in this one.
+	opts.imageLocalFolder, opts.logFile, opts.statsFile = imageLocalFolder, azmountLogFile, azmountStatsFile
+	cmd, err := _azmountRun(opts)
+	if err != nil {
+		return "", nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		common.LogFieldFilesystemIndex: index,
+		common.LogFieldAzureURL:        redactURL(opts.azureImageUrl),
+		common.LogFieldPID:             azmountPID(cmd),
+		common.LogFieldLogFile:         azmountLogFile,
+	}).Info("Started azmount")
+
+	// Wait until the file is available, or until the readiness timeout
+	readyCtx, cancel := context.WithTimeout(ctx, imageReadyTimeout)
+	defer cancel()
+	for {
+		err := checkImageFile(imageLocalFile, azmountStatsFile)
+		if err == nil {
+			// Found
+			break
+		}
+		select {
+		case <-readyCtx.Done():
+			if ctx.Err() != nil {
+				azmountStop(cmd, imageLocalFolder)
+				return "", nil, ctx.Err()
+			}
+			notReady := &AzmountNotReadyError{
+				ImageLocalFile: imageLocalFile,
+				AzmountExited:  _azmountExited(cmd),
+				LogFile:        azmountLogFile,
+				LogTail:        azmountLogTail(azmountLogFile),
+				Timeout:        imageReadyTimeout,
+				Err:            err,
+			}
+			azmountStop(cmd, imageLocalFolder)
+			return "", nil, notReady
+		case <-timeAfter(imageReadyPollInterval):
+		}
+	}
+	logrus.Debugf("Encrypted file system image found: %s", imageLocalFile)
+
+	return imageLocalFile, cmd, nil
+}
+
+// checkImageFile checks that the image exposed by azmount at imageLocalFile is
+// a regular file with the size of the image reported in azmountStatsFile, so
+// that a file that isn't fully set up yet isn't handed to cryptsetup.
+func checkImageFile(imageLocalFile string, azmountStatsFile string) error {
+	fileInfo, err := osStat(imageLocalFile)
+	if err != nil {
+		return err
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return errors.Errorf("%s isn't a regular file: %s", imageLocalFile, fileInfo.Mode())
+	}
+	stats, err := readDownloadStats(azmountStatsFile)
+	if err != nil {
+		return err
+	}
+	if stats.FileSize <= 0 {
+		return errors.Errorf("azmount hasn't reported the size of %s yet", imageLocalFile)
+	}
+	if fileInfo.Size() != stats.FileSize {
+		return errors.Errorf("size of %s is %d bytes, expected %d bytes", imageLocalFile, fileInfo.Size(), stats.FileSize)
+	}
+	return nil
+}
+
+// azureFilesShareFolder returns the folder where mountAzureFilesShare mounts
+// the share of filesystem index.
+func azureFilesShareFolder(tempDir string, index int) string {
+	return filepath.Join(tempDir, fmt.Sprintf("share-%d", index))
+}
+
+// mountAzureFilesShare mounts the Azure Files NFS share, in the format
+// "<account>.file.core.windows.net:/<account>/<share>", in a folder inside
+// tempDir with mounter and returns the path of the folder. Azure Files only
+// supports NFS version 4.1. The host of the share must have been checked
+// against the allowed storage hosts with checkStorageHost, as the kernel NFS
+// client connects to it directly. It is resolved with resolverPolicy, like
+// the hosts of the connections of this process and of azmount.
+func mountAzureFilesShare(ctx context.Context, mounter Mounter, resolverPolicy common.ResolverPolicy, tempDir string, index int, share string, readWrite bool) (string, error) {
+	host, _, found := strings.Cut(share, ":")
+	if !found || host == "" {
+		return "", errors.Errorf("invalid Azure Files share, expected <host>:/<path>: %s", share)
+	}
+
+	// The kernel NFS client doesn't resolve host names, so it needs the address
+	addrs, err := _lookupHost(resolverPolicy, ctx, host)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve host of Azure Files share: %s", host)
+	}
+	if len(addrs) == 0 {
+		return "", errors.Errorf("no address found for host of Azure Files share: %s", host)
+	}
+
+	shareFolder := azureFilesShareFolder(tempDir, index)
+	if err := osMkdirAll(shareFolder, 0755); err != nil {
+		return "", errors.Wrapf(err, "mkdir failed: %s", shareFolder)
+	}
+
+	var flags uintptr
+	if !readWrite {
+		flags = unix.MS_RDONLY
+	}
+	data := fmt.Sprintf("vers=4.1,sec=sys,nolock,addr=%s", addrs[0])
+
+	logrus.Debugf("Mounting Azure Files share %s to %s (%s)", share, shareFolder, data)
+	if err := mounter.Mount(share, shareFolder, "nfs4", flags, data); err != nil {
+		return "", errors.Wrapf(err, "failed to mount Azure Files share: %s", share)
+	}
+
+	return shareFolder, nil
+}
+
+// rawRemoteFilesystemKey sets up the key file path using the raw key passed
+func rawRemoteFilesystemKey(tempDir string, rawKeyHexString string, keyFileFifo bool) (keyFilePath string, err error) {
+	keyFilePath = filepath.Join(tempDir, "keyfile")
+
+	keyBytes := make([]byte, 64)
+	keyBytes, err = hex.DecodeString(rawKeyHexString)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to decode raw key")
+	}
+
+	// dm-crypt expects a key file, so create a key file using the key released in
+	// previous step
+	err = writeKeyFile(keyFilePath, keyBytes, keyFileFifo)
+	if err != nil {
+		return "", err
+	}
+
+	return keyFilePath, nil
+}
+
+// keyFileFifoPollInterval is how often the writer of a key file that is a
+// named pipe checks if cryptsetup has opened it.
+const keyFileFifoPollInterval = 10 * time.Millisecond
+
+// keyFileWriter is the background writer of a key file that is a named pipe.
+// Closing done stops it, and stopped is closed once it has returned.
+type keyFileWriter struct {
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+var (
+	keyFileWritersMutex sync.Mutex
+	keyFileWriters      = make(map[string]*keyFileWriter)
+)
+
+// writeKeyFile creates the key file that is passed to cryptsetup. If fifo is
+// true, the key file is a named pipe and the key is written to it in the
+// background, so that it is only ever held in the pipe buffer. The writer
+// polls the pipe until cryptsetup opens it, so removeKeyFile must be used to
+// stop it in case cryptsetup never reads it. keyBytes is zeroed once it has
+// been written, or once the writer has been stopped.
+func writeKeyFile(keyFilePath string, keyBytes []byte, fifo bool) error {
+	if !fifo {
+		defer clear(keyBytes)
+		if err := ioutilWriteFile(keyFilePath, keyBytes, 0644); err != nil {
+			return errors.Wrapf(err, "failed to create keyfile: %s", keyFilePath)
+		}
+		return nil
+	}
+
+	if err := unixMkfifo(keyFilePath, 0600); err != nil {
+		return errors.Wrapf(err, "failed to create keyfile fifo: %s", keyFilePath)
+	}
+
+	writer := &keyFileWriter{done: make(chan struct{}), stopped: make(chan struct{})}
+	keyFileWritersMutex.Lock()
+	keyFileWriters[keyFilePath] = writer
+	keyFileWritersMutex.Unlock()
+
+	go func() {
+		defer close(writer.stopped)
+		defer clear(keyBytes)
+
+		for {
+			// Without a reader, a non-blocking open fails with ENXIO instead
+			// of blocking until the pipe is opened
+			f, err := os.OpenFile(keyFilePath, os.O_WRONLY|unix.O_NONBLOCK, 0)
+			if err == nil {
+				defer f.Close()
+				if _, err := f.Write(keyBytes); err != nil {
+					logrus.WithError(err).Debugf("failed to write keyfile fifo: %s", keyFilePath)
+				}
+				return
+			}
+			if !errors.Is(err, unix.ENXIO) {
+				logrus.WithError(err).Debugf("failed to open keyfile fifo: %s", keyFilePath)
+				return
+			}
+			select {
+			case <-writer.done:
+				return
+			case <-timeAfter(keyFileFifoPollInterval):
+			}
+		}
+	}()
+
+	return nil
+}
+
+// removeKeyFile deletes the key file created by writeKeyFile. If it is a named
+// pipe, its writer is stopped first, so that it doesn't keep polling the pipe
+// with the key once the pipe is gone.
+func removeKeyFile(keyFilePath string, fifo bool) error {
+	if fifo {
+		keyFileWritersMutex.Lock()
+		writer, ok := keyFileWriters[keyFilePath]
+		delete(keyFileWriters, keyFilePath)
+		keyFileWritersMutex.Unlock()
+		if ok {
+			close(writer.done)
+			<-writer.stopped
+		}
+	}
+	return osRemoveAll(keyFilePath)
+}
+
+// releaseRemoteFilesystemKey releases the key identified by keyBlob from AKV
+// with the identity, cert state and UVM information of opts
+//
+// 1) Retrieve encoded  security policy by reading the environment variable
+//
+// 2) Perform secure key release
+//
+// 3) Prepare the key file path using the released key
+//
+// If the key has already been released by MountAzureFilesystems, it is passed
+// as releasedKey and step 2 is skipped.
+//
+// keyDerivation holds the parameters used to derive the key if it was derived
+// from a released RSA key, or nil if the released key is used as is.
+func releaseRemoteFilesystemKey(ctx context.Context, opts *MountOptions, tempDir string, keyDerivationBlob common.KeyDerivationBlob, keyBlob common.KeyBlob, keyLengthBytes int, keyFileFifo bool, releasedKey jwk.Key) (keyFilePath string, keyDerivation *KeyDerivationStatus, err error) {
+	keyFilePath = filepath.Join(tempDir, "keyfile")
+
+	keyLength, err := resolveKeyLength(keyLengthBytes, keyDerivationBlob)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// 2) release key identified by keyBlob using encoded security policy and certfetcher (contained in CertState object)
+	//    certfetcher is required for validating the attestation report against the cert
+	//    chain of the chip identified in the attestation report
+	jwKey := releasedKey
+	if jwKey == nil {
+		logrus.Info("Performing Secure Key Release...")
+		jwKey, err = secureKeyReleaseWithRetry(ctx, opts, keyBlob)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "failed to release key: %v", keyBlob)
+		}
+	}
+	logrus.Debugf("Key Type: %s", jwKey.KeyType())
+
+	var octetKeyBytes []byte
+	var rawKey interface{}
+	err = jwKey.Raw(&rawKey)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "failed to extract raw key")
+	}
+
+	if jwKey.KeyType() == "oct" {
+		rawOctetKeyBytes, ok := rawKey.([]byte)
+		if !ok || len(rawOctetKeyBytes) != keyLength {
+			return "", nil, errors.Errorf("expected %d-byte octet key", keyLength)
+		}
+		octetKeyBytes = rawOctetKeyBytes
+	} else if jwKey.KeyType() == "RSA" {
+		rawKey, ok := rawKey.(*rsa.PrivateKey)
+		if !ok {
+			return "", nil, errors.Wrapf(err, "expected RSA key")
+		}
+		// decode public salt hexstring
+		salt, err := hex.DecodeString(keyDerivationBlob.Salt)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "failed to decode Key Derivation Salt hexstring")
+		}
+
+		// derive key using secret D exponent, salt, and label
+		logrus.Trace("Deriving symmetric key...")
+		keyDerivationBlob.KeyLength = uint32(keyLength)
+		octetKeyBytes, err = keyDerivationBlob.DeriveKey(rawKey.D.Bytes(), salt)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "failed to derive oct key")
+		}
+
+		keyDerivation = newKeyDerivationStatus(keyDerivationBlob, salt)
+		logrus.Infof("Derived symmetric key (algorithm: %s salt: %s label: %s)", keyDerivation.Algorithm, keyDerivation.Salt, keyDerivation.Label)
+	} else {
+		return "", nil, errors.Wrapf(err, "key type %s not supported", jwKey.KeyType())
+	}
+
+	// 3) dm-crypt expects a key file, so create a key file using the key released in
+	//    previous step
+	logrus.Debugf("Creating keyfile: %s", keyFilePath)
+	err = writeKeyFile(keyFilePath, octetKeyBytes, keyFileFifo)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return keyFilePath, keyDerivation, nil
+}
+
+// resolveKeyLength returns the length in bytes of the encryption key of a
+// filesystem: keyLengthBytes, or else the key_length of keyDerivationBlob, or
+// else 32. Both can be set as long as they agree.
+func resolveKeyLength(keyLengthBytes int, keyDerivationBlob common.KeyDerivationBlob) (int, error) {
+	if keyLengthBytes < 0 {
+		return 0, errors.Errorf("invalid key_length_bytes: %d", keyLengthBytes)
+	}
+	derivedLength := int(keyDerivationBlob.KeyLength)
+	if keyLengthBytes != 0 && derivedLength != 0 && keyLengthBytes != derivedLength {
+		return 0, errors.Errorf("key_length_bytes %d doesn't match key_length %d of key_derivation", keyLengthBytes, derivedLength)
+	}
+	switch {
+	case keyLengthBytes != 0:
+		return keyLengthBytes, nil
+	case derivedLength != 0:
+		return derivedLength, nil
+	default:
+		return common.DefaultKeyDerivationKeyLength, nil
+	}
+}
+
+// defaultDeviceNodeTimeout is how long to wait for the device node created by
+// cryptsetup to appear if the filesystem doesn't specify a timeout.
+const defaultDeviceNodeTimeout = 500 * time.Millisecond
+
+// waitForDeviceNode waits until deviceNamePath exists. The node is created by
+// udev, which can lag behind cryptsetup on busy hosts.
+func waitForDeviceNode(ctx context.Context, deviceNamePath string, timeout time.Duration) error {
+	timeoutChan := timeAfter(timeout)
+	for {
+		_, err := osStat(deviceNamePath)
+		if err == nil {
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to stat device: %s", deviceNamePath)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeoutChan:
+			return errors.Errorf("timed out after %s waiting for device: %s", timeout, deviceNamePath)
+		case <-timeAfter(10 * time.Millisecond):
+		}
+	}
+}
+
+// prewarmChunkSize is the size of the reads done by prewarmDevice.
+const prewarmChunkSize = 1024 * 1024
+
+// prewarmDevice reads the given ranges of deviceNamePath and discards the data.
+// This makes azmount download the blocks and keep them in its cache, so the
+// first reads done by the workload don't need to wait for them.
+func prewarmDevice(ctx context.Context, deviceNamePath string, ranges []PrewarmRange) error {
+	device, err := os.Open(deviceNamePath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open device: %s", deviceNamePath)
+	}
+	defer device.Close()
+
+	buf := make([]byte, prewarmChunkSize)
+	for _, r := range ranges {
+		if r.Offset < 0 || r.Length < 0 {
+			return errors.Errorf("invalid prewarm range (offset %d, length %d)", r.Offset, r.Length)
+		}
+		logrus.Debugf("Prewarming %d bytes at offset %d of %s", r.Length, r.Offset, deviceNamePath)
+		for done := int64(0); done < r.Length; {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			chunk := buf
+			if r.Length-done < int64(len(chunk)) {
+				chunk = chunk[:r.Length-done]
+			}
+			n, err := device.ReadAt(chunk, r.Offset+done)
+			done += int64(n)
+			if err == io.EOF {
+				// The range goes past the end of the device
+				break
+			}
+			if err != nil {
+				return errors.Wrapf(err, "failed to read device: %s", deviceNamePath)
+			}
+		}
+	}
+
+	return nil
+}
+
+// MountError is returned when mounting the decrypted filesystem fails. Errno
+// is the error returned by mount(2), and Reason explains common causes of it.
+type MountError struct {
+	Device string
+	Target string
+	Errno  unix.Errno
+	Reason string
+}
+
+func (e *MountError) Error() string {
+	return fmt.Sprintf("failed to mount filesystem %s to %s: %s (%s)", e.Device, e.Target, e.Reason, e.Errno.Error())
+}
+
+func (e *MountError) Unwrap() error {
+	return e.Errno
+}
+
+// newMountError converts an error returned by unixMount into a MountError with
+// an explanation of the errno.
+func newMountError(device string, target string, err error) error {
+	errno, ok := err.(unix.Errno)
+	if !ok {
+		return errors.Wrapf(err, "failed to mount filesystem: %s", device)
+	}
+
+	var reason string
+	switch errno {
+	case unix.EINVAL:
+		reason = "wrong filesystem type or mount options, or the image doesn't contain an ext4 filesystem"
+	case unix.EIO:
+		reason = "I/O error reading the device, the remote image may be corrupted or unreachable"
+	case unix.ENOSPC:
+		reason = "no space left for the mount metadata"
+	case unix.EBUSY:
+		reason = "the device is already mounted or the mount folder is in use"
+	case unix.ENOENT, unix.ENXIO, unix.ENODEV:
+		reason = "the device doesn't exist"
+	case unix.EACCES, unix.EPERM, unix.EROFS:
+		reason = "permission denied, or read-write mount of a read-only device"
+	default:
+		reason = "mount failed"
+	}
+
+	return &MountError{Device: device, Target: target, Errno: errno, Reason: reason}
+}
+
+const (
+	// Offset of the ext4 superblock in the device
+	ext4SuperblockOffset = 1024
+	// Offsets of the magic number and the UUID inside the superblock
+	ext4MagicOffset = 0x38
+	ext4UUIDOffset  = 0x68
+	ext4Magic       = 0xEF53
+)
+
+// readExt4Superblock returns the start of the superblock of the ext4
+// filesystem in devicePath, up to the UUID.
+func readExt4Superblock(devicePath string) ([]byte, error) {
+	device, err := os.Open(devicePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open device: %s", devicePath)
+	}
+	defer device.Close()
+
+	superblock := make([]byte, ext4UUIDOffset+16)
+	if _, err := device.ReadAt(superblock, ext4SuperblockOffset); err != nil {
+		return nil, errors.Wrapf(err, "failed to read superblock of device: %s", devicePath)
+	}
+
+	magic := binary.LittleEndian.Uint16(superblock[ext4MagicOffset:])
+	if magic != ext4Magic {
+		return nil, errors.Errorf("device %s doesn't contain an ext4 filesystem (magic 0x%04x)", devicePath, magic)
+	}
+	return superblock, nil
+}
+
+// readExt4UUID returns the UUID of the ext4 filesystem in devicePath, read from
+// its superblock.
+func readExt4UUID(devicePath string) (string, error) {
+	superblock, err := readExt4Superblock(devicePath)
+	if err != nil {
+		return "", err
+	}
+
+	u := superblock[ext4UUIDOffset : ext4UUIDOffset+16]
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]), nil
+}
+
+// releaseKeyShares releases the key shares of a filesystem and reconstructs the
+// key from them with opts. Each share is released with its own secure key
+// release and needs to be an octet key.
+func releaseKeyShares(ctx context.Context, opts *MountOptions, fs AzureFilesystem) (jwk.Key, error) {
+	threshold := len(fs.KeyShares)
+	if fs.KeyShareScheme == common.KeyShareSchemeShamir {
+		threshold = fs.KeyShareThreshold
+		if threshold < 2 || threshold > len(fs.KeyShares) || len(fs.KeyShares) > 255 {
+			return nil, errors.Errorf("invalid threshold %d for %d key shares", threshold, len(fs.KeyShares))
+		}
+	}
+
+	reqs := make([]skr.KeyReleaseRequest, len(fs.KeyShares))
+	for i, keyBlob := range fs.KeyShares {
+		reqs[i] = skr.KeyReleaseRequest{KeyBlob: keyBlob}
+	}
+
+	logrus.Infof("Releasing %d key shares...", len(reqs))
+	// Failures are checked for each share, as not all shamir shares are needed
+	results, _ := releaseKeysWithRetry(ctx, opts, reqs)
+
+	var shares []common.KeyShare
+	for i, result := range results {
+		if result.Err != nil || result.Key == nil {
+			logrus.WithError(result.Err).Warnf("failed to release key share %s", fs.KeyShares[i].KID)
+			spanFromContext(ctx).AddEvent("key share release failed", Attribute{"share", i})
+			continue
+		}
+		var rawKey interface{}
+		if err := result.Key.Raw(&rawKey); err != nil {
+			return nil, errors.Wrapf(err, "failed to extract raw key share %s", fs.KeyShares[i].KID)
+		}
+		shareBytes, ok := rawKey.([]byte)
+		if !ok {
+			return nil, errors.Errorf("key share %s is not an octet key", fs.KeyShares[i].KID)
+		}
+		shares = append(shares, common.KeyShare{X: byte(i + 1), Bytes: shareBytes})
+	}
+
+	if len(shares) < threshold {
+		return nil, errors.Errorf("released %d key shares, %d required", len(shares), threshold)
+	}
+
+	key, err := common.CombineKeyShares(fs.KeyShareScheme, threshold, shares)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to combine key shares")
+	}
+
+	jwKey := jwk.NewSymmetricKey()
+	if err := jwKey.FromRaw(key); err != nil {
+		return nil, errors.Wrapf(err, "could not encode combined key as JWK")
+	}
+	return jwKey, nil
+}
+
+// cryptDeviceName returns the name of the device created by cryptsetup for the
+// filesystem at index.
+func cryptDeviceName(index int) string {
+	return fmt.Sprintf("remote-crypt-%d", index)
+}
+
+// Prefix of azure_url for images stored as an OCI artifact in a registry
+const ociURLPrefix = "oci://"
+
+// filesystemHost returns the host of the storage account or Azure Files share
+// of fs.
+func filesystemHost(fs AzureFilesystem) (string, error) {
+	if fs.AzureFilesNfsShare != "" {
+		host, _, _ := strings.Cut(fs.AzureFilesNfsShare, ":")
+		return host, nil
+	}
+	u, err := url.Parse(fs.AzureUrl)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse URL: %s", fs.AzureUrl)
+	}
+	return u.Host, nil
+}
+
+// checkStorageHost checks that the storage account or Azure Files share of fs
+// is in allowedHosts, unless it is empty.
+func checkStorageHost(fs AzureFilesystem, allowedHosts []string) error {
+	if fs.Tmpfs != nil {
+		return nil
+	}
+	host, err := filesystemHost(fs)
+	if err != nil {
+		return err
+	}
+
+	if !common.HostAllowed(host, allowedHosts) {
+		return errors.Errorf("host %s isn't in the list of allowed storage hosts", host)
+	}
+	return nil
+}
+
+// Policies for read-write filesystems whose blocks can't be uploaded by azmount
+const (
+	UploadFailurePolicyFailWrites      = "fail-writes"
+	UploadFailurePolicyRemountReadOnly = "remount-ro"
+)
+
+// SELinux contexts have the form user:role:type, optionally followed by an
+// MLS/MCS level like s0:c1,c2 or s0-s0:c0.c1023
+var selinuxContextRegexp = regexp.MustCompile(`^[A-Za-z0-9_.]+:[A-Za-z0-9_.]+:[A-Za-z0-9_.]+(:[A-Za-z0-9_.:,-]+)?$`)
+
+// ext4MountData returns the data argument of the mount of the ext4
+// filesystem of fs.
+func ext4MountData(fs AzureFilesystem) string {
+	var options []string
+	if !fs.ReadWrite {
+		// A read-only filesystem can't replay its journal unless requested
+		if fs.JournalPolicy != JournalPolicyReplay {
+			options = append(options, "noload")
+		}
+	} else if fs.UploadFailurePolicy == UploadFailurePolicyRemountReadOnly {
+		// azmount fails writes once uploads keep failing, which ext4 sees
+		// as I/O errors
+		options = append(options, "errors=remount-ro")
+	}
+	if fs.SELinuxContext != "" {
+		// The quotes keep the commas of the level in the context
+		options = append(options, fmt.Sprintf("context=\"%s\"", fs.SELinuxContext))
+	}
+	return strings.Join(options, ",")
+}
+
+// Access patterns of a filesystem, which select the read-ahead of azmount
+const (
+	AccessPatternRandom     = "random"
+	AccessPatternSequential = "sequential"
+	AccessPatternAuto       = "auto"
+)
+
+// containerMountAzureFilesystem mounts a remote filesystems specified in the
+// policy of a given container.
+//
+//  1. Get the actual filesystem image. This is done by starting a new azmount
+//     process. The file is then exposed at “/[tempDir]/[index]/data“ and the
+//     log of azmount is saved to “/[tempDir]/log-[index].txt“.
+//
+//  2. Obtain keyfile. This is hardcoded at the moment and needs to be replaced
+//     by the actual code that gets the key. It is saved to a temporary file, or
+//     a named pipe if fs.KeyFileFifo is set, so that it can be passed to
+//     cryptsetup. It can be removed afterwards.
+//
+//  3. Open encrypted filesystem with cryptsetup. The result is a block device in
+//     “/dev/mapper/remote-crypt-[filesystem-index]“.
+//
+// 4) Mount block device as a read-only filesystem.
+//
+//  5. Create a symlink to the filesystem in the path shared between the UVM and
+//     the container.
+//
+// If ctx is cancelled the current step is aborted, and the device and mount
+// created so far are removed.
+//
+// Storage is accessed, the key is released and the filesystem is mounted with
+// opts. releasedKey is the key of the filesystem if it has already been
+// released, or nil. The parameters used to derive the key, if any, are
+// recorded in fsStatus.
+func containerMountAzureFilesystem(ctx context.Context, opts *MountOptions, tempDir string, index int, fs AzureFilesystem, releasedKey jwk.Key, fsStatus *FilesystemStatus) (err error) {
+
+	host, _ := filesystemHost(fs)
+	ctx, span := startSpan(ctx, "filesystem", Attribute{"index", index}, Attribute{"host", host})
+	steps := &stepTracer{ctx: ctx, index: index}
+	defer func() {
+		steps.end(err)
+		endSpan(span, err)
+	}()
+
+	cacheBlockSize := "512"
+	numBlocks := "32"
+	if fs.CacheBlockSizeKiB != 0 {
+		// azmount only supports multiples of the 4 KiB page size, which is
+		// also the largest sector size supported by cryptsetup
+		if fs.CacheBlockSizeKiB < 0 || fs.CacheBlockSizeKiB%4 != 0 {
+			return errors.Errorf("cache block size must be a multiple of 4 KiB: %d", fs.CacheBlockSizeKiB)
+		}
+		cacheBlockSize = strconv.Itoa(fs.CacheBlockSizeKiB)
+	}
+	if fs.CacheBlocks != 0 {
+		if fs.CacheBlocks < 0 {
+			return errors.Errorf("invalid number of cache blocks: %d", fs.CacheBlocks)
+		}
+		numBlocks = strconv.Itoa(fs.CacheBlocks)
+	}
+
+	// A negative number of upload failures means that writes never fail,
+	// which is 0 for azmount
+	maxUploadFailures := "3"
+	if fs.MaxUploadFailures > 0 {
+		maxUploadFailures = strconv.Itoa(fs.MaxUploadFailures)
+	} else if fs.MaxUploadFailures < 0 {
+		maxUploadFailures = "0"
+	}
+
+	// azmount logs at the same level as this tool unless the filesystem
+	// overrides it
+	azmountLogLevel := logrus.GetLevel().String()
+	if fs.AzmountLogLevel != "" {
+		if _, err := logrus.ParseLevel(fs.AzmountLogLevel); err != nil {
+			return errors.Wrapf(err, "invalid azmount log level")
+		}
+		azmountLogLevel = fs.AzmountLogLevel
+	}
+
+	accessPattern := AccessPatternRandom
+	switch fs.AccessPattern {
+	case "":
+	case AccessPatternRandom, AccessPatternSequential, AccessPatternAuto:
+		accessPattern = fs.AccessPattern
+	default:
+		return errors.Errorf("unknown access pattern: %s", fs.AccessPattern)
+	}
+
+	// The timeout of each block is enforced by azmount, the readiness timeout
+	// bounds the wait for azmount to expose the whole image
+	if fs.BlockTimeoutMs < 0 {
+		return errors.Errorf("block timeout can't be negative: %d", fs.BlockTimeoutMs)
+	}
+	if fs.ImageReadyTimeoutMs < 0 {
+		return errors.Errorf("image ready timeout can't be negative: %d", fs.ImageReadyTimeoutMs)
+	}
+	if fs.DownloadConcurrency < 0 {
+		return errors.Errorf("download concurrency can't be negative: %d", fs.DownloadConcurrency)
+	}
+	imageReadyTimeout := defaultImageReadyTimeout
+	if fs.ImageReadyTimeoutMs > 0 {
+		imageReadyTimeout = time.Duration(fs.ImageReadyTimeoutMs) * time.Millisecond
+	}
+
+	switch fs.UploadFailurePolicy {
+	case "", UploadFailurePolicyFailWrites, UploadFailurePolicyRemountReadOnly:
+	default:
+		return errors.Errorf("unknown upload failure policy: %s", fs.UploadFailurePolicy)
+	}
+
+	if strings.HasPrefix(fs.AzureUrl, ociURLPrefix) && fs.ReadWrite {
+		return errors.Errorf("images in a container registry can't be mounted read-write")
+	}
+
+	// azmount detects if the blob is private when it is asked to
+	azureUrlPrivate := strconv.FormatBool(fs.AzureUrlPrivate)
+	if fs.DetectPrivate && !fs.AzureUrlPrivate {
+		if strings.HasPrefix(fs.AzureUrl, ociURLPrefix) {
+			return errors.Errorf("detect_private isn't supported for images in a container registry")
+		}
+		azureUrlPrivate = "auto"
+	}
+
+	if err := fs.CryptsetupOptions.validatePbkdf(); err != nil {
+		return errors.Wrapf(err, "invalid cryptsetup options")
+	}
+	if err := fs.CryptsetupOptions.validateKeySlot(); err != nil {
+		return errors.Wrapf(err, "invalid cryptsetup options")
+	}
+	if err := fs.CryptsetupOptions.validateType(); err != nil {
+		return errors.Wrapf(err, "invalid cryptsetup options")
+	}
+	if fs.CryptsetupOptions.isPlain() && fs.ValidateKey {
+		return errors.Errorf("validate_key can't be used with plain images, which have no LUKS header to check the key against")
+	}
+
+	keyDerivationBlob := fs.KeyDerivationBlob
+	if fs.BindKeyToVolume {
+		if fs.KeyBlob.KID == "" || len(fs.KeyShares) > 0 {
+			return errors.Errorf("bind_key_to_volume needs a key, which must be an RSA key")
+		}
+		keyDerivationBlob, err = keyDerivationBlob.BindToVolume(fs.KeyBlob.KID, common.VolumeBinding{MountPoint: fs.MountPoint, Index: index})
+		if err != nil {
+			return errors.Wrapf(err, "invalid bind_key_to_volume")
+		}
+	}
+
+	if fs.SELinuxContext != "" && !selinuxContextRegexp.MatchString(fs.SELinuxContext) {
+		return errors.Errorf("invalid SELinux context: %s", fs.SELinuxContext)
+	}
+
+	switch fs.FsckFailurePolicy {
+	case "", FsckFailurePolicyFail, FsckFailurePolicyWarn:
+	default:
+		return errors.Errorf("unknown fsck failure policy: %s", fs.FsckFailurePolicy)
+	}
+
+	switch fs.ExistingMount {
+	case "", ExistingMountFail, ExistingMountRemount, ExistingMountReuse:
+	default:
+		return errors.Errorf("unknown existing mount policy: %s", fs.ExistingMount)
+	}
+
+	if fs.ImageSha256 != "" {
+		if !imageSha256Regexp.MatchString(fs.ImageSha256) {
+			return errors.Errorf("invalid image SHA-256 digest: %s", fs.ImageSha256)
+		}
+		// Writes change the image, so its digest only holds once
+		if fs.ReadWrite {
+			return errors.Errorf("image_sha256 can't be used with read-write filesystems")
+		}
+	}
+
+	if len(fs.BlockManifest) > 0 {
+		// azmount only verifies the blocks of read-only images in Azure Blob
+		// Storage
+		if fs.ReadWrite {
+			return errors.Errorf("block_manifest can't be used with read-write filesystems")
+		}
+		if strings.HasPrefix(fs.AzureUrl, ociURLPrefix) {
+			return errors.Errorf("block_manifest isn't supported for images in a container registry")
+		}
+		if fs.AzureFilesNfsShare != "" {
+			return errors.Errorf("block_manifest isn't supported for images in Azure Files shares")
+		}
+		for blockIndex, digest := range fs.BlockManifest {
+			if blockIndex < 0 {
+				return errors.Errorf("invalid block index in block_manifest: %d", blockIndex)
+			}
+			if !imageSha256Regexp.MatchString(digest) {
+				return errors.Errorf("invalid SHA-256 digest of block %d in block_manifest: %s", blockIndex, digest)
+			}
+		}
+	}
+
+	if fs.ValidateKey && fs.KeyFileFifo {
+		return errors.Errorf("validate_key can't be used with key_file_fifo")
+	}
+
+	if err := validateExpectPath(fs.ExpectPath); err != nil {
+		return err
+	}
+	// The image is opened relative to the mount folder of the share
+	if fs.AzureFilesNfsShare != "" && !filepath.IsLocal(fs.AzureFilesImagePath) {
+		return errors.Errorf("azure_files_image_path must be a relative path inside of the share: %s", fs.AzureFilesImagePath)
+	}
+	if err := validateHeaderUrl(fs, opts.AllowedStorageHosts); err != nil {
+		return err
+	}
+	if _, err := resolveKeyLength(fs.KeyLengthBytes, fs.KeyDerivationBlob); err != nil {
+		return err
+	}
+
+	switch fs.JournalPolicy {
+	case "":
+	case JournalPolicyNoload, JournalPolicyReplay, JournalPolicyRefuseIfDirty:
+		// Read-write filesystems always replay their journal
+		if fs.ReadWrite {
+			return errors.Errorf("journal_policy can't be used with read-write filesystems")
+		}
+	default:
+		return errors.Errorf("unknown journal policy: %s", fs.JournalPolicy)
+	}
+
+	// Mounts left behind by a previous run are handled before any key is
+	// released
+	mounter := opts.mounter()
+	reused, err := handleExistingMount(mounter, index, fs, opts.PreviousMounts)
+	if err != nil || reused {
+		return err
+	}
+	if err := checkMountPointFree(index, fs.MountPoint); err != nil {
+		return err
+	}
+
+	// Scratch filesystems don't have an image or a key
+	if fs.Tmpfs != nil {
+		if err := validateTmpfs(fs); err != nil {
+			return err
+		}
+		return mountTmpfs(mounter, steps, index, fs)
+	}
+
+	// 1) Mount remote image
+	steps.step("azmount")
+	var localImagePath string
+	imageSource := fs.AzureUrl
+	if fs.AzureFilesNfsShare != "" {
+		if fs.AzureUrl != "" {
+			return errors.Errorf("only one of azure_url and azure_files_nfs_share can be set")
+		}
+
+		var shareFolder string
+		shareFolder, err = mountAzureFilesShare(ctx, mounter, opts.ResolverPolicy, tempDir, index, fs.AzureFilesNfsShare, fs.ReadWrite)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				if inErr := mounter.Unmount(shareFolder, unix.MNT_DETACH); inErr != nil {
+					logrus.WithError(inErr).Debugf("failed to unmount: %s", shareFolder)
+				}
+			}
+		}()
+
+		localImagePath = filepath.Join(shareFolder, fs.AzureFilesImagePath)
+		imageSource = fs.AzureFilesNfsShare + "/" + fs.AzureFilesImagePath
+	}
+	if err = _checkImageExists(ctx, opts.Identity, fs, localImagePath); err != nil {
+		return err
+	}
+
+	// The detached LUKS header is fetched before azmount is started, and it
+	// is deleted on exit like the keyfile, as it is only read when the
+	// filesystem is opened
+	var headerPath string
+	if fs.HeaderUrl != "" {
+		headerFolder := filepath.Join(tempDir, fmt.Sprintf("header-%d", index))
+		if err := osMkdirAll(headerFolder, 0700); err != nil {
+			return errors.Wrapf(err, "failed to create header folder %s", headerFolder)
+		}
+		defer func() {
+			if inErr := osRemoveAll(headerFolder); inErr != nil {
+				logrus.WithError(inErr).Debugf("failed to delete header folder: %s", headerFolder)
+			} else {
+				logrus.Debugf("Deleted header folder: %s", headerFolder)
+			}
+		}()
+		logrus.Debugf("Downloading detached LUKS header %s", redactURL(fs.HeaderUrl))
+		if headerPath, err = _fetchHeader(ctx, opts.Identity, headerFolder, fs); err != nil {
+			return err
+		}
+	}
+	// azmount reads the block manifest when it starts, before it exposes the
+	// image, so it is deleted once the filesystem is mounted
+	var blockManifestPath string
+	if len(fs.BlockManifest) > 0 {
+		blockManifestPath = filepath.Join(tempDir, fmt.Sprintf("blockmanifest-%d.json", index))
+		manifestBytes, err := json.Marshal(fs.BlockManifest)
+		if err != nil {
+			return errors.Wrapf(err, "failed to marshal block manifest")
+		}
+		if err := ioutilWriteFile(blockManifestPath, manifestBytes, 0600); err != nil {
+			return errors.Wrapf(err, "failed to write block manifest %s", blockManifestPath)
+		}
+		defer func() {
+			if inErr := osRemoveAll(blockManifestPath); inErr != nil {
+				logrus.WithError(inErr).Debugf("failed to delete block manifest: %s", blockManifestPath)
+			}
+		}()
+	}
+	logrus.Debugf("Mounting remote image %s", imageSource)
+	imageLocalFile, azmountCmd, err := mountAzureFile(ctx, tempDir, index, azmountOptions{
+		identity:             opts.Identity,
+		allowedHosts:         opts.AllowedStorageHosts,
+		tlsPolicy:            opts.TLSPolicy,
+		resolverPolicy:       opts.ResolverPolicy,
+		connectionPolicy:     opts.ConnectionPolicy,
+		azureImageUrl:        fs.AzureUrl,
+		azureImageUrlPrivate: azureUrlPrivate,
+		localImagePath:       localImagePath,
+		logLevel:             azmountLogLevel,
+		cacheBlockSize:       cacheBlockSize,
+		numBlocks:            numBlocks,
+		accessPattern:        accessPattern,
+		maxUploadFailures:    maxUploadFailures,
+		readWrite:            fs.ReadWrite,
+		maxImageSizeBytes:    fs.MaxImageSizeBytes,
+		blockTimeoutMs:       fs.BlockTimeoutMs,
+		downloadConcurrency:  fs.DownloadConcurrency,
+		blockManifest:        blockManifestPath,
+	}, imageReadyTimeout)
+	if err != nil {
+		return errors.Wrapf(err, "failed to mount remote file: %s", imageSource)
+	}
+	defer func() {
+		if err != nil {
+			azmountStop(azmountCmd, filepath.Dir(imageLocalFile))
+		}
+	}()
+	fsStatus.AzmountPID = azmountPID(azmountCmd)
+
+	// The digest of the image is checked while the key is released and the
+	// filesystem is opened, and the mount waits for it
+	digest := startImageDigest(ctx, index, fs, imageLocalFile)
+	defer digest.Cancel()
+
+	// 2) Obtain keyfile
+	steps.step("key_release")
+	logrus.Infof("Obtaining keyfile...")
+	var keyFilePath string
+	// Filesystems are mounted concurrently, so each one has its own keyfile
+	keyFolder := filepath.Join(tempDir, fmt.Sprintf("key-%d", index))
+	if err := osMkdirAll(keyFolder, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create key folder %s", keyFolder)
+	}
+	if len(fs.KeyShares) > 0 {
+		if fs.KeyBlob.KID != "" {
+			return errors.Errorf("only one of key and key_shares can be set")
+		}
+		releasedKey, err = releaseKeyShares(ctx, opts, fs)
+		if err != nil {
+			return errors.Wrapf(err, "failed to obtain key from key shares")
+		}
+		auditKeyRelease(index, opts.CertState.Tcbm, fs.KeyShares)
+		keyFilePath, fsStatus.KeyDerivation, err = releaseRemoteFilesystemKey(ctx, opts, keyFolder, fs.KeyDerivationBlob, fs.KeyBlob, fs.KeyLengthBytes, fs.KeyFileFifo, releasedKey)
+		if err != nil {
+			return errors.Wrapf(err, "failed to obtain keyfile from key shares")
+		}
+	} else if fs.KeyBlob.KID != "" {
+		keyFilePath, fsStatus.KeyDerivation, err = releaseRemoteFilesystemKey(ctx, opts, keyFolder, keyDerivationBlob, fs.KeyBlob, fs.KeyLengthBytes, fs.KeyFileFifo, releasedKey)
+		if err != nil {
+			return errors.Wrapf(err, "failed to obtain keyfile %s", fs.KeyBlob.KID)
+		}
+		// Keys released up front have been audited already
+		if releasedKey == nil {
+			auditKeyRelease(index, opts.CertState.Tcbm, []common.KeyBlob{fs.KeyBlob})
+		}
+	} else if allowTestingWithRawKey {
+		keyFilePath, err = rawRemoteFilesystemKey(keyFolder, fs.RawKeyHexString, fs.KeyFileFifo)
+		if err != nil {
+			return errors.Wrapf(err, "failed to obtain keyfile %s", common.LogSecret(fs.RawKeyHexString))
+		}
+	}
+
+	defer func() {
+		// Delete keyfile on exit
+		if inErr := removeKeyFile(keyFilePath, fs.KeyFileFifo); inErr != nil {
+			logrus.WithError(inErr).Debugf("failed to delete keyfile: %s", keyFilePath)
+		} else {
+			logrus.Debugf("Deleted keyfile: %s", keyFilePath)
+		}
+	}()
+
+	// The binding is only in the derivation, which oct keys skip
+	if fs.BindKeyToVolume && fsStatus.KeyDerivation == nil {
+		return errors.Errorf("bind_key_to_volume needs an RSA key, %s isn't one", fs.KeyBlob.KID)
+	}
+
+	// 3) Open encrypted filesystem with cryptsetup. The result is a block
+	// device in /dev/mapper/remote-crypt-[filesystem-index] so that it is
+	// unique from all other filesystems.
+	steps.step("cryptsetup_open")
+	var deviceName = cryptDeviceName(index)
+	var deviceNamePath = "/dev/mapper/" + deviceName
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if fs.ValidateKey {
+		logrus.Debugf("Validating key against the LUKS header of %s", imageLocalFile)
+		if err = _cryptsetupTestKey(imageLocalFile, keyFilePath, headerPath, fs.CryptsetupOptions); err != nil {
+			return err
+		}
+	}
+
+	logrus.Debugf("Opening device at: %s", deviceNamePath)
+	err = _cryptsetupOpen(imageLocalFile, deviceName, keyFilePath, headerPath, fs.CryptsetupOptions)
+	if err != nil {
+		return errors.Wrapf(err, "luksOpen failed: %s", deviceName)
+	}
+	logrus.Debugf("Device opened: %s", deviceName)
+
+	defer func() {
+		// Don't leave the device behind if a later step fails or is cancelled
+		if err != nil {
+			if inErr := _cryptsetupClose(deviceName); inErr != nil {
+				logrus.WithError(inErr).Debugf("failed to close device: %s", deviceName)
+			}
+		}
+	}()
+
+	deviceNodeTimeout := defaultDeviceNodeTimeout
+	if fs.DeviceNodeTimeoutMs > 0 {
+		deviceNodeTimeout = time.Duration(fs.DeviceNodeTimeoutMs) * time.Millisecond
+	}
+	if err = waitForDeviceNode(ctx, deviceNamePath, deviceNodeTimeout); err != nil {
+		return err
+	}
+
+	prewarmRanges := fs.PrewarmRanges
+	if fs.PrewarmBytes > 0 {
+		prewarmRanges = append([]PrewarmRange{{Offset: 0, Length: fs.PrewarmBytes}}, prewarmRanges...)
+	}
+	if len(prewarmRanges) > 0 {
+		logrus.Infof("Prewarming cache of filesystem-%d...", index)
+		if err = prewarmDevice(ctx, deviceNamePath, prewarmRanges); err != nil {
+			return err
+		}
+	}
+
+	if fs.MinBandwidthBytesPerSec > 0 {
+		stats, statsErr := readDownloadStats(azmountStatsFilePath(tempDir, index))
+		if statsErr != nil {
+			logrus.WithError(statsErr).Warnf("Can't check the download bandwidth of filesystem-%d", index)
+		} else if err = checkDownloadBandwidth(index, fs, stats); err != nil {
+			return err
+		}
+	}
+
+	steps.step("image_digest")
+	if err = digest.Wait(); err != nil {
+		return err
+	}
+
+	steps.step("fsck")
+	if err = checkFilesystem(ctx, index, fs, deviceNamePath); err != nil {
+		return err
+	}
+	if err = checkJournal(index, fs, deviceNamePath); err != nil {
+		return err
+	}
+
+	// 4) Mount block device as a read-only filesystem.
+	steps.step("mount")
+	tempMountFolder, err := filesystemMountFolder(index, fs.MountPoint)
+	if err != nil {
+		return err
+	}
+
+	logrus.Debugf("Mounting filesystem-%d to: %s", index, tempMountFolder)
+
+	var flags uintptr
+	if !fs.ReadWrite {
+		flags = unix.MS_RDONLY
+	}
+	data := ext4MountData(fs)
+
+	logrus.Debugf("Creating mount folder: %s", tempMountFolder)
+	if err := osMkdirAll(tempMountFolder, 0755); err != nil {
+		return errors.Wrapf(err, "mkdir failed: %s", tempMountFolder)
+	}
+
+	logrus.Debugf("Mounting filesystem %s to mount folder %s", deviceNamePath, tempMountFolder)
+	if err := mounter.Mount(deviceNamePath, tempMountFolder, "ext4", flags, data); err != nil {
+		return newMountError(deviceNamePath, tempMountFolder, err)
+	}
+
+	defer func() {
+		if err != nil {
+			if inErr := mounter.Unmount(tempMountFolder, 0); inErr != nil {
+				logrus.WithError(inErr).Debugf("failed to unmount: %s", tempMountFolder)
+			}
+		}
+	}()
+
+	if fs.ExpectedFsUUID != "" {
+		fsUUID, err := readExt4UUID(deviceNamePath)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read UUID of filesystem-%d", index)
+		}
+		if !strings.EqualFold(fsUUID, fs.ExpectedFsUUID) {
+			return errors.Errorf("UUID of filesystem-%d is %s, expected %s", index, fsUUID, fs.ExpectedFsUUID)
+		}
+		logrus.Debugf("UUID of filesystem-%d matches: %s", index, fsUUID)
+	}
+
+	if err := checkContent(index, fs, tempMountFolder); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// 5) Create a symlink to the folder where the filesystem is mounted.
+	steps.step("symlink")
+	destPath := fs.MountPoint
+	logrus.Debugf("Creating symlink for filesystem-%d to: %s", index, destPath)
+
+	if err := os.Symlink(fmt.Sprintf(".filesystem-%d", index), destPath); err != nil {
+		return errors.Wrapf(err, "failed to symlink filesystem-%d: %s", index, destPath)
+	}
+
+	return nil
+}
+
+// needsKeyRelease returns whether any filesystem of info that isn't resumed
+// releases its key with SKR, which needs the UVM information.
+func needsKeyRelease(info RemoteFilesystemsInformation, resumed map[int]MountedFilesystem) bool {
+	for i, fs := range info.AzureFilesystems {
+		if _, ok := resumed[i]; ok {
+			continue
+		}
+		if fs.KeyBlob.KID != "" || len(fs.KeyShares) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUvmInformation checks the result of reading the UVM information. If it
+// is absent, it fails when info.RequireUvmInformation is set and a filesystem
+// needs SKR, instead of letting the key release fail later.
+func checkUvmInformation(info RemoteFilesystemsInformation, resumed map[int]MountedFilesystem, uvmInfo common.UvmInformation, uvmErr error) error {
+	if uvmErr == nil && uvmInfo.EncodedSecurityPolicy != "" {
+		return nil
+	}
+	if uvmErr == nil {
+		uvmErr = errors.New("no security policy found")
+	}
+
+	if info.RequireUvmInformation && needsKeyRelease(info, resumed) {
+		return errors.Wrapf(uvmErr, "UVM information is required to release the filesystem keys, but it is absent")
+	}
+	logrus.Infof("Failed to extract UVM_* environment variables: %s", uvmErr.Error())
+	return nil
+}
+
+// mountOrder returns the indexes of filesystems in the order they are mounted:
+// the required ones first and then the optional ones, each in the order of
+// the configuration.
+func mountOrder(filesystems []AzureFilesystem) []int {
+	order := make([]int, 0, len(filesystems))
+	for i, fs := range filesystems {
+		if !fs.Optional {
+			order = append(order, i)
+		}
+	}
+	for i, fs := range filesystems {
+		if fs.Optional {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// FilesystemsMountError is returned by MountAzureFilesystems when filesystems
+// fail to mount. It has the errors of all the failed filesystems, as they are
+// mounted concurrently.
+type FilesystemsMountError struct {
+	// Indexes of the failed filesystems, in the order they were mounted in
+	Indexes []int
+	Errs    []error
+}
+
+func (e *FilesystemsMountError) Error() string {
+	if len(e.Errs) == 1 {
+		return fmt.Sprintf("failed to mount filesystem index %d: %s", e.Indexes[0], e.Errs[0].Error())
+	}
+	indexes := make([]string, len(e.Indexes))
+	errs := make([]string, len(e.Errs))
+	for j, i := range e.Indexes {
+		indexes[j] = strconv.Itoa(i)
+		errs[j] = fmt.Sprintf("filesystem index %d: %s", i, e.Errs[j].Error())
+	}
+	return fmt.Sprintf("failed to mount filesystem indexes %s: %s", strings.Join(indexes, ", "), strings.Join(errs, "; "))
+}
+
+func (e *FilesystemsMountError) Unwrap() []error {
+	return e.Errs
+}
+
+// mountConcurrently calls mount for each filesystem index in indexes, with at
+// most maxConcurrent calls running at the same time. It waits for all of them
+// and returns a FilesystemsMountError with the ones that failed, or nil.
+func mountConcurrently(indexes []int, maxConcurrent int, mount func(int) error) error {
+	errs := make([]error, len(indexes))
+	semaphore := make(chan struct{}, maxConcurrent)
+	var wg sync.WaitGroup
+	for j, i := range indexes {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(j int, i int) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			errs[j] = mount(i)
+		}(j, i)
+	}
+	wg.Wait()
+
+	var mountErr FilesystemsMountError
+	for j, i := range indexes {
+		if errs[j] != nil {
+			mountErr.Indexes = append(mountErr.Indexes, i)
+			mountErr.Errs = append(mountErr.Errs, errs[j])
+		}
+	}
+	if len(mountErr.Errs) == 0 {
+		return nil
+	}
+	return &mountErr
+}
+
+// securityPolicySource returns the source of the security policy used when the
+// UVM information doesn't have it, or nil if there is none.
+func securityPolicySource(info RemoteFilesystemsInformation) common.PolicySource {
+	if PolicySource != nil {
+		return PolicySource
+	}
+	if info.SecurityPolicySource != nil {
+		source := *info.SecurityPolicySource
+		source.Identity = info.AzureInfo.Identity
+		return source
+	}
+	return nil
+}
+
+// MountAzureFilesystems mounts all the filesystems in info. Cancelling ctx
+// aborts the mount in progress and returns ctx.Err(). It blocks until the
+// optional filesystems are mounted too: only required_done in the status file
+// and the /readyz endpoint report that the required ones are mounted before.
+func MountAzureFilesystems(ctx context.Context, tempDir string, info RemoteFilesystemsInformation) (err error) {
+
+	status := newMountStatus(info)
+	updateStatusFile(status)
+
+	ctx, span := startSpan(ctx, "MountAzureFilesystems", Attribute{"filesystems", len(info.AzureFilesystems)})
+	defer func() {
+		endSpan(span, err)
+	}()
+	defer func() {
+		endTime := time.Now()
+		status.Done = true
+		status.EndTime = &endTime
+		status.Success = err == nil
+		if err != nil {
+			status.ErrorCode = statusErrorCode(err)
+			status.Error = statusErrorMessage(err, info)
+		}
+		updateStatusFile(status)
+	}()
+
+	// Bound the whole mount, whichever steps the time is spent in
+	ctx, progress := withMountProgress(ctx)
+	if info.MountDeadlineMs > 0 {
+		deadline := time.Duration(info.MountDeadlineMs) * time.Millisecond
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+		defer func() {
+			if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				step, index := progress.current()
+				err = &MountDeadlineError{Deadline: deadline, Step: step, Index: index, Err: err}
+			}
+		}()
+	}
+
+	if insecureStubAttestation {
+		logrus.Warn("INSECURE: built with stub attestation, released keys are NOT protected by hardware")
+	}
+
+	// The policies are used by the connections of this process and passed to
+	// the azmount processes
+	opts := MountOptions{
+		Identity:            info.AzureInfo.Identity,
+		AllowedStorageHosts: info.AllowedStorageHosts,
+		TLSPolicy:           info.TLSPolicy,
+		ResolverPolicy:      info.ResolverPolicy,
+		ConnectionPolicy:    info.ConnectionPolicy,
+	}
+	if err := common.SetTLSPolicy(opts.TLSPolicy); err != nil {
+		return errors.Wrapf(err, "invalid TLS policy")
+	}
+	if err := common.SetResolverPolicy(opts.ResolverPolicy); err != nil {
+		return errors.Wrapf(err, "invalid resolver policy")
+	}
+	if err := common.SetConnectionPolicy(opts.ConnectionPolicy); err != nil {
+		return errors.Wrapf(err, "invalid connection policy")
+	}
+	if err := attest.ValidateThimCertPolicy(info.AzureInfo.ThimCertPolicy); err != nil {
+		return err
+	}
+	if err := validatePostMountMode(info.PostMountMode); err != nil {
+		return err
+	}
+	if err := skr.SetMaxConcurrentReleases(info.MaxConcurrentKeyReleases); err != nil {
+		return errors.Wrapf(err, "invalid max_concurrent_key_releases")
+	}
+	if info.MaxConcurrentMounts < 0 {
+		return errors.Errorf("max_concurrent_mounts can't be negative")
+	}
+	if info.MaxKeyReleaseRetries < 0 || info.KeyReleaseBackoffMs < 0 {
+		return errors.Errorf("max_key_release_retries and key_release_backoff_ms can't be negative")
+	}
+	opts.MaxKeyReleaseRetries = info.MaxKeyReleaseRetries
+	opts.KeyReleaseBackoff = time.Duration(info.KeyReleaseBackoffMs) * time.Millisecond
+
+	filesystems, err := resolveMountPoints(info)
+	if err != nil {
+		return err
+	}
+	info.AzureFilesystems = filesystems
+	for i, fs := range info.AzureFilesystems {
+		status.Filesystems[i].MountPoint = fs.MountPoint
+	}
+
+	// Check all the hosts before any key is released
+	setMountStep(ctx, -1, "check_storage_hosts")
+	for i, fs := range info.AzureFilesystems {
+		if err := checkStorageHost(fs, opts.AllowedStorageHosts); err != nil {
+			status.Filesystems[i].State = FilesystemStateFailed
+			status.Filesystems[i].ErrorCode = statusErrorCode(err)
+			status.Filesystems[i].Error = statusErrorMessage(err, info)
+			return errors.Wrapf(err, "failed to mount filesystem index %d", i)
+		}
+	}
+
+	// Check that cryptsetup supports all the filesystems before any key is
+	// released, rather than failing when opening them
+	if len(info.AzureFilesystems) > 0 {
+		setMountStep(ctx, -1, "cryptsetup_probe")
+		cryptsetupVersion, err := _cryptsetupProbe()
+		if err != nil {
+			return errors.Wrapf(err, "failed to get the version of cryptsetup")
+		}
+		logrus.Infof("cryptsetup version: %s", cryptsetupVersion)
+		status.CryptsetupVersion = cryptsetupVersion.String()
+
+		for i, fs := range info.AzureFilesystems {
+			if err := checkCryptsetupFeatures(cryptsetupVersion, fs); err != nil {
+				status.Filesystems[i].State = FilesystemStateFailed
+				status.Filesystems[i].ErrorCode = statusErrorCode(err)
+				status.Filesystems[i].Error = statusErrorMessage(err, info)
+				return errors.Wrapf(err, "failed to mount filesystem index %d", i)
+			}
+		}
+	}
+
+	// Skip the filesystems that a previous run has already mounted
+	var state MountState
+	resumed := make(map[int]MountedFilesystem)
+	if StateFilePath != "" {
+		previousState, stateErr := readMountState(StateFilePath)
+		if stateErr != nil {
+			logrus.WithError(stateErr).Warn("Ignoring state file")
+		}
+		resumed = resumableFilesystems(info, previousState)
+		opts.PreviousMounts = previousState.Filesystems
+		for i := range info.AzureFilesystems {
+			if mounted, ok := resumed[i]; ok {
+				logrus.Infof("Filesystem-%d is already mounted, skipping it", i)
+				span.AddEvent("filesystem resumed", Attribute{"index", i})
+				state.Filesystems = append(state.Filesystems, mounted)
+				status.Filesystems[i].State = FilesystemStateMounted
+				status.Filesystems[i].Resumed = true
+				status.Filesystems[i].AzmountPID = mounted.AzmountPID
+				audit(AuditEvent{Event: AuditFilesystemResumed, Index: i, MountPoint: mounted.MountPoint, Source: mounted.Source})
+			}
+		}
+		updateStateFile(state)
+		updateStatusFile(status)
+	}
+
+	// Retrieve the incoming encoded security policy, cert and uvm endorsement
+	setMountStep(ctx, -1, "uvm_information")
+	opts.UvmInformation, err = common.GetUvmInformation()
+	if policySource := securityPolicySource(info); opts.UvmInformation.EncodedSecurityPolicy == "" && policySource != nil && needsKeyRelease(info, resumed) {
+		setMountStep(ctx, -1, "security_policy")
+		policy, policyErr := policySource.EncodedSecurityPolicy(ctx)
+		if policyErr != nil {
+			return errors.Wrapf(policyErr, "failed to fetch the security policy")
+		}
+		logrus.Info("Security policy fetched from its source")
+		opts.UvmInformation.EncodedSecurityPolicy, err = policy, nil
+	}
+	if err := checkUvmInformation(info, resumed, opts.UvmInformation, err); err != nil {
+		return err
+	}
+
+	setMountStep(ctx, -1, "thim_certs")
+	opts.UvmInformation.InitialCerts, err = info.AzureInfo.CertFetcher.InitialCerts(ctx, info.AzureInfo.ThimCertPolicy, opts.UvmInformation.InitialCerts, info.AzureInfo.CertFetcher.Endpoint)
+	if err != nil {
+		return errors.Wrapf(err, "failed to retrieve THIM certs")
+	}
+
+	logrus.Debugf("UvmInformation.InitialCerts.Tcbm: %s\n", opts.UvmInformation.InitialCerts.Tcbm)
+	thimTcbm, err := strconv.ParseUint(opts.UvmInformation.InitialCerts.Tcbm, 16, 64)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse THIM TCBM")
+	}
+
+	reportDataNonce, err := hex.DecodeString(info.AzureInfo.ReportDataNonce)
+	if err != nil {
+		return errors.Wrapf(err, "failed to decode report data nonce hexstring")
+	}
+	if err := attest.ValidateReportDataNonce(reportDataNonce); err != nil {
+		return err
+	}
+	if len(reportDataNonce) > 0 {
+		logrus.Infof("Report data nonce: %s", hex.EncodeToString(reportDataNonce))
+	}
+
+	opts.CertState = attest.CertState{
+		CertFetcher:     info.AzureInfo.CertFetcher,
+		Tcbm:            thimTcbm,
+		ReportDataNonce: reportDataNonce,
+		// The SNP device appears late on some hosts
+		SNPDeviceTimeoutMs: info.AzureInfo.SNPDeviceTimeoutMs,
+		CertChainPolicy:    info.AzureInfo.CertChainPolicy,
+	}
+	span.SetAttributes(Attribute{"tcbm", strconv.FormatUint(thimTcbm, 16)})
+
+	// Release all the keys up front if requested, so that they are released
+	// concurrently and any failure happens before any device is created. The
+	// keys of optional filesystems are released when they are mounted, so
+	// that failing to release them doesn't fail the required ones.
+	releasedKeys := make([]jwk.Key, len(info.AzureFilesystems))
+	if info.PreReleaseKeys {
+		var reqs []skr.KeyReleaseRequest
+		var indexes []int
+		for i, fs := range info.AzureFilesystems {
+			if _, ok := resumed[i]; ok {
+				continue
+			}
+			if fs.KeyBlob.KID != "" && !fs.Optional {
+				reqs = append(reqs, skr.KeyReleaseRequest{KeyBlob: fs.KeyBlob})
+				indexes = append(indexes, i)
+			}
+		}
+
+		logrus.Infof("Releasing %d keys...", len(reqs))
+		setMountStep(ctx, -1, "prerelease_keys")
+		results, err := releaseKeysWithRetry(ctx, &opts, reqs)
+		if err != nil {
+			return errors.Wrapf(err, "failed to release keys")
+		}
+		for j, result := range results {
+			releasedKeys[indexes[j]] = result.Key
+			auditKeyRelease(indexes[j], opts.CertState.Tcbm, []common.KeyBlob{info.AzureFilesystems[indexes[j]].KeyBlob})
+		}
+	}
+
+	// The workload can start once the required filesystems are mounted
+	markRequiredDone := func() {
+		if !status.RequiredDone {
+			logrus.Info("All required filesystems are mounted")
+			status.RequiredDone = true
+			updateStatusFile(status)
+		}
+	}
+
+	// The filesystems are mounted concurrently. The status and state files
+	// are shared, so they are only updated with mountMutex held.
+	var mountMutex sync.Mutex
+	mount := func(i int) error {
+		fs := info.AzureFilesystems[i]
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		log := logrus.WithFields(logrus.Fields{
+			common.LogFieldFilesystemIndex: i,
+			common.LogFieldAzureURL:        redactURL(filesystemSource(fs)),
+			common.LogFieldMountPoint:      fs.MountPoint,
+		})
+		log.Infof("Mounting Azure Storage blob %d...", i)
+
+		mountMutex.Lock()
+		fsStatus := status.Filesystems[i]
+		mountMutex.Unlock()
+		startTime := time.Now()
+		err := _mountSingleFilesystem(ctx, &opts, tempDir, i, fs, releasedKeys[i], &fsStatus)
+		fsStatus.DurationMs = time.Since(startTime).Milliseconds()
+		log = log.WithField(common.LogFieldDurationMs, fsStatus.DurationMs)
+		if err != nil {
+			log.WithError(err).Errorf("Failed to mount filesystem-%d", i)
+		} else {
+			log.Infof("Mounted filesystem-%d", i)
+		}
+		if stats, statsErr := readDownloadStats(azmountStatsFilePath(tempDir, i)); statsErr == nil {
+			logrus.Infof("Filesystem-%d downloaded %d bytes in %d ms (%d bytes/s)", i, stats.BytesDownloaded, stats.DownloadTimeMs, stats.BandwidthBytesPerSec)
+			fsStatus.Download = &stats
+		}
+
+		mountMutex.Lock()
+		defer mountMutex.Unlock()
+		if err != nil {
+			fsStatus.State = FilesystemStateFailed
+			fsStatus.ErrorCode = statusErrorCode(err)
+			fsStatus.Error = statusErrorMessage(err, info)
+			status.Filesystems[i] = fsStatus
+			audit(AuditEvent{Event: AuditFilesystemFailed, Index: i, Source: filesystemSource(fs), ErrorCode: fsStatus.ErrorCode})
+			if fs.Optional && ctx.Err() == nil {
+				logrus.WithError(err).Warnf("Failed to mount optional filesystem-%d, skipping it", i)
+				updateStatusFile(status)
+				return nil
+			}
+			return err
+		}
+		fsStatus.State = FilesystemStateMounted
+		status.Filesystems[i] = fsStatus
+		updateStatusFile(status)
+		audit(AuditEvent{Event: AuditFilesystemMounted, Index: i, MountPoint: fs.MountPoint, Source: filesystemSource(fs)})
+
+		if StateFilePath != "" {
+			mounted := MountedFilesystem{
+				Index:      i,
+				MountPoint: fs.MountPoint,
+				Source:     filesystemSource(fs),
+				AzmountPID: fsStatus.AzmountPID,
+			}
+			if fs.AzureFilesNfsShare != "" {
+				mounted.ShareFolder = azureFilesShareFolder(tempDir, i)
+			}
+			// tmpfs filesystems don't have a device
+			if fs.Tmpfs == nil {
+				deviceName := cryptDeviceName(i)
+				fsUUID, err := _readExt4UUID("/dev/mapper/" + deviceName)
+				if err != nil {
+					logrus.WithError(err).Warnf("Filesystem-%d won't be resumed after a restart", i)
+					return nil
+				}
+				mounted.DeviceName, mounted.FsUUID = deviceName, fsUUID
+			}
+			state.Filesystems = append(state.Filesystems, mounted)
+			updateStateFile(state)
+		}
+		return nil
+	}
+
+	maxConcurrentMounts := info.MaxConcurrentMounts
+	if maxConcurrentMounts == 0 {
+		maxConcurrentMounts = runtime.NumCPU()
+	}
+	var required, optional []int
+	for _, i := range mountOrder(info.AzureFilesystems) {
+		if _, ok := resumed[i]; ok {
+			continue
+		}
+		if info.AzureFilesystems[i].Optional {
+			optional = append(optional, i)
+		} else {
+			required = append(required, i)
+		}
+	}
+	if err := mountConcurrently(required, maxConcurrentMounts, mount); err != nil {
+		return err
+	}
+	markRequiredDone()
+	if err := mountConcurrently(optional, maxConcurrentMounts, mount); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,1164 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/attest"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/skr"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/sys/unix"
+)
+
+func Test_MountAzureFile_Cancelled(t *testing.T) {
+	origAzmountRun, origStat, origUnmount := _azmountRun, osStat, unixUnmount
+	defer func() {
+		_azmountRun, osStat, unixUnmount = origAzmountRun, origStat, origUnmount
+	}()
+
+	_azmountRun = func(azmountOptions) (*exec.Cmd, error) {
+		return nil, nil
+	}
+	// The image never shows up
+	osStat = func(string) (os.FileInfo, error) {
+		return nil, os.ErrNotExist
+	}
+	unmounted := false
+	unixUnmount = func(string, int) error {
+		unmounted = true
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := mountAzureFile(ctx, t.TempDir(), 0, azmountOptions{azureImageUrl: "https://test.blob.core.windows.net/c/image"}, defaultImageReadyTimeout)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if !unmounted {
+		t.Fatalf("expected azmount mount point to be detached")
+	}
+}
+
+func Test_MountAzureFile_AzmountExited(t *testing.T) {
+	origAzmountRun, origAzmountExited, origStat, origTimeAfter, origReadFile, origUnmount := _azmountRun, _azmountExited, osStat, timeAfter, ioutilReadFile, unixUnmount
+	defer func() {
+		_azmountRun, _azmountExited, osStat, timeAfter, ioutilReadFile, unixUnmount = origAzmountRun, origAzmountExited, origStat, origTimeAfter, origReadFile, origUnmount
+	}()
+
+	blockTimeoutMs := 0
+	_azmountRun = func(opts azmountOptions) (*exec.Cmd, error) {
+		blockTimeoutMs = opts.blockTimeoutMs
+		return nil, nil
+	}
+	_azmountExited = func(*exec.Cmd) bool {
+		return true
+	}
+	// The image never shows up
+	osStat = func(string) (os.FileInfo, error) {
+		return nil, os.ErrNotExist
+	}
+	// Poll faster, the readiness timeout still applies
+	polls := 0
+	timeAfter = func(time.Duration) <-chan time.Time {
+		polls++
+		return time.After(10 * time.Millisecond)
+	}
+	ioutilReadFile = func(string) ([]byte, error) {
+		return []byte("authorization failed"), nil
+	}
+	var unmounted []string
+	unixUnmount = func(target string, flags int) error {
+		unmounted = append(unmounted, target)
+		return nil
+	}
+
+	tempDir := t.TempDir()
+	start := time.Now()
+	_, _, err := mountAzureFile(context.Background(), tempDir, 0, azmountOptions{azureImageUrl: "https://test.blob.core.windows.net/c/image", blockTimeoutMs: 5000}, 200*time.Millisecond)
+	var notReady *AzmountNotReadyError
+	if !errors.As(err, &notReady) {
+		t.Fatalf("expected AzmountNotReadyError, got %v", err)
+	}
+	if !notReady.AzmountExited {
+		t.Fatalf("expected the timeout to report that azmount exited")
+	}
+	if len(unmounted) != 1 || unmounted[0] != filepath.Join(tempDir, "0") {
+		t.Fatalf("expected azmount to be stopped after the timeout, got unmounts %v", unmounted)
+	}
+	if !strings.Contains(notReady.LogTail, "authorization failed") || strings.Contains(err.Error(), "authorization failed") {
+		t.Fatalf("expected the azmount log in LogTail only, got %q and %v", notReady.LogTail, err)
+	}
+	if logFile := filepath.Join(tempDir, "log-0.txt"); notReady.LogFile != logFile || !strings.Contains(err.Error(), logFile) {
+		t.Fatalf("expected the path of the azmount log in the error, got %v", err)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected error to wrap the stat error")
+	}
+
+	// The readiness timeout sets how long to wait for the image, and the block
+	// timeout is passed to azmount
+	if elapsed := time.Since(start); notReady.Timeout != 200*time.Millisecond || elapsed < 200*time.Millisecond || elapsed > 5*time.Second || polls < 2 {
+		t.Fatalf("expected to wait 200ms, waited %s in %d polls", elapsed, polls)
+	}
+	if blockTimeoutMs != 5000 {
+		t.Fatalf("expected block timeout of 5000 ms to be passed to azmount, got %d", blockTimeoutMs)
+	}
+}
+
+func Test_AzmountArgs(t *testing.T) {
+	argValue := func(args []string, name string) (string, bool) {
+		for i := 0; i+1 < len(args); i++ {
+			if args[i] == name {
+				return args[i+1], true
+			}
+		}
+		return "", false
+	}
+
+	for _, tc := range []struct {
+		name                string
+		downloadConcurrency int
+		want                string
+	}{
+		{"default", 0, "1"},
+		{"set", 4, "4"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args, err := azmountArgs(azmountOptions{
+				imageLocalFolder:    "/tmp/remotefs-0",
+				azureImageUrl:       "https://account.blob.core.windows.net/container/image.img",
+				blockTimeoutMs:      5000,
+				downloadConcurrency: tc.downloadConcurrency,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := argValue(args, "-downloadconcurrency"); !ok || got != tc.want {
+				t.Errorf("-downloadconcurrency = %q, %v, want %q", got, ok, tc.want)
+			}
+			if got, _ := argValue(args, "-blocktimeout"); got != "5000" {
+				t.Errorf("-blocktimeout = %q, want 5000", got)
+			}
+			if _, ok := argValue(args, "-blockmanifest"); ok {
+				t.Errorf("-blockmanifest passed without a manifest: %v", args)
+			}
+		})
+	}
+
+	args, err := azmountArgs(azmountOptions{
+		imageLocalFolder: "/tmp/remotefs-0",
+		azureImageUrl:    "https://account.blob.core.windows.net/container/image.img",
+		blockManifest:    "/tmp/blockmanifest-0.json",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := argValue(args, "-blockmanifest"); got != "/tmp/blockmanifest-0.json" {
+		t.Errorf("-blockmanifest = %q, want /tmp/blockmanifest-0.json", got)
+	}
+
+	// Images in Azure Files shares are read from the share, not downloaded
+	args, err = azmountArgs(azmountOptions{
+		imageLocalFolder:    "/tmp/remotefs-0",
+		localImagePath:      "/tmp/share-0/image.img",
+		downloadConcurrency: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := argValue(args, "-downloadconcurrency"); ok {
+		t.Errorf("-downloadconcurrency passed for a local image: %v", args)
+	}
+	if got, _ := argValue(args, "-localpath"); got != "/tmp/share-0/image.img" {
+		t.Errorf("-localpath = %q", got)
+	}
+}
+
+func Test_CheckImageFile(t *testing.T) {
+	dir := t.TempDir()
+	imageLocalFile := filepath.Join(dir, "data")
+	statsFile := filepath.Join(dir, "stats.json")
+	writeStats := func(stats string) {
+		if err := os.WriteFile(statsFile, []byte(stats), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := checkImageFile(imageLocalFile, statsFile); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected missing image to fail, got %v", err)
+	}
+
+	// A node that isn't a regular file
+	if err := os.Mkdir(imageLocalFile, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeStats(`{"file_size": 4096}`)
+	if err := checkImageFile(imageLocalFile, statsFile); err == nil {
+		t.Fatalf("expected directory to fail")
+	}
+	if err := os.Remove(imageLocalFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// An empty file before azmount reports the size
+	if err := os.WriteFile(imageLocalFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeStats(`{"bytes_downloaded": 0}`)
+	if err := checkImageFile(imageLocalFile, statsFile); err == nil {
+		t.Fatalf("expected image without reported size to fail")
+	}
+
+	// A partial file
+	writeStats(`{"file_size": 4096}`)
+	if err := os.WriteFile(imageLocalFile, make([]byte, 512), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkImageFile(imageLocalFile, statsFile); err == nil {
+		t.Fatalf("expected partial image to fail")
+	}
+
+	if err := os.WriteFile(imageLocalFile, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkImageFile(imageLocalFile, statsFile); err != nil {
+		t.Fatalf("expected complete image to pass: %v", err)
+	}
+}
+
+func Test_WaitForDeviceNode(t *testing.T) {
+	origStat := osStat
+	defer func() { osStat = origStat }()
+
+	// The device node appears on the third check
+	checks := 0
+	osStat = func(string) (os.FileInfo, error) {
+		checks++
+		if checks < 3 {
+			return nil, os.ErrNotExist
+		}
+		return nil, nil
+	}
+	if err := waitForDeviceNode(context.Background(), "/dev/mapper/remote-crypt-0", time.Second); err != nil {
+		t.Fatalf("expected device node to be found, got %v", err)
+	}
+
+	// The device node never appears
+	osStat = func(string) (os.FileInfo, error) {
+		return nil, os.ErrNotExist
+	}
+	err := waitForDeviceNode(context.Background(), "/dev/mapper/remote-crypt-0", 50*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+}
+
+func Test_PrewarmDevice(t *testing.T) {
+	devicePath := filepath.Join(t.TempDir(), "device")
+	if err := os.WriteFile(devicePath, make([]byte, 3*prewarmChunkSize), 0644); err != nil {
+		t.Fatalf("failed to create device file: %v", err)
+	}
+
+	// The last range goes past the end of the device
+	ranges := []PrewarmRange{{Offset: 0, Length: 2*prewarmChunkSize + 1}, {Offset: 2 * prewarmChunkSize, Length: 2 * prewarmChunkSize}}
+	if err := prewarmDevice(context.Background(), devicePath, ranges); err != nil {
+		t.Fatalf("prewarmDevice failed: %v", err)
+	}
+
+	if err := prewarmDevice(context.Background(), devicePath, []PrewarmRange{{Offset: -1, Length: 1}}); err == nil {
+		t.Fatalf("expected invalid range to be rejected")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := prewarmDevice(ctx, devicePath, ranges); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func Test_ReadExt4UUID(t *testing.T) {
+	devicePath := filepath.Join(t.TempDir(), "device")
+	image := make([]byte, 4096)
+	// ext4 magic number and UUID in the superblock
+	image[ext4SuperblockOffset+ext4MagicOffset] = 0x53
+	image[ext4SuperblockOffset+ext4MagicOffset+1] = 0xEF
+	copy(image[ext4SuperblockOffset+ext4UUIDOffset:], []byte{
+		0x0f, 0x2a, 0x3c, 0x4d, 0x5e, 0x6f, 0x47, 0x81,
+		0x92, 0xa3, 0xb4, 0xc5, 0xd6, 0xe7, 0xf8, 0x09})
+	if err := os.WriteFile(devicePath, image, 0644); err != nil {
+		t.Fatalf("failed to create device file: %v", err)
+	}
+
+	uuid, err := readExt4UUID(devicePath)
+	if err != nil {
+		t.Fatalf("readExt4UUID failed: %v", err)
+	}
+	if uuid != "0f2a3c4d-5e6f-4781-92a3-b4c5d6e7f809" {
+		t.Fatalf("unexpected UUID: %s", uuid)
+	}
+
+	// Not an ext4 filesystem
+	if err := os.WriteFile(devicePath, make([]byte, 4096), 0644); err != nil {
+		t.Fatalf("failed to create device file: %v", err)
+	}
+	if _, err := readExt4UUID(devicePath); err == nil {
+		t.Fatalf("expected error for device without ext4 filesystem")
+	}
+}
+
+func Test_NewMountError(t *testing.T) {
+	for _, errno := range []unix.Errno{unix.EINVAL, unix.EIO, unix.ENOSPC, unix.EBUSY} {
+		err := newMountError("/dev/mapper/remote-crypt-0", "/mnt/.filesystem-0", errno)
+		var mountErr *MountError
+		if !errors.As(err, &mountErr) {
+			t.Fatalf("expected MountError for %v, got %v", errno, err)
+		}
+		if mountErr.Reason == "mount failed" {
+			t.Fatalf("expected specific reason for %v", errno)
+		}
+		if !errors.Is(err, errno) {
+			t.Fatalf("expected error to wrap %v", errno)
+		}
+	}
+
+	// Errors that aren't errnos are wrapped as they are
+	err := newMountError("/dev/mapper/remote-crypt-0", "/mnt/.filesystem-0", errors.New("failure"))
+	var mountErr *MountError
+	if errors.As(err, &mountErr) {
+		t.Fatalf("expected plain error, got MountError")
+	}
+}
+
+func Test_Ext4MountData(t *testing.T) {
+	for _, tc := range []struct {
+		fs   AzureFilesystem
+		data string
+	}{
+		{AzureFilesystem{}, "noload"},
+		{AzureFilesystem{ReadWrite: true}, ""},
+		{AzureFilesystem{ReadWrite: true, UploadFailurePolicy: UploadFailurePolicyRemountReadOnly}, "errors=remount-ro"},
+		{AzureFilesystem{SELinuxContext: "system_u:object_r:container_file_t:s0:c1,c2"}, `noload,context="system_u:object_r:container_file_t:s0:c1,c2"`},
+		{AzureFilesystem{JournalPolicy: JournalPolicyReplay}, ""},
+		{AzureFilesystem{JournalPolicy: JournalPolicyRefuseIfDirty}, "noload"},
+	} {
+		if data := ext4MountData(tc.fs); data != tc.data {
+			t.Errorf("expected %q, got %q", tc.data, data)
+		}
+	}
+
+	for _, selinuxContext := range []string{"system_u:object_r:container_file_t:s0", "u:r:t", "system_u:object_r:container_file_t:s0-s0:c0.c1023"} {
+		if !selinuxContextRegexp.MatchString(selinuxContext) {
+			t.Errorf("expected %s to be a valid SELinux context", selinuxContext)
+		}
+	}
+	for _, selinuxContext := range []string{"container_file_t", `u:r:t:s0",nosuid`, "u:r:t:s0 c1"} {
+		if selinuxContextRegexp.MatchString(selinuxContext) {
+			t.Errorf("expected %s to be rejected", selinuxContext)
+		}
+	}
+}
+
+func Test_MountAzureFilesShare(t *testing.T) {
+	origLookupHost, origMount := _lookupHost, unixMount
+	defer func() {
+		_lookupHost, unixMount = origLookupHost, origMount
+	}()
+
+	var mountSource, mountFstype, mountData string
+	var mountFlags uintptr
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		mountSource, mountFstype, mountFlags, mountData = source, fstype, flags, data
+		return nil
+	}
+
+	// The host is resolved with the resolver policy
+	share := "account.file.core.windows.net:/account/share"
+	resolverPolicy := common.ResolverPolicy{Hosts: map[string]string{"account.file.core.windows.net": "10.0.0.4"}}
+	shareFolder, err := mountAzureFilesShare(context.Background(), unixMounter{}, resolverPolicy, t.TempDir(), 0, share, false)
+	if err != nil {
+		t.Fatalf("mountAzureFilesShare failed: %v", err)
+	}
+	if filepath.Base(shareFolder) != "share-0" {
+		t.Fatalf("unexpected share folder: %s", shareFolder)
+	}
+	if mountSource != share || mountFstype != "nfs4" || mountFlags != unix.MS_RDONLY {
+		t.Fatalf("unexpected mount of %s (%s, flags %d)", mountSource, mountFstype, mountFlags)
+	}
+	if !strings.Contains(mountData, "vers=4.1") || !strings.Contains(mountData, "addr=10.0.0.4") {
+		t.Fatalf("unexpected mount options: %s", mountData)
+	}
+
+	if _, err := mountAzureFilesShare(context.Background(), unixMounter{}, common.ResolverPolicy{}, t.TempDir(), 0, "account/share", false); err == nil {
+		t.Fatalf("expected invalid share to be rejected")
+	}
+
+	_lookupHost = func(policy common.ResolverPolicy, ctx context.Context, host string) ([]string, error) {
+		return nil, nil
+	}
+	if _, err := mountAzureFilesShare(context.Background(), unixMounter{}, common.ResolverPolicy{}, t.TempDir(), 0, share, false); err == nil {
+		t.Fatalf("expected a host without addresses to be rejected")
+	}
+}
+
+func Test_ContainerMountAzureFilesystem_AzureFilesImagePath(t *testing.T) {
+	for _, imagePath := range []string{"", "../other-share/image.img", "/image.img"} {
+		fs := AzureFilesystem{
+			MountPoint:          filepath.Join(t.TempDir(), "share"),
+			AzureFilesNfsShare:  "account.file.core.windows.net:/account/share",
+			AzureFilesImagePath: imagePath,
+		}
+		err := containerMountAzureFilesystem(context.Background(), &MountOptions{}, t.TempDir(), 0, fs, nil, &FilesystemStatus{})
+		if err == nil || !strings.Contains(err.Error(), "azure_files_image_path") {
+			t.Errorf("expected %q to be rejected, got %v", imagePath, err)
+		}
+	}
+}
+
+func Test_ContainerMountAzureFilesystem_BlockManifest(t *testing.T) {
+	digest := strings.Repeat("ab", 32)
+	for _, tc := range []struct {
+		name string
+		fs   AzureFilesystem
+	}{
+		{"read-write", AzureFilesystem{AzureUrl: "https://account.blob.core.windows.net/c/image", ReadWrite: true}},
+		{"registry", AzureFilesystem{AzureUrl: "oci://registry.azurecr.io/image:latest"}},
+		{"share", AzureFilesystem{AzureFilesNfsShare: "account.file.core.windows.net:/account/share", AzureFilesImagePath: "image.img"}},
+		{"digest", AzureFilesystem{AzureUrl: "https://account.blob.core.windows.net/c/image", BlockManifest: map[int64]string{0: "abcd"}}},
+		{"index", AzureFilesystem{AzureUrl: "https://account.blob.core.windows.net/c/image", BlockManifest: map[int64]string{-1: digest}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := tc.fs
+			fs.MountPoint = filepath.Join(t.TempDir(), "data")
+			if fs.BlockManifest == nil {
+				fs.BlockManifest = map[int64]string{0: digest}
+			}
+			err := containerMountAzureFilesystem(context.Background(), &MountOptions{}, t.TempDir(), 0, fs, nil, &FilesystemStatus{})
+			if err == nil || !strings.Contains(err.Error(), "block_manifest") {
+				t.Errorf("expected the block manifest to be rejected, got %v", err)
+			}
+		})
+	}
+
+	origCheckImageExists, origAzmountRun, origSecureKeyRelease, origUnmount := _checkImageExists, _azmountRun, _secureKeyRelease, unixUnmount
+	defer func() {
+		_checkImageExists, _azmountRun, _secureKeyRelease, unixUnmount = origCheckImageExists, origAzmountRun, origSecureKeyRelease, origUnmount
+	}()
+	_checkImageExists = func(ctx context.Context, identity common.Identity, fs AzureFilesystem, localImagePath string) error {
+		return nil
+	}
+	// azmount is passed the manifest, which it reads when it starts
+	var manifestPath string
+	var manifest map[int64]string
+	_azmountRun = func(opts azmountOptions) (*exec.Cmd, error) {
+		manifestPath = opts.blockManifest
+		manifestBytes, err := os.ReadFile(opts.blockManifest)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(opts.imageLocalFolder, "data"), make([]byte, 4096), 0644); err != nil {
+			return nil, err
+		}
+		return nil, os.WriteFile(opts.statsFile, []byte(`{"file_size": 4096}`), 0644)
+	}
+	unixUnmount = func(target string, flags int) error {
+		return nil
+	}
+	_secureKeyRelease = func(ctx context.Context, identity common.Identity, certState attest.CertState, keyBlob common.KeyBlob, uvmInformation common.UvmInformation) (jwk.Key, error) {
+		return nil, errors.New("release denied")
+	}
+
+	fs := AzureFilesystem{
+		AzureUrl:      "https://account.blob.core.windows.net/c/image",
+		MountPoint:    filepath.Join(t.TempDir(), "data"),
+		KeyBlob:       common.KeyBlob{KID: "key"},
+		BlockManifest: map[int64]string{0: digest, 7: strings.ToUpper(digest)},
+	}
+	tempDir := t.TempDir()
+	if err := containerMountAzureFilesystem(context.Background(), &MountOptions{}, tempDir, 0, fs, nil, &FilesystemStatus{}); err == nil {
+		t.Fatal("expected the denied release to fail the mount")
+	}
+	if filepath.Dir(manifestPath) != tempDir || len(manifest) != 2 || manifest[7] != strings.ToUpper(digest) {
+		t.Errorf("expected azmount to be passed the manifest, got %q with %v", manifestPath, manifest)
+	}
+	if _, err := os.Stat(manifestPath); !os.IsNotExist(err) {
+		t.Errorf("expected the block manifest to be deleted, got %v", err)
+	}
+}
+
+func Test_CheckStorageHost(t *testing.T) {
+	blob := AzureFilesystem{AzureUrl: "https://account.blob.core.windows.net/c/image"}
+	share := AzureFilesystem{AzureFilesNfsShare: "account.file.core.windows.net:/account/share"}
+
+	if err := checkStorageHost(blob, nil); err != nil {
+		t.Fatalf("expected any host to be allowed: %v", err)
+	}
+
+	allowedHosts := []string{"*.blob.core.windows.net"}
+	if err := checkStorageHost(blob, allowedHosts); err != nil {
+		t.Fatalf("expected blob host to be allowed: %v", err)
+	}
+	if err := checkStorageHost(share, allowedHosts); err == nil {
+		t.Fatalf("expected share host to be rejected")
+	}
+	if err := checkStorageHost(AzureFilesystem{AzureUrl: "https://attacker.example.com/c/image"}, allowedHosts); err == nil {
+		t.Fatalf("expected attacker host to be rejected")
+	}
+
+	if err := checkStorageHost(share, []string{"account.file.core.windows.net"}); err != nil {
+		t.Fatalf("expected share host to be allowed: %v", err)
+	}
+}
+
+func Test_CheckUvmInformation(t *testing.T) {
+	rawKeyOnly := RemoteFilesystemsInformation{
+		RequireUvmInformation: true,
+		AzureFilesystems:      []AzureFilesystem{{RawKeyHexString: "00"}},
+	}
+	withSKR := RemoteFilesystemsInformation{
+		RequireUvmInformation: true,
+		AzureFilesystems: []AzureFilesystem{
+			{RawKeyHexString: "00"},
+			{KeyBlob: common.KeyBlob{KID: "key"}},
+		},
+	}
+	absent := common.UvmInformation{}
+	present := common.UvmInformation{EncodedSecurityPolicy: "cGFja2FnZQ=="}
+
+	if err := checkUvmInformation(withSKR, nil, present, nil); err != nil {
+		t.Fatalf("expected present UVM information to pass: %v", err)
+	}
+	if err := checkUvmInformation(rawKeyOnly, nil, absent, nil); err != nil {
+		t.Fatalf("expected raw keys to tolerate absent UVM information: %v", err)
+	}
+	if err := checkUvmInformation(withSKR, nil, absent, nil); err == nil {
+		t.Fatalf("expected absent UVM information to fail with SKR")
+	}
+	if err := checkUvmInformation(withSKR, nil, absent, errors.New("bad certificate")); err == nil {
+		t.Fatalf("expected failure to read UVM information to fail with SKR")
+	}
+
+	// Filesystems that are already mounted don't release keys
+	resumed := map[int]MountedFilesystem{1: {Index: 1}}
+	if err := checkUvmInformation(withSKR, resumed, absent, nil); err != nil {
+		t.Fatalf("expected resumed filesystem not to need UVM information: %v", err)
+	}
+
+	withSKR.RequireUvmInformation = false
+	if err := checkUvmInformation(withSKR, nil, absent, nil); err != nil {
+		t.Fatalf("expected absent UVM information to be tolerated by default: %v", err)
+	}
+}
+
+type staticPolicySource string
+
+func (s staticPolicySource) EncodedSecurityPolicy(ctx context.Context) (string, error) {
+	return string(s), nil
+}
+
+func Test_MountAzureFilesystems_PolicySource(t *testing.T) {
+	origProbe, origMountSingle, origPolicySource := _cryptsetupProbe, _mountSingleFilesystem, PolicySource
+	defer func() {
+		_cryptsetupProbe, _mountSingleFilesystem, PolicySource = origProbe, origMountSingle, origPolicySource
+	}()
+
+	// The UVM information has the platform certificates but no policy
+	t.Setenv("UVM_HOST_AMD_CERTIFICATE", base64.StdEncoding.EncodeToString([]byte(`{"vcekCert": "vcek", "tcbm": "db18000000000004", "certificateChain": "chain"}`)))
+	t.Setenv("UVM_SECURITY_POLICY", "")
+	PolicySource = staticPolicySource("cGFja2FnZQ==")
+
+	_cryptsetupProbe = func() (CryptsetupVersion, error) {
+		return CryptsetupVersion{2, 4, 3}, nil
+	}
+	var policy string
+	_mountSingleFilesystem = func(ctx context.Context, opts *MountOptions, tempDir string, index int, fs AzureFilesystem, releasedKey jwk.Key, fsStatus *FilesystemStatus) error {
+		policy = opts.UvmInformation.EncodedSecurityPolicy
+		return nil
+	}
+
+	info := RemoteFilesystemsInformation{
+		RequireUvmInformation: true,
+		AzureFilesystems: []AzureFilesystem{
+			{AzureUrl: "https://account.blob.core.windows.net/c/image", MountPoint: t.TempDir() + "/data", KeyBlob: common.KeyBlob{KID: "key"}},
+		},
+	}
+	if err := MountAzureFilesystems(context.Background(), t.TempDir(), info); err != nil {
+		t.Fatalf("expected the policy source to provide the policy: %v", err)
+	}
+	if policy != "cGFja2FnZQ==" {
+		t.Fatalf("expected the policy of the source, got %q", policy)
+	}
+
+	// Without a source the missing policy fails the mount
+	PolicySource = nil
+	if err := MountAzureFilesystems(context.Background(), t.TempDir(), info); err == nil {
+		t.Fatalf("expected the missing policy to fail the mount")
+	}
+}
+
+func Test_MountAzureFilesystems_Optional(t *testing.T) {
+	origProbe, origMountSingle, origStatusFilePath := _cryptsetupProbe, _mountSingleFilesystem, StatusFilePath
+	defer func() {
+		_cryptsetupProbe, _mountSingleFilesystem, StatusFilePath = origProbe, origMountSingle, origStatusFilePath
+	}()
+
+	// Provide the platform certificates so that they aren't fetched
+	t.Setenv("UVM_HOST_AMD_CERTIFICATE", base64.StdEncoding.EncodeToString([]byte(`{"vcekCert": "vcek", "tcbm": "db18000000000004", "certificateChain": "chain"}`)))
+	StatusFilePath = filepath.Join(t.TempDir(), "status.json")
+
+	_cryptsetupProbe = func() (CryptsetupVersion, error) {
+		return CryptsetupVersion{2, 4, 3}, nil
+	}
+	// Filesystem-0 is optional and fails, and filesystem-1 is required
+	var order []int
+	var requiredDoneBefore []bool
+	_mountSingleFilesystem = func(ctx context.Context, opts *MountOptions, tempDir string, index int, fs AzureFilesystem, releasedKey jwk.Key, fsStatus *FilesystemStatus) error {
+		order = append(order, index)
+		statusJSON, err := os.ReadFile(StatusFilePath)
+		if err != nil {
+			t.Fatalf("failed to read status file: %v", err)
+		}
+		var status MountStatus
+		if err := json.Unmarshal(statusJSON, &status); err != nil {
+			t.Fatalf("failed to unmarshal status file: %v", err)
+		}
+		requiredDoneBefore = append(requiredDoneBefore, status.RequiredDone)
+		if fs.Optional {
+			return errors.New("cache unavailable")
+		}
+		return nil
+	}
+
+	info := RemoteFilesystemsInformation{
+		AzureFilesystems: []AzureFilesystem{
+			{AzureUrl: "https://account.blob.core.windows.net/c/cache", MountPoint: t.TempDir() + "/cache", Optional: true},
+			{AzureUrl: "https://account.blob.core.windows.net/c/data", MountPoint: t.TempDir() + "/data"},
+		},
+	}
+	if err := MountAzureFilesystems(context.Background(), t.TempDir(), info); err != nil {
+		t.Fatalf("expected the failure of an optional filesystem to be tolerated: %v", err)
+	}
+
+	if len(order) != 2 || order[0] != 1 || order[1] != 0 {
+		t.Fatalf("expected the required filesystem to be mounted first, got %v", order)
+	}
+	if requiredDoneBefore[0] || !requiredDoneBefore[1] {
+		t.Fatalf("expected required_done to be set before the optional filesystem, got %v", requiredDoneBefore)
+	}
+
+	statusJSON, err := os.ReadFile(StatusFilePath)
+	if err != nil {
+		t.Fatalf("failed to read status file: %v", err)
+	}
+	var status MountStatus
+	if err := json.Unmarshal(statusJSON, &status); err != nil {
+		t.Fatalf("failed to unmarshal status file: %v", err)
+	}
+	if !status.Done || !status.Success || !status.RequiredDone || status.Filesystems[0].State != FilesystemStateFailed || status.Filesystems[1].State != FilesystemStateMounted {
+		t.Fatalf("unexpected status: %s", statusJSON)
+	}
+
+	// The failure of a required filesystem still fails the mount
+	info.AzureFilesystems[0].Optional = false
+	_mountSingleFilesystem = func(ctx context.Context, opts *MountOptions, tempDir string, index int, fs AzureFilesystem, releasedKey jwk.Key, fsStatus *FilesystemStatus) error {
+		return errors.New("image unavailable")
+	}
+	if err := MountAzureFilesystems(context.Background(), t.TempDir(), info); err == nil {
+		t.Fatalf("expected the failure of a required filesystem to fail the mount")
+	}
+
+	// The keys of optional filesystems aren't released up front, so that a
+	// denied release only fails the optional filesystem
+	origReleaseKeys := _releaseKeys
+	defer func() { _releaseKeys = origReleaseKeys }()
+	var released []string
+	_releaseKeys = func(ctx context.Context, identity common.Identity, certState attest.CertState, reqs []skr.KeyReleaseRequest, uvmInformation common.UvmInformation) ([]skr.KeyReleaseResult, error) {
+		results := make([]skr.KeyReleaseResult, len(reqs))
+		for i, req := range reqs {
+			released = append(released, req.KeyBlob.KID)
+			if req.KeyBlob.KID == "denied" {
+				results[i].Err = errors.New("release denied")
+				continue
+			}
+			results[i].Key = jwk.NewSymmetricKey()
+		}
+		return results, nil
+	}
+	_mountSingleFilesystem = func(ctx context.Context, opts *MountOptions, tempDir string, index int, fs AzureFilesystem, releasedKey jwk.Key, fsStatus *FilesystemStatus) error {
+		if releasedKey == nil {
+			return errors.New("release denied")
+		}
+		return nil
+	}
+	info.PreReleaseKeys = true
+	info.AzureFilesystems[0].Optional = true
+	info.AzureFilesystems[0].KeyBlob = common.KeyBlob{KID: "denied"}
+	info.AzureFilesystems[1].KeyBlob = common.KeyBlob{KID: "key"}
+	if err := MountAzureFilesystems(context.Background(), t.TempDir(), info); err != nil {
+		t.Fatalf("expected the denied key of an optional filesystem not to fail the mount: %v", err)
+	}
+	if fmt.Sprint(released) != "[key]" {
+		t.Fatalf("expected only the key of the required filesystem to be released up front, got %v", released)
+	}
+}
+
+func Test_ReleaseKeyShares(t *testing.T) {
+	origReleaseKeys := _releaseKeys
+	defer func() { _releaseKeys = origReleaseKeys }()
+
+	// Each share is a 32-byte key filled with its index, and the share with
+	// KID "missing" can't be released
+	_releaseKeys = func(ctx context.Context, identity common.Identity, certState attest.CertState, reqs []skr.KeyReleaseRequest, uvmInformation common.UvmInformation) ([]skr.KeyReleaseResult, error) {
+		results := make([]skr.KeyReleaseResult, len(reqs))
+		for i, req := range reqs {
+			if req.KeyBlob.KID == "missing" {
+				results[i].Err = errors.New("release failed")
+				continue
+			}
+			key := jwk.NewSymmetricKey()
+			if err := key.FromRaw(bytes.Repeat([]byte{byte(i + 1)}, 32)); err != nil {
+				t.Fatalf("failed to create key: %v", err)
+			}
+			results[i].Key = key
+		}
+		return results, errors.New("release failed")
+	}
+
+	fs := AzureFilesystem{
+		KeyShares: []common.KeyBlob{{KID: "share1"}, {KID: "share2"}},
+	}
+	jwKey, err := releaseKeyShares(context.Background(), &MountOptions{}, fs)
+	if err != nil {
+		t.Fatalf("releaseKeyShares failed: %v", err)
+	}
+	var rawKey []byte
+	if err := jwKey.Raw(&rawKey); err != nil {
+		t.Fatalf("failed to extract key: %v", err)
+	}
+	if !bytes.Equal(rawKey, bytes.Repeat([]byte{1 ^ 2}, 32)) {
+		t.Fatalf("unexpected xor key: %x", rawKey)
+	}
+
+	// All shares are needed for xor
+	fs.KeyShares = append(fs.KeyShares, common.KeyBlob{KID: "missing"})
+	if _, err := releaseKeyShares(context.Background(), &MountOptions{}, fs); err == nil {
+		t.Fatalf("expected failure with a missing xor share")
+	}
+
+	// Shamir needs threshold shares
+	fs.KeyShareScheme = common.KeyShareSchemeShamir
+	fs.KeyShareThreshold = 2
+	if _, err := releaseKeyShares(context.Background(), &MountOptions{}, fs); err != nil {
+		t.Fatalf("releaseKeyShares failed with 2 of 3 shamir shares: %v", err)
+	}
+	fs.KeyShareThreshold = 3
+	if _, err := releaseKeyShares(context.Background(), &MountOptions{}, fs); err == nil {
+		t.Fatalf("expected failure with 2 of 3 shamir shares released")
+	}
+	fs.KeyShareThreshold = 4
+	if _, err := releaseKeyShares(context.Background(), &MountOptions{}, fs); err == nil {
+		t.Fatalf("expected invalid threshold to be rejected")
+	}
+}
+
+func Test_WriteKeyFile_Fifo(t *testing.T) {
+	keyFilePath := filepath.Join(t.TempDir(), "keyfile")
+	expected := []byte("0123456789abcdef0123456789abcdef")
+	key := bytes.Clone(expected)
+
+	if err := writeKeyFile(keyFilePath, key, true); err != nil {
+		t.Fatalf("writeKeyFile failed: %v", err)
+	}
+
+	fi, err := os.Stat(keyFilePath)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 || fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected 0600 named pipe, got %v", fi.Mode())
+	}
+
+	f, err := os.Open(keyFilePath)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	got, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("read %q from keyfile, expected %q", got, expected)
+	}
+
+	if err := removeKeyFile(keyFilePath, true); err != nil {
+		t.Fatalf("removeKeyFile failed: %v", err)
+	}
+	if _, err := os.Stat(keyFilePath); !os.IsNotExist(err) {
+		t.Fatalf("expected keyfile to be removed, got %v", err)
+	}
+	if !bytes.Equal(key, make([]byte, len(key))) {
+		t.Fatalf("expected the key to be zeroed once written, got %q", key)
+	}
+}
+
+func Test_RemoveKeyFile_FifoNotRead(t *testing.T) {
+	keyFilePath := filepath.Join(t.TempDir(), "keyfile")
+	key := []byte("key")
+
+	if err := writeKeyFile(keyFilePath, key, true); err != nil {
+		t.Fatalf("writeKeyFile failed: %v", err)
+	}
+
+	// Nobody reads the pipe, removing it must stop the writer without
+	// blocking
+	if err := removeKeyFile(keyFilePath, true); err != nil {
+		t.Fatalf("removeKeyFile failed: %v", err)
+	}
+	if _, err := os.Stat(keyFilePath); !os.IsNotExist(err) {
+		t.Fatalf("expected keyfile to be removed, got %v", err)
+	}
+	if !bytes.Equal(key, make([]byte, len(key))) {
+		t.Fatalf("expected the key to be zeroed once the writer is stopped, got %q", key)
+	}
+}
+
+func Test_ReleaseRemoteFilesystemKey_KeyLength(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+	rsaJWK, err := jwk.New(rsaKey)
+	if err != nil {
+		t.Fatalf("failed to create RSA key: %v", err)
+	}
+	blob := common.KeyDerivationBlob{Salt: "92a631f9ab8e7e6f71f4a5bd0a1b1c8e", Label: common.DefaultKeyDerivationLabel}
+
+	for _, keyLength := range []int{32, 64} {
+		// Keys derived from released RSA keys have the key length
+		keyFilePath, keyDerivation, err := releaseRemoteFilesystemKey(context.Background(), &MountOptions{}, t.TempDir(), blob, common.KeyBlob{}, keyLength, false, rsaJWK)
+		if err != nil {
+			t.Fatalf("failed to derive %d-byte key: %v", keyLength, err)
+		}
+		derived, err := os.ReadFile(keyFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(derived) != keyLength || keyDerivation == nil {
+			t.Fatalf("expected %d-byte derived key, got %d bytes", keyLength, len(derived))
+		}
+		salt, _ := hex.DecodeString(blob.Salt)
+		expected := make([]byte, keyLength)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, rsaKey.D.Bytes(), salt, []byte(blob.Label)), expected); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(derived, expected) {
+			t.Fatalf("unexpected %d-byte derived key", keyLength)
+		}
+
+		// Released octet keys must have the key length
+		octJWK := jwk.NewSymmetricKey()
+		if err := octJWK.FromRaw(bytes.Repeat([]byte{1}, keyLength)); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := releaseRemoteFilesystemKey(context.Background(), &MountOptions{}, t.TempDir(), blob, common.KeyBlob{}, keyLength, false, octJWK); err != nil {
+			t.Fatalf("expected %d-byte octet key to be accepted: %v", keyLength, err)
+		}
+		otherLength := 96 - keyLength
+		if _, _, err := releaseRemoteFilesystemKey(context.Background(), &MountOptions{}, t.TempDir(), blob, common.KeyBlob{}, otherLength, false, octJWK); err == nil {
+			t.Fatalf("expected %d-byte octet key to be rejected with key length %d", keyLength, otherLength)
+		}
+	}
+
+	// The key length defaults to the one of the key derivation, and both must
+	// agree when set
+	blob.KeyLength = 64
+	if keyLength, err := resolveKeyLength(0, blob); err != nil || keyLength != 64 {
+		t.Errorf("expected key length 64, got %d: %v", keyLength, err)
+	}
+	if _, err := resolveKeyLength(32, blob); err == nil {
+		t.Errorf("expected mismatched key lengths to be rejected")
+	}
+	if keyLength, err := resolveKeyLength(0, common.KeyDerivationBlob{}); err != nil || keyLength != 32 {
+		t.Errorf("expected default key length 32, got %d: %v", keyLength, err)
+	}
+}
+
+func Test_MountAzureFilesystems_KeyReleaseRetries(t *testing.T) {
+	origProbe, origMountSingle, origSecureKeyRelease, origTimeAfter := _cryptsetupProbe, _mountSingleFilesystem, _secureKeyRelease, timeAfter
+	defer func() {
+		_cryptsetupProbe, _mountSingleFilesystem, _secureKeyRelease, timeAfter = origProbe, origMountSingle, origSecureKeyRelease, origTimeAfter
+	}()
+
+	// Provide the UVM information so that it isn't fetched
+	t.Setenv("UVM_HOST_AMD_CERTIFICATE", base64.StdEncoding.EncodeToString([]byte(`{"vcekCert": "vcek", "tcbm": "db18000000000004", "certificateChain": "chain"}`)))
+	t.Setenv("UVM_SECURITY_POLICY", "cGFja2FnZQ==")
+
+	_cryptsetupProbe = func() (CryptsetupVersion, error) {
+		return CryptsetupVersion{2, 4, 3}, nil
+	}
+	_mountSingleFilesystem = func(ctx context.Context, opts *MountOptions, tempDir string, index int, fs AzureFilesystem, releasedKey jwk.Key, fsStatus *FilesystemStatus) error {
+		_, _, err := releaseRemoteFilesystemKey(ctx, opts, tempDir, fs.KeyDerivationBlob, fs.KeyBlob, fs.KeyLengthBytes, false, releasedKey)
+		return err
+	}
+	var delays []time.Duration
+	timeAfter = func(d time.Duration) <-chan time.Time {
+		delays = append(delays, d)
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	}
+
+	// The release fails twice with transient errors before succeeding
+	var failures []error
+	attempts := 0
+	_secureKeyRelease = func(ctx context.Context, identity common.Identity, certState attest.CertState, keyBlob common.KeyBlob, uvmInformation common.UvmInformation) (jwk.Key, error) {
+		attempts++
+		if attempts <= len(failures) {
+			return nil, failures[attempts-1]
+		}
+		key := jwk.NewSymmetricKey()
+		if err := key.FromRaw(bytes.Repeat([]byte{1}, 32)); err != nil {
+			t.Fatal(err)
+		}
+		return key, nil
+	}
+
+	info := RemoteFilesystemsInformation{
+		MaxKeyReleaseRetries: 2,
+		KeyReleaseBackoffMs:  100,
+		AzureFilesystems: []AzureFilesystem{
+			{AzureUrl: "https://account.blob.core.windows.net/c/image", MountPoint: t.TempDir() + "/data", KeyBlob: common.KeyBlob{KID: "key"}},
+		},
+	}
+	failures = []error{
+		errors.Wrapf(&common.HTTPError{Status: "503 Service Unavailable"}, "AKV unavailable"),
+		errors.Wrapf(&net.OpError{Op: "dial", Err: errors.New("connection refused")}, "HTTP GET failed"),
+	}
+	if err := MountAzureFilesystems(context.Background(), t.TempDir(), info); err != nil {
+		t.Fatalf("expected the mount to succeed after two transient failures: %v", err)
+	}
+	if attempts != 3 || len(delays) != 2 {
+		t.Fatalf("expected 3 attempts and 2 delays, got %d and %v", attempts, delays)
+	}
+	if delays[0] < 50*time.Millisecond || delays[0] > 100*time.Millisecond || delays[1] < 100*time.Millisecond || delays[1] > 200*time.Millisecond {
+		t.Errorf("unexpected delays %v", delays)
+	}
+
+	// Too many transient failures fail the mount
+	attempts, delays = 0, nil
+	failures = append(failures, &common.HTTPError{Status: "429 Too Many Requests"})
+	if err := MountAzureFilesystems(context.Background(), t.TempDir(), info); err == nil || attempts != 3 {
+		t.Fatalf("expected the mount to fail after 3 attempts, got %d: %v", attempts, err)
+	}
+
+	// Denied releases aren't retried
+	attempts = 0
+	failures = []error{&common.AKVError{Status: "403 Forbidden", Code: "Forbidden", Err: &common.HTTPError{Status: "403 Forbidden"}}}
+	if err := MountAzureFilesystems(context.Background(), t.TempDir(), info); err == nil || attempts != 1 {
+		t.Fatalf("expected the denied release not to be retried, got %d attempts: %v", attempts, err)
+	}
+	attempts = 0
+	failures = []error{&common.HTTPError{Status: "401 Unauthorized"}}
+	if err := MountAzureFilesystems(context.Background(), t.TempDir(), info); err == nil || attempts != 1 {
+		t.Fatalf("expected the rejected token not to be retried, got %d attempts: %v", attempts, err)
+	}
+}
+
+func Test_ReleaseKeysWithRetry(t *testing.T) {
+	origReleaseKeys, origTimeAfter := _releaseKeys, timeAfter
+	defer func() {
+		_releaseKeys, timeAfter = origReleaseKeys, origTimeAfter
+	}()
+	opts := &MountOptions{MaxKeyReleaseRetries: 2}
+	timeAfter = func(d time.Duration) <-chan time.Time {
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	}
+
+	// "flaky" fails once with a transient error and "denied" always fails
+	var batches [][]string
+	_releaseKeys = func(ctx context.Context, identity common.Identity, certState attest.CertState, reqs []skr.KeyReleaseRequest, uvmInformation common.UvmInformation) ([]skr.KeyReleaseResult, error) {
+		var kids []string
+		results := make([]skr.KeyReleaseResult, len(reqs))
+		for i, req := range reqs {
+			kids = append(kids, req.KeyBlob.KID)
+			switch {
+			case req.KeyBlob.KID == "flaky" && len(batches) == 0:
+				results[i].Err = &common.HTTPError{Status: "503 Service Unavailable"}
+			case req.KeyBlob.KID == "denied":
+				results[i].Err = &common.HTTPError{Status: "403 Forbidden"}
+			default:
+				results[i].Key = jwk.NewSymmetricKey()
+			}
+		}
+		batches = append(batches, kids)
+		return results, nil
+	}
+
+	reqs := []skr.KeyReleaseRequest{{KeyBlob: common.KeyBlob{KID: "ok"}}, {KeyBlob: common.KeyBlob{KID: "flaky"}}}
+	results, err := releaseKeysWithRetry(context.Background(), opts, reqs)
+	if err != nil || results[0].Key == nil || results[1].Key == nil {
+		t.Fatalf("expected the keys to be released, got %+v: %v", results, err)
+	}
+	// Only the failed key is released again
+	if fmt.Sprint(batches) != "[[ok flaky] [flaky]]" {
+		t.Fatalf("unexpected batches %v", batches)
+	}
+
+	batches = nil
+	reqs = append(reqs, skr.KeyReleaseRequest{KeyBlob: common.KeyBlob{KID: "denied"}})
+	results, err = releaseKeysWithRetry(context.Background(), opts, reqs)
+	if err == nil || !strings.Contains(err.Error(), "denied") || results[2].Err == nil || fmt.Sprint(batches) != "[[ok flaky denied] [flaky]]" {
+		t.Fatalf("expected the denied release to fail without retry, got %v: %v", batches, err)
+	}
+}
+
+func Test_MountAzureFilesystems_Concurrent(t *testing.T) {
+	origProbe, origMountSingle := _cryptsetupProbe, _mountSingleFilesystem
+	defer func() {
+		_cryptsetupProbe, _mountSingleFilesystem = origProbe, origMountSingle
+	}()
+
+	// Provide the platform certificates so that they aren't fetched
+	t.Setenv("UVM_HOST_AMD_CERTIFICATE", base64.StdEncoding.EncodeToString([]byte(`{"vcekCert": "vcek", "tcbm": "db18000000000004", "certificateChain": "chain"}`)))
+
+	_cryptsetupProbe = func() (CryptsetupVersion, error) {
+		return CryptsetupVersion{2, 4, 3}, nil
+	}
+	// Filesystems 1 and 3 fail
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	_mountSingleFilesystem = func(ctx context.Context, opts *MountOptions, tempDir string, index int, fs AzureFilesystem, releasedKey jwk.Key, fsStatus *FilesystemStatus) error {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		if index%2 == 1 {
+			return errors.Errorf("image %d unavailable", index)
+		}
+		return nil
+	}
+
+	info := RemoteFilesystemsInformation{MaxConcurrentMounts: 2}
+	for i := 0; i < 5; i++ {
+		info.AzureFilesystems = append(info.AzureFilesystems, AzureFilesystem{
+			AzureUrl:   "https://account.blob.core.windows.net/c/image",
+			MountPoint: filepath.Join(t.TempDir(), "data"),
+		})
+	}
+	err := MountAzureFilesystems(context.Background(), t.TempDir(), info)
+	var mountErr *FilesystemsMountError
+	if !errors.As(err, &mountErr) {
+		t.Fatalf("expected a FilesystemsMountError, got %v", err)
+	}
+	if len(mountErr.Indexes) != 2 || mountErr.Indexes[0] != 1 || mountErr.Indexes[1] != 3 {
+		t.Fatalf("expected filesystems 1 and 3 to fail, got %v", mountErr.Indexes)
+	}
+	if !strings.Contains(err.Error(), "image 1 unavailable") || !strings.Contains(err.Error(), "image 3 unavailable") {
+		t.Fatalf("expected the error to list both failures: %v", err)
+	}
+	if maxRunning != 2 {
+		t.Fatalf("expected 2 filesystems to be mounted at the same time, got %d", maxRunning)
+	}
+}
+
+func Test_MountAzureFilesystems_JSONLogs(t *testing.T) {
+	origProbe, origMountSingle := _cryptsetupProbe, _mountSingleFilesystem
+	var logs bytes.Buffer
+	logrus.SetOutput(&logs)
+	defer func() {
+		_cryptsetupProbe, _mountSingleFilesystem = origProbe, origMountSingle
+		logrus.SetOutput(os.Stderr)
+		common.SetLogFormat(common.LogFormatText)
+	}()
+	if err := common.SetLogFormat(common.LogFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	// Provide the platform certificates so that they aren't fetched
+	t.Setenv("UVM_HOST_AMD_CERTIFICATE", base64.StdEncoding.EncodeToString([]byte(`{"vcekCert": "vcek", "tcbm": "db18000000000004", "certificateChain": "chain"}`)))
+	_cryptsetupProbe = func() (CryptsetupVersion, error) {
+		return CryptsetupVersion{2, 4, 3}, nil
+	}
+	_mountSingleFilesystem = func(ctx context.Context, opts *MountOptions, tempDir string, index int, fs AzureFilesystem, releasedKey jwk.Key, fsStatus *FilesystemStatus) error {
+		if fs.Optional {
+			return errors.New("cache unavailable")
+		}
+		return nil
+	}
+
+	info := RemoteFilesystemsInformation{
+		AzureFilesystems: []AzureFilesystem{
+			{AzureUrl: "https://account.blob.core.windows.net/c/data?sig=secret-sas", MountPoint: t.TempDir() + "/data"},
+			{AzureUrl: "https://account.blob.core.windows.net/c/cache", MountPoint: t.TempDir() + "/cache", Optional: true},
+		},
+	}
+	if err := MountAzureFilesystems(context.Background(), t.TempDir(), info); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Every line is JSON, and each mount ends with a line with its duration
+	ends := map[float64]map[string]interface{}{}
+	for _, line := range bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n")) {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("log line isn't JSON: %s", line)
+		}
+		if _, ok := entry[common.LogFieldDurationMs].(float64); !ok {
+			continue
+		}
+		if index, ok := entry[common.LogFieldFilesystemIndex].(float64); ok {
+			ends[index] = entry
+		}
+	}
+	if len(ends) != 2 {
+		t.Fatalf("expected a log line with the duration of each mount, got %v", ends)
+	}
+	if ends[0]["msg"] != "Mounted filesystem-0" || ends[0][common.LogFieldAzureURL] != "https://account.blob.core.windows.net/c/data?<redacted>" {
+		t.Errorf("unexpected log line of filesystem-0: %v", ends[0])
+	}
+	if ends[1]["msg"] != "Failed to mount filesystem-1" || ends[1][logrus.ErrorKey] != "cache unavailable" {
+		t.Errorf("unexpected log line of filesystem-1: %v", ends[1])
+	}
+	if strings.Contains(logs.String(), "secret-sas") {
+		t.Errorf("logs contain the SAS token: %s", logs.String())
+	}
+}
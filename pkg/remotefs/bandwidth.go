@@ -0,0 +1,72 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// DownloadStats are the statistics of the blocks of an image downloaded by
+// azmount, as written to its stats file.
+type DownloadStats struct {
+	BytesDownloaded  int64 `json:"bytes_downloaded"`
+	BlocksDownloaded int64 `json:"blocks_downloaded"`
+	// Time during which at least one download was in progress
+	DownloadTimeMs int64 `json:"download_time_ms"`
+	// Effective bandwidth, calculated by readDownloadStats
+	BandwidthBytesPerSec int64 `json:"bandwidth_bytes_per_sec"`
+	// Size of the image exposed by azmount
+	FileSize int64 `json:"file_size,omitempty"`
+}
+
+// azmountStatsFilePath returns the path of the stats file of the azmount
+// process of filesystem index.
+func azmountStatsFilePath(tempDir string, index int) string {
+	return filepath.Join(tempDir, fmt.Sprintf("stats-%d.json", index))
+}
+
+// readDownloadStats reads the stats file written by azmount at path.
+func readDownloadStats(path string) (DownloadStats, error) {
+	var stats DownloadStats
+
+	statsJSON, err := os.ReadFile(path)
+	if err != nil {
+		return stats, errors.Wrapf(err, "failed to read download statistics: %s", path)
+	}
+	if err := json.Unmarshal(statsJSON, &stats); err != nil {
+		return stats, errors.Wrapf(err, "failed to unmarshal download statistics: %s", path)
+	}
+	if stats.DownloadTimeMs > 0 {
+		stats.BandwidthBytesPerSec = stats.BytesDownloaded * 1000 / stats.DownloadTimeMs
+	}
+	return stats, nil
+}
+
+// checkDownloadBandwidth checks that the image of fs has been downloaded at
+// least as fast as fs.MinBandwidthBytesPerSec. A slower download is only
+// logged unless fs.FailBelowMinBandwidth is set.
+func checkDownloadBandwidth(index int, fs AzureFilesystem, stats DownloadStats) error {
+	if fs.MinBandwidthBytesPerSec <= 0 || stats.DownloadTimeMs <= 0 {
+		return nil
+	}
+	if stats.BandwidthBytesPerSec >= fs.MinBandwidthBytesPerSec {
+		return nil
+	}
+
+	err := errors.Errorf("download bandwidth of filesystem-%d is %d bytes/s, expected at least %d bytes/s", index, stats.BandwidthBytesPerSec, fs.MinBandwidthBytesPerSec)
+	if fs.FailBelowMinBandwidth {
+		return err
+	}
+	logrus.Warn(err.Error())
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"os"
+	"testing"
+)
+
+func Test_DownloadBandwidth(t *testing.T) {
+	dir := t.TempDir()
+	path := azmountStatsFilePath(dir, 0)
+	if err := os.WriteFile(path, []byte(`{"bytes_downloaded": 4194304, "blocks_downloaded": 8, "download_time_ms": 2000}`), 0644); err != nil {
+		t.Fatalf("failed to write stats file: %v", err)
+	}
+
+	stats, err := readDownloadStats(path)
+	if err != nil {
+		t.Fatalf("readDownloadStats failed: %v", err)
+	}
+	if stats.BandwidthBytesPerSec != 2097152 {
+		t.Fatalf("expected 2097152 bytes/s, got %d", stats.BandwidthBytesPerSec)
+	}
+
+	fs := AzureFilesystem{MinBandwidthBytesPerSec: 1048576}
+	if err := checkDownloadBandwidth(0, fs, stats); err != nil {
+		t.Fatalf("expected bandwidth above the floor to pass: %v", err)
+	}
+
+	// Below the floor only a warning is logged unless failing is requested
+	fs.MinBandwidthBytesPerSec = 4194304
+	if err := checkDownloadBandwidth(0, fs, stats); err != nil {
+		t.Fatalf("expected bandwidth below the floor to only be logged: %v", err)
+	}
+	fs.FailBelowMinBandwidth = true
+	if err := checkDownloadBandwidth(0, fs, stats); err == nil {
+		t.Fatalf("expected bandwidth below the floor to fail")
+	}
+
+	if _, err := readDownloadStats(azmountStatsFilePath(dir, 1)); err == nil {
+		t.Fatalf("expected missing stats file to fail")
+	}
+}
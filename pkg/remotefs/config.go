@@ -0,0 +1,174 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"encoding/json"
+	"net/url"
+	"runtime"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/attest"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/skr"
+	"github.com/sirupsen/logrus"
+)
+
+// Placeholder of the secrets removed by DumpConfig
+const redacted = "<redacted>"
+
+// redactURL removes the query of rawURL, which can hold a SAS token.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redacted
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = redacted
+	}
+	return u.String()
+}
+
+// redactKeyBlob removes the bearer token of blob.
+func redactKeyBlob(blob common.KeyBlob) common.KeyBlob {
+	if blob.AKV.BearerToken != "" {
+		blob.AKV.BearerToken = redacted
+	}
+	return blob
+}
+
+// effectiveFilesystem returns fs with the defaults that the mount applies to
+// it and its secrets redacted.
+func effectiveFilesystem(fs AzureFilesystem) AzureFilesystem {
+	if fs.RawKeyHexString != "" {
+		fs.RawKeyHexString = redacted
+	}
+	fs.AzureUrl = redactURL(fs.AzureUrl)
+	fs.HeaderUrl = redactURL(fs.HeaderUrl)
+	fs.KeyBlob = redactKeyBlob(fs.KeyBlob)
+	shares := make([]common.KeyBlob, len(fs.KeyShares))
+	for i, share := range fs.KeyShares {
+		shares[i] = redactKeyBlob(share)
+	}
+	fs.KeyShares = shares
+
+	// Tmpfs filesystems don't have an image or a key
+	if fs.Tmpfs != nil {
+		return fs
+	}
+	if fs.CacheBlockSizeKiB == 0 {
+		fs.CacheBlockSizeKiB = 512
+	}
+	if fs.CacheBlocks == 0 {
+		fs.CacheBlocks = 32
+	}
+	if fs.AzmountLogLevel == "" {
+		fs.AzmountLogLevel = logrus.GetLevel().String()
+	}
+	if fs.AccessPattern == "" {
+		fs.AccessPattern = AccessPatternRandom
+	}
+	if fs.DownloadConcurrency == 0 {
+		fs.DownloadConcurrency = 1
+	}
+	if fs.ReadWrite && fs.UploadFailurePolicy == "" {
+		fs.UploadFailurePolicy = UploadFailurePolicyFailWrites
+	}
+	if fs.ReadWrite && fs.MaxUploadFailures == 0 {
+		fs.MaxUploadFailures = 3
+	}
+	if fs.RunFsck && fs.FsckFailurePolicy == "" {
+		fs.FsckFailurePolicy = FsckFailurePolicyFail
+	}
+	if fs.ExistingMount == "" {
+		fs.ExistingMount = ExistingMountFail
+	}
+	if !fs.ReadWrite && fs.JournalPolicy == "" {
+		fs.JournalPolicy = JournalPolicyNoload
+	}
+	// The key derivation only applies to released RSA keys
+	if fs.KeyBlob.KID != "" && len(fs.KeyShares) == 0 {
+		if fs.KeyDerivationBlob.Algorithm == "" {
+			fs.KeyDerivationBlob.Algorithm = common.KeyDerivationHKDF
+		}
+		if fs.KeyDerivationBlob.Algorithm == common.KeyDerivationHKDF && fs.KeyDerivationBlob.Label == "" {
+			fs.KeyDerivationBlob.Label = common.DefaultKeyDerivationLabel
+		}
+	}
+	return fs
+}
+
+// PopulateKeyBlobs sets the API version and the TEE type for which the
+// authority authorizes the secure key release in the key blobs of the
+// filesystems. The API version of the release of the AKV is only set by the
+// configuration, and common.AKV.ReleaseKeyURI uses the default one if it is
+// empty.
+func (info *RemoteFilesystemsInformation) PopulateKeyBlobs() {
+	populate := func(blob *common.KeyBlob) {
+		blob.Authority.APIVersion = "api-version=2020-10-01"
+		blob.Authority.TEEType = "SevSnpVM"
+	}
+	for i := range info.AzureFilesystems {
+		populate(&info.AzureFilesystems[i].KeyBlob)
+		for j := range info.AzureFilesystems[i].KeyShares {
+			populate(&info.AzureFilesystems[i].KeyShares[j])
+		}
+	}
+}
+
+// DumpConfig renders the configuration that the tool runs with as JSON, for
+// diagnostics: the mount points are resolved from the template and the
+// defaults are applied. Raw keys, bearer tokens and the queries of the image
+// URLs are redacted, so it can be logged and included in support bundles. The
+// client ID of the identity, the endpoints, salts and labels aren't secret and
+// are kept.
+func (info RemoteFilesystemsInformation) DumpConfig() string {
+	// If the template is invalid, the mount fails later with the error
+	if filesystems, err := resolveMountPoints(info); err == nil {
+		info.AzureFilesystems = filesystems
+	}
+	filesystems := make([]AzureFilesystem, len(info.AzureFilesystems))
+	for i, fs := range info.AzureFilesystems {
+		filesystems[i] = effectiveFilesystem(fs)
+	}
+	info.AzureFilesystems = filesystems
+	if info.SecurityPolicySource != nil {
+		source := *info.SecurityPolicySource
+		source.URL = redactURL(source.URL)
+		info.SecurityPolicySource = &source
+	}
+
+	if info.ConnectionPolicy.MaxIdleConns == 0 {
+		info.ConnectionPolicy.MaxIdleConns = common.DefaultMaxIdleConns
+	}
+	if info.ConnectionPolicy.MaxIdleConnsPerHost == 0 {
+		info.ConnectionPolicy.MaxIdleConnsPerHost = common.DefaultMaxIdleConnsPerHost
+	}
+	if info.ConnectionPolicy.IdleConnTimeoutSeconds == 0 {
+		info.ConnectionPolicy.IdleConnTimeoutSeconds = int(common.DefaultIdleConnTimeout.Seconds())
+	}
+	if info.AzureInfo.ThimCertPolicy == "" {
+		info.AzureInfo.ThimCertPolicy = attest.ThimCertPolicyFetchIfAbsent
+	}
+	if info.MaxConcurrentKeyReleases == 0 {
+		info.MaxConcurrentKeyReleases = skr.DefaultMaxConcurrentReleases
+	}
+	if info.MaxConcurrentMounts == 0 {
+		info.MaxConcurrentMounts = runtime.NumCPU()
+	}
+	if info.MaxKeyReleaseRetries > 0 && info.KeyReleaseBackoffMs == 0 {
+		info.KeyReleaseBackoffMs = DefaultKeyReleaseBackoff.Milliseconds()
+	}
+	if info.TLSPolicy.MinVersion == "" {
+		info.TLSPolicy.MinVersion = "1.2"
+	}
+
+	configJSON, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return "failed to marshal configuration: " + err.Error()
+	}
+	return string(configJSON)
+}
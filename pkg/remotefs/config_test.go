@@ -0,0 +1,110 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/skr"
+)
+
+func Test_DumpConfig(t *testing.T) {
+	info := RemoteFilesystemsInformation{
+		AzureInfo:          AzureInfo{Identity: common.Identity{ClientId: "client-id"}},
+		MountPointTemplate: "/mnt/data/{{.Name}}",
+		AzureFilesystems: []AzureFilesystem{
+			{
+				AzureUrl:          "https://account.blob.core.windows.net/c/image?sv=2022&sig=secret-sas",
+				HeaderUrl:         "https://account.blob.core.windows.net/c/header?sv=2022&sig=secret-header-sas",
+				Name:              "model",
+				KeyBlob:           common.KeyBlob{KID: "key", AKV: common.AKV{Endpoint: "vault.azure.net", BearerToken: "secret-token"}},
+				KeyDerivationBlob: common.KeyDerivationBlob{Salt: "00112233"},
+			},
+			{
+				AzureUrl:        "https://account.blob.core.windows.net/c/scratch",
+				MountPoint:      "/mnt/scratch",
+				RawKeyHexString: "deadbeef",
+				KeyShares:       []common.KeyBlob{{KID: "share", AKV: common.AKV{BearerToken: "secret-share-token"}}},
+			},
+		},
+	}
+
+	dump := info.DumpConfig()
+	for _, secret := range []string{"secret-sas", "secret-header-sas", "secret-token", "secret-share-token", "deadbeef"} {
+		if strings.Contains(dump, secret) {
+			t.Fatalf("configuration contains %s: %s", secret, dump)
+		}
+	}
+	for _, kept := range []string{"client-id", "vault.azure.net", "00112233"} {
+		if !strings.Contains(dump, kept) {
+			t.Fatalf("configuration doesn't contain %s: %s", kept, dump)
+		}
+	}
+
+	var effective RemoteFilesystemsInformation
+	if err := json.Unmarshal([]byte(dump), &effective); err != nil {
+		t.Fatalf("failed to unmarshal configuration: %v", err)
+	}
+	fs := effective.AzureFilesystems[0]
+	if fs.MountPoint != "/mnt/data/model" || fs.AccessPattern != AccessPatternRandom || fs.CacheBlockSizeKiB != 512 || fs.CacheBlocks != 32 || fs.ExistingMount != ExistingMountFail {
+		t.Fatalf("defaults not applied: %+v", fs)
+	}
+	if fs.KeyDerivationBlob.Algorithm != common.KeyDerivationHKDF || fs.KeyDerivationBlob.Label != common.DefaultKeyDerivationLabel {
+		t.Fatalf("key derivation defaults not applied: %+v", fs.KeyDerivationBlob)
+	}
+	if effective.ConnectionPolicy.MaxIdleConnsPerHost != common.DefaultMaxIdleConnsPerHost {
+		t.Fatalf("connection policy defaults not applied: %+v", effective.ConnectionPolicy)
+	}
+	if effective.MaxConcurrentKeyReleases != skr.DefaultMaxConcurrentReleases {
+		t.Fatalf("default of max_concurrent_key_releases not applied: %d", effective.MaxConcurrentKeyReleases)
+	}
+
+	// The configuration itself isn't modified
+	if info.AzureFilesystems[0].KeyBlob.AKV.BearerToken != "secret-token" || info.AzureFilesystems[1].KeyShares[0].AKV.BearerToken != "secret-share-token" {
+		t.Fatalf("DumpConfig modified the configuration")
+	}
+}
+
+func Test_PopulateKeyBlobs(t *testing.T) {
+	config := `{"azure_filesystems": [
+		{"key": {"kid": "key", "akv": {"endpoint": "myvault.vault.azure.net"}}},
+		{"key": {"kid": "key", "akv": {"endpoint": "myhsm.managedhsm.azure.net"}}},
+		{"key": {"kid": "key", "akv": {"endpoint": "myhsm.privatelink.example.net", "vault_type": "mhsm", "api_version": "api-version=7.5"}},
+		 "key_shares": [{"kid": "share", "akv": {"endpoint": "myvault.vault.azure.net", "vault_type": "akv"}}]}
+	]}`
+	var info RemoteFilesystemsInformation
+	if err := json.Unmarshal([]byte(config), &info); err != nil {
+		t.Fatal(err)
+	}
+	info.PopulateKeyBlobs()
+
+	for i, expected := range []string{
+		"https://myvault.vault.azure.net/keys/key/release?api-version=7.4",
+		"https://myhsm.managedhsm.azure.net/keys/key/release?api-version=7.4",
+		// The API version of the configuration is kept
+		"https://myhsm.privatelink.example.net/keys/key/release?api-version=7.5",
+	} {
+		blob := info.AzureFilesystems[i].KeyBlob
+		uri, err := blob.AKV.ReleaseKeyURI(blob.KID)
+		if err != nil || uri != expected {
+			t.Errorf("expected release URI %s for filesystem %d, got %s, %v", expected, i, uri, err)
+		}
+		if blob.Authority.APIVersion != "api-version=2020-10-01" || blob.Authority.TEEType != "SevSnpVM" {
+			t.Errorf("authority of filesystem %d not populated: %+v", i, blob.Authority)
+		}
+	}
+	share := info.AzureFilesystems[2].KeyShares[0]
+	if uri, err := share.AKV.ReleaseKeyURI(share.KID); err != nil || uri != "https://myvault.vault.azure.net/keys/share/release?api-version=7.4" {
+		t.Errorf("unexpected release URI of the key share: %s, %v", uri, err)
+	}
+	if share.Authority.TEEType != "SevSnpVM" {
+		t.Errorf("authority of the key share not populated: %+v", share.Authority)
+	}
+}
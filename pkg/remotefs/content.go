@@ -0,0 +1,72 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ContentCheckError is returned when a filesystem is mounted but its content
+// isn't the expected one, for example because the image is empty or corrupt.
+type ContentCheckError struct {
+	Index  int
+	Reason string
+}
+
+func (e *ContentCheckError) Error() string {
+	return fmt.Sprintf("unexpected content in filesystem-%d: %s", e.Index, e.Reason)
+}
+
+// validateExpectPath checks that the expect_path of a filesystem is a path
+// inside of the filesystem.
+func validateExpectPath(expectPath string) error {
+	if expectPath != "" && !filepath.IsLocal(expectPath) {
+		return errors.Errorf("expect_path must be a relative path inside of the filesystem: %s", expectPath)
+	}
+	return nil
+}
+
+// checkContent checks the content of a filesystem right after it has been
+// mounted at mountFolder: fs.ExpectPath must exist, and the root directory
+// can't be empty if fs.ExpectNonEmpty is set. A filesystem that is mounted
+// with the wrong content would otherwise go unnoticed.
+func checkContent(index int, fs AzureFilesystem, mountFolder string) error {
+	if fs.ExpectPath != "" {
+		// The path itself must exist, symlinks aren't followed
+		if _, err := os.Lstat(filepath.Join(mountFolder, fs.ExpectPath)); err != nil {
+			if os.IsNotExist(err) {
+				return &ContentCheckError{Index: index, Reason: fmt.Sprintf("%s doesn't exist", fs.ExpectPath)}
+			}
+			return errors.Wrapf(err, "failed to check %s in filesystem-%d", fs.ExpectPath, index)
+		}
+		logrus.Debugf("Found %s in filesystem-%d", fs.ExpectPath, index)
+	}
+
+	if fs.ExpectNonEmpty {
+		entries, err := os.ReadDir(mountFolder)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read root directory of filesystem-%d", index)
+		}
+		// mkfs.ext4 always creates lost+found
+		empty := true
+		for _, entry := range entries {
+			if entry.Name() != "lost+found" {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			return &ContentCheckError{Index: index, Reason: "the root directory is empty"}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func Test_CheckContent(t *testing.T) {
+	mountFolder := t.TempDir()
+	if err := os.Mkdir(filepath.Join(mountFolder, "lost+found"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is checked by default
+	if err := checkContent(0, AzureFilesystem{}, mountFolder); err != nil {
+		t.Fatalf("expected no check by default: %v", err)
+	}
+
+	// A filesystem with only lost+found is empty
+	err := checkContent(0, AzureFilesystem{ExpectNonEmpty: true}, mountFolder)
+	var contentErr *ContentCheckError
+	if !errors.As(err, &contentErr) || statusErrorCode(err) != "unexpected_content" {
+		t.Fatalf("expected ContentCheckError for empty filesystem, got %v", err)
+	}
+	err = checkContent(0, AzureFilesystem{ExpectPath: "models/config.json"}, mountFolder)
+	if !errors.As(err, &contentErr) {
+		t.Fatalf("expected ContentCheckError for missing path, got %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(mountFolder, "models"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(mountFolder, "models", "config.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkContent(0, AzureFilesystem{ExpectPath: "models/config.json", ExpectNonEmpty: true}, mountFolder); err != nil {
+		t.Fatalf("expected populated filesystem to pass: %v", err)
+	}
+
+	// Paths outside of the filesystem are rejected
+	for _, expectPath := range []string{"/etc/passwd", "../data", "models/../../data"} {
+		if err := validateExpectPath(expectPath); err == nil {
+			t.Errorf("expected %s to be rejected", expectPath)
+		}
+	}
+	if err := validateExpectPath("models/config.json"); err != nil {
+		t.Errorf("expected relative path to be accepted: %v", err)
+	}
+}
@@ -0,0 +1,394 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// CryptsetupVersion is the version of the installed cryptsetup binary.
+type CryptsetupVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func (v CryptsetupVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// AtLeast returns whether v is the same as or newer than other.
+func (v CryptsetupVersion) AtLeast(other CryptsetupVersion) bool {
+	if v.Major != other.Major {
+		return v.Major > other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor > other.Minor
+	}
+	return v.Patch >= other.Patch
+}
+
+// CryptsetupOptions are the dm-crypt performance flags used when opening a
+// filesystem. They are all disabled by default.
+type CryptsetupOptions struct {
+	// Process reads synchronously instead of in a kernel workqueue
+	PerfNoReadWorkqueue bool `json:"perf_no_read_workqueue,omitempty"`
+	// Process writes synchronously instead of in a kernel workqueue
+	PerfNoWriteWorkqueue bool `json:"perf_no_write_workqueue,omitempty"`
+	// Encrypt and decrypt on the CPU that issued the request
+	PerfSameCPUCrypt bool `json:"perf_same_cpu_crypt,omitempty"`
+
+	// The PBKDF options only apply to operations that write a keyslot. Zero
+	// values leave the defaults of cryptsetup.
+
+	// Key derivation function of new keyslots: pbkdf2, argon2i or argon2id
+	Pbkdf string `json:"pbkdf,omitempty"`
+	// Time in milliseconds spent deriving the key of new keyslots
+	IterTimeMs int `json:"iter_time_ms,omitempty"`
+	// Memory in KiB used by argon2 to derive the key of new keyslots, which
+	// must fit in the memory of the UVM
+	PbkdfMemoryKiB int `json:"pbkdf_memory_kib,omitempty"`
+
+	// Keyslot tried by luksOpen. If it is unset, cryptsetup tries all of them.
+	KeySlot *int `json:"key_slot,omitempty"`
+
+	// The plain options describe images encrypted without a LUKS header, as
+	// the header isn't there to provide them. They can't be used with LUKS.
+
+	// Type of the image: luks (the default) or plain
+	Type string `json:"type,omitempty"`
+	// Cipher of a plain image, for example aes-xts-plain64
+	Cipher string `json:"cipher,omitempty"`
+	// Size in bits of the key of a plain image, read from the start of the key
+	KeySize int `json:"key_size,omitempty"`
+	// Offset in 512-byte sectors of the encrypted data in a plain image
+	Offset int64 `json:"offset,omitempty"`
+}
+
+// Types of encrypted images
+const (
+	CryptsetupTypeLuks  = "luks"
+	CryptsetupTypePlain = "plain"
+)
+
+// isPlain returns whether o describes an image without a LUKS header.
+func (o CryptsetupOptions) isPlain() bool {
+	return o.Type == CryptsetupTypePlain
+}
+
+// validateType checks the type of o and its plain options.
+func (o CryptsetupOptions) validateType() error {
+	switch o.Type {
+	case "", CryptsetupTypeLuks:
+		if o.Cipher != "" || o.KeySize != 0 || o.Offset != 0 {
+			return errors.Errorf("cipher, key_size and offset can only be used with type %s", CryptsetupTypePlain)
+		}
+	case CryptsetupTypePlain:
+		if o.Cipher == "" {
+			return errors.Errorf("type %s needs a cipher", CryptsetupTypePlain)
+		}
+		if o.KeySize <= 0 || o.KeySize%8 != 0 {
+			return errors.Errorf("invalid key_size: %d", o.KeySize)
+		}
+		if o.Offset < 0 {
+			return errors.Errorf("invalid offset: %d", o.Offset)
+		}
+		if o.KeySlot != nil {
+			return errors.Errorf("key_slot can't be used with type %s", CryptsetupTypePlain)
+		}
+	default:
+		return errors.Errorf("unknown type: %s", o.Type)
+	}
+	return nil
+}
+
+// plainArgs returns the arguments of cryptsetup that describe a plain image.
+func (o CryptsetupOptions) plainArgs() []string {
+	args := []string{"--type", CryptsetupTypePlain, "--cipher", o.Cipher, "--key-size", strconv.Itoa(o.KeySize)}
+	if o.Offset > 0 {
+		args = append(args, "--offset", strconv.FormatInt(o.Offset, 10))
+	}
+	return args
+}
+
+// Key derivation functions supported by LUKS2 keyslots
+const (
+	PbkdfPbkdf2   = "pbkdf2"
+	PbkdfArgon2i  = "argon2i"
+	PbkdfArgon2id = "argon2id"
+)
+
+// validatePbkdf checks the PBKDF options of o.
+func (o CryptsetupOptions) validatePbkdf() error {
+	switch o.Pbkdf {
+	case "", PbkdfArgon2i, PbkdfArgon2id:
+	case PbkdfPbkdf2:
+		if o.PbkdfMemoryKiB != 0 {
+			return errors.Errorf("pbkdf_memory_kib can't be used with %s", PbkdfPbkdf2)
+		}
+	default:
+		return errors.Errorf("unknown pbkdf: %s", o.Pbkdf)
+	}
+	if o.IterTimeMs < 0 {
+		return errors.Errorf("invalid iter_time_ms: %d", o.IterTimeMs)
+	}
+	if o.PbkdfMemoryKiB < 0 {
+		return errors.Errorf("invalid pbkdf_memory_kib: %d", o.PbkdfMemoryKiB)
+	}
+	return nil
+}
+
+// Number of keyslots of a LUKS2 header. LUKS1 headers only have 8, which
+// cryptsetup checks when the filesystem is opened.
+const luksMaxKeySlots = 32
+
+// validateKeySlot checks the keyslot of o.
+func (o CryptsetupOptions) validateKeySlot() error {
+	if o.KeySlot != nil && (*o.KeySlot < 0 || *o.KeySlot >= luksMaxKeySlots) {
+		return errors.Errorf("invalid key_slot: %d", *o.KeySlot)
+	}
+	return nil
+}
+
+// keySlotArgs returns the arguments of cryptsetup for operations that unlock
+// a keyslot, like luksOpen.
+func (o CryptsetupOptions) keySlotArgs() []string {
+	if o.KeySlot == nil {
+		return nil
+	}
+	return []string{"--key-slot", strconv.Itoa(*o.KeySlot)}
+}
+
+// pbkdfArgs returns the arguments of cryptsetup for operations that write a
+// keyslot, like luksFormat or luksAddKey.
+func (o CryptsetupOptions) pbkdfArgs() []string {
+	var args []string
+	if o.Pbkdf != "" {
+		args = append(args, "--pbkdf", o.Pbkdf)
+	}
+	if o.IterTimeMs > 0 {
+		args = append(args, "--iter-time", strconv.Itoa(o.IterTimeMs))
+	}
+	if o.PbkdfMemoryKiB > 0 {
+		args = append(args, "--pbkdf-memory", strconv.Itoa(o.PbkdfMemoryKiB))
+	}
+	return args
+}
+
+// Features of cryptsetup used to open filesystems
+const (
+	// --integrity-no-journal, always used by cryptsetupOpen
+	CryptsetupFeatureIntegrityNoJournal = "integrity-no-journal"
+	// --perf-no_read_workqueue
+	CryptsetupFeaturePerfNoReadWorkqueue = "perf-no_read_workqueue"
+	// --perf-no_write_workqueue
+	CryptsetupFeaturePerfNoWriteWorkqueue = "perf-no_write_workqueue"
+	// --perf-same_cpu_crypt
+	CryptsetupFeaturePerfSameCPUCrypt = "perf-same_cpu_crypt"
+)
+
+// First version of cryptsetup that supports each feature
+var cryptsetupFeatureVersions = map[string]CryptsetupVersion{
+	CryptsetupFeatureIntegrityNoJournal:   {2, 0, 0},
+	CryptsetupFeaturePerfNoReadWorkqueue:  {2, 3, 4},
+	CryptsetupFeaturePerfNoWriteWorkqueue: {2, 3, 4},
+	CryptsetupFeaturePerfSameCPUCrypt:     {1, 7, 0},
+}
+
+var cryptsetupVersionRegexp = regexp.MustCompile(`cryptsetup (\d+)\.(\d+)(?:\.(\d+))?`)
+
+// parseCryptsetupVersion parses the output of "cryptsetup --version", for
+// example "cryptsetup 2.4.3 flags: UDEV BLKID KEYRING KERNEL_CAPI".
+func parseCryptsetupVersion(output string) (CryptsetupVersion, error) {
+	match := cryptsetupVersionRegexp.FindStringSubmatch(output)
+	if match == nil {
+		return CryptsetupVersion{}, errors.Errorf("unexpected cryptsetup version: %s", output)
+	}
+
+	var version CryptsetupVersion
+	version.Major, _ = strconv.Atoi(match[1])
+	version.Minor, _ = strconv.Atoi(match[2])
+	if match[3] != "" {
+		version.Patch, _ = strconv.Atoi(match[3])
+	}
+	return version, nil
+}
+
+// Well-known conditions reported by cryptsetup, matched with errors.Is on the
+// CryptsetupError of a failed command
+var (
+	ErrCryptsetupDeviceExists = errors.New("device already exists")
+	ErrCryptsetupNotLuks      = errors.New("not a LUKS device")
+	ErrCryptsetupNoKey        = errors.New("no key available with this passphrase")
+	ErrCryptsetupInUse        = errors.New("device already in use")
+)
+
+// Messages of cryptsetup for each condition, for example "Device
+// remote-crypt-0 already exists." or "Cannot use device /dev/loop0 which is
+// in use (already mapped or mounted)."
+var cryptsetupConditions = []struct {
+	message   string
+	condition error
+}{
+	{"already exists", ErrCryptsetupDeviceExists},
+	{"is not a valid LUKS device", ErrCryptsetupNotLuks},
+	{"No key available with this passphrase", ErrCryptsetupNoKey},
+	{"which is in use", ErrCryptsetupInUse},
+	{"is still in use", ErrCryptsetupInUse},
+	{"Device or resource busy", ErrCryptsetupInUse},
+}
+
+// cryptsetupVerbosityArgs returns the verbosity arguments of cryptsetup for
+// the log level of the tool: --debug and -v at trace level, -v at debug level
+// and none otherwise. The output of --debug is long and names the devices.
+func cryptsetupVerbosityArgs(level logrus.Level) []string {
+	switch {
+	case level >= logrus.TraceLevel:
+		return []string{"--debug", "-v"}
+	case level >= logrus.DebugLevel:
+		return []string{"-v"}
+	default:
+		return nil
+	}
+}
+
+// CryptsetupError is returned when a cryptsetup command fails. Condition is
+// one of the ErrCryptsetup errors if the output reports a well-known
+// condition, and Output is the raw output of the command for debugging. The
+// error message only includes the messages of cryptsetup, without the "# "
+// lines printed by --debug.
+type CryptsetupError struct {
+	Args      []string
+	Condition error
+	Output    string
+	Err       error
+}
+
+func (e *CryptsetupError) Error() string {
+	message := cryptsetupMessages(e.Output)
+	if e.Condition != nil {
+		return fmt.Sprintf("cryptsetup %s failed: %v: %v: %s", strings.Join(e.Args, " "), e.Condition, e.Err, message)
+	}
+	return fmt.Sprintf("cryptsetup %s failed: %v: %s", strings.Join(e.Args, " "), e.Err, message)
+}
+
+// cryptsetupMessages returns the non-empty lines of output that aren't "# "
+// lines printed by --debug, joined by "; ".
+func cryptsetupMessages(output string) string {
+	var messages []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		messages = append(messages, line)
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *CryptsetupError) Unwrap() []error {
+	if e.Condition != nil {
+		return []error{e.Condition, e.Err}
+	}
+	return []error{e.Err}
+}
+
+// parseCryptsetupCondition returns the well-known condition reported in the
+// output of cryptsetup, or nil. The "# " lines printed by --debug are skipped,
+// as they can mention these words without an error.
+func parseCryptsetupCondition(output string) error {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, c := range cryptsetupConditions {
+			if strings.Contains(line, c.message) {
+				return c.condition
+			}
+		}
+	}
+	return nil
+}
+
+// newCryptsetupError returns the CryptsetupError of the command with args that
+// failed with err and printed output.
+func newCryptsetupError(args []string, output []byte, err error) *CryptsetupError {
+	return &CryptsetupError{
+		Args:      args,
+		Condition: parseCryptsetupCondition(string(output)),
+		Output:    string(output),
+		Err:       err,
+	}
+}
+
+// ErrKeyRejected is returned by cryptsetupTestKey when the key doesn't unlock
+// any keyslot of the LUKS header, or the keyslot selected in the options.
+var ErrKeyRejected = errors.New("derived key rejected by LUKS header")
+
+// Exit code of cryptsetup when the key doesn't unlock any keyslot
+const cryptsetupExitNoPermission = 2
+
+// cryptsetupTestKey checks the key in keyFilePath against the keyslots of the
+// LUKS header of source, or the detached one in headerPath if it is set,
+// without opening it. cryptsetup unlocks the volume key
+// with the keyslot and compares it with the digest stored in the header
+// (mk-digest in LUKS1, the keyslot digest in LUKS2), so no device is created.
+func cryptsetupTestKey(source string, keyFilePath string, headerPath string, options CryptsetupOptions) error {
+	args := append([]string{"luksOpen", "--test-passphrase", source, "--key-file", keyFilePath}, options.keySlotArgs()...)
+	args = append(args, headerArgs(headerPath)...)
+	output, err := exec.Command("cryptsetup", args...).CombinedOutput()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == cryptsetupExitNoPermission {
+			return errors.Wrapf(ErrKeyRejected, "%s", source)
+		}
+		return newCryptsetupError(args, output, err)
+	}
+	return nil
+}
+
+// cryptsetupProbe returns the version of the installed cryptsetup binary.
+func cryptsetupProbe() (CryptsetupVersion, error) {
+	output, err := exec.Command("cryptsetup", "--version").CombinedOutput()
+	if err != nil {
+		return CryptsetupVersion{}, errors.Wrapf(err, "failed to execute cryptsetup: %s", string(output))
+	}
+	return parseCryptsetupVersion(string(output))
+}
+
+// cryptsetupFeatures returns the features of cryptsetup needed to open fs.
+func cryptsetupFeatures(fs AzureFilesystem) []string {
+	features := []string{CryptsetupFeatureIntegrityNoJournal}
+	if fs.CryptsetupOptions.PerfNoReadWorkqueue {
+		features = append(features, CryptsetupFeaturePerfNoReadWorkqueue)
+	}
+	if fs.CryptsetupOptions.PerfNoWriteWorkqueue {
+		features = append(features, CryptsetupFeaturePerfNoWriteWorkqueue)
+	}
+	if fs.CryptsetupOptions.PerfSameCPUCrypt {
+		features = append(features, CryptsetupFeaturePerfSameCPUCrypt)
+	}
+	return features
+}
+
+// checkCryptsetupFeatures checks that version supports all the features
+// needed to open fs.
+func checkCryptsetupFeatures(version CryptsetupVersion, fs AzureFilesystem) error {
+	for _, feature := range cryptsetupFeatures(fs) {
+		if required := cryptsetupFeatureVersions[feature]; !version.AtLeast(required) {
+			return errors.Errorf("cryptsetup %s doesn't support %s, which needs cryptsetup %s or newer", version, feature, required)
+		}
+	}
+	return nil
+}
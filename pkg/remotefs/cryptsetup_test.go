@@ -0,0 +1,266 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func Test_ParseCryptsetupVersion(t *testing.T) {
+	for _, tc := range []struct {
+		output  string
+		version CryptsetupVersion
+	}{
+		{"cryptsetup 2.4.3 flags: UDEV BLKID KEYRING KERNEL_CAPI\n", CryptsetupVersion{2, 4, 3}},
+		{"cryptsetup 2.7.0\n", CryptsetupVersion{2, 7, 0}},
+		{"cryptsetup 1.7\n", CryptsetupVersion{1, 7, 0}},
+	} {
+		version, err := parseCryptsetupVersion(tc.output)
+		if err != nil {
+			t.Fatalf("parseCryptsetupVersion(%q) failed: %v", tc.output, err)
+		}
+		if version != tc.version {
+			t.Fatalf("parseCryptsetupVersion(%q) = %s, expected %s", tc.output, version, tc.version)
+		}
+	}
+
+	if _, err := parseCryptsetupVersion("command not found"); err == nil {
+		t.Fatalf("expected invalid output to be rejected")
+	}
+}
+
+func Test_CheckCryptsetupFeatures(t *testing.T) {
+	fs := AzureFilesystem{MountPoint: "/mnt/remote/share0"}
+
+	if err := checkCryptsetupFeatures(CryptsetupVersion{2, 3, 7}, fs); err != nil {
+		t.Fatalf("expected cryptsetup 2.3.7 to be supported: %v", err)
+	}
+	if err := checkCryptsetupFeatures(CryptsetupVersion{1, 7, 5}, fs); err == nil {
+		t.Fatalf("expected cryptsetup 1.7.5 to be rejected")
+	}
+
+	fs.CryptsetupOptions = CryptsetupOptions{PerfNoReadWorkqueue: true, PerfSameCPUCrypt: true}
+	if err := checkCryptsetupFeatures(CryptsetupVersion{2, 3, 7}, fs); err != nil {
+		t.Fatalf("expected cryptsetup 2.3.7 to support the workqueue flags: %v", err)
+	}
+	if err := checkCryptsetupFeatures(CryptsetupVersion{2, 3, 3}, fs); err == nil {
+		t.Fatalf("expected cryptsetup 2.3.3 to be rejected for --perf-no_read_workqueue")
+	}
+}
+
+func Test_CryptsetupTestKey(t *testing.T) {
+	// Fake cryptsetup that exits with the code in the key file
+	dir := t.TempDir()
+	script := "#!/bin/sh\nread code < \"$5\"\nexit $code\n"
+	if err := os.WriteFile(filepath.Join(dir, "cryptsetup"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	keyFilePath := filepath.Join(dir, "keyfile")
+	for _, tc := range []struct {
+		exitCode string
+		rejected bool
+		fails    bool
+	}{
+		{"0", false, false},
+		{"2", true, true},
+		{"4", false, true},
+	} {
+		if err := os.WriteFile(keyFilePath, []byte(tc.exitCode), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := cryptsetupTestKey("data", keyFilePath, "", CryptsetupOptions{})
+		if (err != nil) != tc.fails || errors.Is(err, ErrKeyRejected) != tc.rejected {
+			t.Errorf("exit code %s: unexpected error %v", tc.exitCode, err)
+		}
+	}
+}
+
+func Test_CryptsetupCommand_Conditions(t *testing.T) {
+	// Fake cryptsetup that prints the message in $MESSAGE and fails
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho \"# Releasing crypt device remote-crypt-0 context, which is in use.\"\necho \"$MESSAGE\"\nexit 5\n"
+	if err := os.WriteFile(filepath.Join(dir, "cryptsetup"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	for _, tc := range []struct {
+		message   string
+		condition error
+		code      string
+	}{
+		{"Device remote-crypt-0 already exists.", ErrCryptsetupDeviceExists, "device_exists"},
+		{"Cannot use device /tmp/0/data which is in use (already mapped or mounted).", ErrCryptsetupInUse, "device_in_use"},
+		{"Device /tmp/0/data is not a valid LUKS device.", ErrCryptsetupNotLuks, "not_luks"},
+		{"No key available with this passphrase.", ErrCryptsetupNoKey, "key_rejected"},
+		{"Cannot allocate memory.", nil, "error"},
+	} {
+		t.Setenv("MESSAGE", tc.message)
+		err := errors.Wrapf(cryptsetupOpen("data", "remote-crypt-0", "keyfile", "", CryptsetupOptions{}), "luksOpen failed")
+
+		var cryptErr *CryptsetupError
+		if !errors.As(err, &cryptErr) {
+			t.Fatalf("%q: expected a CryptsetupError, got %v", tc.message, err)
+		}
+		if cryptErr.Condition != tc.condition || (tc.condition != nil && !errors.Is(err, tc.condition)) {
+			t.Errorf("%q: expected condition %v, got %v", tc.message, tc.condition, cryptErr.Condition)
+		}
+		if code := statusErrorCode(err); code != tc.code {
+			t.Errorf("%q: expected code %s, got %s", tc.message, tc.code, code)
+		}
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 5 {
+			t.Errorf("%q: expected the exit error of cryptsetup, got %v", tc.message, err)
+		}
+		if !strings.Contains(err.Error(), tc.message) {
+			t.Errorf("%q: message missing from %v", tc.message, err)
+		}
+		if strings.Contains(err.Error(), "# Releasing") || !strings.Contains(cryptErr.Output, "# Releasing") {
+			t.Errorf("%q: expected the debug output in Output only, got %v", tc.message, err)
+		}
+	}
+}
+
+func Test_CryptsetupCommand_Verbosity(t *testing.T) {
+	// Fake cryptsetup that records its arguments
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := "#!/bin/sh\necho \"$@\" > " + argsFile + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "cryptsetup"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	origLevel := logrus.GetLevel()
+	defer logrus.SetLevel(origLevel)
+
+	for _, tc := range []struct {
+		level logrus.Level
+		args  string
+	}{
+		{logrus.InfoLevel, "close remote-crypt-0\n"},
+		{logrus.DebugLevel, "-v close remote-crypt-0\n"},
+		{logrus.TraceLevel, "--debug -v close remote-crypt-0\n"},
+	} {
+		logrus.SetLevel(tc.level)
+		if err := cryptsetupCommand([]string{"close", "remote-crypt-0"}); err != nil {
+			t.Fatalf("%s: cryptsetupCommand failed: %v", tc.level, err)
+		}
+		args, err := os.ReadFile(argsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(args) != tc.args {
+			t.Errorf("%s: expected args %q, got %q", tc.level, tc.args, args)
+		}
+	}
+}
+
+func Test_CryptsetupOptions_Pbkdf(t *testing.T) {
+	if args := (CryptsetupOptions{}).pbkdfArgs(); len(args) != 0 {
+		t.Fatalf("expected the defaults of cryptsetup, got %v", args)
+	}
+
+	options := CryptsetupOptions{Pbkdf: PbkdfArgon2id, IterTimeMs: 500, PbkdfMemoryKiB: 65536}
+	if err := options.validatePbkdf(); err != nil {
+		t.Fatalf("expected %+v to be valid: %v", options, err)
+	}
+	expected := []string{"--pbkdf", "argon2id", "--iter-time", "500", "--pbkdf-memory", "65536"}
+	if args := options.pbkdfArgs(); !reflect.DeepEqual(args, expected) {
+		t.Fatalf("expected %v, got %v", expected, args)
+	}
+
+	for _, options := range []CryptsetupOptions{
+		{Pbkdf: "scrypt"},
+		{Pbkdf: PbkdfPbkdf2, PbkdfMemoryKiB: 65536},
+		{IterTimeMs: -1},
+		{PbkdfMemoryKiB: -1},
+	} {
+		if err := options.validatePbkdf(); err == nil {
+			t.Errorf("expected %+v to be rejected", options)
+		}
+	}
+}
+
+func Test_CryptsetupOptions_KeySlot(t *testing.T) {
+	if args := (CryptsetupOptions{}).keySlotArgs(); len(args) != 0 {
+		t.Fatalf("expected all keyslots to be tried, got %v", args)
+	}
+
+	slot := 1
+	options := CryptsetupOptions{KeySlot: &slot}
+	if err := options.validateKeySlot(); err != nil {
+		t.Fatalf("expected keyslot %d to be valid: %v", slot, err)
+	}
+	expected := []string{"--key-slot", "1"}
+	if args := options.keySlotArgs(); !reflect.DeepEqual(args, expected) {
+		t.Fatalf("expected %v, got %v", expected, args)
+	}
+
+	for _, slot := range []int{-1, luksMaxKeySlots} {
+		slot := slot
+		options := CryptsetupOptions{KeySlot: &slot}
+		if err := options.validateKeySlot(); err == nil {
+			t.Errorf("expected keyslot %d to be rejected", slot)
+		}
+	}
+}
+
+func Test_CryptsetupOptions_Plain(t *testing.T) {
+	// Fake cryptsetup that records its arguments
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := "#!/bin/sh\necho \"$@\" > " + argsFile + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "cryptsetup"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	origLevel := logrus.GetLevel()
+	defer logrus.SetLevel(origLevel)
+	logrus.SetLevel(logrus.InfoLevel)
+
+	options := CryptsetupOptions{Type: CryptsetupTypePlain, Cipher: "aes-xts-plain64", KeySize: 512, Offset: 8, PerfSameCPUCrypt: true}
+	if err := options.validateType(); err != nil {
+		t.Fatalf("expected %+v to be valid: %v", options, err)
+	}
+	if err := cryptsetupOpen("data", "remote-crypt-0", "keyfile", "", options); err != nil {
+		t.Fatalf("cryptsetupOpen failed: %v", err)
+	}
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "open data remote-crypt-0 --key-file keyfile --type plain --cipher aes-xts-plain64 --key-size 512 --offset 8 --perf-same_cpu_crypt\n"
+	if string(args) != expected {
+		t.Errorf("expected args %q, got %q", expected, args)
+	}
+
+	slot := 0
+	for _, options := range []CryptsetupOptions{
+		{Type: "plain64"},
+		{Type: CryptsetupTypePlain, KeySize: 256},
+		{Type: CryptsetupTypePlain, Cipher: "aes-xts-plain64"},
+		{Type: CryptsetupTypePlain, Cipher: "aes-xts-plain64", KeySize: 100},
+		{Type: CryptsetupTypePlain, Cipher: "aes-xts-plain64", KeySize: 256, Offset: -1},
+		{Type: CryptsetupTypePlain, Cipher: "aes-xts-plain64", KeySize: 256, KeySlot: &slot},
+		{Cipher: "aes-xts-plain64"},
+		{Type: CryptsetupTypeLuks, Offset: 8},
+	} {
+		if err := options.validateType(); err == nil {
+			t.Errorf("expected %+v to be rejected", options)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MountDeadlineError is returned by MountAzureFilesystems when the mount
+// deadline expires. It identifies the step that was in progress.
+type MountDeadlineError struct {
+	Deadline time.Duration
+	// Step in progress when the deadline expired, e.g. "key_release"
+	Step string
+	// Index of the filesystem being mounted, or -1 if the deadline expired
+	// before or between filesystems
+	Index int
+	// Error returned by the step that was interrupted
+	Err error
+}
+
+func (e *MountDeadlineError) Error() string {
+	where := e.Step
+	if e.Index >= 0 {
+		where = fmt.Sprintf("%s of filesystem-%d", e.Step, e.Index)
+	}
+	return fmt.Sprintf("mount deadline of %s exceeded during %s: %v", e.Deadline, where, e.Err)
+}
+
+func (e *MountDeadlineError) Unwrap() error {
+	return e.Err
+}
+
+// mountProgress records the step of MountAzureFilesystems in progress, so that
+// an expired deadline can be attributed to it.
+type mountProgress struct {
+	mutex sync.Mutex
+	step  string
+	index int
+}
+
+type mountProgressKey struct{}
+
+// withMountProgress returns a context that carries a new mountProgress.
+func withMountProgress(ctx context.Context) (context.Context, *mountProgress) {
+	progress := &mountProgress{index: -1}
+	return context.WithValue(ctx, mountProgressKey{}, progress), progress
+}
+
+// setMountStep records that step of filesystem index, or -1 for steps that
+// aren't specific to a filesystem, is in progress in the mount of ctx.
+func setMountStep(ctx context.Context, index int, step string) {
+	progress, ok := ctx.Value(mountProgressKey{}).(*mountProgress)
+	if !ok {
+		return
+	}
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	progress.step, progress.index = step, index
+}
+
+func (p *mountProgress) current() (string, int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.step, p.index
+}
@@ -0,0 +1,58 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/pkg/errors"
+)
+
+func Test_MountDeadline(t *testing.T) {
+	origProbe, origMountSingle := _cryptsetupProbe, _mountSingleFilesystem
+	defer func() {
+		_cryptsetupProbe, _mountSingleFilesystem = origProbe, origMountSingle
+	}()
+
+	// Provide the platform certificates so that they aren't fetched
+	t.Setenv("UVM_HOST_AMD_CERTIFICATE", base64.StdEncoding.EncodeToString([]byte(`{"vcekCert": "vcek", "tcbm": "db18000000000004", "certificateChain": "chain"}`)))
+
+	_cryptsetupProbe = func() (CryptsetupVersion, error) {
+		return CryptsetupVersion{2, 4, 3}, nil
+	}
+	// The key release of the filesystem hangs until the context is done
+	_mountSingleFilesystem = func(ctx context.Context, opts *MountOptions, tempDir string, index int, fs AzureFilesystem, releasedKey jwk.Key, fsStatus *FilesystemStatus) error {
+		steps := &stepTracer{ctx: ctx, index: index}
+		steps.step("azmount")
+		steps.step("key_release")
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	info := RemoteFilesystemsInformation{
+		MountDeadlineMs:  50,
+		AzureFilesystems: []AzureFilesystem{{AzureUrl: "https://account.blob.core.windows.net/c/image", MountPoint: t.TempDir() + "/share"}},
+	}
+	err := MountAzureFilesystems(context.Background(), t.TempDir(), info)
+
+	var deadlineErr *MountDeadlineError
+	if !errors.As(err, &deadlineErr) {
+		t.Fatalf("expected MountDeadlineError, got %v", err)
+	}
+	if deadlineErr.Step != "key_release" || deadlineErr.Index != 0 {
+		t.Fatalf("expected deadline in key_release of filesystem-0, got %s of %d", deadlineErr.Step, deadlineErr.Index)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected error to wrap context.DeadlineExceeded: %v", err)
+	}
+	if code := statusErrorCode(err); code != "deadline_exceeded" {
+		t.Fatalf("expected deadline_exceeded error code, got %s", code)
+	}
+}
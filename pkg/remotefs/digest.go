@@ -0,0 +1,112 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var imageSha256Regexp = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// ImageDigestError is returned when the digest of an image doesn't match the
+// expected one.
+type ImageDigestError struct {
+	Image    string
+	Expected string
+	Actual   string
+}
+
+func (e *ImageDigestError) Error() string {
+	return fmt.Sprintf("SHA-256 digest of image %s is %s, expected %s", e.Image, e.Actual, e.Expected)
+}
+
+// contextReader stops reading when its context is cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// hashImage returns the hex-encoded SHA-256 digest of the whole image at path.
+func hashImage(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to open image %s", path)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, contextReader{ctx: ctx, r: f}); err != nil {
+		return "", errors.Wrapf(err, "failed to read image %s", path)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// imageDigest checks the digest of an image in the background, while the
+// filesystem is being opened.
+type imageDigest struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// startImageDigest starts hashing the image at path if fs.ImageSha256 is set.
+// The image is read once through azmount, which doesn't keep it all cached, so
+// this only checks the image as it is at the time of the mount.
+func startImageDigest(ctx context.Context, index int, fs AzureFilesystem, path string) *imageDigest {
+	ctx, cancel := context.WithCancel(ctx)
+	d := &imageDigest{cancel: cancel, done: make(chan struct{})}
+	if fs.ImageSha256 == "" {
+		close(d.done)
+		return d
+	}
+
+	logrus.Infof("Checking digest of the image of filesystem-%d...", index)
+	go func() {
+		defer close(d.done)
+		actual, err := _hashImage(ctx, path)
+		if err != nil {
+			d.err = err
+			return
+		}
+		if !strings.EqualFold(actual, fs.ImageSha256) {
+			d.err = &ImageDigestError{Image: path, Expected: strings.ToLower(fs.ImageSha256), Actual: actual}
+			return
+		}
+		logrus.Debugf("Digest of the image of filesystem-%d matches: %s", index, actual)
+	}()
+	return d
+}
+
+// Wait waits for the digest check to end and returns its result.
+func (d *imageDigest) Wait() error {
+	<-d.done
+	return d.err
+}
+
+// Cancel stops the digest check and waits for it to end, so that the image
+// isn't read after it is unmounted.
+func (d *imageDigest) Cancel() {
+	d.cancel()
+	<-d.done
+}
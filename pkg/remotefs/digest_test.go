@@ -0,0 +1,70 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func Test_HashImage(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "image")
+	if err := os.WriteFile(image, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := hashImage(context.Background(), image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Errorf("unexpected digest: %s", digest)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := hashImage(ctx, image); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancellation, got %v", err)
+	}
+}
+
+func Test_ImageDigest(t *testing.T) {
+	origHashImage := _hashImage
+	defer func() { _hashImage = origHashImage }()
+
+	calls := 0
+	_hashImage = func(context.Context, string) (string, error) {
+		calls++
+		return "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", nil
+	}
+	ctx := context.Background()
+
+	// The image isn't hashed without an expected digest
+	d := startImageDigest(ctx, 0, AzureFilesystem{}, "image")
+	if err := d.Wait(); err != nil || calls != 0 {
+		t.Errorf("unexpected digest check: calls=%d err=%v", calls, err)
+	}
+	d.Cancel()
+
+	d = startImageDigest(ctx, 0, AzureFilesystem{ImageSha256: "BA7816BF8F01CFEA414140DE5DAE2223B00361A396177A9CB410FF61F20015AD"}, "image")
+	if err := d.Wait(); err != nil {
+		t.Errorf("digest should match: %v", err)
+	}
+	d.Cancel()
+
+	d = startImageDigest(ctx, 0, AzureFilesystem{ImageSha256: "0000000000000000000000000000000000000000000000000000000000000000"}, "image")
+	err := d.Wait()
+	var digestErr *ImageDigestError
+	if !errors.As(err, &digestErr) || statusErrorCode(err) != "image_digest_mismatch" {
+		t.Errorf("expected digest mismatch, got %v", err)
+	}
+	d.Cancel()
+}
@@ -0,0 +1,222 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// What to do if the mount folder of a filesystem is already a mount point,
+// for example one left behind by a run of the tool that crashed
+const (
+	// Fail with an ExistingMountError
+	ExistingMountFail = "fail"
+	// Unmount it, and close the device of the filesystem, before mounting
+	ExistingMountRemount = "remount"
+	// Keep it instead of mounting the filesystem again if it was mounted from
+	// the same device, with the same type and read-only flag, and from the
+	// same image according to the state file or expected_fs_uuid
+	ExistingMountReuse = "reuse"
+)
+
+// ExistingMountError is returned when the mount folder of a filesystem is
+// already a mount point that can't be reused.
+type ExistingMountError struct {
+	Index       int
+	MountFolder string
+	Source      string
+	Fstype      string
+	Reason      string
+}
+
+func (e *ExistingMountError) Error() string {
+	return fmt.Sprintf("mount folder %s of filesystem-%d is already mounted from %s (%s): %s", e.MountFolder, e.Index, e.Source, e.Fstype, e.Reason)
+}
+
+// mountInfo is the entry of a mount point in /proc/self/mountinfo.
+type mountInfo struct {
+	Target   string
+	Source   string
+	Fstype   string
+	ReadOnly bool
+}
+
+// unescapeMountInfo undoes the octal escapes of spaces, tabs, newlines and
+// backslashes in the paths of /proc/self/mountinfo.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// readMountTable returns the mounts in /proc/self/mountinfo, in the order in
+// which they were mounted.
+func readMountTable() ([]mountInfo, error) {
+	mountInfoPath := filepath.Join(procRoot, "self", "mountinfo")
+	data, err := ioutilReadFile(mountInfoPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", mountInfoPath)
+	}
+
+	var mounts []mountInfo
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// For example "36 35 98:0 / /mnt/.filesystem-0 ro,relatime shared:1 - ext4 /dev/mapper/remote-crypt-0 ro"
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i, field := range fields {
+			if field == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator < 6 || separator+2 >= len(fields) {
+			continue
+		}
+		mount := mountInfo{
+			Target: unescapeMountInfo(fields[4]),
+			Source: unescapeMountInfo(fields[separator+2]),
+			Fstype: fields[separator+1],
+		}
+		for _, option := range strings.Split(fields[5], ",") {
+			if option == "ro" {
+				mount.ReadOnly = true
+			}
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// readMountInfo returns the mount at target, or nil if target isn't a mount
+// point. If several filesystems are mounted on target, the last one is the
+// visible one.
+func readMountInfo(target string) (*mountInfo, error) {
+	mounts, err := readMountTable()
+	if err != nil {
+		return nil, err
+	}
+
+	var found *mountInfo
+	for i := range mounts {
+		if mounts[i].Target == target {
+			found = &mounts[i]
+		}
+	}
+	return found, nil
+}
+
+// recordedMount returns whether previous records filesystem index as mounted
+// from the image of fs.
+func recordedMount(previous []MountedFilesystem, index int, fs AzureFilesystem) bool {
+	for _, mounted := range previous {
+		if mounted.Index == index && mounted.Source == filesystemSource(fs) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleExistingMount checks if the mount folder of fs is already a mount
+// point and applies fs.ExistingMount to it. It returns true if the existing
+// mount is reused, and so the filesystem doesn't need to be mounted. Existing
+// mounts are unmounted with mounter. previous are the filesystems recorded in
+// the state file of a previous run.
+func handleExistingMount(mounter Mounter, index int, fs AzureFilesystem, previous []MountedFilesystem) (bool, error) {
+	mountFolder, err := filesystemMountFolder(index, fs.MountPoint)
+	if err != nil {
+		return false, err
+	}
+	existing, err := readMountInfo(mountFolder)
+	if err != nil || existing == nil {
+		return false, err
+	}
+
+	deviceName := cryptDeviceName(index)
+	expectedSource, expectedFstype, expectedReadOnly := "/dev/mapper/"+deviceName, "ext4", !fs.ReadWrite
+	if fs.Tmpfs != nil {
+		expectedSource, expectedFstype, expectedReadOnly = "tmpfs", "tmpfs", false
+	}
+	conflict := func(reason string) *ExistingMountError {
+		return &ExistingMountError{Index: index, MountFolder: mountFolder, Source: existing.Source, Fstype: existing.Fstype, Reason: reason}
+	}
+
+	switch fs.ExistingMount {
+	case ExistingMountReuse:
+		if existing.Source != expectedSource || existing.Fstype != expectedFstype || existing.ReadOnly != expectedReadOnly {
+			return false, conflict(fmt.Sprintf("it can't be reused, expected %s (%s, read-only %t)", expectedSource, expectedFstype, expectedReadOnly))
+		}
+		// The device name only depends on the index, so a mount of another
+		// image at the same index would look the same
+		if fs.ExpectedFsUUID == "" && fs.Tmpfs == nil && !recordedMount(previous, index, fs) {
+			return false, conflict(fmt.Sprintf("it can't be reused, %s isn't recorded as its image in the state file and expected_fs_uuid isn't set", filesystemSource(fs)))
+		}
+		if fs.ExpectedFsUUID != "" && fs.Tmpfs == nil {
+			fsUUID, err := _readExt4UUID(expectedSource)
+			if err != nil {
+				return false, errors.Wrapf(err, "failed to read UUID of filesystem-%d", index)
+			}
+			if !strings.EqualFold(fsUUID, fs.ExpectedFsUUID) {
+				return false, conflict(fmt.Sprintf("it can't be reused, its UUID is %s instead of %s", fsUUID, fs.ExpectedFsUUID))
+			}
+		}
+
+		target, err := os.Readlink(fs.MountPoint)
+		if os.IsNotExist(err) {
+			if err := os.Symlink(fmt.Sprintf(".filesystem-%d", index), fs.MountPoint); err != nil {
+				return false, errors.Wrapf(err, "failed to symlink filesystem-%d: %s", index, fs.MountPoint)
+			}
+		} else if err != nil || target != fmt.Sprintf(".filesystem-%d", index) {
+			return false, conflict(fmt.Sprintf("it can't be reused, %s isn't a symlink to it", fs.MountPoint))
+		}
+		logrus.Infof("Reusing the existing mount of filesystem-%d", index)
+		return true, nil
+
+	case ExistingMountRemount:
+		logrus.Warnf("Unmounting the existing mount of filesystem-%d from %s (%s)", index, existing.Source, existing.Fstype)
+		if err := mounter.Unmount(mountFolder, 0); err != nil {
+			return false, errors.Wrapf(err, "failed to unmount the existing mount of filesystem-%d", index)
+		}
+		if target, err := os.Readlink(fs.MountPoint); err == nil && target == fmt.Sprintf(".filesystem-%d", index) {
+			if err := os.Remove(fs.MountPoint); err != nil {
+				return false, errors.Wrapf(err, "failed to remove symlink of filesystem-%d", index)
+			}
+		}
+		if fs.Tmpfs == nil {
+			if _, err := osStat("/dev/mapper/" + deviceName); err == nil {
+				if err := _cryptsetupClose(deviceName); err != nil {
+					return false, errors.Wrapf(err, "failed to close the existing device of filesystem-%d", index)
+				}
+			}
+		}
+		return false, nil
+
+	default:
+		return false, conflict("set existing_mount to remount or reuse it")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func Test_HandleExistingMount(t *testing.T) {
+	origProcRoot, origStat, origClose := procRoot, osStat, _cryptsetupClose
+	defer func() {
+		procRoot, osStat, _cryptsetupClose = origProcRoot, origStat, origClose
+	}()
+
+	dir := t.TempDir()
+	procRoot = filepath.Join(dir, "proc")
+	if err := os.MkdirAll(filepath.Join(procRoot, "self"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Filesystem 0 was left mounted by a crashed run, filesystem 1 isn't
+	// mounted and the mount folder of filesystem 2 has a space in its path
+	mountInfo := strings.Join([]string{
+		"22 1 0:21 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw",
+		fmt.Sprintf("36 22 253:0 / %s ro,relatime shared:1 - ext4 /dev/mapper/remote-crypt-0 ro", filepath.Join(dir, ".filesystem-0")),
+		fmt.Sprintf("37 22 0:40 / %s rw,nosuid,nodev shared:2 - tmpfs tmpfs rw,size=1024k", strings.ReplaceAll(filepath.Join(dir, "my share", ".filesystem-2"), " ", `\040`)),
+	}, "\n") + "\n"
+	if err := os.WriteFile(filepath.Join(procRoot, "self", "mountinfo"), []byte(mountInfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "my share"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &recordingMounter{}
+	osStat = func(string) (os.FileInfo, error) {
+		return nil, nil
+	}
+	var closed []string
+	_cryptsetupClose = func(deviceName string) error {
+		closed = append(closed, deviceName)
+		return nil
+	}
+
+	fs := AzureFilesystem{MountPoint: filepath.Join(dir, "share0"), AzureUrl: "https://account.blob.core.windows.net/container/image0"}
+	previous := []MountedFilesystem{{Index: 0, Source: fs.AzureUrl}}
+
+	// Nothing mounted
+	if reused, err := handleExistingMount(recorder, 1, AzureFilesystem{MountPoint: filepath.Join(dir, "share1")}, nil); err != nil || reused {
+		t.Fatalf("expected nothing to be done, got reused %t, %v", reused, err)
+	}
+
+	// The default is to fail
+	_, err := handleExistingMount(recorder, 0, fs, previous)
+	var existingErr *ExistingMountError
+	if !errors.As(err, &existingErr) || existingErr.Source != "/dev/mapper/remote-crypt-0" || statusErrorCode(err) != "mount_conflict" {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+
+	// Not reused if the state file doesn't record it as mounted from the
+	// same image, as the device name doesn't depend on the image
+	fs.ExistingMount = ExistingMountReuse
+	if _, err := handleExistingMount(recorder, 0, fs, nil); !errors.As(err, &existingErr) {
+		t.Fatalf("expected an unrecorded mount not to be reused, got %v", err)
+	}
+	changed := []MountedFilesystem{{Index: 0, Source: "https://account.blob.core.windows.net/container/old"}}
+	if _, err := handleExistingMount(recorder, 0, fs, changed); !errors.As(err, &existingErr) {
+		t.Fatalf("expected a mount of another image not to be reused, got %v", err)
+	}
+
+	// Reused, if it matches, and the missing symlink is created
+	if reused, err := handleExistingMount(recorder, 0, fs, previous); err != nil || !reused {
+		t.Fatalf("expected the mount to be reused, got reused %t, %v", reused, err)
+	}
+	if target, err := os.Readlink(fs.MountPoint); err != nil || target != ".filesystem-0" {
+		t.Fatalf("expected a symlink to .filesystem-0, got %s, %v", target, err)
+	}
+	fs.ReadWrite = true
+	if _, err := handleExistingMount(recorder, 0, fs, previous); !errors.As(err, &existingErr) {
+		t.Fatalf("expected a read-only mount not to be reused for a read-write filesystem, got %v", err)
+	}
+	tmpfs := AzureFilesystem{MountPoint: filepath.Join(dir, "my share", "scratch"), Tmpfs: &TmpfsOptions{SizeBytes: 1024 * 1024}, ExistingMount: ExistingMountReuse}
+	if reused, err := handleExistingMount(recorder, 2, tmpfs, nil); err != nil || !reused {
+		t.Fatalf("expected the tmpfs to be reused, got reused %t, %v", reused, err)
+	}
+
+	// Unmounted, with its symlink and device, to be mounted again
+	fs.ExistingMount = ExistingMountRemount
+	if reused, err := handleExistingMount(recorder, 0, fs, nil); err != nil || reused {
+		t.Fatalf("expected the mount to be removed, got reused %t, %v", reused, err)
+	}
+	if len(recorder.calls) != 1 || recorder.calls[0] != fmt.Sprintf("umount %s 0x0", filepath.Join(dir, ".filesystem-0")) {
+		t.Fatalf("unexpected calls %q", recorder.calls)
+	}
+	if _, err := os.Lstat(fs.MountPoint); !os.IsNotExist(err) {
+		t.Fatalf("expected the symlink to be removed: %v", err)
+	}
+	if len(closed) != 1 || closed[0] != "remote-crypt-0" {
+		t.Fatalf("expected the device to be closed, got %v", closed)
+	}
+}
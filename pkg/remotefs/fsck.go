@@ -0,0 +1,81 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// What happens when fsck finds errors it can't fix
+const (
+	FsckFailurePolicyFail = "fail"
+	FsckFailurePolicyWarn = "warn"
+)
+
+// Exit codes of e2fsck, which are a bitmask
+const (
+	fsckExitErrorsCorrected   = 1
+	fsckExitRebootRequired    = 2
+	fsckExitErrorsUncorrected = 4
+)
+
+// FsckError is returned when e2fsck can't fix the errors of a filesystem.
+type FsckError struct {
+	Device   string
+	ExitCode int
+	Output   string
+}
+
+func (e *FsckError) Error() string {
+	return fmt.Sprintf("e2fsck of %s failed with exit code %d: %s", e.Device, e.ExitCode, e.Output)
+}
+
+// runFsck runs "e2fsck -p" on devicePath, which fixes the errors that can be
+// fixed safely without asking, like the ones left by an unclean shutdown.
+func runFsck(ctx context.Context, devicePath string) error {
+	output, err := exec.CommandContext(ctx, "e2fsck", "-p", devicePath).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return errors.Wrapf(err, "failed to execute e2fsck")
+	}
+	code := exitErr.ExitCode()
+	if code&^(fsckExitErrorsCorrected|fsckExitRebootRequired) == 0 {
+		logrus.Infof("e2fsck corrected errors of %s: %s", devicePath, string(output))
+		return nil
+	}
+	return &FsckError{Device: devicePath, ExitCode: code, Output: string(output)}
+}
+
+// checkFilesystem runs fsck on the device of fs if it is requested, and
+// handles the errors according to fs.FsckFailurePolicy.
+func checkFilesystem(ctx context.Context, index int, fs AzureFilesystem, devicePath string) error {
+	if !fs.RunFsck || !fs.ReadWrite {
+		return nil
+	}
+
+	logrus.Infof("Checking filesystem-%d...", index)
+	err := _runFsck(ctx, devicePath)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+
+	var fsckErr *FsckError
+	if fs.FsckFailurePolicy == FsckFailurePolicyWarn && errors.As(err, &fsckErr) {
+		logrus.WithError(err).Warnf("Mounting filesystem-%d with uncorrected errors", index)
+		return nil
+	}
+	return err
+}
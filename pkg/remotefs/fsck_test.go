@@ -0,0 +1,78 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func Test_RunFsck(t *testing.T) {
+	// Fake e2fsck that exits with the code in the device file
+	dir := t.TempDir()
+	script := "#!/bin/sh\nread code < \"$2\"\nexit $code\n"
+	if err := os.WriteFile(filepath.Join(dir, "e2fsck"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	device := filepath.Join(dir, "device")
+	for _, tc := range []struct {
+		exitCode string
+		fails    bool
+	}{
+		{"0", false},
+		{"1", false},
+		{"3", false},
+		{"4", true},
+		{"8", true},
+	} {
+		if err := os.WriteFile(device, []byte(tc.exitCode), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := runFsck(context.Background(), device)
+		var fsckErr *FsckError
+		if (err != nil) != tc.fails || (err != nil && !errors.As(err, &fsckErr)) {
+			t.Errorf("exit code %s: unexpected error %v", tc.exitCode, err)
+		}
+	}
+}
+
+func Test_CheckFilesystem(t *testing.T) {
+	origRunFsck := _runFsck
+	defer func() { _runFsck = origRunFsck }()
+
+	calls := 0
+	_runFsck = func(context.Context, string) error {
+		calls++
+		return &FsckError{Device: "/dev/mapper/remote-crypt-0", ExitCode: 4}
+	}
+	ctx := context.Background()
+
+	// fsck is only run on read-write filesystems that request it
+	if err := checkFilesystem(ctx, 0, AzureFilesystem{RunFsck: true}, "/dev/mapper/remote-crypt-0"); err != nil || calls != 0 {
+		t.Fatalf("expected fsck to be skipped for a read-only filesystem (%d calls, %v)", calls, err)
+	}
+	if err := checkFilesystem(ctx, 0, AzureFilesystem{ReadWrite: true}, "/dev/mapper/remote-crypt-0"); err != nil || calls != 0 {
+		t.Fatalf("expected fsck to be skipped when not requested (%d calls, %v)", calls, err)
+	}
+
+	fs := AzureFilesystem{ReadWrite: true, RunFsck: true}
+	err := checkFilesystem(ctx, 0, fs, "/dev/mapper/remote-crypt-0")
+	if calls != 1 || statusErrorCode(err) != "fsck_failed" {
+		t.Fatalf("expected uncorrected errors to fail the mount, got %v", err)
+	}
+
+	fs.FsckFailurePolicy = FsckFailurePolicyWarn
+	if err := checkFilesystem(ctx, 0, fs, "/dev/mapper/remote-crypt-0"); err != nil {
+		t.Fatalf("expected uncorrected errors to be logged with the warn policy, got %v", err)
+	}
+}
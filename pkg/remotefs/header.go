@@ -0,0 +1,102 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Timeout of the download of a detached LUKS header
+const headerDownloadTimeout = 60 * time.Second
+
+// Maximum size of a detached LUKS header. Headers created by cryptsetup with
+// the default metadata and keyslots areas are 16 MiB.
+const maxHeaderSizeBytes = 64 << 20
+
+var _fetchHeader = fetchHeader
+
+// validateHeaderUrl checks the URL of the detached LUKS header of fs, if any,
+// and that its host is in allowedHosts, unless it is empty.
+func validateHeaderUrl(fs AzureFilesystem, allowedHosts []string) error {
+	if fs.HeaderUrl == "" {
+		return nil
+	}
+	if fs.CryptsetupOptions.isPlain() {
+		return errors.Errorf("header_url can't be used with plain images, which have no LUKS header")
+	}
+	u, err := url.Parse(fs.HeaderUrl)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse header URL: %s", redactURL(fs.HeaderUrl))
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return errors.Errorf("header URL must be a blob URL: %s", redactURL(fs.HeaderUrl))
+	}
+	if !common.HostAllowed(u.Host, allowedHosts) {
+		return errors.Errorf("host %s of the header isn't in the list of allowed storage hosts", u.Host)
+	}
+	return nil
+}
+
+// fetchHeader downloads the detached LUKS header of fs to a file in
+// headerFolder and returns its path. The header blob is accessed like the
+// image, with a token of identity if the image is private or its access is
+// detected.
+func fetchHeader(ctx context.Context, identity common.Identity, headerFolder string, fs AzureFilesystem) (string, error) {
+	u, err := url.Parse(fs.HeaderUrl)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse header URL: %s", redactURL(fs.HeaderUrl))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, headerDownloadTimeout)
+	defer cancel()
+
+	resp, err := blobRequest(ctx, identity, http.MethodGet, u, fs.AzureUrlPrivate)
+	if err == nil && fs.DetectPrivate && !fs.AzureUrlPrivate && anonymousAccessDenied(resp.StatusCode) {
+		resp.Body.Close()
+		resp, err = blobRequest(ctx, identity, http.MethodGet, u, true)
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to download header %s", redactURL(fs.HeaderUrl))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("failed to download header %s: %s", redactURL(fs.HeaderUrl), resp.Status)
+	}
+
+	header, err := io.ReadAll(io.LimitReader(resp.Body, maxHeaderSizeBytes+1))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to download header %s", redactURL(fs.HeaderUrl))
+	}
+	if len(header) > maxHeaderSizeBytes {
+		return "", errors.Errorf("header %s is larger than %d bytes", redactURL(fs.HeaderUrl), maxHeaderSizeBytes)
+	}
+
+	headerPath := filepath.Join(headerFolder, "header")
+	if err := ioutilWriteFile(headerPath, header, 0600); err != nil {
+		return "", errors.Wrapf(err, "failed to create header file: %s", headerPath)
+	}
+	logrus.Debugf("Downloaded header %s to %s (%d bytes)", redactURL(fs.HeaderUrl), headerPath, len(header))
+	return headerPath, nil
+}
+
+// headerArgs returns the arguments of cryptsetup to read the LUKS header from
+// headerPath instead of from the image, if it is set.
+func headerArgs(headerPath string) []string {
+	if headerPath == "" {
+		return nil
+	}
+	return []string{"--header", headerPath}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/sirupsen/logrus"
+)
+
+func Test_FetchHeader(t *testing.T) {
+	header := []byte("LUKS\xba\xbe header")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Write([]byte(`{"access_token":"token","expires_in":"3600"}`))
+			return
+		}
+		if r.Method != http.MethodGet || r.Header.Get("x-ms-version") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/c/header":
+			w.Write(header)
+		case "/detect/header":
+			// Private container, which is only found with a token
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(header)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	identity := common.Identity{TokenEndpoint: server.URL + "/token"}
+	for _, fs := range []AzureFilesystem{
+		{HeaderUrl: server.URL + "/c/header"},
+		{HeaderUrl: server.URL + "/detect/header", DetectPrivate: true},
+	} {
+		headerPath, err := fetchHeader(ctx, identity, t.TempDir(), fs)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", fs.HeaderUrl, err)
+		}
+		data, err := os.ReadFile(headerPath)
+		if err != nil || string(data) != string(header) {
+			t.Fatalf("%s: expected the header in %s, got %q (%v)", fs.HeaderUrl, headerPath, data, err)
+		}
+	}
+
+	_, err := fetchHeader(ctx, identity, t.TempDir(), AzureFilesystem{HeaderUrl: server.URL + "/c/typo"})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected a missing header to fail, got %v", err)
+	}
+}
+
+func Test_ValidateHeaderUrl(t *testing.T) {
+	allowedHosts := []string{"*.blob.core.windows.net"}
+
+	for _, fs := range []AzureFilesystem{
+		{},
+		{HeaderUrl: "https://account.blob.core.windows.net/c/header"},
+	} {
+		if err := validateHeaderUrl(fs, allowedHosts); err != nil {
+			t.Errorf("expected header URL %q to be valid: %v", fs.HeaderUrl, err)
+		}
+	}
+	for _, fs := range []AzureFilesystem{
+		{HeaderUrl: "https://attacker.example.com/c/header"},
+		{HeaderUrl: "oci://account.blob.core.windows.net/c/header"},
+		{HeaderUrl: "https://account.blob.core.windows.net/c/header", CryptsetupOptions: CryptsetupOptions{Type: CryptsetupTypePlain, Cipher: "aes-xts-plain64"}},
+	} {
+		if err := validateHeaderUrl(fs, allowedHosts); err == nil {
+			t.Errorf("expected header URL %q to be rejected", fs.HeaderUrl)
+		}
+	}
+}
+
+func Test_CryptsetupOpen_Header(t *testing.T) {
+	// Fake cryptsetup that records its arguments
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := "#!/bin/sh\necho \"$@\" >> " + argsFile + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "cryptsetup"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	origLevel := logrus.GetLevel()
+	defer logrus.SetLevel(origLevel)
+	logrus.SetLevel(logrus.InfoLevel)
+
+	if err := cryptsetupTestKey("data", "keyfile", "header", CryptsetupOptions{}); err != nil {
+		t.Fatalf("cryptsetupTestKey failed: %v", err)
+	}
+	if err := cryptsetupOpen("data", "remote-crypt-0", "keyfile", "header", CryptsetupOptions{}); err != nil {
+		t.Fatalf("cryptsetupOpen failed: %v", err)
+	}
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "luksOpen --test-passphrase data --key-file keyfile --header header\n" +
+		"luksOpen data remote-crypt-0 --key-file keyfile --integrity-no-journal --persistent --header header\n"
+	if string(args) != expected {
+		t.Errorf("expected args %q, got %q", expected, args)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Health of the tool reported to readiness probes, with the names used by the
+// gRPC health checking protocol
+const (
+	HealthServing    = "SERVING"
+	HealthNotServing = "NOT_SERVING"
+)
+
+// HealthStatus is served by the health service. Unlike MountStatus, it only
+// has states and error codes, without error messages, so that nothing read
+// from the configuration or returned by a server can end up in it.
+type HealthStatus struct {
+	// SERVING once all the required filesystems are mounted
+	Status string `json:"status"`
+	// Why the tool isn't serving: "starting", "mounting" or the error code
+	// of the mount
+	Reason      string             `json:"reason,omitempty"`
+	Filesystems []FilesystemHealth `json:"filesystems"`
+}
+
+// FilesystemHealth is the health of a single filesystem.
+type FilesystemHealth struct {
+	Index      int    `json:"index"`
+	MountPoint string `json:"mount_point"`
+	State      string `json:"state"`
+	ErrorCode  string `json:"error_code,omitempty"`
+}
+
+var (
+	healthMutex  sync.Mutex
+	healthStatus = HealthStatus{Status: HealthNotServing, Reason: "starting", Filesystems: []FilesystemHealth{}}
+)
+
+// newHealthStatus returns the health of the tool with the mounts in status.
+func newHealthStatus(status *MountStatus) HealthStatus {
+	health := HealthStatus{
+		Status:      HealthNotServing,
+		Filesystems: make([]FilesystemHealth, len(status.Filesystems)),
+	}
+	for i, fs := range status.Filesystems {
+		health.Filesystems[i] = FilesystemHealth{
+			Index:      fs.Index,
+			MountPoint: fs.MountPoint,
+			State:      fs.State,
+			ErrorCode:  fs.ErrorCode,
+		}
+	}
+	switch {
+	case status.Done && !status.Success:
+		health.Reason = status.ErrorCode
+	case status.RequiredDone || (status.Done && status.Success):
+		health.Status = HealthServing
+	default:
+		health.Reason = "mounting"
+	}
+	return health
+}
+
+// setHealthStatus updates the health served by the health service with the
+// mounts in status.
+func setHealthStatus(status *MountStatus) {
+	health := newHealthStatus(status)
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	healthStatus = health
+}
+
+// getHealthStatus returns the health served by the health service.
+func getHealthStatus() HealthStatus {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	return healthStatus
+}
+
+// healthHandler serves the health of the tool as JSON. /readyz fails with 503
+// until the required filesystems are mounted, and /healthz always succeeds
+// while the tool is running.
+func healthHandler() http.Handler {
+	serve := func(ready bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+				return
+			}
+			health := getHealthStatus()
+			w.Header().Set("Content-Type", "application/json")
+			if ready && health.Status != HealthServing {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			if err := json.NewEncoder(w).Encode(health); err != nil {
+				logrus.Debugf("Failed to write health: %s", err.Error())
+			}
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/readyz", serve(true))
+	mux.Handle("/healthz", serve(false))
+	return mux
+}
+
+// ServeHealth serves the health of the tool over HTTP on address, for example
+// ":8080", in the background.
+func ServeHealth(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", address)
+	}
+	go func() {
+		if err := http.Serve(listener, healthHandler()); err != nil {
+			logrus.Errorf("Health server stopped: %s", err.Error())
+		}
+	}()
+	return nil
+}
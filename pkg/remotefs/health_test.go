@@ -0,0 +1,83 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_HealthHandler(t *testing.T) {
+	origHealth := getHealthStatus()
+	defer func() { healthStatus = origHealth }()
+
+	server := httptest.NewServer(healthHandler())
+	defer server.Close()
+	get := func(path string) (int, HealthStatus) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var health HealthStatus
+		if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, health
+	}
+
+	info := RemoteFilesystemsInformation{AzureFilesystems: []AzureFilesystem{
+		{MountPoint: "/mnt/remote/data", RawKeyHexString: "0123456789abcdef"},
+		{MountPoint: "/mnt/remote/cache", Optional: true},
+	}}
+	status := newMountStatus(info)
+	setHealthStatus(status)
+	if code, health := get("/readyz"); code != http.StatusServiceUnavailable || health.Status != HealthNotServing || health.Reason != "mounting" {
+		t.Fatalf("expected not to be ready while mounting, got %d %+v", code, health)
+	}
+	if code, health := get("/healthz"); code != http.StatusOK || len(health.Filesystems) != 2 {
+		t.Fatalf("expected to be live while mounting, got %d %+v", code, health)
+	}
+
+	// Ready once the required filesystems are mounted
+	status.Filesystems[0].State = FilesystemStateMounted
+	status.RequiredDone = true
+	setHealthStatus(status)
+	if code, health := get("/readyz"); code != http.StatusOK || health.Status != HealthServing || health.Filesystems[0].State != FilesystemStateMounted {
+		t.Fatalf("expected to be ready, got %d %+v", code, health)
+	}
+
+	// A failure is reported with its code, without the message
+	status = newMountStatus(info)
+	status.Done = true
+	status.ErrorCode = "key_rejected"
+	status.Error = "failed to open with key 0123456789abcdef"
+	status.Filesystems[0].State = FilesystemStateFailed
+	status.Filesystems[0].ErrorCode = "key_rejected"
+	status.Filesystems[0].Error = status.Error
+	setHealthStatus(status)
+	code, health := get("/readyz")
+	if code != http.StatusServiceUnavailable || health.Reason != "key_rejected" || health.Filesystems[0].ErrorCode != "key_rejected" {
+		t.Fatalf("expected failure to be reported, got %d %+v", code, health)
+	}
+	body, _ := json.Marshal(health)
+	if strings.Contains(string(body), "0123456789abcdef") {
+		t.Fatalf("health contains a secret: %s", body)
+	}
+
+	resp, err := http.Post(server.URL+"/readyz", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected POST to be rejected, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux && insecure_stub_attestation
+// +build linux,insecure_stub_attestation
+
+package remotefs
+
+// This file is only compiled in when building with the
+// insecure_stub_attestation build tag, for example:
+//
+//     go build -tags insecure_stub_attestation ./cmd/remotefs
+//
+// It replaces secure key release with a stub that fetches a canned attestation
+// report and returns the key found in the INSECURE_STUB_KEY environment
+// variable, so that the release, derivation and mount steps can be exercised
+// on hardware without SEV-SNP. Production images never set this build tag.
+
+import (
+	"context"
+	"encoding/base64"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/attest"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/skr"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Environment variable holding the JWK (oct or RSA) returned by the stub
+const insecureStubKeyEnv = "INSECURE_STUB_KEY"
+
+func init() {
+	insecureStubAttestation = true
+	_secureKeyRelease = insecureStubSecureKeyRelease
+	_releaseKeys = insecureStubReleaseKeys
+}
+
+func insecureStubReleaseKeys(ctx context.Context, identity common.Identity, certState attest.CertState, reqs []skr.KeyReleaseRequest, uvmInformation common.UvmInformation) ([]skr.KeyReleaseResult, error) {
+	results := make([]skr.KeyReleaseResult, len(reqs))
+	for i, req := range reqs {
+		results[i].Key, results[i].Err = insecureStubSecureKeyRelease(ctx, identity, certState, req.KeyBlob, uvmInformation)
+		if results[i].Err != nil {
+			return results, results[i].Err
+		}
+	}
+	return results, nil
+}
+
+func insecureStubSecureKeyRelease(ctx context.Context, identity common.Identity, certState attest.CertState, keyBlob common.KeyBlob, uvmInformation common.UvmInformation) (jwk.Key, error) {
+	logrus.Warnf("INSECURE: releasing key %s using stub attestation", keyBlob.KID)
+
+	inittimeDataBytes, err := base64.StdEncoding.DecodeString(uvmInformation.EncodedSecurityPolicy)
+	if err != nil {
+		return nil, errors.Wrap(err, "Decoding policy from Base64 format failed")
+	}
+
+	// Fetch a canned attestation report bound to the policy, as the real
+	// flow would do, so that report generation is exercised too.
+	reportFetcher := attest.UnsafeNewFakeAttestationReportFetcher(attest.GenerateMAAHostData(inittimeDataBytes))
+	reportBytes, err := reportFetcher.FetchAttestationReportByte(attest.GenerateMAAReportData([]byte(keyBlob.KID)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to retrieve stub attestation report")
+	}
+
+	var report attest.SNPAttestationReport
+	if err = report.DeserializeReport(reportBytes); err != nil {
+		return nil, errors.Wrapf(err, "failed to deserialize stub attestation report")
+	}
+	logrus.Debugf("Stub attestation report: %+v", report)
+
+	keyJSON := osGetenv(insecureStubKeyEnv)
+	if keyJSON == "" {
+		return nil, errors.Errorf("%s must be set to a JWK when using stub attestation", insecureStubKeyEnv)
+	}
+
+	jwKey, err := jwk.ParseKey([]byte(keyJSON))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", insecureStubKeyEnv)
+	}
+
+	return jwKey, nil
+}
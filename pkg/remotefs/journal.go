@@ -0,0 +1,74 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// What happens to the ext4 journal of a read-only filesystem
+const (
+	// Mount with "noload", which ignores the journal even if it isn't empty
+	JournalPolicyNoload = "noload"
+	// Let the kernel replay the journal, which fails the mount of a dirty
+	// filesystem if its device can't be written
+	JournalPolicyReplay = "replay"
+	// Fail the mount if the journal isn't empty, and mount with "noload"
+	// otherwise
+	JournalPolicyRefuseIfDirty = "refuse-if-dirty"
+)
+
+const (
+	// Offset of the incompatible features inside the superblock
+	ext4FeatureIncompatOffset = 0x60
+	// Incompatible feature set while the journal needs to be replayed
+	ext4FeatureIncompatRecover = 0x4
+)
+
+// JournalDirtyError is returned when the journal of a filesystem with the
+// refuse-if-dirty journal policy needs to be replayed.
+type JournalDirtyError struct {
+	Index  int
+	Device string
+}
+
+func (e *JournalDirtyError) Error() string {
+	return fmt.Sprintf("journal of filesystem-%d (%s) needs to be replayed, the filesystem wasn't unmounted cleanly", e.Index, e.Device)
+}
+
+// readExt4NeedsRecovery returns whether the journal of the ext4 filesystem in
+// devicePath needs to be replayed, from the features in its superblock.
+func readExt4NeedsRecovery(devicePath string) (bool, error) {
+	superblock, err := readExt4Superblock(devicePath)
+	if err != nil {
+		return false, err
+	}
+	incompat := binary.LittleEndian.Uint32(superblock[ext4FeatureIncompatOffset:])
+	return incompat&ext4FeatureIncompatRecover != 0, nil
+}
+
+// checkJournal applies fs.JournalPolicy to the device of a read-only
+// filesystem before it is mounted.
+func checkJournal(index int, fs AzureFilesystem, devicePath string) error {
+	if fs.ReadWrite || fs.JournalPolicy != JournalPolicyRefuseIfDirty {
+		return nil
+	}
+
+	dirty, err := readExt4NeedsRecovery(devicePath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to check the journal of filesystem-%d", index)
+	}
+	if dirty {
+		return &JournalDirtyError{Index: index, Device: devicePath}
+	}
+	logrus.Debugf("Journal of filesystem-%d is clean", index)
+	return nil
+}
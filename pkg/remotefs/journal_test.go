@@ -0,0 +1,60 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func Test_CheckJournal(t *testing.T) {
+	devicePath := filepath.Join(t.TempDir(), "device")
+	writeSuperblock := func(needsRecovery bool) {
+		image := make([]byte, 4096)
+		image[ext4SuperblockOffset+ext4MagicOffset] = 0x53
+		image[ext4SuperblockOffset+ext4MagicOffset+1] = 0xEF
+		// has_journal and extents
+		image[ext4SuperblockOffset+ext4FeatureIncompatOffset+1] = 0x02
+		if needsRecovery {
+			image[ext4SuperblockOffset+ext4FeatureIncompatOffset] = ext4FeatureIncompatRecover
+		}
+		if err := os.WriteFile(devicePath, image, 0644); err != nil {
+			t.Fatalf("failed to create device file: %v", err)
+		}
+	}
+	refuse := AzureFilesystem{JournalPolicy: JournalPolicyRefuseIfDirty}
+
+	writeSuperblock(false)
+	if err := checkJournal(0, refuse, devicePath); err != nil {
+		t.Fatalf("expected clean journal to pass: %v", err)
+	}
+
+	writeSuperblock(true)
+	err := checkJournal(0, refuse, devicePath)
+	var journalErr *JournalDirtyError
+	if !errors.As(err, &journalErr) || statusErrorCode(err) != "journal_dirty" {
+		t.Fatalf("expected JournalDirtyError, got %v", err)
+	}
+
+	// The other policies don't check the journal
+	for _, fs := range []AzureFilesystem{{}, {JournalPolicy: JournalPolicyNoload}, {JournalPolicy: JournalPolicyReplay}} {
+		if err := checkJournal(0, fs, devicePath); err != nil {
+			t.Fatalf("expected journal policy %q not to check the journal: %v", fs.JournalPolicy, err)
+		}
+	}
+
+	// Not an ext4 filesystem
+	if err := os.WriteFile(devicePath, make([]byte, 4096), 0644); err != nil {
+		t.Fatalf("failed to create device file: %v", err)
+	}
+	if err := checkJournal(0, refuse, devicePath); err == nil {
+		t.Fatalf("expected error for device without ext4 filesystem")
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/skr"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Delay before the first retry of a key release if none is specified. It
+	// doubles with each retry.
+	DefaultKeyReleaseBackoff = 500 * time.Millisecond
+	// Longest delay between two attempts to release a key
+	maxKeyReleaseBackoff = 30 * time.Second
+)
+
+var randInt63n = rand.Int63n
+
+// keyReleaseRetryable returns true if a key release that failed with err may
+// succeed if it is tried again: the request didn't reach the server, or the
+// server answered with a status that usually means a transient problem, like
+// 429 or 503. Denied releases and rejected tokens aren't retried.
+func keyReleaseRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var httpErr *common.HTTPError
+	if errors.As(err, &httpErr) {
+		fields := strings.Fields(httpErr.Status)
+		if len(fields) == 0 {
+			return false
+		}
+		statusCode, convErr := strconv.Atoi(fields[0])
+		if convErr != nil {
+			return false
+		}
+		return common.Retryable(nil, &http.Response{StatusCode: statusCode})
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// keyReleaseBackoff returns the delay before the retry that follows the
+// attempt-th attempt, starting at 1: base doubled for each previous retry,
+// of which a random half is kept so that sidecars started together don't
+// retry together.
+func keyReleaseBackoff(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < maxKeyReleaseBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxKeyReleaseBackoff {
+		delay = maxKeyReleaseBackoff
+	}
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + randInt63n(half+1))
+}
+
+// secureKeyReleaseWithRetry releases the key of keyBlob with opts, trying
+// again up to opts.MaxKeyReleaseRetries times, after opts.KeyReleaseBackoff
+// doubled for each retry, while the release fails with a transient error.
+func secureKeyReleaseWithRetry(ctx context.Context, opts *MountOptions, keyBlob common.KeyBlob) (jwk.Key, error) {
+	base := opts.KeyReleaseBackoff
+	if base <= 0 {
+		base = DefaultKeyReleaseBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		logrus.Infof("Releasing key %s, attempt %d of %d", keyBlob.KID, attempt, opts.MaxKeyReleaseRetries+1)
+		jwKey, err := _secureKeyRelease(ctx, opts.Identity, opts.CertState, keyBlob, opts.UvmInformation)
+		if err == nil {
+			return jwKey, nil
+		}
+		if attempt > opts.MaxKeyReleaseRetries || !keyReleaseRetryable(err) {
+			if attempt > 1 {
+				return nil, errors.Wrapf(err, "failed after %d attempts", attempt)
+			}
+			return nil, err
+		}
+		delay := keyReleaseBackoff(base, attempt)
+		logrus.Warnf("Attempt %d to release key %s failed, retrying in %s: %s", attempt, keyBlob.KID, delay, err.Error())
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "stopped retrying the release of key %s", keyBlob.KID)
+		case <-timeAfter(delay):
+		}
+	}
+}
+
+// releaseKeysWithRetry releases the keys of reqs with opts in a batch like
+// skr.ReleaseKeys, and then releases the keys that failed with a transient
+// error again, like secureKeyReleaseWithRetry does for a single key. The
+// results are in the same order as the requests and the returned error is the
+// first failure, if any.
+func releaseKeysWithRetry(ctx context.Context, opts *MountOptions, reqs []skr.KeyReleaseRequest) ([]skr.KeyReleaseResult, error) {
+	base := opts.KeyReleaseBackoff
+	if base <= 0 {
+		base = DefaultKeyReleaseBackoff
+	}
+	results := make([]skr.KeyReleaseResult, len(reqs))
+	attempts := make([]int, len(reqs))
+	pending := make([]int, len(reqs))
+	for i := range pending {
+		pending[i] = i
+	}
+	for attempt := 1; len(pending) > 0; attempt++ {
+		logrus.Infof("Releasing %d keys, attempt %d of %d", len(pending), attempt, opts.MaxKeyReleaseRetries+1)
+		batch := make([]skr.KeyReleaseRequest, len(pending))
+		for j, i := range pending {
+			batch[j] = reqs[i]
+		}
+		batchResults, err := _releaseKeys(ctx, opts.Identity, opts.CertState, batch, opts.UvmInformation)
+
+		var retry []int
+		for j, i := range pending {
+			attempts[i] = attempt
+			if j < len(batchResults) {
+				results[i] = batchResults[j]
+			} else {
+				results[i] = skr.KeyReleaseResult{Err: err}
+			}
+			if results[i].Err != nil && attempt <= opts.MaxKeyReleaseRetries && keyReleaseRetryable(results[i].Err) {
+				retry = append(retry, i)
+			}
+		}
+		if len(retry) == 0 {
+			break
+		}
+
+		delay := keyReleaseBackoff(base, attempt)
+		logrus.Warnf("Attempt %d to release %d keys failed, retrying in %s: %s", attempt, len(retry), delay, results[retry[0]].Err.Error())
+		select {
+		case <-ctx.Done():
+			for _, i := range retry {
+				results[i].Err = errors.Wrapf(ctx.Err(), "stopped retrying the release of key %s", reqs[i].KeyBlob.KID)
+			}
+			retry = nil
+		case <-timeAfter(delay):
+		}
+		pending = retry
+	}
+
+	for i, result := range results {
+		if result.Err == nil {
+			continue
+		}
+		if attempts[i] > 1 {
+			results[i].Err = errors.Wrapf(result.Err, "failed after %d attempts", attempts[i])
+		}
+		return results, errors.Wrapf(results[i].Err, "releasing key %s failed", reqs[i].KeyBlob.KID)
+	}
+	return results, nil
+}
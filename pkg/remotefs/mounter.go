@@ -0,0 +1,26 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+// Mounter mounts and unmounts the filesystems of the tool: the decrypted ext4
+// filesystems, tmpfs filesystems and Azure Files shares. The arguments are the
+// ones of the mount and umount2 system calls.
+type Mounter interface {
+	Mount(source string, target string, fstype string, flags uintptr, data string) error
+	Unmount(target string, flags int) error
+}
+
+// unixMounter is the default Mounter, which makes the system calls directly.
+type unixMounter struct{}
+
+func (unixMounter) Mount(source string, target string, fstype string, flags uintptr, data string) error {
+	return unixMount(source, target, fstype, flags, data)
+}
+
+func (unixMounter) Unmount(target string, flags int) error {
+	return unixUnmount(target, flags)
+}
@@ -0,0 +1,59 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// recordingMounter records the calls made to it instead of mounting.
+type recordingMounter struct {
+	calls []string
+}
+
+func (m *recordingMounter) Mount(source string, target string, fstype string, flags uintptr, data string) error {
+	m.calls = append(m.calls, fmt.Sprintf("mount %s %s %s %#x %s", source, target, fstype, flags, data))
+	return nil
+}
+
+func (m *recordingMounter) Unmount(target string, flags int) error {
+	m.calls = append(m.calls, fmt.Sprintf("umount %s %#x", target, flags))
+	return nil
+}
+
+func Test_Mounter(t *testing.T) {
+	recorder := &recordingMounter{}
+
+	// The symlink can't be created over an existing file, so the tmpfs is
+	// unmounted again
+	dir := t.TempDir()
+	fs := AzureFilesystem{
+		MountPoint: filepath.Join(dir, "scratch"),
+		Tmpfs:      &TmpfsOptions{SizeBytes: 1024 * 1024},
+	}
+	if err := os.WriteFile(fs.MountPoint, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := mountTmpfs(recorder, &stepTracer{ctx: context.Background(), index: 0}, 0, fs); err == nil {
+		t.Fatalf("expected the symlink to fail")
+	}
+
+	mountFolder := filepath.Join(dir, ".filesystem-0")
+	expected := []string{
+		fmt.Sprintf("mount tmpfs %s tmpfs %#x size=1048576", mountFolder, unix.MS_NOSUID|unix.MS_NODEV),
+		fmt.Sprintf("umount %s 0x0", mountFolder),
+	}
+	if fmt.Sprint(recorder.calls) != fmt.Sprint(expected) {
+		t.Fatalf("expected calls %q, got %q", expected, recorder.calls)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// MountedFS returns the decrypted filesystem mounted at mountPoint by
+// MountAzureFilesystems or MountSingleFilesystem as an fs.FS, so that the
+// program that imports this package can read it with fs.ReadFile or
+// fs.WalkDir. It is backed by the kernel mount, which must stay mounted while
+// it is used. It fails if nothing is mounted at mountPoint, so that the
+// directory under it isn't read by mistake.
+func MountedFS(mountPoint string) (fs.FS, error) {
+	// The mount point is usually a symlink to the directory of the mount
+	target, err := filepath.EvalSymlinks(mountPoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve mount point %s", mountPoint)
+	}
+	mounted, err := isMountPoint(target)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to check mount point %s", mountPoint)
+	}
+	if !mounted {
+		return nil, errors.Errorf("no filesystem is mounted at %s", mountPoint)
+	}
+	return os.DirFS(target), nil
+}
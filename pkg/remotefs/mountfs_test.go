@@ -0,0 +1,47 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_MountedFS(t *testing.T) {
+	dir := t.TempDir()
+
+	// Nothing is mounted at the mount point, its directory is read instead
+	if err := os.Mkdir(filepath.Join(dir, ".filesystem-0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(".filesystem-0", filepath.Join(dir, "data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MountedFS(filepath.Join(dir, "data")); err == nil {
+		t.Fatalf("expected an unmounted mount point to be rejected")
+	}
+	if _, err := MountedFS(filepath.Join(dir, "missing")); err == nil {
+		t.Fatalf("expected a missing mount point to be rejected")
+	}
+
+	// /proc stands for the mount of a filesystem
+	if mounted, err := isMountPoint("/proc"); err != nil || !mounted {
+		t.Skip("/proc isn't mounted")
+	}
+	if err := os.Symlink("/proc", filepath.Join(dir, "proc")); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := MountedFS(filepath.Join(dir, "proc"))
+	if err != nil {
+		t.Fatalf("MountedFS failed: %v", err)
+	}
+	if _, err := fs.ReadFile(fsys, "self/mountinfo"); err != nil {
+		t.Fatalf("failed to read file of mounted filesystem: %v", err)
+	}
+}
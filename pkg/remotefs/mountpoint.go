@@ -0,0 +1,125 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// filesystemMountFolder returns the folder next to mountPoint where the
+// filesystem at index is mounted, and which mountPoint links to.
+func filesystemMountFolder(index int, mountPoint string) (string, error) {
+	mountFolder, err := filepath.Abs(filepath.Join(mountPoint, fmt.Sprintf("../.filesystem-%d", index)))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve absolute path of mount point %s for filesystem-%d", mountPoint, index)
+	}
+	return mountFolder, nil
+}
+
+// MountPointConflictError is returned when the mount point of a filesystem is
+// already used, by another filesystem of the configuration or by a file that
+// is in the way.
+type MountPointConflictError struct {
+	Index      int
+	MountPoint string
+	// Index of the filesystem that uses the mount point, or -1 if it isn't
+	// used by a filesystem
+	OtherIndex int
+}
+
+func (e *MountPointConflictError) Error() string {
+	if e.OtherIndex < 0 {
+		return fmt.Sprintf("mount point of filesystem-%d already exists: %s", e.Index, e.MountPoint)
+	}
+	return fmt.Sprintf("filesystem-%d and filesystem-%d have the same mount point: %s", e.OtherIndex, e.Index, e.MountPoint)
+}
+
+// mountPointKey returns the path that mountPoint refers to, with the symlinks
+// of its parent directory resolved, so that two paths of the same mount point
+// are detected. The mount point itself becomes a symlink once it is mounted.
+func mountPointKey(mountPoint string) string {
+	mountPoint = filepath.Clean(mountPoint)
+	if parent, err := filepath.EvalSymlinks(filepath.Dir(mountPoint)); err == nil {
+		return filepath.Join(parent, filepath.Base(mountPoint))
+	}
+	return mountPoint
+}
+
+// checkMountPointFree checks that nothing exists yet at the mount point of
+// filesystem index, right before its devices are set up, so that a conflict
+// fails the mount before anything needs to be cleaned up.
+func checkMountPointFree(index int, mountPoint string) error {
+	target, err := os.Readlink(mountPoint)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	conflict := &MountPointConflictError{Index: index, MountPoint: mountPoint, OtherIndex: -1}
+	// The symlink of a mounted filesystem points to .filesystem-<index>
+	if err == nil && strings.HasPrefix(target, ".filesystem-") {
+		if other, err := strconv.Atoi(strings.TrimPrefix(target, ".filesystem-")); err == nil {
+			conflict.OtherIndex = other
+		}
+	}
+	return conflict
+}
+
+// mountPointTemplateData is the data that MountPointTemplate is executed with.
+type mountPointTemplateData struct {
+	Index int
+	Name  string
+}
+
+// resolveMountPoints returns a copy of the filesystems of info in which the
+// filesystems without a MountPoint get the one of info.MountPointTemplate.
+// All the mount points must be absolute and different from each other.
+func resolveMountPoints(info RemoteFilesystemsInformation) ([]AzureFilesystem, error) {
+	var tmpl *template.Template
+	if info.MountPointTemplate != "" {
+		var err error
+		tmpl, err = template.New("mount_point_template").Parse(info.MountPointTemplate)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid mount point template")
+		}
+	}
+
+	filesystems := make([]AzureFilesystem, len(info.AzureFilesystems))
+	indexes := make(map[string]int)
+	for i, fs := range info.AzureFilesystems {
+		if fs.Name != "" && (strings.Contains(fs.Name, "/") || fs.Name == "." || fs.Name == "..") {
+			return nil, errors.Errorf("invalid name of filesystem-%d: %s", i, fs.Name)
+		}
+
+		if fs.MountPoint == "" {
+			if tmpl == nil {
+				return nil, errors.Errorf("filesystem-%d has no mount point and there is no mount point template", i)
+			}
+			var mountPoint strings.Builder
+			if err := tmpl.Execute(&mountPoint, mountPointTemplateData{Index: i, Name: fs.Name}); err != nil {
+				return nil, errors.Wrapf(err, "failed to resolve the mount point of filesystem-%d", i)
+			}
+			fs.MountPoint = mountPoint.String()
+		}
+
+		if !filepath.IsAbs(fs.MountPoint) {
+			return nil, errors.Errorf("mount point of filesystem-%d isn't absolute: %s", i, fs.MountPoint)
+		}
+		key := mountPointKey(fs.MountPoint)
+		if j, ok := indexes[key]; ok {
+			return nil, &MountPointConflictError{Index: i, MountPoint: fs.MountPoint, OtherIndex: j}
+		}
+		indexes[key] = i
+		filesystems[i] = fs
+	}
+	return filesystems, nil
+}
@@ -0,0 +1,116 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func Test_ResolveMountPoints(t *testing.T) {
+	info := RemoteFilesystemsInformation{
+		MountPointTemplate: "/mnt/data/{{.Name}}",
+		AzureFilesystems: []AzureFilesystem{
+			{Name: "models"},
+			{Name: "datasets"},
+			{Name: "models", MountPoint: "/mnt/override"},
+		},
+	}
+	filesystems, err := resolveMountPoints(info)
+	if err != nil {
+		t.Fatalf("resolveMountPoints failed: %v", err)
+	}
+	for i, expected := range []string{"/mnt/data/models", "/mnt/data/datasets", "/mnt/override"} {
+		if filesystems[i].MountPoint != expected {
+			t.Errorf("expected mount point %s for filesystem-%d, got %s", expected, i, filesystems[i].MountPoint)
+		}
+	}
+	if info.AzureFilesystems[0].MountPoint != "" {
+		t.Fatalf("expected the filesystems of info not to be modified")
+	}
+
+	info = RemoteFilesystemsInformation{
+		MountPointTemplate: "/mnt/vol{{.Index}}",
+		AzureFilesystems:   []AzureFilesystem{{}, {}},
+	}
+	if filesystems, err := resolveMountPoints(info); err != nil || filesystems[1].MountPoint != "/mnt/vol1" {
+		t.Fatalf("expected /mnt/vol1, got %+v (%v)", filesystems, err)
+	}
+
+	for name, info := range map[string]RemoteFilesystemsInformation{
+		"no template":      {AzureFilesystems: []AzureFilesystem{{}}},
+		"duplicate":        {MountPointTemplate: "/mnt/data/{{.Name}}", AzureFilesystems: []AzureFilesystem{{Name: "a"}, {MountPoint: "/mnt/data/a/"}}},
+		"relative":         {MountPointTemplate: "mnt/{{.Name}}", AzureFilesystems: []AzureFilesystem{{Name: "a"}}},
+		"invalid name":     {MountPointTemplate: "/mnt/{{.Name}}", AzureFilesystems: []AzureFilesystem{{Name: "../etc"}}},
+		"unknown field":    {MountPointTemplate: "/mnt/{{.Label}}", AzureFilesystems: []AzureFilesystem{{}}},
+		"invalid template": {MountPointTemplate: "/mnt/{{.Name", AzureFilesystems: []AzureFilesystem{{}}},
+	} {
+		if _, err := resolveMountPoints(info); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func Test_FilesystemMountFolder(t *testing.T) {
+	for _, mountPoint := range []string{"/mnt/remote/share0", "/mnt/remote/share0/", "/mnt/remote/./share0"} {
+		mountFolder, err := filesystemMountFolder(0, mountPoint)
+		if err != nil || mountFolder != "/mnt/remote/.filesystem-0" {
+			t.Errorf("%s: expected /mnt/remote/.filesystem-0, got %s (%v)", mountPoint, mountFolder, err)
+		}
+	}
+}
+
+func Test_MountPointConflict(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "real"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("real", filepath.Join(dir, "alias")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same mount point through a symlink of its parent directory
+	info := RemoteFilesystemsInformation{AzureFilesystems: []AzureFilesystem{
+		{MountPoint: filepath.Join(dir, "other")},
+		{MountPoint: filepath.Join(dir, "real", "data")},
+		{MountPoint: filepath.Join(dir, "alias", "data")},
+	}}
+	_, err := resolveMountPoints(info)
+	var conflict *MountPointConflictError
+	if !errors.As(err, &conflict) || conflict.OtherIndex != 1 || conflict.Index != 2 || statusErrorCode(err) != "mount_point_conflict" {
+		t.Fatalf("expected conflict between filesystem-1 and filesystem-2, got %v", err)
+	}
+
+	mountPoint := filepath.Join(dir, "real", "data")
+	if err := checkMountPointFree(0, mountPoint); err != nil {
+		t.Fatalf("expected free mount point: %v", err)
+	}
+
+	// Mounted by another filesystem
+	if err := os.Symlink(".filesystem-1", mountPoint); err != nil {
+		t.Fatal(err)
+	}
+	err = checkMountPointFree(2, mountPoint)
+	if !errors.As(err, &conflict) || conflict.OtherIndex != 1 || conflict.Index != 2 {
+		t.Fatalf("expected conflict with filesystem-1, got %v", err)
+	}
+
+	// A file in the way
+	if err := os.Remove(mountPoint); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(mountPoint, 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = checkMountPointFree(2, mountPoint)
+	if !errors.As(err, &conflict) || conflict.OtherIndex != -1 {
+		t.Fatalf("expected conflict with an existing directory, got %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"github.com/pkg/errors"
+)
+
+// What the tool does once the filesystems are mounted
+const (
+	// Exit, for example when the tool runs before the workload in the same
+	// container
+	PostMountModeExit = "exit"
+	// Keep running until the tool receives SIGINT or SIGTERM, for example
+	// when it is the main process of a sidecar container
+	PostMountModeStayResident = "stay-resident"
+)
+
+// validatePostMountMode checks that mode is empty or one of the PostMountMode
+// values.
+func validatePostMountMode(mode string) error {
+	switch mode {
+	case "", PostMountModeExit, PostMountModeStayResident:
+		return nil
+	default:
+		return errors.Errorf("unknown post mount mode: %s", mode)
+	}
+}
+
+// EffectivePostMountMode returns the post mount mode of info. By default the
+// tool stays resident if it serves the health of the mounts, so that the
+// probes keep working, and exits otherwise.
+func EffectivePostMountMode(info RemoteFilesystemsInformation, healthAddr string) string {
+	if info.PostMountMode != "" {
+		return info.PostMountMode
+	}
+	if healthAddr != "" {
+		return PostMountModeStayResident
+	}
+	return PostMountModeExit
+}
@@ -0,0 +1,39 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"testing"
+)
+
+func Test_PostMountMode(t *testing.T) {
+	for _, mode := range []string{"", PostMountModeExit, PostMountModeStayResident} {
+		if err := validatePostMountMode(mode); err != nil {
+			t.Errorf("expected %q to be accepted: %v", mode, err)
+		}
+	}
+	if err := validatePostMountMode("daemon"); err == nil {
+		t.Errorf("expected unknown mode to be rejected")
+	}
+
+	cases := []struct {
+		mode       string
+		healthAddr string
+		expected   string
+	}{
+		{"", "", PostMountModeExit},
+		{"", ":8080", PostMountModeStayResident},
+		{PostMountModeExit, ":8080", PostMountModeExit},
+		{PostMountModeStayResident, "", PostMountModeStayResident},
+	}
+	for _, c := range cases {
+		info := RemoteFilesystemsInformation{PostMountMode: c.mode}
+		if mode := EffectivePostMountMode(info, c.healthAddr); mode != c.expected {
+			t.Errorf("mode %q with health address %q: expected %s, got %s", c.mode, c.healthAddr, c.expected, mode)
+		}
+	}
+}
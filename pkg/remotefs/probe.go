@@ -0,0 +1,150 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/msi"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Timeout of the request that checks that an image exists
+const imageProbeTimeout = 5 * time.Second
+
+// Version of the Blob Storage REST API, required for bearer tokens
+const blobStorageAPIVersion = "2020-10-02"
+
+// ImageNotFoundError is returned when the image of a filesystem doesn't exist
+// or can't be accessed, which is detected before starting azmount.
+type ImageNotFoundError struct {
+	Image string
+	// HTTP status of the request, or empty for local files
+	Status string
+	// Error of the local file
+	Err error
+}
+
+func (e *ImageNotFoundError) Error() string {
+	if e.Status != "" {
+		return "image " + e.Image + " isn't accessible: " + e.Status
+	}
+	return "image " + e.Image + " isn't accessible: " + e.Err.Error()
+}
+
+func (e *ImageNotFoundError) Unwrap() error {
+	return e.Err
+}
+
+// storageAccessToken returns a token of identity to access the private blobs
+// of host.
+func storageAccessToken(ctx context.Context, identity common.Identity, host string) (string, error) {
+	audience := identity.StorageAudience(host)
+
+	if msi.WorkloadIdentityEnabled() {
+		return msi.GetAccessTokenFromFederatedToken(ctx, audience)
+	}
+	token, err := common.GetToken(audience, identity)
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// anonymousAccessDenied returns whether status is the answer of a storage
+// account to an anonymous request to a blob that isn't public. Storage
+// accounts answer 404 instead of 403 when the container is private, and 409
+// when anonymous access is disabled for the whole account.
+func anonymousAccessDenied(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusConflict:
+		return true
+	}
+	return false
+}
+
+// blobRequest sends a request with method to the blob at u, with a token of
+// identity if private is set. The caller must close the body of the response.
+func blobRequest(ctx context.Context, identity common.Identity, method string, u *url.URL, private bool) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create request")
+	}
+	req.Header.Set("x-ms-version", blobStorageAPIVersion)
+
+	if private {
+		token, err := storageAccessToken(ctx, identity, u.Host)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get a token")
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return common.HTTPClient().Do(req)
+}
+
+// headImage sends a HEAD request to the blob at u, with a token of identity if
+// private is set. The body of the response is closed.
+func headImage(ctx context.Context, identity common.Identity, u *url.URL, private bool) (*http.Response, error) {
+	resp, err := blobRequest(ctx, identity, http.MethodHead, u, private)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// checkImageExists checks that the image of fs exists before azmount is
+// started, so that a wrong URL or missing permissions fail right away instead
+// of after the azmount timeout. Only definite answers, like a 404 or 403 from
+// the storage account, are errors. If the check itself fails, azmount is
+// started anyway and reports the problem. Private images are accessed with a
+// token of identity.
+func checkImageExists(ctx context.Context, identity common.Identity, fs AzureFilesystem, localImagePath string) error {
+	if localImagePath != "" {
+		if _, err := osStat(localImagePath); err != nil {
+			return &ImageNotFoundError{Image: localImagePath, Err: err}
+		}
+		return nil
+	}
+
+	// Images in a registry are resolved by azmount
+	if strings.HasPrefix(fs.AzureUrl, ociURLPrefix) {
+		return nil
+	}
+
+	u, err := url.Parse(fs.AzureUrl)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse URL: %s", fs.AzureUrl)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, imageProbeTimeout)
+	defer cancel()
+
+	resp, err := headImage(ctx, identity, u, fs.AzureUrlPrivate)
+	// Like azmount, use a token if anonymous access is denied
+	if err == nil && fs.DetectPrivate && !fs.AzureUrlPrivate && anonymousAccessDenied(resp.StatusCode) {
+		resp, err = headImage(ctx, identity, u, true)
+	}
+	if err != nil {
+		logrus.WithError(err).Debugf("Can't check image %s, leaving it to azmount", fs.AzureUrl)
+		return nil
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusForbidden, http.StatusUnauthorized:
+		return &ImageNotFoundError{Image: fs.AzureUrl, Status: resp.Status}
+	}
+	logrus.Debugf("Image %s: %s", fs.AzureUrl, resp.Status)
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/pkg/errors"
+)
+
+func Test_CheckImageExists(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Write([]byte(`{"access_token":"token","expires_in":"3600"}`))
+			return
+		}
+		if r.Method != http.MethodHead || r.Header.Get("x-ms-version") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/c/image":
+			w.WriteHeader(http.StatusOK)
+		case "/private/image":
+			w.WriteHeader(http.StatusForbidden)
+		case "/detect/image":
+			// Private container, which is only found with a token
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case "/busy/image":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	var notFound *ImageNotFoundError
+
+	if err := checkImageExists(ctx, common.Identity{}, AzureFilesystem{AzureUrl: server.URL + "/c/image"}, ""); err != nil {
+		t.Fatalf("expected existing image to pass: %v", err)
+	}
+	if err := checkImageExists(ctx, common.Identity{}, AzureFilesystem{AzureUrl: server.URL + "/c/typo"}, ""); !errors.As(err, &notFound) {
+		t.Fatalf("expected missing image to fail, got %v", err)
+	}
+	if err := checkImageExists(ctx, common.Identity{}, AzureFilesystem{AzureUrl: server.URL + "/private/image"}, ""); !errors.As(err, &notFound) {
+		t.Fatalf("expected forbidden image to fail, got %v", err)
+	}
+	// With detect_private, a token is used if anonymous access is denied
+	identity := common.Identity{TokenEndpoint: server.URL + "/token"}
+	if err := checkImageExists(ctx, identity, AzureFilesystem{AzureUrl: server.URL + "/detect/image", DetectPrivate: true}, ""); err != nil {
+		t.Fatalf("expected private image to be found with a token: %v", err)
+	}
+	if err := checkImageExists(ctx, identity, AzureFilesystem{AzureUrl: server.URL + "/detect/typo", DetectPrivate: true}, ""); !errors.As(err, &notFound) {
+		t.Fatalf("expected missing image to fail, got %v", err)
+	}
+
+	// Other errors are left to azmount
+	if err := checkImageExists(ctx, identity, AzureFilesystem{AzureUrl: server.URL + "/busy/image"}, ""); err != nil {
+		t.Fatalf("expected unavailable storage not to fail the check: %v", err)
+	}
+
+	// Images in Azure Files shares are checked in the mounted share
+	image := filepath.Join(t.TempDir(), "image")
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+	if err := checkImageExists(ctx, identity, AzureFilesystem{}, image); err != nil {
+		t.Fatalf("expected existing local image to pass: %v", err)
+	}
+	if err := checkImageExists(ctx, identity, AzureFilesystem{}, image+"-typo"); !errors.As(err, &notFound) {
+		t.Fatalf("expected missing local image to fail, got %v", err)
+	}
+	if code := statusErrorCode(errors.Wrapf(&ImageNotFoundError{Image: "image", Status: "404 Not Found"}, "failed")); code != "image_not_found" {
+		t.Fatalf("expected image_not_found error code, got %s", code)
+	}
+}
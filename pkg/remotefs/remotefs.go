@@ -0,0 +1,238 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+// Package remotefs mounts encrypted filesystem images stored remotely, like in
+// Azure Blob Storage, after releasing their keys with secure key release. It is
+// the implementation of the remotefs tool, and it can be embedded by other
+// programs.
+package remotefs
+
+import (
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/attest"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+)
+
+type AzureInfo struct {
+	CertFetcher attest.CertFetcher `json:"certcache,omitempty"`
+	Identity    common.Identity    `json:"identity,omitempty"`
+	// Hex-encoded nonce included in the report data of the attestation
+	// reports, for auditing. It is not secret.
+	ReportDataNonce string `json:"report_data_nonce,omitempty"`
+	// Maximum time in milliseconds to wait for the SNP device to appear
+	// before the first attestation. Zero means that it isn't waited for.
+	SNPDeviceTimeoutMs int64 `json:"snp_device_timeout_ms,omitempty"`
+	// Checks of the VCEK certificate chain before each attestation
+	CertChainPolicy attest.CertChainPolicy `json:"cert_chain_policy,omitempty"`
+	// This is when the THIM certificates of the UVM information are replaced
+	// by the ones fetched from the certcache endpoint: "use-provided",
+	// "fetch-if-absent" (default) or "always-fetch"
+	ThimCertPolicy string `json:"thim_cert_policy,omitempty"`
+}
+
+type RemoteFilesystemsInformation struct {
+	AzureInfo        AzureInfo         `json:"azure_info"`
+	AzureFilesystems []AzureFilesystem `json:"azure_filesystems"`
+	// If true, the keys of all filesystems are released before mounting any
+	// of them
+	PreReleaseKeys bool `json:"prerelease_keys,omitempty"`
+	// If not empty, the hosts of the storage accounts and Azure Files shares
+	// of all filesystems must be in this list. Entries like
+	// "*.blob.core.windows.net" match any subdomain.
+	AllowedStorageHosts []string `json:"allowed_storage_hosts,omitempty"`
+	// TLS policy of all outbound connections, including the ones of azmount
+	TLSPolicy common.TLSPolicy `json:"tls_policy,omitempty"`
+	// Resolver of all outbound connections, including the ones of azmount
+	ResolverPolicy common.ResolverPolicy `json:"resolver_policy,omitempty"`
+	// Pool of idle connections of all outbound connections, including the ones
+	// of azmount
+	ConnectionPolicy common.ConnectionPolicy `json:"connection_policy,omitempty"`
+	// This is the maximum number of keys released from AKV at the same time.
+	// Zero means skr.DefaultMaxConcurrentReleases.
+	MaxConcurrentKeyReleases int `json:"max_concurrent_key_releases,omitempty"`
+	// This is the maximum number of filesystems mounted at the same time. Zero
+	// means the number of CPUs.
+	MaxConcurrentMounts int `json:"max_concurrent_mounts,omitempty"`
+	// This is the number of times the release of the key of a filesystem is
+	// tried again when it fails with a transient error, like a 429 or 503
+	// response. Zero means no retries.
+	MaxKeyReleaseRetries int `json:"max_key_release_retries,omitempty"`
+	// This is the delay in milliseconds before the first retry of a key
+	// release, doubled for each retry. Zero means the default.
+	KeyReleaseBackoffMs int64 `json:"key_release_backoff_ms,omitempty"`
+	// If true, the tool fails before mounting anything when the UVM
+	// information is absent and a filesystem releases its key with SKR
+	RequireUvmInformation bool `json:"require_uvm_information,omitempty"`
+	// Service that the security policy is fetched from if the UVM information
+	// doesn't have it, with the identity of azure_info
+	SecurityPolicySource *common.HTTPPolicySource `json:"security_policy_source,omitempty"`
+	// This is the maximum time in milliseconds that mounting all the
+	// filesystems can take, including all retries. Zero means no limit.
+	MountDeadlineMs int64 `json:"mount_deadline_ms,omitempty"`
+	// This is the template of the mount point of the filesystems that don't
+	// set MountPoint, for example "/mnt/data/{{.Name}}" or "/mnt/vol{{.Index}}"
+	MountPointTemplate string `json:"mount_point_template,omitempty"`
+	// This is what the tool does once the filesystems are mounted: "exit" or
+	// "stay-resident". By default it stays resident if it serves the health of
+	// the mounts and exits otherwise.
+	PostMountMode string `json:"post_mount_mode,omitempty"`
+}
+
+// AzureFilesystem contains information about a filesystem image stored in Azure
+// Blob Storage.
+type AzureFilesystem struct {
+	// This is the URL of the image, or oci://<registry>/<repository>:<tag> for
+	// an image stored as the only layer of an OCI artifact in a registry
+	AzureUrl string `json:"azure_url"`
+	// This is a private AzureUrl
+	AzureUrlPrivate bool `json:"azure_url_private"`
+	// This is a flag specifying if AzureUrl is accessed anonymously first and
+	// with a token only if anonymous access is denied, instead of following
+	// AzureUrlPrivate. It is ignored if AzureUrlPrivate is true.
+	DetectPrivate bool `json:"detect_private,omitempty"`
+	// This is an Azure Files NFS share that contains the image, used instead of
+	// AzureUrl, in the format <account>.file.core.windows.net:/<account>/<share>
+	AzureFilesNfsShare string `json:"azure_files_nfs_share,omitempty"`
+	// This is the path of the image inside AzureFilesNfsShare
+	AzureFilesImagePath string `json:"azure_files_image_path,omitempty"`
+	// This is the path where the filesystem will be exposed in the container.
+	// If empty, it is resolved from the mount point template.
+	MountPoint string `json:"mount_point"`
+	// This is the name of the filesystem used by the mount point template
+	Name string `json:"name,omitempty"`
+	// This is the information used by encfs to derive the encryption key of the filesystem
+	// if the key being released is a private RSA key
+	KeyDerivationBlob common.KeyDerivationBlob `json:"key_derivation,omitempty"`
+	// If true, the HKDF label of KeyDerivationBlob is bound to the KID of
+	// KeyBlob, the mount point and the index of the filesystem, so the key
+	// derived for another filesystem is different
+	BindKeyToVolume bool `json:"bind_key_to_volume,omitempty"`
+	// This is the information used by skr to release the encryption key of the filesystem
+	KeyBlob common.KeyBlob `json:"key,omitempty"`
+	// These are the shares of the encryption key of the filesystem, each one
+	// released from its own key vault, used instead of KeyBlob. The key is
+	// reconstructed from them with KeyShareScheme, using at least
+	// KeyShareThreshold shares for the shamir scheme.
+	KeyShares         []common.KeyBlob `json:"key_shares,omitempty"`
+	KeyShareScheme    string           `json:"key_share_scheme,omitempty"`
+	KeyShareThreshold int              `json:"key_share_threshold,omitempty"`
+	// This is a testing key hexstring encoded to be used against the filesystem. This should
+	// be used only for testing.
+	RawKeyHexString string `json:"raw_key,omitempty"`
+	// This is the length in bytes of the encryption key, for example 64 for
+	// aes-xts-plain64 with a 512-bit key. Released octet keys must have this
+	// length and derived keys are derived with it. Zero means the key_length
+	// of KeyDerivationBlob, or 32.
+	KeyLengthBytes int `json:"key_length_bytes,omitempty"`
+	// This is a flag specifying if this file system is read-write
+	ReadWrite bool `json:"read_write,omitempty"`
+	// This is the maximum size in bytes of the image. Images bigger than this
+	// are rejected by azmount. Zero means unlimited.
+	MaxImageSizeBytes int64 `json:"max_image_size_bytes,omitempty"`
+	// This is the maximum time in milliseconds that azmount can take to
+	// download or upload a block of the image. Zero means no limit.
+	BlockTimeoutMs int `json:"block_timeout_ms,omitempty"`
+	// This is the number of sub-ranges of each block that azmount downloads
+	// at the same time from Azure Blob Storage. Zero means 1, a single
+	// request per block.
+	DownloadConcurrency int `json:"download_concurrency,omitempty"`
+	// This is the time in milliseconds to wait for azmount to expose the
+	// image. Zero means the default.
+	ImageReadyTimeoutMs int `json:"image_ready_timeout_ms,omitempty"`
+	// This is a flag specifying if the key is passed to cryptsetup through a
+	// named pipe instead of a regular file
+	KeyFileFifo bool `json:"key_file_fifo,omitempty"`
+	// This is a flag specifying if the key is checked against the digest in
+	// the LUKS header before the filesystem is opened
+	ValidateKey bool `json:"validate_key,omitempty"`
+	// This is the time in milliseconds to wait for the device node created by
+	// cryptsetup to appear. Zero means the default.
+	DeviceNodeTimeoutMs int `json:"device_node_timeout_ms,omitempty"`
+	// This is the number of bytes at the start of the filesystem that are read
+	// after opening it, so that they are cached before the workload starts
+	PrewarmBytes int64 `json:"prewarm_bytes,omitempty"`
+	// These are ranges of the filesystem that are read after opening it, so
+	// that they are cached before the workload starts
+	PrewarmRanges []PrewarmRange `json:"prewarm_ranges,omitempty"`
+	// This is the expected UUID of the ext4 filesystem. If set, the mount fails
+	// if the UUID of the decrypted filesystem is different.
+	ExpectedFsUUID string `json:"expected_fs_uuid,omitempty"`
+	// This is a path relative to the root of the filesystem that must exist
+	// after it is mounted, or the mount fails
+	ExpectPath string `json:"expect_path,omitempty"`
+	// This is a flag specifying if the mount fails when the root directory of
+	// the filesystem is empty
+	ExpectNonEmpty bool `json:"expect_non_empty,omitempty"`
+	// This is the size in KiB of the blocks cached and uploaded by azmount.
+	// It must be a multiple of 4 KiB. Zero means the default of 512 KiB.
+	CacheBlockSizeKiB int `json:"cache_block_size_kib,omitempty"`
+	// This is the number of blocks cached by azmount, so that blocks read
+	// again aren't downloaded again. Zero means the default of 32.
+	CacheBlocks int `json:"cache_blocks,omitempty"`
+	// This is what happens to a read-write filesystem when azmount keeps
+	// failing to upload blocks: "fail-writes" (the default) fails the writes,
+	// "remount-ro" also makes the kernel remount the filesystem read-only.
+	UploadFailurePolicy string `json:"upload_failure_policy,omitempty"`
+	// This is the number of consecutive failed uploads of a read-write
+	// filesystem after which azmount fails the writes. Zero means the
+	// default of 3, and a negative number means that writes never fail.
+	MaxUploadFailures int `json:"max_upload_failures,omitempty"`
+	// This is the log level of azmount. By default it is the same as the log
+	// level of this tool.
+	AzmountLogLevel string `json:"azmount_log_level,omitempty"`
+	// These are the options passed to cryptsetup when opening the filesystem
+	CryptsetupOptions CryptsetupOptions `json:"cryptsetup_options,omitempty"`
+	// This is the minimum expected download bandwidth of the image in bytes
+	// per second. Zero means that it isn't checked.
+	MinBandwidthBytesPerSec int64 `json:"min_bandwidth_bytes_per_sec,omitempty"`
+	// This is a flag specifying if the mount fails when the download bandwidth
+	// is below MinBandwidthBytesPerSec, instead of only logging a warning
+	FailBelowMinBandwidth bool `json:"fail_below_min_bandwidth,omitempty"`
+	// This is a hint of how the filesystem is read, which selects the
+	// read-ahead of azmount: "random" (the default), "sequential" or "auto"
+	AccessPattern string `json:"access_pattern,omitempty"`
+	// This is the SELinux context of the files of the filesystem, passed to
+	// the mount as context="...", for example
+	// "system_u:object_r:container_file_t:s0"
+	SELinuxContext string `json:"selinux_context,omitempty"`
+	// This is a flag specifying if "e2fsck -p" is run on a read-write
+	// filesystem before it is mounted
+	RunFsck bool `json:"run_fsck,omitempty"`
+	// This is what happens when fsck finds errors that it can't fix: "fail"
+	// (the default) fails the mount, "warn" logs a warning and mounts it
+	FsckFailurePolicy string `json:"fsck_failure_policy,omitempty"`
+	// This is what happens if the mount folder is already a mount point, for
+	// example after a crash: "fail" (the default), "remount" or "reuse"
+	ExistingMount string `json:"existing_mount,omitempty"`
+	// This is what happens to the journal of a read-only filesystem: "noload"
+	// (the default) ignores it, "replay" lets the kernel replay it and
+	// "refuse-if-dirty" fails the mount if it isn't empty
+	JournalPolicy string `json:"journal_policy,omitempty"`
+	// This is the expected hex-encoded SHA-256 digest of the whole encrypted
+	// image, checked once before the filesystem is mounted. Blocks downloaded
+	// again after the check aren't verified.
+	ImageSha256 string `json:"image_sha256,omitempty"`
+	// This maps the indices of blocks of the image, counted in blocks of
+	// CacheBlockSizeKiB, to their hex-encoded SHA-256 digests. azmount
+	// verifies every download of these blocks against them.
+	BlockManifest map[int64]string `json:"block_manifest,omitempty"`
+	// This is the URL of a blob with the detached LUKS2 header of the image,
+	// which then only holds the encrypted data. It is accessed like AzureUrl.
+	HeaderUrl string `json:"header_url,omitempty"`
+	// This is a flag specifying if the workload can start without this
+	// filesystem. Optional filesystems are mounted after the required ones,
+	// and failing to mount them doesn't fail the tool.
+	Optional bool `json:"optional,omitempty"`
+	// If set, the filesystem is a tmpfs of this size held in memory instead
+	// of an encrypted image, for scratch space
+	Tmpfs *TmpfsOptions `json:"tmpfs,omitempty"`
+}
+
+type PrewarmRange struct {
+	// Offset in bytes of the range in the decrypted filesystem
+	Offset int64 `json:"offset"`
+	// Length in bytes of the range
+	Length int64 `json:"length"`
+}
@@ -0,0 +1,87 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"time"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/attest"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/pkg/errors"
+)
+
+// MountOptions are what a filesystem is mounted with. MountAzureFilesystems
+// sets them from the RemoteFilesystemsInformation and the UVM information of
+// the environment.
+type MountOptions struct {
+	// Identity used to access storage and release the key
+	Identity common.Identity
+	// Attestation state and UVM information used to release the key
+	CertState      attest.CertState
+	UvmInformation common.UvmInformation
+	// Hosts that the filesystem can be fetched from. Any host is allowed if it
+	// is empty.
+	AllowedStorageHosts []string
+	// Policies of the outbound connections of azmount. The hosts of the Azure
+	// Files shares are resolved with ResolverPolicy too. The connections of
+	// this process follow the policies set with common.SetTLSPolicy,
+	// common.SetResolverPolicy and common.SetConnectionPolicy instead.
+	TLSPolicy        common.TLSPolicy
+	ResolverPolicy   common.ResolverPolicy
+	ConnectionPolicy common.ConnectionPolicy
+	// Number of times a key release that failed with a transient error is
+	// tried again, after KeyReleaseBackoff doubled for each retry. If
+	// KeyReleaseBackoff is zero, DefaultKeyReleaseBackoff is used.
+	MaxKeyReleaseRetries int
+	KeyReleaseBackoff    time.Duration
+	// Mounter of the filesystems and Azure Files shares. If it is nil, the
+	// system calls are made directly.
+	Mounter Mounter
+	// Filesystems mounted by a previous run, as recorded in its state file.
+	// With existing_mount set to reuse, a mount left behind is only reused if
+	// it is recorded here with the same image, or if expected_fs_uuid is set.
+	PreviousMounts []MountedFilesystem
+}
+
+// mounter returns the Mounter of opts, or the one that makes the system calls.
+func (opts *MountOptions) mounter() Mounter {
+	if opts.Mounter == nil {
+		return unixMounter{}
+	}
+	return opts.Mounter
+}
+
+// mountSingleFilesystem checks the storage host of fs and mounts it with
+// containerMountAzureFilesystem. It is what both MountAzureFilesystems and
+// MountSingleFilesystem mount each filesystem with.
+func mountSingleFilesystem(ctx context.Context, opts *MountOptions, tempDir string, index int, fs AzureFilesystem, releasedKey jwk.Key, fsStatus *FilesystemStatus) error {
+	if err := checkStorageHost(fs, opts.AllowedStorageHosts); err != nil {
+		return err
+	}
+	return containerMountAzureFilesystem(ctx, opts, tempDir, index, fs, releasedKey, fsStatus)
+}
+
+// MountSingleFilesystem mounts fs as filesystem index with opts, using tempDir
+// for its azmount folder, logs and key file. Unlike MountAzureFilesystems, it
+// doesn't read the UVM information from the environment, set the policies of
+// the connections of this process or write the status and state files. The
+// returned status has the PID of the azmount process serving the filesystem.
+func MountSingleFilesystem(ctx context.Context, opts MountOptions, tempDir string, index int, fs AzureFilesystem) (FilesystemStatus, error) {
+	fsStatus := FilesystemStatus{Index: index, MountPoint: fs.MountPoint}
+	if opts.MaxKeyReleaseRetries < 0 || opts.KeyReleaseBackoff < 0 {
+		return fsStatus, errors.Errorf("MaxKeyReleaseRetries and KeyReleaseBackoff can't be negative")
+	}
+	err := mountSingleFilesystem(ctx, &opts, tempDir, index, fs, nil, &fsStatus)
+	if err != nil {
+		fsStatus.State = FilesystemStateFailed
+		return fsStatus, err
+	}
+	fsStatus.State = FilesystemStateMounted
+	return fsStatus, nil
+}
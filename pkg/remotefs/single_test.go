@@ -0,0 +1,137 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/attest"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/pkg/errors"
+)
+
+func Test_MountSingleFilesystem(t *testing.T) {
+	origCheckImageExists, origAzmountRun, origSecureKeyRelease, origUnmount := _checkImageExists, _azmountRun, _secureKeyRelease, unixUnmount
+	defer func() {
+		_checkImageExists, _azmountRun, _secureKeyRelease, unixUnmount = origCheckImageExists, origAzmountRun, origSecureKeyRelease, origUnmount
+	}()
+
+	opts := MountOptions{
+		Identity:            common.Identity{ClientId: "client"},
+		CertState:           attest.CertState{Tcbm: 0xdb18000000000004},
+		UvmInformation:      common.UvmInformation{EncodedSecurityPolicy: "cGFja2FnZQ=="},
+		AllowedStorageHosts: []string{"*.blob.core.windows.net"},
+		TLSPolicy:           common.TLSPolicy{MinVersion: "1.3"},
+	}
+
+	var probeIdentity common.Identity
+	_checkImageExists = func(ctx context.Context, identity common.Identity, fs AzureFilesystem, localImagePath string) error {
+		probeIdentity = identity
+		return nil
+	}
+	// azmount exposes a 4 KiB image
+	var azmountOpts azmountOptions
+	_azmountRun = func(opts azmountOptions) (*exec.Cmd, error) {
+		azmountOpts = opts
+		if err := os.WriteFile(filepath.Join(opts.imageLocalFolder, "data"), make([]byte, 4096), 0644); err != nil {
+			return nil, err
+		}
+		return nil, os.WriteFile(opts.statsFile, []byte(`{"file_size": 4096}`), 0644)
+	}
+	var unmounted []string
+	unixUnmount = func(target string, flags int) error {
+		unmounted = append(unmounted, target)
+		return nil
+	}
+	// The release is denied, which stops the mount
+	var releaseIdentity common.Identity
+	var releaseCertState attest.CertState
+	var releaseUvm common.UvmInformation
+	_secureKeyRelease = func(ctx context.Context, identity common.Identity, certState attest.CertState, keyBlob common.KeyBlob, uvmInformation common.UvmInformation) (jwk.Key, error) {
+		releaseIdentity, releaseCertState, releaseUvm = identity, certState, uvmInformation
+		return nil, errors.New("release denied")
+	}
+
+	fs := AzureFilesystem{
+		AzureUrl:          "https://account.blob.core.windows.net/c/image",
+		MountPoint:        filepath.Join(t.TempDir(), "data"),
+		KeyBlob:           common.KeyBlob{KID: "key"},
+		CacheBlocks:       64,
+		MaxUploadFailures: 5,
+	}
+	fsStatus, err := MountSingleFilesystem(context.Background(), opts, t.TempDir(), 0, fs)
+	if err == nil || fsStatus.State != FilesystemStateFailed {
+		t.Fatalf("expected the denied release to fail the mount, got %s: %v", fsStatus.State, err)
+	}
+
+	// azmount doesn't outlive the failed mount
+	if len(unmounted) != 1 || unmounted[0] != azmountOpts.imageLocalFolder {
+		t.Errorf("expected azmount to be stopped, got unmounts %v", unmounted)
+	}
+	if azmountOpts.numBlocks != "64" {
+		t.Errorf("expected azmount to cache 64 blocks, got %s", azmountOpts.numBlocks)
+	}
+	if azmountOpts.maxUploadFailures != "5" {
+		t.Errorf("expected azmount to fail writes after 5 upload failures, got %s", azmountOpts.maxUploadFailures)
+	}
+
+	// The options are used by every step
+	if probeIdentity.ClientId != "client" || azmountOpts.identity.ClientId != "client" || releaseIdentity.ClientId != "client" {
+		t.Errorf("expected the identity to be passed to the image check, azmount and the key release, got %+v, %+v and %+v", probeIdentity, azmountOpts.identity, releaseIdentity)
+	}
+	if fmt.Sprint(azmountOpts.allowedHosts) != "[*.blob.core.windows.net]" || azmountOpts.tlsPolicy.MinVersion != "1.3" {
+		t.Errorf("expected the allowed hosts and policies to be passed to azmount, got %v and %+v", azmountOpts.allowedHosts, azmountOpts.tlsPolicy)
+	}
+	if releaseCertState.Tcbm != opts.CertState.Tcbm || releaseUvm.EncodedSecurityPolicy != opts.UvmInformation.EncodedSecurityPolicy {
+		t.Errorf("expected the cert state and UVM information to be passed to the key release")
+	}
+
+	// Hosts that aren't allowed are rejected before azmount is started
+	azmountOpts = azmountOptions{}
+	fs.AzureUrl = "https://attacker.example.com/c/image"
+	if _, err := MountSingleFilesystem(context.Background(), opts, t.TempDir(), 0, fs); err == nil || azmountOpts.imageLocalFolder != "" {
+		t.Fatalf("expected the host to be rejected before azmount is started: %v", err)
+	}
+}
+
+func Test_MountSingleFilesystem_AzureFilesHostNotAllowed(t *testing.T) {
+	origLookupHost := _lookupHost
+	defer func() {
+		_lookupHost = origLookupHost
+	}()
+
+	var resolved []string
+	_lookupHost = func(policy common.ResolverPolicy, ctx context.Context, host string) ([]string, error) {
+		resolved = append(resolved, host)
+		return []string{"10.0.0.4"}, nil
+	}
+	recorder := &recordingMounter{}
+	opts := MountOptions{
+		AllowedStorageHosts: []string{"*.blob.core.windows.net", "allowed.file.core.windows.net"},
+		Mounter:             recorder,
+	}
+	fs := AzureFilesystem{
+		AzureFilesNfsShare:  "attacker.file.core.windows.net:/attacker/share",
+		AzureFilesImagePath: "image.img",
+		MountPoint:          filepath.Join(t.TempDir(), "data"),
+		KeyBlob:             common.KeyBlob{KID: "key"},
+	}
+
+	// The share is neither resolved nor mounted
+	if _, err := MountSingleFilesystem(context.Background(), opts, t.TempDir(), 0, fs); err == nil {
+		t.Fatalf("expected the host of the share to be rejected")
+	}
+	if len(resolved) != 0 || len(recorder.calls) != 0 {
+		t.Fatalf("expected the share not to be resolved or mounted, got lookups %v and calls %v", resolved, recorder.calls)
+	}
+}
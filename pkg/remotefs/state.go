@@ -0,0 +1,164 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// MountState is written to the state file by MountAzureFilesystems after each
+// filesystem is mounted, so that a restarted tool can skip the filesystems
+// that are already mounted instead of releasing their keys again. It never
+// contains keys.
+type MountState struct {
+	Filesystems []MountedFilesystem `json:"filesystems"`
+}
+
+// MountedFilesystem is a filesystem mounted by a previous run of the tool.
+type MountedFilesystem struct {
+	Index      int    `json:"index"`
+	MountPoint string `json:"mount_point"`
+	// Image the filesystem was mounted from, to detect configuration changes
+	Source string `json:"source"`
+	// Name of the device created by cryptsetup, empty for tmpfs filesystems
+	DeviceName string `json:"device_name"`
+	// UUID of the ext4 filesystem in the device
+	FsUUID string `json:"fs_uuid"`
+	// PID of the azmount process serving the image, zero for tmpfs
+	// filesystems
+	AzmountPID int `json:"azmount_pid,omitempty"`
+	// Folder where the Azure Files share of the image is mounted, empty for
+	// images that aren't in a share
+	ShareFolder string `json:"share_folder,omitempty"`
+}
+
+// filesystemSource returns the image that fs is mounted from.
+func filesystemSource(fs AzureFilesystem) string {
+	if fs.Tmpfs != nil {
+		return "tmpfs"
+	}
+	if fs.AzureFilesNfsShare != "" {
+		return fs.AzureFilesNfsShare + "/" + fs.AzureFilesImagePath
+	}
+	return fs.AzureUrl
+}
+
+// readMountState reads the state file at path. A missing file is an empty
+// state.
+func readMountState(path string) (MountState, error) {
+	var state MountState
+
+	stateJSON, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, errors.Wrapf(err, "failed to read state file: %s", path)
+	}
+
+	if err := json.Unmarshal(stateJSON, &state); err != nil {
+		return state, errors.Wrapf(err, "failed to unmarshal state file: %s", path)
+	}
+	return state, nil
+}
+
+// writeMountState atomically replaces the state file at path with state.
+func writeMountState(path string, state MountState) error {
+	stateJSON, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal state")
+	}
+	return writeFileAtomic(path, stateJSON, 0600)
+}
+
+// isMountPoint returns whether path is the root of a mounted filesystem.
+func isMountPoint(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	parentInfo, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		return false, err
+	}
+	return info.Sys().(*syscall.Stat_t).Dev != parentInfo.Sys().(*syscall.Stat_t).Dev, nil
+}
+
+// checkMountedFilesystem checks that the filesystem mounted at index by a
+// previous run is still set up as recorded in mounted, and that fs hasn't
+// changed since then.
+func checkMountedFilesystem(index int, fs AzureFilesystem, mounted MountedFilesystem) error {
+	if mounted.MountPoint != fs.MountPoint || mounted.Source != filesystemSource(fs) {
+		return errors.Errorf("configuration of filesystem-%d has changed", index)
+	}
+
+	if fs.Tmpfs == nil {
+		devicePath := "/dev/mapper/" + mounted.DeviceName
+		if _, err := osStat(devicePath); err != nil {
+			return errors.Wrapf(err, "device of filesystem-%d is missing", index)
+		}
+		fsUUID, err := _readExt4UUID(devicePath)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read UUID of filesystem-%d", index)
+		}
+		if !strings.EqualFold(fsUUID, mounted.FsUUID) {
+			return errors.Errorf("UUID of filesystem-%d is %s, expected %s", index, fsUUID, mounted.FsUUID)
+		}
+	}
+
+	target, err := os.Readlink(fs.MountPoint)
+	if err != nil {
+		return errors.Wrapf(err, "symlink of filesystem-%d is missing", index)
+	}
+	if target != fmt.Sprintf(".filesystem-%d", index) {
+		return errors.Errorf("symlink of filesystem-%d points to %s", index, target)
+	}
+	mountFolder, err := filesystemMountFolder(index, fs.MountPoint)
+	if err != nil {
+		return err
+	}
+	if ok, err := _isMountPoint(mountFolder); err != nil || !ok {
+		return errors.Errorf("filesystem-%d isn't mounted at %s", index, mountFolder)
+	}
+
+	return nil
+}
+
+// resumableFilesystems returns the indices of the filesystems of info that
+// are recorded in state and are still mounted.
+func resumableFilesystems(info RemoteFilesystemsInformation, state MountState) map[int]MountedFilesystem {
+	resumable := make(map[int]MountedFilesystem)
+	for _, mounted := range state.Filesystems {
+		if mounted.Index < 0 || mounted.Index >= len(info.AzureFilesystems) {
+			continue
+		}
+		if err := checkMountedFilesystem(mounted.Index, info.AzureFilesystems[mounted.Index], mounted); err != nil {
+			logrus.WithError(err).Warnf("Not resuming filesystem-%d", mounted.Index)
+			continue
+		}
+		resumable[mounted.Index] = mounted
+	}
+	return resumable
+}
+
+// updateStateFile writes state to StateFilePath, if it is set. Failures are
+// only logged, as they only prevent resuming the mounts after a restart.
+func updateStateFile(state MountState) {
+	if StateFilePath == "" {
+		return
+	}
+	if err := writeMountState(StateFilePath, state); err != nil {
+		logrus.WithError(err).Warn("failed to update state file")
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_StateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	state, err := readMountState(path)
+	if err != nil || len(state.Filesystems) != 0 {
+		t.Fatalf("expected empty state for missing file, got %+v (%v)", state, err)
+	}
+
+	state.Filesystems = append(state.Filesystems, MountedFilesystem{
+		Index:      0,
+		MountPoint: "/mnt/remote/share0",
+		Source:     "https://account.blob.core.windows.net/c/image",
+		DeviceName: cryptDeviceName(0),
+		FsUUID:     "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0",
+	})
+	if err := writeMountState(path, state); err != nil {
+		t.Fatalf("writeMountState failed: %v", err)
+	}
+
+	readState, err := readMountState(path)
+	if err != nil {
+		t.Fatalf("readMountState failed: %v", err)
+	}
+	if len(readState.Filesystems) != 1 || readState.Filesystems[0] != state.Filesystems[0] {
+		t.Fatalf("unexpected state: %+v", readState)
+	}
+}
+
+func Test_ResumableFilesystems(t *testing.T) {
+	origStat, origReadExt4UUID, origIsMountPoint := osStat, _readExt4UUID, _isMountPoint
+	defer func() {
+		osStat, _readExt4UUID, _isMountPoint = origStat, origReadExt4UUID, origIsMountPoint
+	}()
+
+	fsUUID := "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0"
+	osStat = func(name string) (os.FileInfo, error) {
+		return nil, nil
+	}
+	_readExt4UUID = func(devicePath string) (string, error) {
+		return fsUUID, nil
+	}
+	_isMountPoint = func(path string) (bool, error) {
+		return true, nil
+	}
+
+	dir := t.TempDir()
+	info := RemoteFilesystemsInformation{
+		AzureFilesystems: []AzureFilesystem{
+			{MountPoint: filepath.Join(dir, "share0"), AzureUrl: "https://account.blob.core.windows.net/c/image0"},
+			{MountPoint: filepath.Join(dir, "share1"), AzureUrl: "https://account.blob.core.windows.net/c/image1"},
+		},
+	}
+	for i, fs := range info.AzureFilesystems {
+		if err := os.Symlink(fmt.Sprintf(".filesystem-%d", i), fs.MountPoint); err != nil {
+			t.Fatalf("failed to create symlink: %v", err)
+		}
+	}
+
+	var state MountState
+	for i, fs := range info.AzureFilesystems {
+		state.Filesystems = append(state.Filesystems, MountedFilesystem{
+			Index:      i,
+			MountPoint: fs.MountPoint,
+			Source:     filesystemSource(fs),
+			DeviceName: cryptDeviceName(i),
+			FsUUID:     fsUUID,
+		})
+	}
+
+	resumable := resumableFilesystems(info, state)
+	if len(resumable) != 2 {
+		t.Fatalf("expected both filesystems to be resumable, got %v", resumable)
+	}
+
+	// A filesystem whose image has changed is mounted again
+	info.AzureFilesystems[1].AzureUrl = "https://account.blob.core.windows.net/c/other"
+	resumable = resumableFilesystems(info, state)
+	if _, ok := resumable[1]; ok || len(resumable) != 1 {
+		t.Fatalf("expected only filesystem 0 to be resumable, got %v", resumable)
+	}
+
+	// So is a filesystem that isn't mounted anymore
+	_isMountPoint = func(path string) (bool, error) {
+		return filepath.Base(path) != ".filesystem-0", nil
+	}
+	resumable = resumableFilesystems(info, state)
+	if len(resumable) != 0 {
+		t.Fatalf("expected no resumable filesystems, got %v", resumable)
+	}
+
+	// And one whose device contains a different filesystem
+	_isMountPoint = func(path string) (bool, error) {
+		return true, nil
+	}
+	_readExt4UUID = func(devicePath string) (string, error) {
+		return "00000000-0000-0000-0000-000000000000", nil
+	}
+	resumable = resumableFilesystems(info, state)
+	if len(resumable) != 0 {
+		t.Fatalf("expected no resumable filesystems, got %v", resumable)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/attest"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// States of a filesystem in the status file
+const (
+	FilesystemStatePending = "pending"
+	FilesystemStateMounted = "mounted"
+	FilesystemStateFailed  = "failed"
+)
+
+// FilesystemStatus is the status of a single filesystem in the status file.
+type FilesystemStatus struct {
+	Index      int    `json:"index"`
+	MountPoint string `json:"mount_point"`
+	State      string `json:"state"`
+	// Classification of the error, e.g. "azmount_exited" or "mount_EIO"
+	ErrorCode string `json:"error_code,omitempty"`
+	// Error message, with any secrets removed
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+	// Set if the filesystem was mounted by a previous run of the tool
+	Resumed bool `json:"resumed,omitempty"`
+	// PID of the azmount process serving the image
+	AzmountPID int `json:"azmount_pid,omitempty"`
+	// Statistics of the image downloads made by azmount while mounting
+	Download *DownloadStats `json:"download,omitempty"`
+	// Parameters used to derive the key, if it was derived from a released
+	// RSA key
+	KeyDerivation *KeyDerivationStatus `json:"key_derivation,omitempty"`
+}
+
+// KeyDerivationStatus holds the effective parameters used to derive the key of
+// a filesystem, with the defaults applied. They aren't secret.
+type KeyDerivationStatus struct {
+	Algorithm string `json:"algorithm"`
+	// Salt as a hex string
+	Salt string `json:"salt"`
+	// Only used by HKDF
+	Label string `json:"label,omitempty"`
+}
+
+// newKeyDerivationStatus returns the effective parameters of blob when it is
+// used to derive a key with salt.
+func newKeyDerivationStatus(blob common.KeyDerivationBlob, salt []byte) *KeyDerivationStatus {
+	status := &KeyDerivationStatus{
+		Algorithm: blob.Algorithm,
+		Salt:      hex.EncodeToString(salt),
+	}
+	if status.Algorithm == "" {
+		status.Algorithm = common.KeyDerivationHKDF
+	}
+	if status.Algorithm == common.KeyDerivationHKDF {
+		status.Label = blob.Label
+		if status.Label == "" {
+			status.Label = common.DefaultKeyDerivationLabel
+		}
+	}
+	return status
+}
+
+// MountStatus is written to the status file by MountAzureFilesystems so that
+// orchestrators can find out if the filesystems have been mounted, and why
+// not, without parsing the logs. It never contains keys or tokens.
+type MountStatus struct {
+	Done        bool               `json:"done"`
+	Success     bool               `json:"success"`
+	ErrorCode   string             `json:"error_code,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	StartTime   time.Time          `json:"start_time"`
+	EndTime     *time.Time         `json:"end_time,omitempty"`
+	Filesystems []FilesystemStatus `json:"filesystems"`
+	// Version of the installed cryptsetup binary
+	CryptsetupVersion string `json:"cryptsetup_version,omitempty"`
+	// Set once all the required filesystems are mounted, while the optional
+	// ones may still be mounting
+	RequiredDone bool `json:"required_done"`
+}
+
+func newMountStatus(info RemoteFilesystemsInformation) *MountStatus {
+	status := &MountStatus{
+		StartTime:   time.Now(),
+		Filesystems: make([]FilesystemStatus, len(info.AzureFilesystems)),
+	}
+	for i, fs := range info.AzureFilesystems {
+		status.Filesystems[i] = FilesystemStatus{
+			Index:      i,
+			MountPoint: fs.MountPoint,
+			State:      FilesystemStatePending,
+		}
+	}
+	return status
+}
+
+// statusErrorCode classifies err for the status file.
+func statusErrorCode(err error) string {
+	var notReady *AzmountNotReadyError
+	var mountErr *MountError
+	var deadlineErr *MountDeadlineError
+	var notFound *ImageNotFoundError
+	var fsckErr *FsckError
+	var digestErr *ImageDigestError
+	var existingErr *ExistingMountError
+	var journalErr *JournalDirtyError
+	var contentErr *ContentCheckError
+	var mountPointErr *MountPointConflictError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	case errors.As(err, &deadlineErr), errors.Is(err, context.DeadlineExceeded):
+		return "deadline_exceeded"
+	case errors.As(err, &notFound):
+		return "image_not_found"
+	case errors.As(err, &notReady):
+		if notReady.AzmountExited {
+			return "azmount_exited"
+		}
+		return "azmount_timeout"
+	case errors.As(err, &fsckErr):
+		return "fsck_failed"
+	case errors.As(err, &digestErr):
+		return "image_digest_mismatch"
+	case errors.As(err, &existingErr):
+		return "mount_conflict"
+	case errors.As(err, &mountPointErr):
+		return "mount_point_conflict"
+	case errors.As(err, &journalErr):
+		return "journal_dirty"
+	case errors.As(err, &contentErr):
+		return "unexpected_content"
+	case errors.Is(err, ErrCryptsetupDeviceExists):
+		return "device_exists"
+	case errors.Is(err, ErrCryptsetupInUse):
+		return "device_in_use"
+	case errors.Is(err, ErrCryptsetupNotLuks):
+		return "not_luks"
+	case errors.Is(err, ErrCryptsetupNoKey):
+		return "key_rejected"
+	case errors.Is(err, attest.ErrCertExpired):
+		return "cert_expired"
+	case errors.Is(err, attest.ErrCertRevoked):
+		return "cert_revoked"
+	case errors.Is(err, attest.ErrUntrustedRoot):
+		return "untrusted_root"
+	case errors.As(err, &mountErr):
+		return "mount_" + unix.ErrnoName(mountErr.Errno)
+	default:
+		return "error"
+	}
+}
+
+// statusErrorMessage returns the message of err without the secrets of info.
+func statusErrorMessage(err error, info RemoteFilesystemsInformation) string {
+	msg := err.Error()
+
+	var secrets []string
+	for _, fs := range info.AzureFilesystems {
+		secrets = append(secrets, fs.RawKeyHexString, fs.KeyBlob.AKV.BearerToken)
+		// The SAS tokens of the URLs are in their queries
+		for _, rawURL := range []string{fs.AzureUrl, fs.HeaderUrl} {
+			if u, err := url.Parse(rawURL); err == nil {
+				secrets = append(secrets, u.RawQuery)
+			}
+		}
+		for _, share := range fs.KeyShares {
+			secrets = append(secrets, share.AKV.BearerToken)
+		}
+	}
+	for _, secret := range secrets {
+		if secret != "" {
+			msg = strings.ReplaceAll(msg, secret, "<redacted>")
+		}
+	}
+
+	return msg
+}
+
+// writeStatusFile atomically replaces the status file at path with status.
+func writeStatusFile(path string, status *MountStatus) error {
+	statusJSON, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal status")
+	}
+	return writeFileAtomic(path, statusJSON, 0644)
+}
+
+// writeFileAtomic replaces the file at path with data, so that readers never
+// see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create temporary file for %s", path)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+	if err := tmpFile.Chmod(perm); err != nil {
+		tmpFile.Close()
+		return errors.Wrapf(err, "failed to set permissions of %s", path)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return errors.Wrapf(err, "failed to replace %s", path)
+	}
+	return nil
+}
+
+// updateStatusFile writes status to StatusFilePath, if it is set, and
+// updates the health served by the health service. Failures are only logged,
+// as the status file must not affect the mounts.
+func updateStatusFile(status *MountStatus) {
+	setHealthStatus(status)
+	if StatusFilePath == "" {
+		return
+	}
+	if err := writeStatusFile(StatusFilePath, status); err != nil {
+		logrus.WithError(err).Warn("failed to update status file")
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/attest"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+func Test_StatusFile(t *testing.T) {
+	info := RemoteFilesystemsInformation{
+		AzureFilesystems: []AzureFilesystem{
+			{MountPoint: "/mnt/remote/share0"},
+			{MountPoint: "/mnt/remote/share1", RawKeyHexString: "00112233", AzureUrl: "https://a.blob.core.windows.net/c/data?sig=imagesas", HeaderUrl: "https://a.blob.core.windows.net/c/header?sig=headersas"},
+		},
+	}
+	status := newMountStatus(info)
+	status.Filesystems[0].State = FilesystemStateMounted
+
+	err := errors.Wrapf(errors.New("bad key 00112233 for https://a.blob.core.windows.net/c/data?sig=imagesas, https://a.blob.core.windows.net/c/header?sig=headersas"), "failed to mount filesystem index 1")
+	status.Filesystems[1].State = FilesystemStateFailed
+	status.Filesystems[1].ErrorCode = statusErrorCode(err)
+	status.Filesystems[1].Error = statusErrorMessage(err, info)
+
+	for _, secret := range []string{"00112233", "imagesas", "headersas"} {
+		if strings.Contains(status.Filesystems[1].Error, secret) {
+			t.Fatalf("status contains the secret %s: %s", secret, status.Filesystems[1].Error)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "status.json")
+	if err := writeStatusFile(path, status); err != nil {
+		t.Fatalf("writeStatusFile failed: %v", err)
+	}
+
+	statusJSON, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read status file: %v", err)
+	}
+	var readStatus MountStatus
+	if err := json.Unmarshal(statusJSON, &readStatus); err != nil {
+		t.Fatalf("failed to unmarshal status file: %v", err)
+	}
+	if len(readStatus.Filesystems) != 2 || readStatus.Filesystems[0].State != FilesystemStateMounted || readStatus.Filesystems[1].State != FilesystemStateFailed {
+		t.Fatalf("unexpected status: %s", statusJSON)
+	}
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected only the status file, got %v (%v)", entries, err)
+	}
+}
+
+func Test_StatusErrorCode(t *testing.T) {
+	notReady := &AzmountNotReadyError{ImageLocalFile: "/tmp/0/data", AzmountExited: true, LogFile: "/tmp/log-0.txt", LogTail: "token abc", Err: os.ErrNotExist}
+	err := errors.Wrapf(notReady, "failed to mount remote file")
+	if code := statusErrorCode(err); code != "azmount_exited" {
+		t.Fatalf("unexpected error code: %s", code)
+	}
+	if msg := statusErrorMessage(err, RemoteFilesystemsInformation{}); strings.Contains(msg, "token abc") || !strings.Contains(msg, "/tmp/log-0.txt") {
+		t.Fatalf("status contains the azmount log or lacks its path: %s", msg)
+	}
+
+	err = newMountError("/dev/mapper/remote-crypt-0", "/mnt/.filesystem-0", unix.EIO)
+	if code := statusErrorCode(err); code != "mount_EIO" {
+		t.Fatalf("unexpected error code: %s", code)
+	}
+
+	err = errors.Wrapf(errors.Wrapf(attest.ErrCertExpired, "SEV-VCEK is valid from ..."), "attestation failed")
+	if code := statusErrorCode(err); code != "cert_expired" {
+		t.Fatalf("unexpected error code: %s", code)
+	}
+}
+
+func Test_NewKeyDerivationStatus(t *testing.T) {
+	salt := []byte{0x92, 0xa6, 0x31}
+
+	status := newKeyDerivationStatus(common.KeyDerivationBlob{}, salt)
+	expected := KeyDerivationStatus{Algorithm: common.KeyDerivationHKDF, Salt: "92a631", Label: common.DefaultKeyDerivationLabel}
+	if *status != expected {
+		t.Fatalf("expected %+v, got %+v", expected, *status)
+	}
+
+	status = newKeyDerivationStatus(common.KeyDerivationBlob{Algorithm: common.KeyDerivationPBKDF2, Label: "unused"}, salt)
+	expected = KeyDerivationStatus{Algorithm: common.KeyDerivationPBKDF2, Salt: "92a631"}
+	if *status != expected {
+		t.Fatalf("expected %+v, got %+v", expected, *status)
+	}
+}
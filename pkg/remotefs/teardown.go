@@ -0,0 +1,216 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultTeardownGracePeriod is how long the teardown waits for the workload
+// to release a filesystem before escalating.
+const DefaultTeardownGracePeriod = 5 * time.Second
+
+// Interval between the attempts to unmount a busy filesystem or to close a
+// busy device
+const teardownRetryInterval = 100 * time.Millisecond
+
+// unmountWithEscalation unmounts target. While the workload keeps files open
+// in it the unmount fails with EBUSY, so it is retried until gracePeriod has
+// passed, and then target is detached with MNT_DETACH: it disappears from the
+// mount table and the kernel releases it once the files are closed. It
+// returns whether target had to be detached.
+func unmountWithEscalation(target string, gracePeriod time.Duration) (bool, error) {
+	timeoutChan := timeAfter(gracePeriod)
+	for {
+		err := unixUnmount(target, 0)
+		if err == nil {
+			return false, nil
+		}
+		if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOENT) {
+			logrus.Debugf("%s isn't mounted", target)
+			return false, nil
+		}
+		if !errors.Is(err, unix.EBUSY) {
+			return false, errors.Wrapf(err, "failed to unmount %s", target)
+		}
+		select {
+		case <-timeoutChan:
+			logrus.Warnf("%s is still busy after %s, detaching it", target, gracePeriod)
+			if err := unixUnmount(target, unix.MNT_DETACH); err != nil {
+				return false, errors.Wrapf(err, "failed to detach %s", target)
+			}
+			return true, nil
+		case <-timeAfter(teardownRetryInterval):
+		}
+	}
+}
+
+// closeDeviceWithEscalation closes the device created by cryptsetupOpen. If it
+// is still in use after gracePeriod, or right away if its filesystem had to be
+// detached, it is marked for deferred removal instead. It returns whether the
+// removal was deferred.
+func closeDeviceWithEscalation(deviceName string, gracePeriod time.Duration, detached bool) (bool, error) {
+	if !detached {
+		timeoutChan := timeAfter(gracePeriod)
+	retry:
+		for {
+			err := _cryptsetupClose(deviceName)
+			if err == nil {
+				return false, nil
+			}
+			logrus.WithError(err).Debugf("failed to close device: %s", deviceName)
+			select {
+			case <-timeoutChan:
+				break retry
+			case <-timeAfter(teardownRetryInterval):
+			}
+		}
+	}
+
+	logrus.Warnf("Device %s is still in use, deferring its removal", deviceName)
+	if err := _cryptsetupCloseDeferred(deviceName); err != nil {
+		return false, errors.Wrapf(err, "failed to close device: %s", deviceName)
+	}
+	return true, nil
+}
+
+// azmountMountFolder returns the folder where the azmount process pid serves
+// the image, from its command line. It fails if pid isn't an azmount process.
+func azmountMountFolder(pid int) (string, error) {
+	cmdlinePath := filepath.Join(procRoot, strconv.Itoa(pid), "cmdline")
+	cmdline, err := ioutilReadFile(cmdlinePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %s", cmdlinePath)
+	}
+
+	args := bytes.Split(bytes.TrimSuffix(cmdline, []byte{0}), []byte{0})
+	if filepath.Base(string(args[0])) != "azmount" {
+		return "", errors.Errorf("process %d isn't azmount: %s", pid, args[0])
+	}
+	for i := 1; i+1 < len(args); i++ {
+		if string(args[i]) == "-mountpoint" {
+			return string(args[i+1]), nil
+		}
+	}
+	return "", errors.Errorf("no mount point in the command line of azmount %d", pid)
+}
+
+// stopAzmountProcess kills the azmount process pid and detaches the FUSE
+// filesystem it was serving.
+func stopAzmountProcess(pid int) error {
+	mountFolder, err := azmountMountFolder(pid)
+	if err != nil {
+		return err
+	}
+	if err := unixKill(pid, unix.SIGKILL); err != nil {
+		return errors.Wrapf(err, "failed to kill azmount %d", pid)
+	}
+	if err := unixUnmount(mountFolder, unix.MNT_DETACH); err != nil {
+		logrus.WithError(err).Debugf("failed to unmount %s", mountFolder)
+	}
+	return nil
+}
+
+// teardownFilesystem unmounts a filesystem mounted by MountAzureFilesystems,
+// closes its device, stops its azmount process and unmounts the Azure Files
+// share of its image. If the workload doesn't release the filesystem within
+// gracePeriod, it is detached and the removal of the device is deferred until
+// it does. azmount and the share are then left mounted to serve the files that
+// are still open.
+func teardownFilesystem(mounted MountedFilesystem, gracePeriod time.Duration) error {
+	// Remove the symlink first so that the workload can't open new files
+	if err := os.Remove(mounted.MountPoint); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove symlink of filesystem-%d", mounted.Index)
+	}
+
+	mountFolder, err := filesystemMountFolder(mounted.Index, mounted.MountPoint)
+	if err != nil {
+		return err
+	}
+	detached, err := unmountWithEscalation(mountFolder, gracePeriod)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(mountFolder); err != nil {
+		logrus.WithError(err).Debugf("failed to remove %s", mountFolder)
+	}
+
+	// tmpfs filesystems don't have a device nor azmount
+	if mounted.DeviceName == "" {
+		return nil
+	}
+	if _, err := osStat("/dev/mapper/" + mounted.DeviceName); os.IsNotExist(err) {
+		logrus.Debugf("Device %s has already been closed", mounted.DeviceName)
+	} else {
+		deferred, err := closeDeviceWithEscalation(mounted.DeviceName, gracePeriod, detached)
+		if err != nil {
+			return err
+		}
+		if deferred {
+			logrus.Warnf("Filesystem-%d is still in use, keeping its azmount process running", mounted.Index)
+			return nil
+		}
+	}
+
+	if mounted.AzmountPID != 0 {
+		if err := stopAzmountProcess(mounted.AzmountPID); err != nil {
+			logrus.WithError(err).Warnf("Failed to stop azmount of filesystem-%d", mounted.Index)
+		}
+	}
+
+	// The share is only released once azmount, which serves the image from
+	// it, has stopped
+	if mounted.ShareFolder != "" {
+		if _, err := unmountWithEscalation(mounted.ShareFolder, gracePeriod); err != nil {
+			return errors.Wrapf(err, "failed to unmount the Azure Files share of filesystem-%d", mounted.Index)
+		}
+		if err := os.Remove(mounted.ShareFolder); err != nil {
+			logrus.WithError(err).Debugf("failed to remove %s", mounted.ShareFolder)
+		}
+	}
+	return nil
+}
+
+// TeardownAzureFilesystems tears down the filesystems recorded in the state
+// file at path, in the reverse order of their mounts. The filesystems that
+// can't be torn down are kept in the state file.
+func TeardownAzureFilesystems(path string, gracePeriod time.Duration) error {
+	state, err := readMountState(path)
+	if err != nil {
+		return err
+	}
+
+	var remaining []MountedFilesystem
+	var failed []int
+	for i := len(state.Filesystems) - 1; i >= 0; i-- {
+		mounted := state.Filesystems[i]
+		logrus.Infof("Tearing down filesystem-%d...", mounted.Index)
+		if err := teardownFilesystem(mounted, gracePeriod); err != nil {
+			logrus.WithError(err).Errorf("Failed to tear down filesystem-%d", mounted.Index)
+			remaining = append([]MountedFilesystem{mounted}, remaining...)
+			failed = append(failed, mounted.Index)
+			continue
+		}
+		audit(AuditEvent{Event: AuditFilesystemTornDown, Index: mounted.Index, MountPoint: mounted.MountPoint, Source: mounted.Source})
+	}
+
+	if err := writeMountState(path, MountState{Filesystems: remaining}); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("failed to tear down filesystems %v", failed)
+	}
+	return nil
+}
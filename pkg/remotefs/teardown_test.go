@@ -0,0 +1,163 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+func Test_UnmountWithEscalation(t *testing.T) {
+	origUnmount := unixUnmount
+	defer func() {
+		unixUnmount = origUnmount
+	}()
+
+	// Busy until the workload closes its files after 3 attempts
+	attempts := 0
+	unixUnmount = func(target string, flags int) error {
+		attempts++
+		if flags == 0 && attempts <= 3 {
+			return unix.EBUSY
+		}
+		return nil
+	}
+	detached, err := unmountWithEscalation("/mnt/remote/.filesystem-0", time.Minute)
+	if err != nil || detached {
+		t.Fatalf("expected a clean unmount, got detached %t, %v", detached, err)
+	}
+
+	// Never released
+	var detachFlags int
+	unixUnmount = func(target string, flags int) error {
+		if flags == 0 {
+			return unix.EBUSY
+		}
+		detachFlags = flags
+		return nil
+	}
+	detached, err = unmountWithEscalation("/mnt/remote/.filesystem-0", 10*time.Millisecond)
+	if err != nil || !detached || detachFlags != unix.MNT_DETACH {
+		t.Fatalf("expected the mount to be detached, got detached %t, flags %d, %v", detached, detachFlags, err)
+	}
+
+	// Not mounted anymore
+	unixUnmount = func(target string, flags int) error {
+		return unix.EINVAL
+	}
+	if detached, err = unmountWithEscalation("/mnt/remote/.filesystem-0", time.Minute); err != nil || detached {
+		t.Fatalf("expected a missing mount to be ignored, got detached %t, %v", detached, err)
+	}
+}
+
+func Test_TeardownAzureFilesystems(t *testing.T) {
+	origUnmount, origStat, origClose, origCloseDeferred, origKill, origProcRoot := unixUnmount, osStat, _cryptsetupClose, _cryptsetupCloseDeferred, unixKill, procRoot
+	defer func() {
+		unixUnmount, osStat, _cryptsetupClose, _cryptsetupCloseDeferred, unixKill, procRoot = origUnmount, origStat, origClose, origCloseDeferred, origKill, origProcRoot
+	}()
+
+	dir := t.TempDir()
+	state := MountState{}
+	for i := 0; i < 2; i++ {
+		mountPoint := filepath.Join(dir, fmt.Sprintf("share%d", i))
+		if err := os.Mkdir(filepath.Join(dir, fmt.Sprintf(".filesystem-%d", i)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(fmt.Sprintf(".filesystem-%d", i), mountPoint); err != nil {
+			t.Fatal(err)
+		}
+		state.Filesystems = append(state.Filesystems, MountedFilesystem{
+			Index:      i,
+			MountPoint: mountPoint,
+			Source:     "https://test.blob.core.windows.net/c/image",
+			DeviceName: cryptDeviceName(i),
+			AzmountPID: 100 + i,
+		})
+	}
+	// The image of filesystem 0 is in an Azure Files share
+	state.Filesystems[0].Source = "account.file.core.windows.net:/account/share/image.img"
+	state.Filesystems[0].ShareFolder = "/tmp/remotefs/share-0"
+	statePath := filepath.Join(dir, "state.json")
+	if err := writeMountState(statePath, state); err != nil {
+		t.Fatal(err)
+	}
+
+	procRoot = filepath.Join(dir, "proc")
+	for i := 0; i < 2; i++ {
+		pidDir := filepath.Join(procRoot, fmt.Sprintf("%d", 100+i))
+		if err := os.MkdirAll(pidDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		cmdline := fmt.Sprintf("/bin/azmount\x00-mountpoint\x00/tmp/remotefs/%d\x00-readWrite\x00false\x00", i)
+		if err := os.WriteFile(filepath.Join(pidDir, "cmdline"), []byte(cmdline), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The workload never releases filesystem 1
+	var unmounted []string
+	unixUnmount = func(target string, flags int) error {
+		if flags == 0 && target == filepath.Join(dir, ".filesystem-1") {
+			return unix.EBUSY
+		}
+		unmounted = append(unmounted, target)
+		return nil
+	}
+	osStat = func(string) (os.FileInfo, error) {
+		return nil, nil
+	}
+	var closed, deferred []string
+	_cryptsetupClose = func(deviceName string) error {
+		if deviceName == cryptDeviceName(1) {
+			return errors.New("device is busy")
+		}
+		closed = append(closed, deviceName)
+		return nil
+	}
+	_cryptsetupCloseDeferred = func(deviceName string) error {
+		deferred = append(deferred, deviceName)
+		return nil
+	}
+	var killed []int
+	unixKill = func(pid int, sig syscall.Signal) error {
+		killed = append(killed, pid)
+		return nil
+	}
+
+	if err := TeardownAzureFilesystems(statePath, 10*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := os.Lstat(state.Filesystems[i].MountPoint); !os.IsNotExist(err) {
+			t.Errorf("expected the symlink of filesystem %d to be removed: %v", i, err)
+		}
+	}
+	expectedUnmounted := []string{filepath.Join(dir, ".filesystem-1"), filepath.Join(dir, ".filesystem-0"), "/tmp/remotefs/0", "/tmp/remotefs/share-0"}
+	if fmt.Sprint(unmounted) != fmt.Sprint(expectedUnmounted) {
+		t.Errorf("expected %v to be unmounted, got %v", expectedUnmounted, unmounted)
+	}
+	if len(closed) != 1 || closed[0] != cryptDeviceName(0) || len(deferred) != 1 || deferred[0] != cryptDeviceName(1) {
+		t.Errorf("unexpected closed devices %v and deferred devices %v", closed, deferred)
+	}
+	// azmount of filesystem 1 keeps serving its open files
+	if len(killed) != 1 || killed[0] != 100 {
+		t.Errorf("expected only azmount 100 to be killed, got %v", killed)
+	}
+
+	remaining, err := readMountState(statePath)
+	if err != nil || len(remaining.Filesystems) != 0 {
+		t.Fatalf("expected the state file to be empty, got %+v, %v", remaining, err)
+	}
+}
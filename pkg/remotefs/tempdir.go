@@ -0,0 +1,150 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Pattern of the temporary directories created by main
+const TempDirPattern = "remotefs"
+
+// Name of the file that marks a temporary directory as created by the tool,
+// with the PID of the run that created it
+const tempDirMarker = ".remotefs-run"
+
+// MarkTempDir marks tempDir as created by this run of the tool, so that later
+// runs can remove it once nothing uses it anymore.
+func MarkTempDir(tempDir string) error {
+	markerPath := filepath.Join(tempDir, tempDirMarker)
+	if err := os.WriteFile(markerPath, []byte(strconv.Itoa(os.Getpid())), 0600); err != nil {
+		return errors.Wrapf(err, "failed to write %s", markerPath)
+	}
+	return nil
+}
+
+// tempDirOwner returns the PID of the run of the tool that marked dir if it
+// is still running, or 0. The PID may have been reused since, so the process
+// must be the tool too.
+func tempDirOwner(dir string) int {
+	marker, err := ioutilReadFile(filepath.Join(dir, tempDirMarker))
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(marker)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	cmdline, err := ioutilReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return 0
+	}
+	args := bytes.Split(cmdline, []byte{0})
+	if filepath.Base(string(args[0])) != "remotefs" {
+		return 0
+	}
+	return pid
+}
+
+// processesUsing returns the PIDs of the processes whose command line refers
+// to a path in dir, like the azmount processes serving images from it.
+func processesUsing(dir string) ([]int, error) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", procRoot)
+	}
+
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// The process may have exited since
+		cmdline, err := ioutilReadFile(filepath.Join(procRoot, entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		for _, arg := range bytes.Split(cmdline, []byte{0}) {
+			if path := string(arg); path == dir || strings.HasPrefix(path, dir+"/") {
+				pids = append(pids, pid)
+				break
+			}
+		}
+	}
+	return pids, nil
+}
+
+// tempDirInUse returns why dir can't be removed, or "" if it is stale: a
+// filesystem is mounted under it, like the FUSE mount of azmount or an Azure
+// Files share, the run that created it is still running, or a process still
+// refers to it.
+func tempDirInUse(dir string, mounts []mountInfo) (string, error) {
+	for _, mount := range mounts {
+		if mount.Target == dir || strings.HasPrefix(mount.Target, dir+"/") {
+			return "mounted at " + mount.Target, nil
+		}
+	}
+	if pid := tempDirOwner(dir); pid != 0 {
+		return "created by run " + strconv.Itoa(pid) + ", which is still running", nil
+	}
+	pids, err := processesUsing(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(pids) > 0 {
+		return "used by process " + strconv.Itoa(pids[0]), nil
+	}
+	return "", nil
+}
+
+// CleanupStaleTempDirs removes the temporary directories that previous runs
+// of the tool left in the temporary directory of the system, with their key
+// files and azmount logs. Only the directories marked by MarkTempDir are
+// removed, and only once the run that created them has exited, nothing is
+// mounted under them and no process refers to them, so the directories of the
+// azmount processes still serving resumed filesystems are kept. current is the
+// directory of this run.
+func CleanupStaleTempDirs(current string) error {
+	dirs, err := filepath.Glob(filepath.Join(os.TempDir(), TempDirPattern+"*"))
+	if err != nil {
+		return errors.Wrapf(err, "failed to list temporary directories")
+	}
+	mounts, err := readMountTable()
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if dir == current {
+			continue
+		}
+		if _, err := osStat(filepath.Join(dir, tempDirMarker)); err != nil {
+			continue
+		}
+		reason, err := tempDirInUse(dir, mounts)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			logrus.Debugf("Keeping temporary directory %s: %s", dir, reason)
+			continue
+		}
+		logrus.Infof("Removing stale temporary directory %s", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			logrus.WithError(err).Warnf("Failed to remove %s", dir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_CleanupStaleTempDirs(t *testing.T) {
+	origProcRoot := procRoot
+	defer func() {
+		procRoot = origProcRoot
+	}()
+	procRoot = t.TempDir()
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	dirs := map[string]bool{
+		"remotefs1": true,  // Stale
+		"remotefs2": true,  // The FUSE mount of azmount is still there
+		"remotefs3": true,  // An azmount process still writes its log there
+		"remotefs4": false, // Not created by the tool
+		"remotefs5": true,  // Current run
+		"remotefs6": true,  // The run that created it is still running
+		"remotefs7": true,  // The PID of the run that created it was reused
+	}
+	for name, marked := range dirs {
+		dir := filepath.Join(tmp, name)
+		if err := os.MkdirAll(filepath.Join(dir, "0"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "keyfile"), []byte("key"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if marked {
+			if err := MarkTempDir(dir); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	mountInfo := "36 35 0:40 / " + filepath.Join(tmp, "remotefs2", "0") + " rw,nosuid - fuse azmount rw\n"
+	if err := os.MkdirAll(filepath.Join(procRoot, "self"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(procRoot, "self", "mountinfo"), []byte(mountInfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmdline := "/bin/azmount\x00-logfile\x00" + filepath.Join(tmp, "remotefs3", "log-0.txt") + "\x00"
+	if err := os.MkdirAll(filepath.Join(procRoot, "100"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(procRoot, "100", "cmdline"), []byte(cmdline), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, pid := range map[string]string{"remotefs6": "200", "remotefs7": "300"} {
+		if err := os.WriteFile(filepath.Join(tmp, name, tempDirMarker), []byte(pid), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for pid, cmdline := range map[string]string{"200": "/usr/bin/remotefs\x00", "300": "/bin/sh\x00"} {
+		if err := os.MkdirAll(filepath.Join(procRoot, pid), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(procRoot, pid, "cmdline"), []byte(cmdline), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := CleanupStaleTempDirs(filepath.Join(tmp, "remotefs5")); err != nil {
+		t.Fatalf("CleanupStaleTempDirs failed: %v", err)
+	}
+
+	for name := range dirs {
+		_, err := os.Stat(filepath.Join(tmp, name))
+		if removed := os.IsNotExist(err); removed != (name == "remotefs1" || name == "remotefs7") {
+			t.Errorf("%s: unexpected removed=%t", name, removed)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// TmpfsOptions describe a scratch filesystem held in memory, which has no
+// image and no key. The memory of the UVM is encrypted by SEV-SNP, so its
+// contents are as confidential as the ones of the encrypted filesystems, and
+// they are lost when the UVM stops.
+type TmpfsOptions struct {
+	// Maximum size of the filesystem in bytes
+	SizeBytes int64 `json:"size_bytes"`
+}
+
+// validateTmpfs checks that fs, which is a tmpfs filesystem, doesn't set any
+// image or key.
+func validateTmpfs(fs AzureFilesystem) error {
+	if fs.Tmpfs.SizeBytes <= 0 {
+		return errors.Errorf("size of tmpfs must be positive: %d", fs.Tmpfs.SizeBytes)
+	}
+	if fs.AzureUrl != "" || fs.AzureFilesNfsShare != "" {
+		return errors.Errorf("tmpfs filesystems can't have an image")
+	}
+	if fs.KeyBlob.KID != "" || len(fs.KeyShares) > 0 || fs.RawKeyHexString != "" {
+		return errors.Errorf("tmpfs filesystems can't have a key")
+	}
+	return nil
+}
+
+// tmpfsMountData returns the data argument of the mount of the tmpfs
+// filesystem of fs.
+func tmpfsMountData(fs AzureFilesystem) string {
+	data := fmt.Sprintf("size=%d", fs.Tmpfs.SizeBytes)
+	if fs.SELinuxContext != "" {
+		data += fmt.Sprintf(",context=%q", fs.SELinuxContext)
+	}
+	return data
+}
+
+// mountTmpfs mounts the tmpfs filesystem of fs next to its mount point and
+// links the mount point to it, like the encrypted filesystems, with mounter.
+func mountTmpfs(mounter Mounter, steps *stepTracer, index int, fs AzureFilesystem) (err error) {
+	steps.step("mount")
+	tempMountFolder, err := filesystemMountFolder(index, fs.MountPoint)
+	if err != nil {
+		return err
+	}
+
+	logrus.Debugf("Creating mount folder: %s", tempMountFolder)
+	if err := osMkdirAll(tempMountFolder, 0755); err != nil {
+		return errors.Wrapf(err, "mkdir failed: %s", tempMountFolder)
+	}
+
+	logrus.Debugf("Mounting tmpfs of %d bytes to mount folder %s", fs.Tmpfs.SizeBytes, tempMountFolder)
+	if err := mounter.Mount("tmpfs", tempMountFolder, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, tmpfsMountData(fs)); err != nil {
+		return newMountError("tmpfs", tempMountFolder, err)
+	}
+
+	defer func() {
+		if err != nil {
+			if inErr := mounter.Unmount(tempMountFolder, 0); inErr != nil {
+				logrus.WithError(inErr).Debugf("failed to unmount: %s", tempMountFolder)
+			}
+		}
+	}()
+
+	steps.step("symlink")
+	logrus.Debugf("Creating symlink for filesystem-%d to: %s", index, fs.MountPoint)
+	if err := os.Symlink(fmt.Sprintf(".filesystem-%d", index), fs.MountPoint); err != nil {
+		return errors.Wrapf(err, "failed to symlink filesystem-%d: %s", index, fs.MountPoint)
+	}
+	return nil
+}
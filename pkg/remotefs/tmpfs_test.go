@@ -0,0 +1,63 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"golang.org/x/sys/unix"
+)
+
+func Test_MountTmpfs(t *testing.T) {
+	origMount := unixMount
+	defer func() { unixMount = origMount }()
+
+	var mountSource, mountTarget, mountFstype, mountData string
+	var mountFlags uintptr
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		mountSource, mountTarget, mountFstype, mountFlags, mountData = source, target, fstype, flags, data
+		return nil
+	}
+	dir := t.TempDir()
+	fs := AzureFilesystem{
+		MountPoint: filepath.Join(dir, "scratch"),
+		Tmpfs:      &TmpfsOptions{SizeBytes: 64 * 1024 * 1024},
+	}
+
+	// No image is mounted and no key is released
+	if err := containerMountAzureFilesystem(context.Background(), &MountOptions{}, dir, 0, fs, nil, &FilesystemStatus{}); err != nil {
+		t.Fatalf("containerMountAzureFilesystem failed: %v", err)
+	}
+	if mountSource != "tmpfs" || mountFstype != "tmpfs" || mountFlags != unix.MS_NOSUID|unix.MS_NODEV {
+		t.Fatalf("unexpected mount of %s (%s, flags %d)", mountSource, mountFstype, mountFlags)
+	}
+	if mountTarget != filepath.Join(dir, ".filesystem-0") || mountData != "size=67108864" {
+		t.Fatalf("unexpected mount to %s with options %s", mountTarget, mountData)
+	}
+	if target, err := os.Readlink(fs.MountPoint); err != nil || target != ".filesystem-0" {
+		t.Fatalf("unexpected symlink to %s (%v)", target, err)
+	}
+
+	fs.SELinuxContext = "system_u:object_r:container_file_t:s0"
+	if data := tmpfsMountData(fs); data != `size=67108864,context="system_u:object_r:container_file_t:s0"` {
+		t.Fatalf("unexpected mount options: %s", data)
+	}
+
+	for _, invalid := range []AzureFilesystem{
+		{Tmpfs: &TmpfsOptions{}},
+		{Tmpfs: &TmpfsOptions{SizeBytes: 1024}, AzureUrl: "https://account.blob.core.windows.net/c/image"},
+		{Tmpfs: &TmpfsOptions{SizeBytes: 1024}, KeyBlob: common.KeyBlob{KID: "key"}},
+	} {
+		if err := validateTmpfs(invalid); err == nil {
+			t.Errorf("expected %+v to be rejected", invalid)
+		}
+	}
+}
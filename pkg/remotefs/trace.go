@@ -0,0 +1,107 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+)
+
+// Attribute is a key-value pair attached to spans and span events. Values must
+// never be secrets.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is the subset of an OpenTelemetry span used by remotefs.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	AddEvent(name string, attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// Tracer creates the spans of the mount pipeline. It mirrors the Start method
+// of an OpenTelemetry tracer, so that an adapter can be set in MountTracer to
+// export the mount to a collector:
+//
+//	MountAzureFilesystems
+//	└── filesystem (per filesystem)
+//	    ├── azmount
+//	    ├── key_release
+//	    ├── cryptsetup_open
+//	    ├── mount
+//	    └── symlink
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(attrs ...Attribute)         {}
+func (noopSpan) AddEvent(name string, attrs ...Attribute) {}
+func (noopSpan) RecordError(err error)                    {}
+func (noopSpan) End()                                     {}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+// MountTracer traces the mounts. By default spans aren't recorded.
+var MountTracer Tracer = noopTracer{}
+
+type spanKey struct{}
+
+// startSpan starts a span with MountTracer as a child of the span in ctx, and
+// returns a context that contains the new span.
+func startSpan(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	if _, ok := MountTracer.(noopTracer); ok {
+		return ctx, noopSpan{}
+	}
+	ctx, span := MountTracer.Start(ctx, name, attrs...)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// spanFromContext returns the span in ctx, used to add events to it.
+func spanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return noopSpan{}
+}
+
+// endSpan records err, if any, in span and ends it.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// stepTracer traces the consecutive steps of the mount of filesystem index.
+// Each step ends when the next one starts, or with the error that aborts the
+// mount. The step in progress is also recorded for the mount deadline.
+type stepTracer struct {
+	ctx   context.Context
+	index int
+	span  Span
+}
+
+func (s *stepTracer) step(name string, attrs ...Attribute) {
+	s.end(nil)
+	setMountStep(s.ctx, s.index, name)
+	_, s.span = startSpan(s.ctx, name, attrs...)
+}
+
+func (s *stepTracer) end(err error) {
+	if s.span != nil {
+		endSpan(s.span, err)
+		s.span = nil
+	}
+}
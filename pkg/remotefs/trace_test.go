@@ -0,0 +1,91 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type recordedSpan struct {
+	name   string
+	events []string
+	err    error
+	ended  bool
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...Attribute) {}
+
+func (s *recordedSpan) AddEvent(name string, attrs ...Attribute) {
+	s.events = append(s.events, name)
+}
+
+func (s *recordedSpan) RecordError(err error) {
+	s.err = err
+}
+
+func (s *recordedSpan) End() {
+	s.ended = true
+}
+
+type recordingTracer struct {
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	span := &recordedSpan{name: name}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+func Test_StepTracer(t *testing.T) {
+	origMountTracer := MountTracer
+	defer func() { MountTracer = origMountTracer }()
+
+	tracer := &recordingTracer{}
+	MountTracer = tracer
+
+	ctx, span := startSpan(context.Background(), "filesystem")
+	spanFromContext(ctx).AddEvent("retry")
+
+	steps := &stepTracer{ctx: ctx}
+	steps.step("azmount")
+	steps.step("key_release")
+	stepErr := errors.New("key release failed")
+	steps.end(stepErr)
+	endSpan(span, stepErr)
+
+	var names []string
+	for _, s := range tracer.spans {
+		names = append(names, s.name)
+		if !s.ended {
+			t.Fatalf("span %s wasn't ended", s.name)
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"filesystem", "azmount", "key_release"}) {
+		t.Fatalf("unexpected spans: %v", names)
+	}
+	if !reflect.DeepEqual(tracer.spans[0].events, []string{"retry"}) {
+		t.Fatalf("unexpected events: %v", tracer.spans[0].events)
+	}
+	if tracer.spans[1].err != nil || tracer.spans[2].err != stepErr || tracer.spans[0].err != stepErr {
+		t.Fatalf("errors recorded in the wrong spans")
+	}
+}
+
+func Test_NoopTracer(t *testing.T) {
+	ctx := context.Background()
+	spanCtx, span := startSpan(ctx, "filesystem")
+	if spanCtx != ctx {
+		t.Fatalf("expected the context to be unchanged by the no-op tracer")
+	}
+	if _, ok := span.(noopSpan); !ok {
+		t.Fatalf("expected a no-op span")
+	}
+}
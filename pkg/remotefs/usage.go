@@ -0,0 +1,112 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Root of the proc filesystem, changed by the tests
+var procRoot = "/proc"
+
+// AzmountUsage is the resource usage of the azmount process of a filesystem.
+type AzmountUsage struct {
+	Index      int    `json:"index"`
+	MountPoint string `json:"mount_point"`
+	PID        int    `json:"pid"`
+	// Resident memory of the process, mostly the block cache
+	RSSBytes int64 `json:"rss_bytes,omitempty"`
+	// Why the usage couldn't be read, e.g. because azmount has exited
+	Error string `json:"error,omitempty"`
+}
+
+// readProcessRSS returns the resident memory of the azmount process pid, from
+// the VmRSS line of /proc/<pid>/status. It fails if pid isn't an azmount
+// process, which happens if it has exited and the PID has been reused.
+func readProcessRSS(pid int) (int64, error) {
+	statusPath := filepath.Join(procRoot, strconv.Itoa(pid), "status")
+	status, err := ioutilReadFile(statusPath)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to read %s", statusPath)
+	}
+
+	var name string
+	var rss int64 = -1
+	scanner := bufio.NewScanner(bytes.NewReader(status))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Name":
+			name = value
+		case "VmRSS":
+			// For example "VmRSS:	   21884 kB"
+			kiB, err := strconv.ParseInt(strings.TrimSuffix(value, " kB"), 10, 64)
+			if err != nil {
+				return 0, errors.Wrapf(err, "invalid VmRSS in %s: %s", statusPath, value)
+			}
+			rss = kiB * 1024
+		}
+	}
+	if name != "azmount" {
+		return 0, errors.Errorf("process %d isn't azmount: %s", pid, name)
+	}
+	if rss < 0 {
+		return 0, errors.Errorf("no VmRSS in %s", statusPath)
+	}
+	return rss, nil
+}
+
+// azmountUsage returns the resource usage of the azmount processes of the
+// filesystems in state. tmpfs filesystems don't have one.
+func azmountUsage(state MountState) []AzmountUsage {
+	usage := []AzmountUsage{}
+	for _, mounted := range state.Filesystems {
+		if mounted.AzmountPID == 0 {
+			continue
+		}
+		u := AzmountUsage{
+			Index:      mounted.Index,
+			MountPoint: mounted.MountPoint,
+			PID:        mounted.AzmountPID,
+		}
+		rss, err := readProcessRSS(mounted.AzmountPID)
+		if err != nil {
+			u.Error = err.Error()
+		} else {
+			u.RSSBytes = rss
+		}
+		usage = append(usage, u)
+	}
+	return usage
+}
+
+// PrintAzmountUsage prints the resource usage of the azmount processes of the
+// filesystems in the state file at path as JSON.
+func PrintAzmountUsage(path string) error {
+	state, err := readMountState(path)
+	if err != nil {
+		return err
+	}
+	usageJSON, err := json.MarshalIndent(azmountUsage(state), "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal usage")
+	}
+	fmt.Println(string(usageJSON))
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//go:build linux
+// +build linux
+
+package remotefs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_AzmountUsage(t *testing.T) {
+	origProcRoot := procRoot
+	defer func() {
+		procRoot = origProcRoot
+	}()
+	procRoot = t.TempDir()
+
+	for pid, status := range map[string]string{
+		"100": "Name:\tazmount\nUmask:\t0022\nVmRSS:\t   21884 kB\nThreads:\t9\n",
+		// The PID has been reused by another process
+		"101": "Name:\tsleep\nVmRSS:\t     800 kB\n",
+	} {
+		if err := os.MkdirAll(filepath.Join(procRoot, pid), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(procRoot, pid, "status"), []byte(status), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state := MountState{Filesystems: []MountedFilesystem{
+		{Index: 0, MountPoint: "/mnt/remote/share0", AzmountPID: 100},
+		{Index: 1, MountPoint: "/mnt/remote/share1", AzmountPID: 101},
+		// Exited
+		{Index: 2, MountPoint: "/mnt/remote/share2", AzmountPID: 102},
+		// tmpfs
+		{Index: 3, MountPoint: "/mnt/remote/share3"},
+	}}
+	usage := azmountUsage(state)
+	if len(usage) != 3 {
+		t.Fatalf("expected the usage of 3 processes, got %+v", usage)
+	}
+	if usage[0].RSSBytes != 21884*1024 || usage[0].Error != "" {
+		t.Errorf("unexpected usage of azmount: %+v", usage[0])
+	}
+	for _, u := range usage[1:] {
+		if u.RSSBytes != 0 || u.Error == "" {
+			t.Errorf("expected the usage of PID %d to fail: %+v", u.PID, u)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package skr
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultMaxConcurrentReleases is the number of keys that are released from
+// AKV at the same time unless SetMaxConcurrentReleases changes it. AKV and
+// managed HSM throttle bursts of requests with 429s, so it is kept low.
+const DefaultMaxConcurrentReleases = 4
+
+var (
+	releaseSlotsMutex sync.Mutex
+	// Semaphore of the key releases in flight, one element per release
+	releaseSlots = make(chan struct{}, DefaultMaxConcurrentReleases)
+)
+
+// SetMaxConcurrentReleases sets the maximum number of keys that are released
+// from AKV at the same time by SecureKeyRelease and ReleaseKeys. Zero restores
+// DefaultMaxConcurrentReleases. Releases already in flight keep their slot of
+// the previous limit.
+func SetMaxConcurrentReleases(n int) error {
+	if n < 0 {
+		return errors.Errorf("maximum number of concurrent key releases %d is negative", n)
+	}
+	if n == 0 {
+		n = DefaultMaxConcurrentReleases
+	}
+
+	releaseSlotsMutex.Lock()
+	defer releaseSlotsMutex.Unlock()
+	releaseSlots = make(chan struct{}, n)
+	return nil
+}
+
+// acquireReleaseSlot blocks until fewer than the maximum number of key
+// releases are in flight or ctx is done. The returned function frees the slot.
+func acquireReleaseSlot(ctx context.Context) (func(), error) {
+	releaseSlotsMutex.Lock()
+	slots := releaseSlots
+	releaseSlotsMutex.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
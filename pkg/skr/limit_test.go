@@ -0,0 +1,72 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package skr
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_SetMaxConcurrentReleases(t *testing.T) {
+	defer SetMaxConcurrentReleases(0)
+
+	if err := SetMaxConcurrentReleases(-1); err == nil {
+		t.Fatalf("expected negative limit to be rejected")
+	}
+	if err := SetMaxConcurrentReleases(2); err != nil {
+		t.Fatalf("SetMaxConcurrentReleases failed: %v", err)
+	}
+
+	var inFlight, maxInFlight int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := acquireReleaseSlot(context.Background())
+			if err != nil {
+				t.Errorf("acquireReleaseSlot failed: %v", err)
+				return
+			}
+			defer release()
+
+			n := atomic.AddInt32(&inFlight, 1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&inFlight, -1)
+		}()
+	}
+	wg.Wait()
+
+	if maxInFlight != 2 {
+		t.Fatalf("expected 2 releases in flight at most, got %d", maxInFlight)
+	}
+}
+
+func Test_AcquireReleaseSlot_Cancelled(t *testing.T) {
+	defer SetMaxConcurrentReleases(0)
+
+	if err := SetMaxConcurrentReleases(1); err != nil {
+		t.Fatalf("SetMaxConcurrentReleases failed: %v", err)
+	}
+	release, err := acquireReleaseSlot(context.Background())
+	if err != nil {
+		t.Fatalf("acquireReleaseSlot failed: %v", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := acquireReleaseSlot(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded while all slots are taken, got %v", err)
+	}
+}
@@ -9,7 +9,12 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Microsoft/confidential-sidecar-containers/pkg/attest"
 	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
@@ -19,11 +24,43 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// Url-encoded common.ManagedHSMTokenAudience and common.KeyVaultTokenAudience
 const (
 	ResourceIdManagedHSM = "https%3A%2F%2Fmanagedhsm.azure.net"
 	ResourceIdVault      = "https%3A%2F%2Fvault.azure.net"
 )
 
+// TokenResourceID returns the url-encoded resource for which the authentication
+// token used to access the AKV is requested. If akv.TokenResource isn't set, it
+// is derived from the endpoint: the endpoint of a key vault or managed HSM in
+// any cloud is "<name>.vault.<domain>" or "<name>.managedhsm.<domain>", and the
+// resource is "https://vault.<domain>" or "https://managedhsm.<domain>". Other
+// endpoints, such as private endpoints, default to the public cloud resource
+// of their vault type.
+// The audience of the storage tokens of the identity is never used.
+func TokenResourceID(akv common.AKV) string {
+	if akv.TokenResource != "" {
+		return url.QueryEscape(akv.TokenResource)
+	}
+
+	host := akv.Endpoint
+	if u, err := url.Parse(host); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	host = strings.SplitN(host, "/", 2)[0]
+
+	if _, domain, found := strings.Cut(host, "."); found {
+		if strings.HasPrefix(domain, "vault.") || strings.HasPrefix(domain, "managedhsm.") {
+			return url.QueryEscape("https://" + domain)
+		}
+	}
+
+	if strings.Contains(akv.Endpoint, "managedhsm") || akv.VaultType == common.VaultTypeManagedHSM {
+		return ResourceIdManagedHSM
+	}
+	return ResourceIdVault
+}
+
 // SecureKeyRelease releases a key identified by the KID and AKV in the keyblob.
 //  1. Retrieve an MAA token using the attestation package. This token can be presented to a Azure Key
 //     Vault to release a secret.
@@ -34,11 +71,97 @@ const (
 // The method requires serveral attributes including the uVM infomration, keyblob that contains
 // information about the AKV, authority and the key to be released.
 //
+// The release is aborted between steps if ctx is cancelled.
+//
 // The return type is a JWK key
-func SecureKeyRelease(identity common.Identity, certState attest.CertState, SKRKeyBlob common.KeyBlob, uvmInformation common.UvmInformation) (_ jwk.Key, err error) {
-	logrus.Info("Performing secure key release...")
-	logrus.Debugf("Releasing key blob: %v", SKRKeyBlob)
+func SecureKeyRelease(ctx context.Context, identity common.Identity, certState attest.CertState, SKRKeyBlob common.KeyBlob, uvmInformation common.UvmInformation) (_ jwk.Key, err error) {
+	log := logrus.WithFields(logrus.Fields{
+		common.LogFieldKID:         SKRKeyBlob.KID,
+		common.LogFieldAKVEndpoint: SKRKeyBlob.AKV.Endpoint,
+	})
+	log.Info("Performing secure key release...")
+	logrus.Debugf("Releasing key blob: %v", common.LogSecret(SKRKeyBlob))
+
+	startTime := time.Now()
+	defer func() {
+		log = log.WithField(common.LogFieldDurationMs, time.Since(startTime).Milliseconds())
+		if err != nil {
+			log.WithError(err).Warn("Secure key release failed")
+		} else {
+			log.Info("Secure key release done")
+		}
+	}()
+
+	maaToken, privateWrappingKey, err := attestForKeyRelease(ctx, certState, SKRKeyBlob.Authority, uvmInformation)
+	if err != nil {
+		return nil, err
+	}
+
+	return releaseKey(ctx, identity, SKRKeyBlob, maaToken, privateWrappingKey)
+}
+
+// KeyReleaseRequest identifies a key to be released by ReleaseKeys.
+type KeyReleaseRequest struct {
+	KeyBlob common.KeyBlob
+}
+
+// KeyReleaseResult is the result of the KeyReleaseRequest with the same index.
+type KeyReleaseResult struct {
+	Key jwk.Key
+	Err error
+}
 
+// ReleaseKeys releases a batch of keys. The requests with the same authority
+// share one MAA token, so attestation is only done once per authority, and the
+// keys are released concurrently, up to the limit of SetMaxConcurrentReleases.
+//
+// The results are in the same order as the requests. The returned error is the
+// first failure, if any, so that callers can fail before using any of the keys.
+func ReleaseKeys(ctx context.Context, identity common.Identity, certState attest.CertState, reqs []KeyReleaseRequest, uvmInformation common.UvmInformation) ([]KeyReleaseResult, error) {
+	logrus.Infof("Performing secure key release of %d keys...", len(reqs))
+
+	type attestation struct {
+		maaToken           string
+		privateWrappingKey *rsa.PrivateKey
+		err                error
+	}
+	attestations := make(map[common.MAA]*attestation)
+
+	results := make([]KeyReleaseResult, len(reqs))
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		a, ok := attestations[req.KeyBlob.Authority]
+		if !ok {
+			a = &attestation{}
+			a.maaToken, a.privateWrappingKey, a.err = attestForKeyRelease(ctx, certState, req.KeyBlob.Authority, uvmInformation)
+			attestations[req.KeyBlob.Authority] = a
+		}
+		if a.err != nil {
+			results[i].Err = a.err
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, keyBlob common.KeyBlob) {
+			defer wg.Done()
+			results[i].Key, results[i].Err = releaseKey(ctx, identity, keyBlob, a.maaToken, a.privateWrappingKey)
+		}(i, req.KeyBlob)
+	}
+	wg.Wait()
+
+	for i, result := range results {
+		if result.Err != nil {
+			return results, errors.Wrapf(result.Err, "releasing key %s failed", reqs[i].KeyBlob.KID)
+		}
+	}
+
+	return results, nil
+}
+
+// attestForKeyRelease generates a wrapping key and retrieves an MAA token from
+// authority that includes it as runtime claim. The token can be presented to
+// an AKV to release keys wrapped with the wrapping key.
+func attestForKeyRelease(ctx context.Context, certState attest.CertState, authority common.MAA, uvmInformation common.UvmInformation) (string, *rsa.PrivateKey, error) {
 	// Retrieve an MAA token
 	var maaToken string
 
@@ -49,35 +172,86 @@ func SecureKeyRelease(identity common.Identity, certState attest.CertState, SKRK
 	logrus.Trace("Generating RSA key pair...")
 	privateWrappingKey, err := rsa.GenerateKey(rand.Reader, common.RSASize)
 	if err != nil {
-		return nil, errors.Wrapf(err, "rsa key pair generation failed")
+		return "", nil, errors.Wrapf(err, "rsa key pair generation failed")
 	}
 
 	// construct the key blob
 	logrus.Info("Construct the key blob...")
 	jwkSetBytes, err := common.GenerateJWKSet(privateWrappingKey)
 	if err != nil {
-		return nil, errors.Wrapf(err, "generating key blob failed")
+		return "", nil, errors.Wrapf(err, "generating key blob failed")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
 	}
 
 	// Attest
 	logrus.Info("Attesting...")
-	maaToken, err = certState.Attest(SKRKeyBlob.Authority, jwkSetBytes, uvmInformation)
+	maaToken, err = certState.Attest(ctx, authority, jwkSetBytes, uvmInformation)
 	if err != nil {
-		return nil, errors.Wrapf(err, "attestation failed")
+		return "", nil, errors.Wrapf(err, "attestation failed")
 	}
 
-	var ResourceIDTemplate string
+	return maaToken, privateWrappingKey, nil
+}
 
-	// If endpoint contains managedhsm, request a token for managedhsm
-	// resource; otherwise for a vault
-	if ResourceIDTemplate = ResourceIdVault; strings.Contains(SKRKeyBlob.AKV.Endpoint, "managedhsm") {
-		ResourceIDTemplate = ResourceIdManagedHSM
-		logrus.Infof("Requesting token from %s", ResourceIDTemplate)
+// attestationClaims returns the claims of the attestation of maaToken, which
+// the release policy is evaluated against. They aren't secret. The runtime
+// claims, which hold the public wrapping key, are left out.
+func attestationClaims(maaToken string) (map[string]interface{}, error) {
+	fields := strings.Split(maaToken, ".")
+	if len(fields) != 3 {
+		return nil, errors.Errorf("token has %d fields instead of 3", len(fields))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, errors.Wrapf(err, "decoding token payload failed")
 	}
 
+	var payloadMap map[string]interface{}
+	if err := json.Unmarshal(payload, &payloadMap); err != nil {
+		return nil, errors.Wrapf(err, "unmarshalling token payload failed")
+	}
+
+	claims := make(map[string]interface{})
+	for name, value := range payloadMap {
+		if strings.HasPrefix(name, "x-ms-") && name != "x-ms-runtime" {
+			claims[name] = value
+		}
+	}
+	return claims, nil
+}
+
+// releaseDenied returns the error of AKV in err if AKV denied the release
+// with 403, when the attestation doesn't satisfy the release policy. Other
+// errors, like throttling or server errors, aren't about the claims.
+func releaseDenied(err error) *common.AKVError {
+	var akvErr *common.AKVError
+	if errors.As(err, &akvErr) && strings.HasPrefix(akvErr.Status, "403") {
+		return akvErr
+	}
+	return nil
+}
+
+// releaseKey releases the key identified by SKRKeyBlob presenting maaToken,
+// which has been obtained by attestForKeyRelease with privateWrappingKey. It
+// waits while the maximum number of concurrent releases are in flight.
+func releaseKey(ctx context.Context, identity common.Identity, SKRKeyBlob common.KeyBlob, maaToken string, privateWrappingKey *rsa.PrivateKey) (_ jwk.Key, err error) {
+	release, err := acquireReleaseSlot(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "waiting to release the key %s failed", SKRKeyBlob.KID)
+	}
+	defer release()
+
+	// Request a token for the managed HSM or vault resource of the endpoint
+	ResourceIDTemplate := TokenResourceID(SKRKeyBlob.AKV)
+	tokenRequested := SKRKeyBlob.AKV.BearerToken == ""
+
 	// retrieve an Azure authentication token for authenticating with AKV
-	if SKRKeyBlob.AKV.BearerToken == "" {
-		ctx, cancel := context.WithTimeout(context.Background(), msi.WorkloadIdentityRquestTokenTimeout)
+	if tokenRequested {
+		logrus.Infof("Requesting token from %s", ResourceIDTemplate)
+		ctx, cancel := context.WithTimeout(ctx, msi.WorkloadIdentityRquestTokenTimeout)
 		defer cancel()
 		bearerToken := ""
 
@@ -101,7 +275,11 @@ func SecureKeyRelease(identity common.Identity, certState attest.CertState, SKRK
 		// set the azure authentication token to the AKV instance
 		SKRKeyBlob.AKV.BearerToken = bearerToken
 	}
-	logrus.Debugf("AAD Token: %s ", SKRKeyBlob.AKV.BearerToken)
+	logrus.Debugf("AAD Token: %s ", common.LogSecret(SKRKeyBlob.AKV.BearerToken))
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	// use the MAA token obtained from the AKV's authority to retrieve the key identified by kid. The ReleaseKey
 	// operation requires the private wrapping key to unwrap the encrypted key material released from
@@ -110,10 +288,25 @@ func SecureKeyRelease(identity common.Identity, certState attest.CertState, SKRK
 	keyBytes, kty, err := SKRKeyBlob.AKV.ReleaseKey(maaToken, SKRKeyBlob.KID, privateWrappingKey)
 	if err != nil {
 		logrus.Debugf("releasing the key %s failed. err: %s", SKRKeyBlob.KID, err.Error())
+		if akvErr := releaseDenied(err); akvErr != nil {
+			// Log the claims that the release policy was evaluated against,
+			// so that the failing condition can be found
+			claims, claimsErr := attestationClaims(maaToken)
+			if claimsErr != nil {
+				logrus.WithError(claimsErr).Debug("Can't decode the claims of the attestation token")
+			}
+			logrus.WithField("claims", claims).Warnf("AKV denied the release of key %s: %s", SKRKeyBlob.KID, akvErr.Message)
+		}
+		var httpErr *common.HTTPError
+		if tokenRequested && errors.As(err, &httpErr) && strings.HasPrefix(httpErr.Status, "401") {
+			// The token was rejected, most likely because it was requested for
+			// the wrong resource
+			return nil, errors.Wrapf(err, "releasing the key %s failed, check that the token resource %s is right for the AKV %s", SKRKeyBlob.KID, ResourceIDTemplate, SKRKeyBlob.AKV.Endpoint)
+		}
 		return nil, errors.Wrapf(err, "releasing the key %s failed", SKRKeyBlob.KID)
 	}
 
-	logrus.Debugf("Key Type: %s Key %v", kty, keyBytes)
+	logrus.Debugf("Key Type: %s Key %v", kty, common.LogSecret(keyBytes))
 
 	if kty == "oct" || kty == "oct-HSM" {
 		logrus.Trace("Encoding OCT key as JWK...")
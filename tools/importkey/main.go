@@ -15,13 +15,10 @@ import (
 	"encoding/pem"
 	"flag"
 	"fmt"
-	"io"
 	"os"
-	"strings"
-
-	"golang.org/x/crypto/hkdf"
 
 	"github.com/Microsoft/confidential-sidecar-containers/pkg/common"
+	"github.com/Microsoft/confidential-sidecar-containers/pkg/skr"
 	"github.com/lestrrat-go/jwx/jwk"
 )
 
@@ -30,6 +27,9 @@ type importKeyConfig struct {
 	Key           common.KeyBlob           `json:"key"`
 	Claims        [][]common.ClaimStruct   `json:"claims"`
 	Identity      common.Identity          `json:"identity,omitempty"`
+
+	// Filesystem that the derived key is bound to, for bind_key_to_volume
+	VolumeBinding *common.VolumeBinding `json:"volume_binding,omitempty"`
 }
 
 type RSAKey struct {
@@ -85,12 +85,7 @@ func main() {
 
 	// retrieve a token from AKV. this requires to be run within a VM that has been assigned a managed identity associated with the AKV resource
 	if runInsideAzure {
-		var ResourceIDTemplate string
-		if strings.Contains(importKeyCfg.Key.AKV.Endpoint, "managedhsm") {
-			ResourceIDTemplate = "https%3A%2F%2Fmanagedhsm.azure.net"
-		} else {
-			ResourceIDTemplate = "https%3A%2F%2Fvault.azure.net"
-		}
+		ResourceIDTemplate := skr.TokenResourceID(importKeyCfg.Key.AKV)
 
 		token, err := common.GetToken(ResourceIDTemplate, importKeyCfg.Identity)
 		if err != nil {
@@ -198,11 +193,8 @@ func main() {
 		// note that using a derived octet key is safe as long as the RSA key is not used in
 		// other means.
 		if outputOctetKeyfile {
-			// use sha256 as hashing function for HKDF
-			hash := sha256.New
-
-			// public salt and label
-			salt := make([]byte, hash().Size())
+			// public salt
+			salt := make([]byte, sha256.Size)
 			var err error
 			if importKeyCfg.KeyDerivation.Salt != "" {
 				salt, err = hex.DecodeString(importKeyCfg.KeyDerivation.Salt)
@@ -216,23 +208,27 @@ func main() {
 				return
 			}
 
-			var labelString string
-			if importKeyCfg.KeyDerivation.Label != "" {
-				labelString = importKeyCfg.KeyDerivation.Label
-			} else {
-				labelString = "Symmetric Encryption Key"
+			if importKeyCfg.VolumeBinding != nil {
+				importKeyCfg.KeyDerivation, err = importKeyCfg.KeyDerivation.BindToVolume(importKeyCfg.Key.KID, *importKeyCfg.VolumeBinding)
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
 			}
 
-			hkdf := hkdf.New(hash, jwKey.D(), salt, []byte(labelString))
+			labelString := importKeyCfg.KeyDerivation.Label
+			if labelString == "" {
+				labelString = common.DefaultKeyDerivationLabel
+			}
 
 			// derive key
-			octKey = make([]byte, 32)
-			if _, err := io.ReadFull(hkdf, octKey); err != nil {
+			octKey, err = importKeyCfg.KeyDerivation.DeriveKey(jwKey.D(), salt)
+			if err != nil {
 				fmt.Println(err)
 				return
 			}
 
-			fmt.Printf("Symmetric key %s (salt: %s label: %s)\n", hex.EncodeToString(octKey), hex.EncodeToString(salt), labelString)
+			fmt.Printf("Symmetric key %s (algorithm: %s salt: %s label: %s)\n", hex.EncodeToString(octKey), importKeyCfg.KeyDerivation.Algorithm, hex.EncodeToString(salt), labelString)
 		}
 	} else if importKeyCfg.Key.KTY == "oct-HSM" || importKeyCfg.Key.KTY == "" {
 		// if not specified, default is to generate an OCT key